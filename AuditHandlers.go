@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+func QueryAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	// the filter body is optional
+	var filter AuditFilter
+	if r.ContentLength != 0 {
+		if !DecodeJSONBody(w, r, &filter) {
+			return
+		}
+	}
+
+	queryAuditLog(w, r, filter)
+}
+
+func queryAuditLog(w http.ResponseWriter, r *http.Request, filter AuditFilter) {
+	if !IsAdminRequest(r) {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Admin token required")
+		return
+	}
+
+	if fieldErrors := ValidateAuditFilter(filter); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	events, err := QueryAuditEvents(filter)
+	if err != nil {
+		log.Printf("Error querying audit log: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to query audit log")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Audit events retrieved successfully", events)
+}
+
+// ReindexCasesHandler backfills the case search and title sort attributes
+func ReindexCasesHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAdminRequest(r) {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Admin token required")
+		return
+	}
+
+	updated, err := ReindexCases()
+	if err != nil {
+		log.Printf("Error reindexing cases after %d updates: %v", updated, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to reindex cases")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Cases reindexed", ReindexResult{Updated: updated})
+}
+
+// ReindexDocumentsHandler backfills the file_type attribute used to filter
+// document listings
+func ReindexDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAdminRequest(r) {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Admin token required")
+		return
+	}
+
+	updated, err := ReindexDocuments()
+	if err != nil {
+		log.Printf("Error reindexing documents after %d updates: %v", updated, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to reindex documents")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Documents reindexed", ReindexResult{Updated: updated})
+}
+
+// ExtractDocumentsHandler queues text extraction for the documents that have
+// never been processed, such as those uploaded before it existed
+func ExtractDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAdminRequest(r) {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Admin token required")
+		return
+	}
+
+	documents, err := DocumentsAwaitingExtraction(true)
+	if err != nil {
+		log.Printf("Error finding documents to extract: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to queue text extraction")
+		return
+	}
+
+	go func() {
+		for _, doc := range documents {
+			extractionQueue <- doc
+		}
+	}()
+
+	WriteSuccess(w, r, http.StatusAccepted, "Text extraction queued", ReindexResult{Updated: len(documents)})
+}
+
+func VerifyAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	if !IsAdminRequest(r) {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Admin token required")
+		return
+	}
+
+	brokenAt, err := VerifyAuditChain()
+	if err != nil {
+		log.Printf("Error verifying audit log: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to verify audit log")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Audit log verified", AuditVerification{
+		Intact:   brokenAt == 0,
+		BrokenAt: brokenAt,
+	})
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+const (
+	AuditLoginSuccess         = "login.success"
+	AuditLoginFailure         = "login.failure"
+	AuditPasswordChange       = "user.password_changed"
+	AuditPasswordReset        = "user.password_reset"
+	AuditUserDeleted          = "user.deleted"
+	AuditEmailChangeRequested = "user.email_change_requested"
+	AuditEmailChanged         = "user.email_changed"
+	AuditUserExported         = "user.exported"
+	AuditUserErased           = "user.erased"
+	AuditCaseDeleted          = "case.deleted"
+	AuditCaseExported         = "case.exported"
+	AuditDocumentDelete       = "document.deleted"
+	AuditDocumentDownload     = "document.downloaded"
+	AuditDocumentMoved        = "document.moved"
+	AuditDocumentCopied       = "document.copied"
+	AuditDuplicateLinked      = "document.duplicate_linked"
+	AuditVersionAdded         = "document.version_added"
+	AuditVersionRestored      = "document.version_restored"
+)
+
+// auditHeadID is the key of the item holding the sequence and hash of the
+// last event in the log. Every append updates it in the same transaction as
+// the event, conditional on the sequence it read, so concurrent writers
+// cannot fork the chain.
+const auditHeadID = "head"
+
+func auditEventID(sequence int64) string {
+	return fmt.Sprintf("%020d", sequence)
+}
+
+// HashAuditEvent hashes the event with its hash field cleared, so the hash
+// covers the previous event's hash as well as this event's contents. Empty
+// details are hashed as {} whether or not they survived storage, which
+// reads an empty map back as nil.
+func HashAuditEvent(event AuditEvent) string {
+	event.Hash = ""
+	if event.Details == nil {
+		event.Details = map[string]string{}
+	}
+	payload, _ := json.Marshal(event)
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+func getAllAuditEvents() ([]AuditEvent, error) {
+	var events []AuditEvent
+
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(AuditTable),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if isAuditHead(item) {
+				continue
+			}
+			var event AuditEvent
+			if err := dynamodbattribute.UnmarshalMap(item, &event); err != nil {
+				log.Printf("Error unmarshalling audit event: %v", err)
+				continue
+			}
+			events = append(events, event)
+		}
+		return true
+	})
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Sequence < events[j].Sequence
+	})
+
+	return events, err
+}
+
+func isAuditHead(item map[string]*dynamodb.AttributeValue) bool {
+	id := item["_id"]
+	return id != nil && aws.StringValue(id.S) == auditHeadID
+}
+
+// getAuditHead returns the sequence and hash stored in the head item, and
+// whether there is one
+func getAuditHead() (int64, string, bool, error) {
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(auditHeadID),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+		TableName:      aws.String(AuditTable),
+	})
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	if result.Item != nil {
+		var head struct {
+			Sequence int64  `json:"sequence"`
+			Hash     string `json:"hash"`
+		}
+		if err := dynamodbattribute.UnmarshalMap(result.Item, &head); err != nil {
+			return 0, "", false, err
+		}
+		return head.Sequence, head.Hash, true, nil
+	}
+
+	return 0, "", false, nil
+}
+
+// loadAuditHead returns the sequence and hash of the last event. A log
+// written before the head item existed is scanned once to find them.
+func loadAuditHead() (int64, string, bool, error) {
+	sequence, hash, found, err := getAuditHead()
+	if err != nil || found {
+		return sequence, hash, found, err
+	}
+
+	events, err := getAllAuditEvents()
+	if err != nil || len(events) == 0 {
+		return 0, "", false, err
+	}
+	last := events[len(events)-1]
+	return last.Sequence, last.Hash, false, nil
+}
+
+// AppendAuditEvent chains the event to the current head and writes it. The
+// event is put only if its sequence is unused and the head only moves if no
+// one else moved it first, so the store is append only.
+func AppendAuditEvent(event AuditEvent) (AuditEvent, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		sequence, hash, found, err := loadAuditHead()
+		if err != nil {
+			return AuditEvent{}, err
+		}
+
+		event.Sequence = sequence + 1
+		event.ID = auditEventID(event.Sequence)
+		event.PrevHash = hash
+		if event.Timestamp == "" {
+			event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		event.Hash = HashAuditEvent(event)
+
+		av, err := dynamodbattribute.MarshalMap(event)
+		if err != nil {
+			return AuditEvent{}, err
+		}
+		setAuditIndexAttributes(av)
+
+		headCondition := "attribute_not_exists(#id)"
+		values := map[string]*dynamodb.AttributeValue{
+			":s": {N: aws.String(strconv.FormatInt(event.Sequence, 10))},
+			":h": {S: aws.String(event.Hash)},
+		}
+		if found {
+			headCondition = "#s = :prev"
+			values[":prev"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(sequence, 10))}
+		}
+
+		_, err = dynamo.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{
+					Put: &dynamodb.Put{
+						Item:                av,
+						TableName:           aws.String(AuditTable),
+						ConditionExpression: aws.String("attribute_not_exists(#id)"),
+						ExpressionAttributeNames: map[string]*string{
+							"#id": aws.String("_id"),
+						},
+					},
+				},
+				{
+					Update: &dynamodb.Update{
+						Key: map[string]*dynamodb.AttributeValue{
+							"_id": {
+								S: aws.String(auditHeadID),
+							},
+						},
+						TableName:                 aws.String(AuditTable),
+						ConditionExpression:       aws.String(headCondition),
+						UpdateExpression:          aws.String("SET #s = :s, #h = :h"),
+						ExpressionAttributeNames:  auditHeadNames(found),
+						ExpressionAttributeValues: values,
+					},
+				},
+			},
+		})
+
+		var canceled *dynamodb.TransactionCanceledException
+		if errors.As(err, &canceled) {
+			// another writer appended first, read the new head and retry
+			continue
+		}
+		if err != nil {
+			return AuditEvent{}, err
+		}
+
+		return event, nil
+	}
+
+	return AuditEvent{}, fmt.Errorf("failed to append audit event after retries")
+}
+
+// setAuditIndexAttributes adds the day the event is listed under in
+// AuditByDayIndex and removes empty index keys, which DynamoDB rejects. The
+// day is not part of the event, so it is not hashed.
+func setAuditIndexAttributes(item map[string]*dynamodb.AttributeValue) {
+	if timestamp := aws.StringValue(item["timestamp"].S); len(timestamp) >= len("2006-01-02") {
+		item["day"] = &dynamodb.AttributeValue{S: aws.String(timestamp[:len("2006-01-02")])}
+	}
+	for _, name := range []string{"actor_id", "case_id"} {
+		if value := item[name]; value != nil && aws.StringValue(value.S) == "" {
+			delete(item, name)
+		}
+	}
+}
+
+func auditHeadNames(found bool) map[string]*string {
+	names := map[string]*string{
+		"#s": aws.String("sequence"),
+		"#h": aws.String("hash"),
+	}
+	if !found {
+		names["#id"] = aws.String("_id")
+	}
+	return names
+}
+
+// auditRetries holds events that could not be appended while their request
+// was handled
+var auditRetries = make(chan AuditEvent, 1000)
+
+// StartAuditRetryWorker starts the worker that appends the events
+// RecordAuditEvent could not, backing off while the log is contended
+func StartAuditRetryWorker() {
+	go func() {
+		for event := range auditRetries {
+			retryAuditEvent(event)
+		}
+	}()
+}
+
+func retryAuditEvent(event AuditEvent) {
+	delay := time.Second
+	for attempt := 0; attempt < 10; attempt++ {
+		time.Sleep(delay)
+		_, err := AppendAuditEvent(event)
+		if err == nil {
+			return
+		}
+		log.Printf("Error retrying audit event %s: %v", event.Type, err)
+		delay = min(delay*2, time.Minute)
+	}
+
+	payload, _ := json.Marshal(event)
+	log.Printf("Audit event lost after retries: %s", payload)
+}
+
+// RecordAuditEvent appends an event built from the request. An event that
+// cannot be appended is queued for StartAuditRetryWorker rather than failing
+// the handler, keeping the time it happened.
+func RecordAuditEvent(r *http.Request, eventType string, event AuditEvent) {
+	event.Type = eventType
+	if event.Details == nil {
+		event.Details = map[string]string{}
+	}
+	// the actor is only ever who the request proves it is; a claimed user
+	// is kept in the details
+	if event.ActorID == "" {
+		event.ActorID = RequestActor(r)
+	}
+	if claimed := r.Header.Get("X-User-ID"); claimed != "" && claimed != event.ActorID {
+		event.Details["claimed_user_id"] = claimed
+	}
+	event.RemoteAddr = r.RemoteAddr
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+
+	if _, err := AppendAuditEvent(event); err != nil {
+		log.Printf("Error recording audit event %s, queued for retry: %v", eventType, err)
+		select {
+		case auditRetries <- event:
+		default:
+			payload, _ := json.Marshal(event)
+			log.Printf("Audit retry queue full, event lost: %s", payload)
+		}
+	}
+}
+
+// QueryAuditEvents returns the events matching filter in sequence order. A
+// case or actor is looked up in its index, and a time range alone in
+// AuditByDayIndex one day at a time; only a filter on type alone scans the
+// log.
+func QueryAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	collect := func(item map[string]*dynamodb.AttributeValue) error {
+		if isAuditHead(item) {
+			return nil
+		}
+		var event AuditEvent
+		if err := dynamodbattribute.UnmarshalMap(item, &event); err != nil {
+			log.Printf("Error unmarshalling audit event: %v", err)
+			return nil
+		}
+		events = append(events, event)
+		return nil
+	}
+
+	var err error
+	switch {
+	case filter.CaseID != "":
+		err = queryAuditIndex(AuditByCaseIndex, "case_id", filter.CaseID, filter, collect)
+	case filter.ActorID != "":
+		err = queryAuditIndex(AuditByActorIndex, "actor_id", filter.ActorID, filter, collect)
+	case filter.Start != "":
+		var days []string
+		days, err = auditDays(filter.Start, filter.End)
+		for _, day := range days {
+			if err != nil {
+				break
+			}
+			err = queryAuditIndex(AuditByDayIndex, "day", day, filter, collect)
+		}
+	default:
+		err = scanAuditEvents(filter, collect)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Sequence < events[j].Sequence
+	})
+
+	return events, err
+}
+
+// auditFilterConditions returns the conditions of filter other than the key
+// of the index being queried
+func auditFilterConditions(filter AuditFilter, key string) []expression.ConditionBuilder {
+	var conditions []expression.ConditionBuilder
+
+	if filter.ActorID != "" && key != "actor_id" {
+		conditions = append(conditions, expression.Name("actor_id").Equal(expression.Value(filter.ActorID)))
+	}
+	if filter.CaseID != "" && key != "case_id" {
+		conditions = append(conditions, expression.Name("case_id").Equal(expression.Value(filter.CaseID)))
+	}
+	if filter.Type != "" {
+		conditions = append(conditions, expression.Name("type").Equal(expression.Value(filter.Type)))
+	}
+	return conditions
+}
+
+func queryAuditIndex(index string, key string, value string, filter AuditFilter, fn func(map[string]*dynamodb.AttributeValue) error) error {
+	keyCond := expression.Key(key).Equal(expression.Value(value))
+	switch {
+	case filter.Start != "" && filter.End != "":
+		keyCond = keyCond.And(expression.Key("timestamp").Between(expression.Value(filter.Start), expression.Value(filter.End)))
+	case filter.Start != "":
+		keyCond = keyCond.And(expression.Key("timestamp").GreaterThanEqual(expression.Value(filter.Start)))
+	case filter.End != "":
+		keyCond = keyCond.And(expression.Key("timestamp").LessThanEqual(expression.Value(filter.End)))
+	}
+
+	builder := expression.NewBuilder().WithKeyCondition(keyCond)
+	if conditions := auditFilterConditions(filter, key); len(conditions) > 0 {
+		builder = builder.WithFilter(andConditions(conditions))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = QueryPage(&dynamodb.QueryInput{
+		TableName:                 aws.String(AuditTable),
+		IndexName:                 aws.String(index),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}, 0, fn)
+	return err
+}
+
+func scanAuditEvents(filter AuditFilter, fn func(map[string]*dynamodb.AttributeValue) error) error {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(AuditTable),
+	}
+
+	conditions := auditFilterConditions(filter, "")
+	if filter.End != "" {
+		conditions = append(conditions, expression.Name("timestamp").LessThanEqual(expression.Value(filter.End)))
+	}
+	if len(conditions) > 0 {
+		expr, err := expression.NewBuilder().WithFilter(andConditions(conditions)).Build()
+		if err != nil {
+			return err
+		}
+
+		input.ExpressionAttributeNames = expr.Names()
+		input.ExpressionAttributeValues = expr.Values()
+		input.FilterExpression = expr.Filter()
+	}
+
+	var fnErr error
+	err := dynamo.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if fnErr = fn(item); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func andConditions(conditions []expression.ConditionBuilder) expression.ConditionBuilder {
+	cond := conditions[0]
+	for _, c := range conditions[1:] {
+		cond = cond.And(c)
+	}
+	return cond
+}
+
+// auditDays returns the UTC days from start to end, or to today when end is
+// empty
+func auditDays(start string, end string) ([]string, error) {
+	from, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return nil, err
+	}
+	to := time.Now()
+	if end != "" {
+		if to, err = time.Parse(time.RFC3339, end); err != nil {
+			return nil, err
+		}
+	}
+
+	var days []string
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to.UTC()); day = day.AddDate(0, 0, 1) {
+		days = append(days, day.Format("2006-01-02"))
+	}
+	return days, nil
+}
+
+// ValidateAuditFilter checks that the time range is made of RFC 3339
+// timestamps
+func ValidateAuditFilter(filter AuditFilter) []FieldError {
+	var fieldErrors []FieldError
+	for _, field := range []struct{ name, value string }{{"start", filter.Start}, {"end", filter.End}} {
+		if field.value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, field.value); err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: field.name, Message: "must be an RFC 3339 timestamp"})
+		}
+	}
+	return fieldErrors
+}
+
+// ReindexAuditLog sets the day and drops the empty index keys of events
+// written before the audit indexes existed. It returns the number of events
+// updated, or with dryRun set the number that would be.
+func ReindexAuditLog(dryRun bool) (int, error) {
+	updated := 0
+	var scanErr error
+
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		TableName:        aws.String(AuditTable),
+		FilterExpression: aws.String("attribute_not_exists(#day) AND #id <> :head"),
+		ExpressionAttributeNames: map[string]*string{
+			"#day": aws.String("day"),
+			"#id":  aws.String("_id"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":head": {S: aws.String(auditHeadID)},
+		},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if dryRun {
+				updated++
+				continue
+			}
+			setAuditIndexAttributes(item)
+			// events are append only, so the rewrite must not create one
+			_, err := dynamo.PutItem(&dynamodb.PutItemInput{
+				Item:                item,
+				TableName:           aws.String(AuditTable),
+				ConditionExpression: aws.String("attribute_exists(#id)"),
+				ExpressionAttributeNames: map[string]*string{
+					"#id": aws.String("_id"),
+				},
+			})
+			if err != nil {
+				scanErr = err
+				return false
+			}
+			updated++
+		}
+		return true
+	})
+	if err != nil {
+		return updated, err
+	}
+	return updated, scanErr
+}
+
+// VerifyAuditChain recomputes every hash in the log and returns the sequence
+// of the first event that does not match, or 0 if the chain is intact. The
+// last event must also be the one the head item records, so events removed
+// from or added to the end of the log are caught.
+func VerifyAuditChain() (int64, error) {
+	sequence, hash, found, err := getAuditHead()
+	if err != nil {
+		return 0, err
+	}
+
+	events, err := getAllAuditEvents()
+	if err != nil {
+		return 0, err
+	}
+
+	return verifyAuditEvents(events, sequence, hash, found), nil
+}
+
+// verifyAuditEvents checks events, sorted by sequence, against each other and
+// against the head. Logs written before the head item existed have none.
+func verifyAuditEvents(events []AuditEvent, headSequence int64, headHash string, found bool) int64 {
+	prevHash := ""
+	for i, event := range events {
+		if event.Sequence != int64(i+1) || event.PrevHash != prevHash || HashAuditEvent(event) != event.Hash {
+			return event.Sequence
+		}
+		prevHash = event.Hash
+	}
+
+	if !found {
+		return 0
+	}
+
+	last := int64(len(events))
+	switch {
+	case last < headSequence:
+		// the first missing event
+		return last + 1
+	case last > headSequence:
+		// the first event past the head
+		return headSequence + 1
+	case last > 0 && prevHash != headHash:
+		return last
+	}
+	return 0
+}
+
+func auditDetails(pairs ...string) map[string]string {
+	details := map[string]string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		details[pairs[i]] = pairs[i+1]
+	}
+	return details
+}
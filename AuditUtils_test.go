@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+func TestHashAuditEventSurvivesStorage(t *testing.T) {
+	for _, details := range []map[string]string{nil, {}, {"reason": "password_mismatch"}} {
+		event := AuditEvent{
+			ID:        auditEventID(1),
+			Sequence:  1,
+			Timestamp: "2026-01-02T03:04:05Z",
+			Type:      AuditLoginSuccess,
+			ActorID:   "u1",
+			Details:   details,
+		}
+		event.Hash = HashAuditEvent(event)
+
+		item, err := dynamodbattribute.MarshalMap(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored AuditEvent
+		if err := dynamodbattribute.UnmarshalMap(item, &stored); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := HashAuditEvent(stored); got != event.Hash {
+			t.Errorf("details %v: hash after storage is %s, want %s", details, got, event.Hash)
+		}
+	}
+}
+
+func TestHashAuditEventCoversContents(t *testing.T) {
+	event := AuditEvent{Sequence: 1, Type: AuditCaseDeleted, CaseID: "c1"}
+	hash := HashAuditEvent(event)
+
+	event.CaseID = "c2"
+	if HashAuditEvent(event) == hash {
+		t.Error("changing the case did not change the hash")
+	}
+}
+
+func auditChain(n int) []AuditEvent {
+	var events []AuditEvent
+	prevHash := ""
+	for i := 1; i <= n; i++ {
+		event := AuditEvent{ID: auditEventID(int64(i)), Sequence: int64(i), Type: AuditLoginSuccess, PrevHash: prevHash}
+		event.Hash = HashAuditEvent(event)
+		events = append(events, event)
+		prevHash = event.Hash
+	}
+	return events
+}
+
+func TestVerifyAuditEventsChecksTheHead(t *testing.T) {
+	events := auditChain(3)
+	head := events[2]
+
+	tests := []struct {
+		name   string
+		events []AuditEvent
+		want   int64
+	}{
+		{name: "intact", events: events, want: 0},
+		{name: "last event removed", events: events[:2], want: 3},
+		{name: "every event removed", events: nil, want: 1},
+		{name: "event past the head", events: auditChain(4), want: 4},
+	}
+	for _, test := range tests {
+		if got := verifyAuditEvents(test.events, head.Sequence, head.Hash, true); got != test.want {
+			t.Errorf("%s: broken at %d, want %d", test.name, got, test.want)
+		}
+	}
+
+	if got := verifyAuditEvents(events, head.Sequence, "forged", true); got != 3 {
+		t.Errorf("head hash mismatch: broken at %d, want 3", got)
+	}
+	if got := verifyAuditEvents(events[:2], 0, "", false); got != 0 {
+		t.Errorf("log without a head: broken at %d, want 0", got)
+	}
+
+	tampered := auditChain(3)
+	tampered[1].ActorID = "someone else"
+	if got := verifyAuditEvents(tampered, head.Sequence, head.Hash, true); got != 2 {
+		t.Errorf("tampered event: broken at %d, want 2", got)
+	}
+}
+
+func TestSetAuditIndexAttributes(t *testing.T) {
+	item, err := dynamodbattribute.MarshalMap(AuditEvent{Timestamp: "2026-03-04T05:06:07.89Z", ActorID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAuditIndexAttributes(item)
+
+	if day := item["day"]; day == nil || *day.S != "2026-03-04" {
+		t.Errorf("day = %v, want 2026-03-04", day)
+	}
+	if _, ok := item["case_id"]; ok {
+		t.Error("empty case_id was kept as an index key")
+	}
+	if item["actor_id"] == nil {
+		t.Error("actor_id was removed")
+	}
+}
+
+func TestAuditDays(t *testing.T) {
+	days, err := auditDays("2026-02-27T23:00:00Z", "2026-03-01T01:00:00+02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2026-02-27", "2026-02-28"}
+	if !reflect.DeepEqual(days, want) {
+		t.Errorf("days = %v, want %v", days, want)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+// BlobPrefix holds document files. Documents with the same content share
+// one object, which is deleted when the last of them is.
+var BlobPrefix = "blobs/"
+
+// Blob counts the documents stored in one object. It is keyed by the hex
+// SHA-256 of the content.
+type Blob struct {
+	SHA256    string `json:"_id"`
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	Refs      int64  `json:"refs"`
+	CreatedAt string `json:"created_at"`
+}
+
+// NewBlobKey is where a new file is written before its digest is known. If
+// no blob has the digest yet, the object becomes the blob where it is.
+func NewBlobKey() string {
+	return BlobPrefix + generateRandomString(24)
+}
+
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func GetBlobByHash(sha string) (Blob, error) {
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(sha),
+			},
+		},
+		TableName: &BlobsTable,
+	})
+	if err != nil || result.Item == nil {
+		return Blob{}, err
+	}
+
+	var blob Blob
+	err = dynamodbattribute.UnmarshalMap(result.Item, &blob)
+	return blob, err
+}
+
+// BlobKeysWithPrefix returns the keys under prefix that blobs are stored at.
+// Documents copied from a case uploaded before deduplication share their
+// original's object, so a case's prefix can hold blobs other cases use.
+func BlobKeysWithPrefix(prefix string) (map[string]bool, error) {
+	filt := expression.Name("key").BeginsWith(prefix)
+	expr, err := expression.NewBuilder().WithFilter(filt).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	err = dynamo.ScanPages(&dynamodb.ScanInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		TableName:                 &BlobsTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if key := item["key"]; key != nil && key.S != nil {
+				keys[*key.S] = true
+			}
+		}
+		return true
+	})
+
+	return keys, err
+}
+
+// addBlobRefs adds delta references to a blob and returns it as updated. It
+// returns an empty Blob if there is none.
+func addBlobRefs(sha string, delta int) (Blob, error) {
+	result, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String("attribute_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id": aws.String("_id"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":delta": {
+				N: aws.String(fmt.Sprint(delta)),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(sha),
+			},
+		},
+		ReturnValues:     aws.String(dynamodb.ReturnValueAllNew),
+		TableName:        &BlobsTable,
+		UpdateExpression: aws.String("ADD refs :delta"),
+	})
+	if isConditionFailed(err) {
+		return Blob{}, nil
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+
+	var blob Blob
+	err = dynamodbattribute.UnmarshalMap(result.Attributes, &blob)
+	return blob, err
+}
+
+// AcquireBlob takes another reference to a stored blob, for a document that
+// shares its content
+func AcquireBlob(sha string) error {
+	blob, err := addBlobRefs(sha, 1)
+	if err == nil && blob.Key == "" {
+		return fmt.Errorf("blob %s not found", sha)
+	}
+	return err
+}
+
+// StoreBlob takes a reference to the blob for a file just written to key
+// and returns the blob's key. When the content is already stored, the new
+// object is deleted and the existing blob's key returned.
+func StoreBlob(key string, sha string, size int64) (string, error) {
+	// a blob created or removed by another upload in between is retried
+	for attempt := 0; attempt < 3; attempt++ {
+		blob, err := addBlobRefs(sha, 1)
+		if err != nil {
+			return "", err
+		}
+		if blob.Key != "" {
+			if blob.Key != key {
+				discardStoredUpload(key)
+			}
+			return blob.Key, nil
+		}
+
+		av, err := dynamodbattribute.MarshalMap(Blob{
+			SHA256:    sha,
+			Key:       key,
+			Size:      size,
+			Refs:      1,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+			ConditionExpression: aws.String("attribute_not_exists(#id)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#id": aws.String("_id"),
+			},
+			Item:      av,
+			TableName: &BlobsTable,
+		})
+		if !isConditionFailed(err) {
+			return key, err
+		}
+	}
+
+	return "", fmt.Errorf("blob %s kept changing", sha)
+}
+
+// MoveBlob points a blob held by a single document at newKey, where its
+// object has been copied. It returns false, leaving the blob alone, if
+// another document has taken a reference or the blob is no longer at
+// oldKey.
+func MoveBlob(sha string, oldKey string, newKey string) (bool, error) {
+	_, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String("refs = :one AND #key = :old"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key": aws.String("key"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {
+				N: aws.String("1"),
+			},
+			":old": {
+				S: aws.String(oldKey),
+			},
+			":new": {
+				S: aws.String(newKey),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(sha),
+			},
+		},
+		TableName:        &BlobsTable,
+		UpdateExpression: aws.String("SET #key = :new"),
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseBlob drops a reference to a blob. The last reference deletes the
+// blob and its object.
+func ReleaseBlob(sha string) error {
+	blob, err := addBlobRefs(sha, -1)
+	if err != nil || blob.Key == "" || blob.Refs > 0 {
+		return err
+	}
+
+	// a document may have taken a reference since
+	_, err = dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+		ConditionExpression: aws.String("refs <= :zero"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero": {
+				N: aws.String("0"),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(sha),
+			},
+		},
+		TableName: &BlobsTable,
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := DeleteFileFromS3(blob.Key); err != nil {
+		log.Printf("Error deleting blob %s: %v", blob.Key, err)
+	}
+
+	return nil
+}
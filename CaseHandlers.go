@@ -1,11 +1,11 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
+	"errors"
 	"log"
-
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func CreateCaseHandler(w http.ResponseWriter, r *http.Request) {
@@ -14,57 +14,43 @@ func CreateCaseHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
 	var myCase Case
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to create case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	if err := json.Unmarshal(body, &myCase); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &myCase) {
 		return
 	}
 
 	log.Printf("Case: %+v", myCase)
 
 	// check if no fields are blank
-	if myCase.CaseTitle == "" || myCase.AttorneyFirstName == "" || myCase.AttorneyLastName == "" || myCase.CaseInfo == "" || myCase.CaseType == "" || myCase.City == "" || myCase.Date == "" || myCase.JudgeName == "" || myCase.State == "" || myCase.UserID == "" {
-		response := ErrorResponse{
-			Message: "All fields must be filled out",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if fieldErrors := requireCaseFields(myCase); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
 		return
 	}
 
 	log.Printf("All fields filled out")
 
-	var return_case Case
-	return_case, err = CreateCase(myCase)
+	createCase(w, r, myCase)
+}
+
+func requireCaseFields(myCase Case) []FieldError {
+	return RequireFields(
+		"case_title", myCase.CaseTitle,
+		"attorney_first_name", myCase.AttorneyFirstName,
+		"attorney_last_name", myCase.AttorneyLastName,
+		"case_info", myCase.CaseInfo,
+		"case_type", myCase.CaseType,
+		"city", myCase.City,
+		"date", myCase.Date,
+		"judge_name", myCase.JudgeName,
+		"state", myCase.State,
+		"user_id", myCase.UserID,
+	)
+}
+
+func createCase(w http.ResponseWriter, r *http.Request, myCase Case) {
+	return_case, err := CreateCase(myCase)
 	if err != nil {
 		log.Printf("Error creating case: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to create case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create case")
 		return
 	}
 
@@ -74,306 +60,241 @@ func CreateCaseHandler(w http.ResponseWriter, r *http.Request) {
 	err = CreateChat(return_case.ID, return_case.UserID)
 	if err != nil {
 		log.Printf("Error creating chat: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to create chat",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create chat")
 		return
 	}
 
 	log.Printf("Chat created successfully")
 
+	EmitWebhookEvent(WebhookCaseCreated, return_case.UserID, return_case.ID, return_case)
+
 	// return case
-	response := SuccessResponse{
-		Message: "Case created successfully",
-		Status:  http.StatusCreated,
-		Object:  return_case,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+	WriteSuccess(w, r, http.StatusCreated, "Case created successfully", return_case)
 }
 
 func GetCaseByIDHandler(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	var getCaseByIDRequest struct {
 		ID string `json:"_id"`
 	}
 
-	if err := json.Unmarshal(body, &getCaseByIDRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &getCaseByIDRequest) {
 		return
-
 	}
 
-	var return_case Case
-	return_case, err = GetCaseFromId(getCaseByIDRequest.ID)
+	getCase(w, r, getCaseByIDRequest.ID)
+}
+
+func getCase(w http.ResponseWriter, r *http.Request, caseID string) {
+	return_case, err := GetCaseFromId(caseID)
 	if err != nil {
 		log.Printf("Error getting case: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to get case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
 		return
 	}
 
 	// check if case exists
 	if return_case.ID == "" {
-		response := ErrorResponse{
-			Message: "Case not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
 		return
 	}
 
 	// return case
-	response := SuccessResponse{
-		Message: "Case retrieved successfully",
-		Status:  http.StatusOK,
-		Object:  return_case,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	WriteSuccess(w, r, http.StatusOK, "Case retrieved successfully", return_case)
 
 }
 
 func GetCaseByUserHandler(w http.ResponseWriter, r *http.Request) {
-
 	// Handle preflight requests
 	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+	// the filter fields are optional; without them every case is listed,
+	// newest first
+	var getCaseByUserRequest struct {
+		UserID    string `json:"user_id"`
+		CaseType  string `json:"case_type"`
+		State     string `json:"state"`
+		City      string `json:"city"`
+		JudgeName string `json:"judge_name"`
+		DateFrom  string `json:"date_from"`
+		DateTo    string `json:"date_to"`
+		Query     string `json:"q"`
+		Sort      string `json:"sort"`
+		Order     string `json:"order"`
+		Limit     int64  `json:"limit"`
+		Cursor    string `json:"cursor"`
+	}
+
+	if !DecodeJSONBody(w, r, &getCaseByUserRequest) {
 		return
 	}
 
-	var getCaseByUserRequest struct {
-		UserID string `json:"user_id"`
+	filter := CaseFilter{
+		CaseType:  getCaseByUserRequest.CaseType,
+		State:     getCaseByUserRequest.State,
+		City:      getCaseByUserRequest.City,
+		JudgeName: getCaseByUserRequest.JudgeName,
+		DateFrom:  getCaseByUserRequest.DateFrom,
+		DateTo:    getCaseByUserRequest.DateTo,
+		Query:     getCaseByUserRequest.Query,
+		Sort:      getCaseByUserRequest.Sort,
+		Order:     getCaseByUserRequest.Order,
+		Limit:     getCaseByUserRequest.Limit,
+		Cursor:    getCaseByUserRequest.Cursor,
+	}
+	if fieldErrors := ValidateCaseFilter(filter); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
 	}
 
-	if err := json.Unmarshal(body, &getCaseByUserRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
+	getUserCases(w, r, getCaseByUserRequest.UserID, filter)
+}
+
+// ParseCaseFilter reads case listing options from the query string
+func ParseCaseFilter(r *http.Request) (CaseFilter, []FieldError) {
+	query := r.URL.Query()
+	filter := CaseFilter{
+		CaseType:  query.Get("case_type"),
+		State:     query.Get("state"),
+		City:      query.Get("city"),
+		JudgeName: query.Get("judge_name"),
+		DateFrom:  query.Get("date_from"),
+		DateTo:    query.Get("date_to"),
+		Query:     query.Get("q"),
+		Sort:      query.Get("sort"),
+		Order:     query.Get("order"),
+		Cursor:    query.Get("cursor"),
+	}
+
+	var fieldErrors []FieldError
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit < 1 {
+			fieldErrors = append(fieldErrors, FieldError{Field: "limit", Message: "must be an integer between 1 and 100"})
+		} else {
+			filter.Limit = limit
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
 	}
 
-	var return_user User
-	return_user, err = getUserFromId(getCaseByUserRequest.UserID)
+	return filter, append(fieldErrors, ValidateCaseFilter(filter)...)
+}
+
+// ValidateCaseFilter checks case listing options. A zero Limit lists every
+// case.
+func ValidateCaseFilter(filter CaseFilter) []FieldError {
+	var fieldErrors []FieldError
+	for _, d := range []struct{ field, value string }{{"date_from", filter.DateFrom}, {"date_to", filter.DateTo}} {
+		if d.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d.value); err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: d.field, Message: "must be an ISO date (YYYY-MM-DD)"})
+		}
+	}
+	if filter.Sort != "" && filter.Sort != "date" && filter.Sort != "title" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "sort", Message: "must be date or title"})
+	}
+	if filter.Order != "" && filter.Order != "asc" && filter.Order != "desc" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "order", Message: "must be asc or desc"})
+	}
+	if filter.Limit < 0 || filter.Limit > 100 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "limit", Message: "must be an integer between 1 and 100"})
+	}
+	if _, err := decodeCursor(filter.Cursor); err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "cursor", Message: "is not a valid cursor"})
+	}
+
+	return fieldErrors
+}
+
+func getUserCases(w http.ResponseWriter, r *http.Request, userID string, filter CaseFilter) {
+	return_user, err := getUserFromId(userID)
 	if err != nil {
 		log.Printf("Error getting user: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to get user",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get user")
 		return
 	}
 
 	if return_user.ID == "" {
-		response := ErrorResponse{
-			Message: "User not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
 		return
 	}
 
-	var return_cases []Case
-	return_cases, err = GetCasesByUserId(getCaseByUserRequest.UserID)
+	return_cases, nextCursor, err := QueryUserCases(userID, filter)
 	if err != nil {
 		log.Printf("Error getting case: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to get case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
 		return
 	}
 
-	response := SuccessResponse{
-		Message: "Case retrieved successfully",
-		Status:  http.StatusOK,
-		Object:  return_cases,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	WritePage(w, r, "Case retrieved successfully", return_cases, nextCursor, nil)
 }
 
 func DeleteCaseByIDHandler(w http.ResponseWriter, r *http.Request) {
-	// read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to delete case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	var deleteCaseByIdRequest struct {
 		ID string `json:"_id"`
 	}
 
 	// unmarshal request body
-	if err := json.Unmarshal(body, &deleteCaseByIdRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &deleteCaseByIdRequest) {
 		return
 	}
 
+	deleteCase(w, r, deleteCaseByIdRequest.ID)
+}
+
+func deleteCase(w http.ResponseWriter, r *http.Request, caseID string) {
 	// delete case
-	var return_case Case
-	return_case, err = DeleteCaseById(deleteCaseByIdRequest.ID)
+	return_case, err := DeleteCaseById(caseID)
 	if err != nil {
 		log.Printf("Error deleting case: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to delete case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete case")
 		return
 	}
 
 	// check if case exists
 	if return_case.ID == "" {
-		response := ErrorResponse{
-			Message: "Case not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
 		return
 	}
 
+	RecordAuditEvent(r, AuditCaseDeleted, AuditEvent{
+		CaseID:   return_case.ID,
+		TargetID: return_case.UserID,
+	})
+	EmitWebhookEvent(WebhookCaseDeleted, return_case.UserID, return_case.ID, return_case)
+
 	// return case
-	response := SuccessResponse{
-		Message: "Case deleted successfully",
-		Status:  http.StatusOK,
-		Object:  return_case,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	WriteSuccess(w, r, http.StatusOK, "Case deleted successfully", return_case)
 }
 
 func DeleteCasesByUserHandler(w http.ResponseWriter, r *http.Request) {
-	// read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to delete case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	var deleteCasesByUserRequest struct {
 		UserID string `json:"user_id"`
 	}
 
 	// unmarshal request body
-	if err := json.Unmarshal(body, &deleteCasesByUserRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &deleteCasesByUserRequest) {
 		return
 	}
 
+	deleteUserCases(w, r, deleteCasesByUserRequest.UserID)
+}
+
+func deleteUserCases(w http.ResponseWriter, r *http.Request, userID string) {
 	// get user
-	var return_user User
-	return_user, err = getUserFromId(deleteCasesByUserRequest.UserID)
+	return_user, err := getUserFromId(userID)
 	if err != nil {
 		log.Printf("Error getting user: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to get user",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get user")
 		return
 	}
 
 	// check if user exists
 	if return_user.ID == "" {
-		response := ErrorResponse{
-			Message: "User not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
 		return
 	}
 
@@ -382,35 +303,98 @@ func DeleteCasesByUserHandler(w http.ResponseWriter, r *http.Request) {
 	return_cases, err = DeleteCasesByUser(return_user.ID)
 	if err != nil {
 		log.Printf("Error deleting case: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to delete case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete case")
 		return
 	}
 
 	// check if cases exist
 	if len(return_cases) == 0 {
-		response := ErrorResponse{
-			Message: "User has no cases to be deleted",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeNoCases, "User has no cases to be deleted")
 		return
 	}
 
+	for _, c := range return_cases {
+		RecordAuditEvent(r, AuditCaseDeleted, AuditEvent{
+			CaseID:   c.ID,
+			TargetID: c.UserID,
+		})
+		EmitWebhookEvent(WebhookCaseDeleted, c.UserID, c.ID, c)
+	}
+
 	// return cases
-	response := SuccessResponse{
-		Message: "Cases deleted successfully",
-		Status:  http.StatusOK,
-		Object:  return_cases,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	WriteSuccess(w, r, http.StatusOK, "Cases deleted successfully", return_cases)
+}
+
+func UpdateCaseHandler(w http.ResponseWriter, r *http.Request) {
+	var updateCaseRequest struct {
+		ID string `json:"_id"`
+		CaseUpdate
+	}
+
+	if !DecodeJSONBody(w, r, &updateCaseRequest) {
+		return
+	}
+
+	updateCase(w, r, updateCaseRequest.ID, updateCaseRequest.CaseUpdate)
+}
+
+func updateCase(w http.ResponseWriter, r *http.Request, caseID string, update CaseUpdate) {
+	if fieldErrors := ValidateCaseUpdate(update); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	return_case, err := UpdateCase(caseID, update, RequestActor(r))
+	if errors.Is(err, ErrCaseOwnerChange) {
+		WriteValidationError(w, r, []FieldError{{Field: "user_id", Message: "cannot be changed"}})
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating case: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update case")
+		return
+	}
+
+	// check if case exists
+	if return_case.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Case updated successfully", return_case)
+}
+
+func GetCaseHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var getCaseHistoryRequest struct {
+		CaseID string `json:"case_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &getCaseHistoryRequest) {
+		return
+	}
+
+	getCaseHistory(w, r, getCaseHistoryRequest.CaseID)
+}
+
+func getCaseHistory(w http.ResponseWriter, r *http.Request, caseID string) {
+	return_case, err := GetCaseFromId(caseID)
+	if err != nil {
+		log.Printf("Error getting case: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
+		return
+	}
+
+	if return_case.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
+		return
+	}
+
+	history, err := GetCaseHistory(caseID)
+	if err != nil {
+		log.Printf("Error getting case history: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case history")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Case history retrieved successfully", history)
 }
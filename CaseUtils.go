@@ -1,60 +1,75 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
 )
 
 func CreateCase(myCase Case) (Case, error) {
+	if caseType, ok := canonicalCaseType(myCase.CaseType); ok {
+		myCase.CaseType = caseType
+	}
 
 	case_id := generateRandomString(16)
 	myCase.ID = case_id
 
-	_, err := dynamo.PutItem(&dynamodb.PutItemInput{
-		Item: map[string]*dynamodb.AttributeValue{
-			"_id": {
-				S: aws.String(case_id),
-			},
-			"case_title": {
-				S: aws.String(myCase.CaseTitle),
-			},
-			"attorney_first_name": {
-				S: aws.String(myCase.AttorneyFirstName),
-			},
-			"attorney_last_name": {
-				S: aws.String(myCase.AttorneyLastName),
-			},
+	item := map[string]*dynamodb.AttributeValue{
+		"_id": {
+			S: aws.String(case_id),
+		},
+		"case_title": {
+			S: aws.String(myCase.CaseTitle),
+		},
+		"attorney_first_name": {
+			S: aws.String(myCase.AttorneyFirstName),
+		},
+		"attorney_last_name": {
+			S: aws.String(myCase.AttorneyLastName),
+		},
 
-			"case_info": {
-				S: aws.String(myCase.CaseInfo),
-			},
-			"case_type": {
-				S: aws.String(myCase.CaseType),
-			},
-			"city": {
-				S: aws.String(myCase.City),
-			},
-			"date": {
-				S: aws.String(myCase.Date),
-			},
-			"judge_name": {
-				S: aws.String(myCase.JudgeName),
-			},
-			"number_files": {
-				N: aws.String(strconv.Itoa(myCase.NumberFiles)),
-			},
+		"case_info": {
+			S: aws.String(myCase.CaseInfo),
+		},
+		"case_type": {
+			S: aws.String(myCase.CaseType),
+		},
+		"city": {
+			S: aws.String(myCase.City),
+		},
+		"date": {
+			S: aws.String(myCase.Date),
+		},
+		"judge_name": {
+			S: aws.String(myCase.JudgeName),
+		},
+		"number_files": {
+			N: aws.String(strconv.Itoa(myCase.NumberFiles)),
+		},
 
-			"state": {
-				S: aws.String(myCase.State),
-			},
-			"user_id": {
-				S: aws.String(myCase.UserID),
-			},
+		"state": {
+			S: aws.String(myCase.State),
 		},
+		"user_id": {
+			S: aws.String(myCase.UserID),
+		},
+	}
+	for name, value := range caseIndexAttributes(myCase) {
+		item[name] = value
+	}
+
+	_, err := dynamo.PutItem(&dynamodb.PutItemInput{
+		Item:      item,
 		TableName: &CasesTable,
 	})
 
@@ -122,59 +137,41 @@ func GetCaseFromId(caseID string) (Case, error) {
 	return myCase, nil
 }
 
+// GetCasesByUserId returns every case the user owns. It scans rather than
+// reading the user_id indexes so cases without a date or title_key are
+// included.
 func GetCasesByUserId(user_id string) ([]Case, error) {
 	filt := expression.Name("user_id").Equal(expression.Value(user_id))
-	log.Printf("User ID: %s", user_id)
 	expr, err := expression.NewBuilder().WithFilter(filt).Build()
 	if err != nil {
 		return []Case{}, err
 	}
 
-	result, err := dynamo.Scan(&dynamodb.ScanInput{
+	cases := []Case{}
+	var unmarshalErr error
+	err = dynamo.ScanPages(&dynamodb.ScanInput{
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		FilterExpression:          expr.Filter(),
 		TableName:                 &CasesTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var myCase Case
+			if unmarshalErr = dynamodbattribute.UnmarshalMap(item, &myCase); unmarshalErr != nil {
+				return false
+			}
+			cases = append(cases, myCase)
+		}
+		return true
 	})
-
+	if err == nil {
+		err = unmarshalErr
+	}
 	if err != nil {
 		return []Case{}, err
 	}
 
-	if len(result.Items) == 0 {
-		return []Case{}, nil
-	}
-
-	var cases []Case
-
-	for _, i := range result.Items {
-		numberFiles, err := strconv.Atoi(*i["number_files"].N)
-		if err != nil {
-			return []Case{}, err
-		}
-
-		myCase := Case{
-			ID:                *i["_id"].S,
-			CaseTitle:         *i["case_title"].S,
-			AttorneyFirstName: *i["attorney_first_name"].S,
-			AttorneyLastName:  *i["attorney_last_name"].S,
-			CaseInfo:          *i["case_info"].S,
-			CaseType:          *i["case_type"].S,
-			City:              *i["city"].S,
-			Date:              *i["date"].S,
-			JudgeName:         *i["judge_name"].S,
-			NumberFiles:       numberFiles,
-			State:             *i["state"].S,
-			UserID:            *i["user_id"].S,
-		}
-
-		cases = append(cases, myCase)
-	}
-
-	log.Printf("Cases: %+v", cases)
-
 	return cases, nil
-
 }
 
 func DeleteCaseById(caseID string) (Case, error) {
@@ -195,6 +192,9 @@ func DeleteCaseById(caseID string) (Case, error) {
 		},
 		TableName: &CasesTable,
 	})
+	if err == nil {
+		DropCaseIndex(caseID)
+	}
 
 	return myCase, err
 }
@@ -221,6 +221,7 @@ func DeleteCasesByUser(user_id string) ([]Case, error) {
 		if err != nil {
 			return []Case{}, err
 		}
+		DropCaseIndex(c.ID)
 	}
 
 	return cases, nil
@@ -248,3 +249,544 @@ func CaseUpdateNumberFiles(case_id string) {
 	}
 
 }
+
+// CaseAdjustNumberFiles adds delta to a case's number_files. A case that
+// has been deleted is left deleted.
+func CaseAdjustNumberFiles(caseID string, delta int) {
+	_, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String("attribute_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id": aws.String("_id"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":val": {
+				N: aws.String(strconv.Itoa(delta)),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(caseID),
+			},
+		},
+		TableName:        &CasesTable,
+		UpdateExpression: aws.String("ADD number_files :val"),
+	})
+
+	if err != nil && !isConditionFailed(err) {
+		log.Printf("Error updating number of files: %v", err)
+	}
+}
+
+// SetCaseNumberFiles overwrites a case's number_files, for repairing counts
+// that have drifted from the documents table
+func SetCaseNumberFiles(caseID string, numberFiles int) error {
+	_, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":val": {
+				N: aws.String(strconv.Itoa(numberFiles)),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(caseID),
+			},
+		},
+		TableName:        &CasesTable,
+		UpdateExpression: aws.String("SET number_files = :val"),
+	})
+
+	return err
+}
+
+// GetAllCases scans the cases table
+func GetAllCases() ([]Case, error) {
+	cases := []Case{}
+
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		TableName: &CasesTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var myCase Case
+			if err := dynamodbattribute.UnmarshalMap(item, &myCase); err != nil {
+				log.Printf("Error unmarshalling case: %v", err)
+				continue
+			}
+			cases = append(cases, myCase)
+		}
+		return true
+	})
+
+	return cases, err
+}
+
+// usStateCodes lists the postal codes accepted for Case.State
+var usStateCodes = map[string]bool{
+	"AL": true, "AK": true, "AZ": true, "AR": true, "CA": true, "CO": true, "CT": true, "DE": true,
+	"FL": true, "GA": true, "HI": true, "ID": true, "IL": true, "IN": true, "IA": true, "KS": true,
+	"KY": true, "LA": true, "ME": true, "MD": true, "MA": true, "MI": true, "MN": true, "MS": true,
+	"MO": true, "MT": true, "NE": true, "NV": true, "NH": true, "NJ": true, "NM": true, "NY": true,
+	"NC": true, "ND": true, "OH": true, "OK": true, "OR": true, "PA": true, "RI": true, "SC": true,
+	"SD": true, "TN": true, "TX": true, "UT": true, "VT": true, "VA": true, "WA": true, "WV": true,
+	"WI": true, "WY": true, "DC": true, "PR": true, "GU": true, "VI": true, "AS": true, "MP": true,
+}
+
+var defaultCaseTypes = []string{
+	"Civil",
+	"Criminal",
+	"Family",
+	"Probate",
+	"Bankruptcy",
+	"Employment",
+	"Personal Injury",
+	"Immigration",
+	"Intellectual Property",
+	"Real Estate",
+	"Contract",
+}
+
+// CaseTypes returns the allowed case types from the comma separated
+// CASE_TYPES variable, falling back to defaultCaseTypes
+func CaseTypes() []string {
+	configured := os.Getenv("CASE_TYPES")
+	if configured == "" {
+		return defaultCaseTypes
+	}
+
+	var caseTypes []string
+	for _, t := range strings.Split(configured, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			caseTypes = append(caseTypes, t)
+		}
+	}
+	return caseTypes
+}
+
+// canonicalCaseType returns the allowed case type matching caseType in any
+// case, spelled as configured
+func canonicalCaseType(caseType string) (string, bool) {
+	for _, t := range CaseTypes() {
+		if strings.EqualFold(t, caseType) {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+func ValidateCaseUpdate(update CaseUpdate) []FieldError {
+	var fieldErrors []FieldError
+
+	required := []struct {
+		field string
+		value *string
+	}{
+		{"case_title", update.CaseTitle},
+		{"attorney_first_name", update.AttorneyFirstName},
+		{"attorney_last_name", update.AttorneyLastName},
+		{"case_info", update.CaseInfo},
+		{"case_type", update.CaseType},
+		{"city", update.City},
+		{"date", update.Date},
+		{"judge_name", update.JudgeName},
+		{"state", update.State},
+		{"user_id", update.UserID},
+	}
+	for _, f := range required {
+		if f.value != nil && strings.TrimSpace(*f.value) == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: f.field, Message: "must not be empty"})
+		}
+	}
+
+	if update.Date != nil && *update.Date != "" {
+		if _, err := time.Parse("2006-01-02", *update.Date); err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "date", Message: "must be an ISO date (YYYY-MM-DD)"})
+		}
+	}
+
+	if update.State != nil && *update.State != "" && !usStateCodes[*update.State] {
+		fieldErrors = append(fieldErrors, FieldError{Field: "state", Message: "must be a two letter US state code"})
+	}
+
+	if update.CaseType != nil && *update.CaseType != "" {
+		if _, ok := canonicalCaseType(*update.CaseType); !ok {
+			fieldErrors = append(fieldErrors, FieldError{Field: "case_type", Message: "must be one of " + strings.Join(CaseTypes(), ", ")})
+		}
+	}
+
+	return fieldErrors
+}
+
+// ErrCaseOwnerChange is returned by UpdateCase for a user_id other than the
+// case's owner. Moving a case between users is not supported.
+var ErrCaseOwnerChange = errors.New("a case's user_id cannot be changed")
+
+// UpdateCase applies the non-nil fields of update to the case and records
+// the changed values in the case history. It returns an empty Case if the
+// case does not exist. A user_id equal to the owner's is ignored, so clients
+// may send the whole case back.
+func UpdateCase(caseID string, update CaseUpdate, changedBy string) (Case, error) {
+	myCase, err := GetCaseFromId(caseID)
+	if err != nil {
+		return Case{}, err
+	}
+
+	if myCase.ID == "" {
+		return Case{}, nil
+	}
+
+	if update.UserID != nil && *update.UserID != myCase.UserID {
+		return Case{}, ErrCaseOwnerChange
+	}
+	if update.CaseType != nil {
+		if caseType, ok := canonicalCaseType(*update.CaseType); ok {
+			update.CaseType = &caseType
+		}
+	}
+
+	fields := []struct {
+		name    string
+		current *string
+		value   *string
+	}{
+		{"case_title", &myCase.CaseTitle, update.CaseTitle},
+		{"attorney_first_name", &myCase.AttorneyFirstName, update.AttorneyFirstName},
+		{"attorney_last_name", &myCase.AttorneyLastName, update.AttorneyLastName},
+		{"case_info", &myCase.CaseInfo, update.CaseInfo},
+		{"case_type", &myCase.CaseType, update.CaseType},
+		{"city", &myCase.City, update.City},
+		{"date", &myCase.Date, update.Date},
+		{"judge_name", &myCase.JudgeName, update.JudgeName},
+		{"state", &myCase.State, update.State},
+	}
+
+	var changes []FieldChange
+	var set expression.UpdateBuilder
+	for _, f := range fields {
+		if f.value == nil || *f.value == *f.current {
+			continue
+		}
+
+		changes = append(changes, FieldChange{
+			Field:    f.name,
+			OldValue: *f.current,
+			NewValue: *f.value,
+		})
+		set = set.Set(expression.Name(f.name), expression.Value(*f.value))
+		*f.current = *f.value
+	}
+
+	if len(changes) == 0 {
+		return myCase, nil
+	}
+
+	if update.CaseTitle != nil || update.CaseInfo != nil {
+		set = setCaseIndexAttributes(set, myCase)
+	}
+
+	expr, err := expression.NewBuilder().
+		WithUpdate(set).
+		WithCondition(expression.AttributeExists(expression.Name("_id"))).
+		Build()
+	if err != nil {
+		return Case{}, err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(caseID),
+			},
+		},
+		TableName: &CasesTable,
+	})
+	if err != nil {
+		return Case{}, err
+	}
+
+	change := CaseChange{
+		ID:        generateRandomString(16),
+		CaseID:    caseID,
+		ChangedBy: changedBy,
+		ChangedAt: time.Now().UTC().Format(time.RFC3339),
+		Changes:   changes,
+	}
+
+	if err := CreateCaseChange(change); err != nil {
+		log.Printf("Error recording case change for %s: %v", caseID, err)
+	}
+
+	return myCase, nil
+}
+
+func CreateCaseChange(change CaseChange) error {
+	av, err := dynamodbattribute.MarshalMap(change)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: &CaseHistoryTable,
+	})
+
+	return err
+}
+
+func GetCaseHistory(caseID string) ([]CaseChange, error) {
+	filt := expression.Name("case_id").Equal(expression.Value(caseID))
+	expr, err := expression.NewBuilder().WithFilter(filt).Build()
+	if err != nil {
+		return []CaseChange{}, err
+	}
+
+	history := []CaseChange{}
+	err = dynamo.ScanPages(&dynamodb.ScanInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		TableName:                 &CaseHistoryTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var change CaseChange
+			if err := dynamodbattribute.UnmarshalMap(item, &change); err != nil {
+				log.Printf("Error unmarshalling case change: %v", err)
+				continue
+			}
+			history = append(history, change)
+		}
+		return true
+	})
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].ChangedAt < history[j].ChangedAt
+	})
+
+	return history, err
+}
+
+// DeleteCaseHistory deletes a case's change history and returns how many
+// changes were deleted
+func DeleteCaseHistory(caseID string) (int, error) {
+	history, err := GetCaseHistory(caseID)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, change := range history {
+		_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				"_id": {
+					S: aws.String(change.ID),
+				},
+			},
+			TableName: &CaseHistoryTable,
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(history), nil
+}
+
+// caseSearchTerms splits text into the lower case words stored in a case's
+// search_terms set
+func caseSearchTerms(text ...string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, t := range text {
+		words := strings.FieldsFunc(strings.ToLower(t), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		for _, word := range words {
+			if len(word) < 2 || seen[word] {
+				continue
+			}
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// caseIndexAttributes returns the derived attributes that back the title
+// sort index and text search for a case
+func caseIndexAttributes(myCase Case) map[string]*dynamodb.AttributeValue {
+	attributes := map[string]*dynamodb.AttributeValue{
+		"title_key": {
+			S: aws.String(strings.ToLower(myCase.CaseTitle)),
+		},
+	}
+	if terms := caseSearchTerms(myCase.CaseTitle, myCase.CaseInfo); len(terms) > 0 {
+		attributes["search_terms"] = &dynamodb.AttributeValue{SS: aws.StringSlice(terms)}
+	}
+	return attributes
+}
+
+// setCaseIndexAttributes adds updates for the derived index attributes of
+// myCase to set
+func setCaseIndexAttributes(set expression.UpdateBuilder, myCase Case) expression.UpdateBuilder {
+	set = set.Set(expression.Name("title_key"), expression.Value(strings.ToLower(myCase.CaseTitle)))
+
+	terms := caseSearchTerms(myCase.CaseTitle, myCase.CaseInfo)
+	if len(terms) == 0 {
+		return set.Remove(expression.Name("search_terms"))
+	}
+	return set.Set(expression.Name("search_terms"), expression.Value(stringSet(terms)))
+}
+
+// stringSet marshals as a DynamoDB string set rather than a list
+type stringSet []string
+
+func (s stringSet) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	av.SS = aws.StringSlice(s)
+	return nil
+}
+
+// QueryUserCases lists a user's cases through the user_id date or title
+// index. Equality filters and text search run as filter expressions on the
+// index query, so only the user's partition is read. Search matches whole
+// words of the title and info: each word of filter.Query must be one of the
+// case's search_terms, so "contr" does not find "contract". It returns a
+// cursor for the next page when filter.Limit is set and more results remain.
+func QueryUserCases(userID string, filter CaseFilter) ([]Case, string, error) {
+	index := CasesByDateIndex
+	sortKey := "date"
+	if filter.Sort == "title" {
+		index = CasesByTitleIndex
+		sortKey = "title_key"
+	}
+
+	keyCond := expression.Key("user_id").Equal(expression.Value(userID))
+	var conditions []expression.ConditionBuilder
+
+	switch {
+	case sortKey != "date":
+		if filter.DateFrom != "" {
+			conditions = append(conditions, expression.Name("date").GreaterThanEqual(expression.Value(filter.DateFrom)))
+		}
+		if filter.DateTo != "" {
+			conditions = append(conditions, expression.Name("date").LessThanEqual(expression.Value(filter.DateTo)))
+		}
+	case filter.DateFrom != "" && filter.DateTo != "":
+		keyCond = keyCond.And(expression.Key("date").Between(expression.Value(filter.DateFrom), expression.Value(filter.DateTo)))
+	case filter.DateFrom != "":
+		keyCond = keyCond.And(expression.Key("date").GreaterThanEqual(expression.Value(filter.DateFrom)))
+	case filter.DateTo != "":
+		keyCond = keyCond.And(expression.Key("date").LessThanEqual(expression.Value(filter.DateTo)))
+	}
+
+	equals := []struct {
+		name  string
+		value string
+	}{
+		{"case_type", filter.CaseType},
+		{"state", filter.State},
+		{"city", filter.City},
+		{"judge_name", filter.JudgeName},
+	}
+	for _, e := range equals {
+		if e.value != "" {
+			conditions = append(conditions, expression.Name(e.name).Equal(expression.Value(e.value)))
+		}
+	}
+
+	for _, term := range caseSearchTerms(filter.Query) {
+		conditions = append(conditions, expression.Contains(expression.Name("search_terms"), term))
+	}
+
+	builder := expression.NewBuilder().WithKeyCondition(keyCond)
+	if len(conditions) == 1 {
+		builder = builder.WithFilter(conditions[0])
+	} else if len(conditions) > 1 {
+		builder = builder.WithFilter(expression.And(conditions[0], conditions[1], conditions[2:]...))
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return []Case{}, "", err
+	}
+
+	startKey, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return []Case{}, "", err
+	}
+
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		IndexName:                 aws.String(index),
+		ScanIndexForward:          aws.Bool(filter.Order == "asc" || (filter.Order == "" && filter.Sort == "title")),
+		ExclusiveStartKey:         startKey,
+		TableName:                 &CasesTable,
+	}
+
+	cases := []Case{}
+	cursor, err := QueryPage(input, filter.Limit, func(item map[string]*dynamodb.AttributeValue) error {
+		var myCase Case
+		if err := dynamodbattribute.UnmarshalMap(item, &myCase); err != nil {
+			return err
+		}
+		cases = append(cases, myCase)
+		return nil
+	})
+	if err != nil {
+		return []Case{}, "", err
+	}
+
+	return cases, cursor, nil
+}
+
+// ReindexCases rewrites the title_key and search_terms attributes of every
+// case so cases created before the indexes existed can be listed and
+// searched. It returns the number of cases updated.
+func ReindexCases() (int, error) {
+	updated := 0
+	var scanErr error
+
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		TableName: &CasesTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var myCase Case
+			if err := dynamodbattribute.UnmarshalMap(item, &myCase); err != nil {
+				scanErr = err
+				return false
+			}
+
+			expr, err := expression.NewBuilder().WithUpdate(setCaseIndexAttributes(expression.UpdateBuilder{}, myCase)).Build()
+			if err != nil {
+				scanErr = err
+				return false
+			}
+
+			_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+				UpdateExpression:          expr.Update(),
+				Key: map[string]*dynamodb.AttributeValue{
+					"_id": {
+						S: aws.String(myCase.ID),
+					},
+				},
+				TableName: &CasesTable,
+			})
+			if err != nil {
+				scanErr = err
+				return false
+			}
+			updated++
+		}
+		return true
+	})
+	if err != nil {
+		return updated, err
+	}
+
+	return updated, scanErr
+}
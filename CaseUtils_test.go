@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalCaseType(t *testing.T) {
+	t.Setenv("CASE_TYPES", "")
+	for input, want := range map[string]string{
+		"civil":           "Civil",
+		"PERSONAL INJURY": "Personal Injury",
+		"Family":          "Family",
+	} {
+		if got, ok := canonicalCaseType(input); !ok || got != want {
+			t.Errorf("canonicalCaseType(%q) = %q, %v, want %q", input, got, ok, want)
+		}
+	}
+	if got, ok := canonicalCaseType("Maritime"); ok {
+		t.Errorf("canonicalCaseType(Maritime) = %q, want not allowed", got)
+	}
+}
+
+func TestCreateCaseResourceHandlerValidatesFields(t *testing.T) {
+	t.Setenv("CASE_TYPES", "")
+	valid := map[string]string{
+		"case_title":          "Doe v. Roe",
+		"attorney_first_name": "Ann",
+		"attorney_last_name":  "Lee",
+		"case_info":           "Contract dispute",
+		"case_type":           "civil",
+		"city":                "Fresno",
+		"date":                "2024-05-01",
+		"judge_name":          "Judge Dredd",
+		"state":               "CA",
+		"user_id":             "u1",
+	}
+
+	for field, bad := range map[string]string{
+		"date":      "05/01/2024",
+		"state":     "California",
+		"case_type": "Maritime",
+	} {
+		body := map[string]string{}
+		for k, v := range valid {
+			body[k] = v
+		}
+		body[field] = bad
+		b, _ := json.Marshal(body)
+
+		rec := httptest.NewRecorder()
+		CreateCaseResourceHandler(rec, httptest.NewRequest("POST", "/v1/cases", strings.NewReader(string(b))))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"field":"`+field+`"`) {
+			t.Errorf("%s %q: got %d %s, want a validation error", field, bad, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -1,135 +1,77 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func GetChatByCaseIDHandler(w http.ResponseWriter, r *http.Request) {
-	// read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get chat",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	// unmarshal the request body
 	var getChatByCaseIdRequest struct {
 		CaseID string `json:"case_id"`
 	}
 
-	if err := json.Unmarshal(body, &getChatByCaseIdRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &getChatByCaseIdRequest) {
 		return
 	}
 
+	getCaseChat(w, r, getChatByCaseIdRequest.CaseID)
+}
+
+func getCaseChat(w http.ResponseWriter, r *http.Request, caseID string) {
 	// get chat object
-	var return_chat Chat
-	return_chat, err = GetChatFromCaseId(getChatByCaseIdRequest.CaseID)
+	return_chat, err := GetChatFromCaseId(caseID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get chat",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get chat")
 		return
 	}
 
 	// check if chat exists
 	if return_chat.ID == "" {
-		response := ErrorResponse{
-			Message: "Chat not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeChatNotFound, "Chat not found")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(return_chat)
+	WriteSuccess(w, r, http.StatusOK, "Chat retrieved successfully", return_chat)
 }
 
 func AddMessageToChatHandler(w http.ResponseWriter, r *http.Request) {
-	// read the request body
-
 	log.Printf("Adding message to chat")
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to add message",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	// unmarshal the request body
 	var addMessageToChatRequest struct {
 		CaseID  string  `json:"case_id"`
 		Message Message `json:"message"`
 	}
 
-	if err := json.Unmarshal(body, &addMessageToChatRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &addMessageToChatRequest) {
 		return
 	}
 
-	log.Printf("Unmarshalled request body %v", addMessageToChatRequest)
+	postChatMessage(w, r, addMessageToChatRequest.CaseID, addMessageToChatRequest.Message, http.StatusOK)
+}
+
+func postChatMessage(w http.ResponseWriter, r *http.Request, caseID string, message Message, successStatus int) {
+	log.Printf("Unmarshalled request body %v", message)
 
 	//make sure fields are not empty
-	if addMessageToChatRequest.CaseID == "" || addMessageToChatRequest.Message.Text == "" || addMessageToChatRequest.Message.Sender == "" || addMessageToChatRequest.Message.Timestamp == "" {
-		response := ErrorResponse{
-			Message: "Fields cannot be empty",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if fieldErrors := RequireFields(
+		"case_id", caseID,
+		"message.text", message.Text,
+		"message.sender", message.Sender,
+		"message.timestamp", message.Timestamp,
+	); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
 		return
 	}
 
 	// get chat object
-	var return_chat Chat
-	return_chat, err = GetChatFromCaseId(addMessageToChatRequest.CaseID)
+	return_chat, err := GetChatFromCaseId(caseID)
 
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get chat",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get chat")
 		return
 	}
 
@@ -137,42 +79,222 @@ func AddMessageToChatHandler(w http.ResponseWriter, r *http.Request) {
 
 	// check if chat exists
 	if return_chat.ID == "" {
-		response := ErrorResponse{
-			Message: "Chat not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeChatNotFound, "Chat not found")
 		return
 	}
 
 	log.Printf("Chat exists")
 
 	// add message to chat
-	err = AddMessageToChat(addMessageToChatRequest.CaseID, addMessageToChatRequest.Message.Text, addMessageToChatRequest.Message.Sender, addMessageToChatRequest.Message.Timestamp)
+	err = AddMessageToChat(caseID, message.Text, message.Sender, message.Timestamp)
 
 	log.Printf("Message added")
 
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to add message",
-			Status:  http.StatusInternalServerError,
+		log.Printf("Error adding message: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to add message")
+		return
+	}
+
+	EmitWebhookEvent(WebhookChatMessageAdded, return_chat.UserID, caseID, message)
+
+	WriteSuccess(w, r, successStatus, "Message added successfully", nil)
+}
+
+// chatKeepAlive is how often an idle chat stream sends a comment so proxies
+// do not close it
+const chatKeepAlive = 20 * time.Second
+
+// streamCaseChat follows a case chat as Server-Sent Events. Messages appended
+// after the Last-Event-ID header, or the last_event_id query parameter for
+// clients that cannot set headers, are replayed before live events.
+func streamCaseChat(w http.ResponseWriter, r *http.Request, caseID string) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	lastSeen := -1
+	if lastEventID != "" {
+		var err error
+		if lastSeen, err = strconv.Atoi(lastEventID); err != nil || lastSeen < 0 {
+			WriteValidationError(w, r, []FieldError{{Field: "Last-Event-ID", Message: "must be a message ID"}})
+			return
 		}
+	}
 
-		// log error
-		log.Printf("Error adding message: %v", err)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Streaming is not supported")
+		return
+	}
+
+	chat, err := GetChatFromCaseId(caseID)
+	if err != nil {
+		log.Printf("Error getting chat: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get chat")
+		return
+	}
+
+	if chat.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeChatNotFound, "Chat not found")
+		return
+	}
+
+	allowed, err := canFollowChat(r, chat)
+	if err != nil {
+		log.Printf("Error authorizing chat stream: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to authorize chat stream")
+		return
+	}
+	if !allowed {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Not allowed to follow this chat")
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+	userID := AuthenticatedUserID(r)
+	wasPresent := userID != "" && isPresent(caseID, userID)
+
+	// subscribe before reading the chat again for the replay so no message
+	// falls between the replay and the live events
+	events, cancel := chatBroker.Subscribe(caseID, userID)
+	defer cancel()
+
+	chat, err = GetChatFromCaseId(caseID)
+	if err != nil {
+		log.Printf("Error getting chat: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get chat")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(SuccessResponse{
-		Message: "Message added successfully",
-		Status:  http.StatusOK,
+
+	now := func() string { return time.Now().UTC().Format(time.RFC3339Nano) }
+
+	// a client without a Last-Event-ID has the chat already and only wants
+	// what comes next
+	if lastEventID == "" {
+		lastSeen = len(chat.Messages) - 1
+	}
+	for i := lastSeen + 1; i < len(chat.Messages); i++ {
+		message := chat.Messages[i]
+		if err := writeChatEvent(w, ChatEvent{Type: ChatEventMessage, CaseID: caseID, MessageID: strconv.Itoa(i), Message: &message, Timestamp: message.Timestamp}); err != nil {
+			return
+		}
+	}
+	if len(chat.Messages)-1 > lastSeen {
+		lastSeen = len(chat.Messages) - 1
+	}
+
+	if err := writeChatEvent(w, ChatEvent{Type: ChatEventPresence, CaseID: caseID, State: PresenceCurrent, Users: chatBroker.Present(caseID), Timestamp: now()}); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	if userID != "" && !wasPresent {
+		chatBroker.Publish(ChatEvent{Type: ChatEventPresence, CaseID: caseID, UserID: userID, State: PresenceJoined, Timestamp: now()})
+		defer func() {
+			if !isPresent(caseID, userID) {
+				chatBroker.Publish(ChatEvent{Type: ChatEventPresence, CaseID: caseID, UserID: userID, State: PresenceLeft, Timestamp: now()})
+			}
+		}()
+	}
+
+	keepAlive := time.NewTicker(chatKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				// dropped for falling behind; the client resumes from its
+				// Last-Event-ID
+				return
+			}
+			if event.Type == ChatEventMessage {
+				// already replayed from the chat
+				if id, err := strconv.Atoi(event.MessageID); err == nil && id <= lastSeen {
+					continue
+				}
+			}
+			if err := writeChatEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func SetTypingHandler(w http.ResponseWriter, r *http.Request) {
+	var setTypingRequest struct {
+		CaseID string `json:"case_id"`
+		Typing bool   `json:"typing"`
+	}
+
+	if !DecodeJSONBody(w, r, &setTypingRequest) {
+		return
+	}
+
+	setTyping(w, r, setTypingRequest.CaseID, setTypingRequest.Typing)
+}
+
+// setTyping tells the streams following a chat that the session's user
+// started or stopped typing. Typing signals are not stored.
+func setTyping(w http.ResponseWriter, r *http.Request, caseID string, typing bool) {
+	if fieldErrors := RequireFields("case_id", caseID); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	userID := AuthenticatedUserID(r)
+	if userID == "" {
+		WriteError(w, r, http.StatusUnauthorized, CodeUnauthenticated, "Session token required")
+		return
+	}
+
+	chat, err := GetChatFromCaseId(caseID)
+	if err != nil {
+		log.Printf("Error getting chat: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get chat")
+		return
+	}
+
+	if chat.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeChatNotFound, "Chat not found")
+		return
+	}
+
+	allowed, err := canFollowChat(r, chat)
+	if err != nil {
+		log.Printf("Error authorizing typing signal: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to authorize typing signal")
+		return
+	}
+	if !allowed {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Not allowed to post to this chat")
+		return
+	}
+
+	state := TypingStopped
+	if typing {
+		state = TypingStarted
+	}
+	chatBroker.Publish(ChatEvent{
+		Type:      ChatEventTyping,
+		CaseID:    caseID,
+		UserID:    userID,
+		State:     state,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
 	})
+
+	WriteSuccess(w, r, http.StatusAccepted, "Typing status sent", nil)
 }
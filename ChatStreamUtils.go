@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const (
+	ChatEventMessage  = "message"
+	ChatEventTyping   = "typing"
+	ChatEventPresence = "presence"
+
+	TypingStarted   = "started"
+	TypingStopped   = "stopped"
+	PresenceJoined  = "joined"
+	PresenceLeft    = "left"
+	PresenceCurrent = "snapshot"
+)
+
+// chatSubscriberBuffer is how many events a stream may fall behind before the
+// broker drops it. Dropped clients reconnect with Last-Event-ID and replay the
+// messages they missed from the chat.
+const chatSubscriberBuffer = 64
+
+// ChatBroker fans chat events out to the streams following a case. The
+// in-process broker only reaches streams on this instance; a broker backed
+// by a shared bus can replace it without changing the handlers.
+type ChatBroker interface {
+	Publish(event ChatEvent)
+	// Subscribe follows a case's events until cancel is called. The channel
+	// is closed when the subscription ends, including when the broker drops
+	// a subscriber that is not keeping up.
+	Subscribe(caseID string, userID string) (events <-chan ChatEvent, cancel func())
+	// Present lists the users with an open subscription to a case
+	Present(caseID string) []string
+}
+
+var chatBroker ChatBroker = newMemoryChatBroker()
+
+type chatSubscriber struct {
+	userID string
+	events chan ChatEvent
+}
+
+type memoryChatBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*chatSubscriber]struct{}
+}
+
+func newMemoryChatBroker() *memoryChatBroker {
+	return &memoryChatBroker{subscribers: map[string]map[*chatSubscriber]struct{}{}}
+}
+
+func (b *memoryChatBroker) Publish(event ChatEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers[event.CaseID] {
+		select {
+		case sub.events <- event:
+		default:
+			b.remove(event.CaseID, sub)
+		}
+	}
+}
+
+func (b *memoryChatBroker) Subscribe(caseID string, userID string) (<-chan ChatEvent, func()) {
+	sub := &chatSubscriber{userID: userID, events: make(chan ChatEvent, chatSubscriberBuffer)}
+
+	b.mu.Lock()
+	if b.subscribers[caseID] == nil {
+		b.subscribers[caseID] = map[*chatSubscriber]struct{}{}
+	}
+	b.subscribers[caseID][sub] = struct{}{}
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[caseID][sub]; ok {
+			b.remove(caseID, sub)
+		}
+	}
+
+	return sub.events, cancel
+}
+
+func (b *memoryChatBroker) Present(caseID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seen := map[string]bool{}
+	users := []string{}
+	for sub := range b.subscribers[caseID] {
+		if sub.userID != "" && !seen[sub.userID] {
+			seen[sub.userID] = true
+			users = append(users, sub.userID)
+		}
+	}
+	return users
+}
+
+// remove must be called with b.mu held
+func (b *memoryChatBroker) remove(caseID string, sub *chatSubscriber) {
+	delete(b.subscribers[caseID], sub)
+	if len(b.subscribers[caseID]) == 0 {
+		delete(b.subscribers, caseID)
+	}
+	close(sub.events)
+}
+
+func isPresent(caseID string, userID string) bool {
+	for _, present := range chatBroker.Present(caseID) {
+		if present == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// writeChatEvent writes one Server-Sent Event. Only message events carry an
+// id, so a reconnecting client's Last-Event-ID is the last message it saw.
+func writeChatEvent(w io.Writer, event ChatEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if event.Type == ChatEventMessage {
+		if _, err := fmt.Fprintf(w, "id: %s\n", event.MessageID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// canFollowChat reports whether a request may follow a case chat: admins, the
+// case owner, and users in the owner's organization. Users are identified by
+// their session token, never by X-User-ID.
+func canFollowChat(r *http.Request, chat Chat) (bool, error) {
+	if IsAdminRequest(r) {
+		return true, nil
+	}
+
+	userID := AuthenticatedUserID(r)
+	if userID == "" {
+		return false, nil
+	}
+	if userID == chat.UserID {
+		return true, nil
+	}
+
+	user, err := getUserFromId(userID)
+	if err != nil {
+		return false, err
+	}
+	if user.ID == "" || user.Organization == "" {
+		return false, nil
+	}
+
+	owner, err := getUserFromId(chat.UserID)
+	if err != nil {
+		return false, err
+	}
+	return owner.Organization == user.Organization, nil
+}
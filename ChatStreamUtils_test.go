@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanFollowChatIgnoresClaimedUser(t *testing.T) {
+	t.Setenv("SESSION_SIGNING_KEY", "secret")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	chat := Chat{ID: "c1", UserID: "owner"}
+
+	r := httptest.NewRequest("GET", "/v1/cases/c1/chat/stream", nil)
+	r.Header.Set("X-User-ID", "owner")
+	if allowed, err := canFollowChat(r, chat); err != nil || allowed {
+		t.Errorf("claimed owner: allowed = %v, err = %v, want refused", allowed, err)
+	}
+
+	token, err := IssueSessionToken("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if allowed, err := canFollowChat(r, chat); err != nil || !allowed {
+		t.Errorf("owner's session: allowed = %v, err = %v, want allowed", allowed, err)
+	}
+
+	r = httptest.NewRequest("GET", "/v1/cases/c1/chat/stream", nil)
+	r.Header.Set("X-Admin-Token", "admin-secret")
+	if allowed, err := canFollowChat(r, chat); err != nil || !allowed {
+		t.Errorf("admin: allowed = %v, err = %v, want allowed", allowed, err)
+	}
+}
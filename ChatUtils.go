@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -90,6 +91,7 @@ func AddMessageToChat(caseID string, message string, sender string, date string)
 		Key: map[string]*dynamodb.AttributeValue{
 			"_id": {S: &caseID}},
 		UpdateExpression: aws.String("SET messages = list_append(messages, :newMessage)"),
+		ReturnValues:     aws.String(dynamodb.ReturnValueUpdatedNew),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":newMessage": {
 				L: []*dynamodb.AttributeValue{
@@ -105,13 +107,26 @@ func AddMessageToChat(caseID string, message string, sender string, date string)
 		},
 	}
 
-	_, err = dynamo.UpdateItem(input)
+	result, err := dynamo.UpdateItem(input)
 	if err != nil {
 		return fmt.Errorf("failed to update item, %v", err)
 	}
 
 	fmt.Println("Added message to chat")
 
+	// the message's index in the list is its ID on the chat stream
+	var messages []*dynamodb.AttributeValue
+	if updated := result.Attributes["messages"]; updated != nil {
+		messages = updated.L
+	}
+	chatBroker.Publish(ChatEvent{
+		Type:      ChatEventMessage,
+		CaseID:    caseID,
+		MessageID: strconv.Itoa(len(messages) - 1),
+		Message:   &newMessage,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	})
+
 	return nil
 }
 
@@ -151,3 +166,100 @@ func CreateChat(caseID string, userID string) error {
 
 	return nil
 }
+
+func GetAllChats() ([]Chat, error) {
+	var chats []Chat
+
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(ChatsTable),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var chat Chat
+			if err := dynamodbattribute.UnmarshalMap(item, &chat); err != nil {
+				log.Printf("Error unmarshalling chat: %v", err)
+				continue
+			}
+			chats = append(chats, chat)
+		}
+		return true
+	})
+
+	return chats, err
+}
+
+func DeleteChatById(caseID string) error {
+	_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(caseID),
+			},
+		},
+		TableName: aws.String(ChatsTable),
+	})
+
+	return err
+}
+
+// ReplaceChatMessages overwrites the message list of a chat
+func ReplaceChatMessages(caseID string, messages []Message) error {
+	av, err := dynamodbattribute.MarshalList(messages)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(ChatsTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {S: aws.String(caseID)},
+		},
+		UpdateExpression: aws.String("SET messages = :messages"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":messages": {L: av},
+		},
+	})
+
+	return err
+}
+
+// RemoveSelectedDocs removes every selected_docs entry matching one of refs,
+// which may be document IDs or file URLs
+func RemoveSelectedDocs(caseID string, refs ...string) error {
+	chat, err := GetChatFromCaseId(caseID)
+	if err != nil || chat.ID == "" {
+		return err
+	}
+
+	remove := map[string]bool{}
+	for _, ref := range refs {
+		remove[ref] = true
+	}
+
+	selectedDocs := []string{}
+	for _, d := range chat.SelectedDocs {
+		if !remove[d] {
+			selectedDocs = append(selectedDocs, d)
+		}
+	}
+
+	if len(selectedDocs) == len(chat.SelectedDocs) {
+		return nil
+	}
+
+	av, err := dynamodbattribute.MarshalList(selectedDocs)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(ChatsTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {S: aws.String(caseID)},
+		},
+		UpdateExpression: aws.String("SET selected_docs = :selected_docs"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":selected_docs": {L: av},
+		},
+	})
+
+	return err
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// avalonctl is the operator tool for repairing data without the AWS
+// console. It is this binary run under the name avalonctl, so it uses the
+// same storage code and configuration as the server:
+//
+//	go build -o avalonctl .
+//	avalonctl cases recount <case-id> --dry-run
+//
+// Running the server binary as "avalon ctl ..." does the same.
+
+// ctlResult is what a command prints. Rows are only used for text output,
+// with the header first.
+type ctlResult struct {
+	Message string      `json:"message"`
+	DryRun  bool        `json:"dry_run"`
+	Object  interface{} `json:"object,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	rows    [][]string
+}
+
+type ctlCommand struct {
+	args    []string
+	summary string
+	// flags registers the command's own flags and returns its action
+	flags func(fs *flag.FlagSet) func(args []string, dryRun bool) (ctlResult, error)
+}
+
+var errCtlUsage = errors.New("usage")
+
+var ctlCommands = map[string]ctlCommand{
+	"users list": {
+		summary: "list users, optionally only the one with --email",
+		flags: func(fs *flag.FlagSet) func([]string, bool) (ctlResult, error) {
+			email := fs.String("email", "", "only list the user with this email")
+			return func(args []string, dryRun bool) (ctlResult, error) {
+				return ctlListUsers(*email)
+			}
+		},
+	},
+	"users get": {
+		args:    []string{"user-id"},
+		summary: "show a user",
+		flags:   ctlNoFlags(ctlGetUser),
+	},
+	"users delete": {
+		args:    []string{"user-id"},
+		summary: "delete a user record, leaving their cases",
+		flags:   ctlNoFlags(ctlDeleteUser),
+	},
+	"users erase": {
+		args:    []string{"user-id"},
+		summary: "erase a user and everything they own",
+		flags:   ctlNoFlags(ctlEraseUser),
+	},
+	"users reset-password": {
+		args:    []string{"user-id"},
+		summary: "set a new password, generated unless --password is given",
+		flags: func(fs *flag.FlagSet) func([]string, bool) (ctlResult, error) {
+			password := fs.String("password", "", "the new password")
+			return func(args []string, dryRun bool) (ctlResult, error) {
+				return ctlResetPassword(args[0], *password, dryRun)
+			}
+		},
+	},
+	"cases list": {
+		summary: "list cases, optionally only those of --user",
+		flags: func(fs *flag.FlagSet) func([]string, bool) (ctlResult, error) {
+			userID := fs.String("user", "", "only list this user's cases")
+			return func(args []string, dryRun bool) (ctlResult, error) {
+				return ctlListCases(*userID)
+			}
+		},
+	},
+	"cases get": {
+		args:    []string{"case-id"},
+		summary: "show a case",
+		flags:   ctlNoFlags(ctlGetCase),
+	},
+	"cases delete": {
+		args:    []string{"case-id"},
+		summary: "delete a case record",
+		flags:   ctlNoFlags(ctlDeleteCase),
+	},
+	"cases recount": {
+		args:    []string{"case-id"},
+		summary: "recompute number_files from the documents table",
+		flags: ctlNoFlags(func(args []string, dryRun bool) (ctlResult, error) {
+			myCase, err := ctlCase(args[0])
+			if err != nil {
+				return ctlResult{}, err
+			}
+			return ctlRecountFiles([]Case{myCase}, dryRun)
+		}),
+	},
+	"cases export": {
+		args:    []string{"case-id"},
+		summary: "write a zip archive of the case, its history, documents and chat to --out",
+		flags: func(fs *flag.FlagSet) func([]string, bool) (ctlResult, error) {
+			out := fs.String("out", "", "path of the zip archive to write")
+			return func(args []string, dryRun bool) (ctlResult, error) {
+				return ctlExportCase(args[0], *out, dryRun)
+			}
+		},
+	},
+	"documents list": {
+		summary: "list documents, optionally only those of --case",
+		flags: func(fs *flag.FlagSet) func([]string, bool) (ctlResult, error) {
+			caseID := fs.String("case", "", "only list this case's documents")
+			return func(args []string, dryRun bool) (ctlResult, error) {
+				return ctlListDocuments(*caseID)
+			}
+		},
+	},
+	"documents get": {
+		args:    []string{"document-id"},
+		summary: "show a document",
+		flags:   ctlNoFlags(ctlGetDocument),
+	},
+	"documents delete": {
+		args:    []string{"document-id"},
+		summary: "delete a document record",
+		flags:   ctlNoFlags(ctlDeleteDocument),
+	},
+	"jobs recount-files": {
+		summary: "recompute number_files for every case",
+		flags: ctlNoFlags(func(args []string, dryRun bool) (ctlResult, error) {
+			cases, err := GetAllCases()
+			if err != nil {
+				return ctlResult{}, err
+			}
+			return ctlRecountFiles(cases, dryRun)
+		}),
+	},
+	"jobs reindex-cases": {
+		summary: "rewrite the case search and title sort attributes",
+		flags:   ctlNoFlags(ctlReindexCases),
+	},
+	"jobs reindex-documents": {
+		summary: "set file_type on documents that are missing it",
+		flags:   ctlNoFlags(ctlReindexDocuments),
+	},
+	"jobs reindex-audit-log": {
+		summary: "add the index attributes to audit events written before the audit indexes",
+		flags:   ctlNoFlags(ctlReindexAuditLog),
+	},
+	"jobs sweep-uploads": {
+		summary: "remove abandoned direct upload reservations, expired resumable uploads and their files",
+		flags:   ctlNoFlags(ctlSweepUploads),
+	},
+	"jobs verify-audit-log": {
+		summary: "check the audit log hash chain",
+		flags:   ctlNoFlags(ctlVerifyAuditLog),
+	},
+}
+
+func ctlNoFlags(run func(args []string, dryRun bool) (ctlResult, error)) func(*flag.FlagSet) func([]string, bool) (ctlResult, error) {
+	return func(*flag.FlagSet) func([]string, bool) (ctlResult, error) {
+		return run
+	}
+}
+
+func ctlUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: avalonctl <resource> <command> [args] [--dry-run] [--json] [--verbose]")
+	fmt.Fprintln(w)
+
+	names := make([]string, 0, len(ctlCommands))
+	for name := range ctlCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		command := ctlCommands[name]
+		usage := name
+		for _, arg := range command.args {
+			usage += " <" + arg + ">"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", usage, command.summary)
+	}
+	tw.Flush()
+}
+
+// parseCtlFlags parses flags that may come before, between or after the
+// positional arguments and returns the positional arguments
+func parseCtlFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// RunCtl runs one avalonctl command and returns the process exit code
+func RunCtl(args []string) int {
+	if len(args) < 2 {
+		ctlUsage(os.Stderr)
+		return 2
+	}
+
+	name := args[0] + " " + args[1]
+	command, ok := ctlCommands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		ctlUsage(os.Stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would change without changing it")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+	verbose := fs.Bool("verbose", false, "show storage logs on stderr")
+	run := command.flags(fs)
+
+	positional, err := parseCtlFlags(fs, args[2:])
+	if err != nil {
+		return 2
+	}
+	if len(positional) != len(command.args) {
+		fmt.Fprintf(os.Stderr, "%s takes %d argument(s)\n", name, len(command.args))
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	result, err := run(positional, *dryRun)
+	result.DryRun = *dryRun
+	if errors.Is(err, errCtlUsage) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, result.Message)
+		return 2
+	}
+	if err != nil {
+		result.Message = "failed"
+		result.Error = err.Error()
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	} else {
+		writeCtlText(os.Stdout, result)
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func writeCtlText(w io.Writer, result ctlResult) {
+	if result.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", result.Error)
+		return
+	}
+
+	fmt.Fprintln(w, result.Message)
+
+	if len(result.rows) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, row := range result.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		tw.Flush()
+	}
+}
+
+// ctlAction picks the verb for a result message
+func ctlAction(dryRun bool, done string, planned string) string {
+	if dryRun {
+		return planned
+	}
+	return done
+}
+
+// ctlAudit records a change made with avalonctl. The operator is taken from
+// the shell since there is no request to take it from.
+func ctlAudit(eventType string, event AuditEvent) {
+	event.Type = eventType
+	event.ActorID = "avalonctl"
+	if event.Details == nil {
+		event.Details = map[string]string{}
+	}
+	event.Details["operator"] = os.Getenv("USER")
+
+	if _, err := AppendAuditEvent(event); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to record audit event %s: %v\n", eventType, err)
+	}
+}
+
+func userRows(users ...User) [][]string {
+	rows := [][]string{{"ID", "EMAIL", "NAME", "ORGANIZATION"}}
+	for _, user := range users {
+		rows = append(rows, []string{user.ID, user.Email, strings.TrimSpace(user.FirstName + " " + user.LastName), user.Organization})
+	}
+	return rows
+}
+
+func caseRows(cases ...Case) [][]string {
+	rows := [][]string{{"ID", "TITLE", "USER", "TYPE", "DATE", "FILES"}}
+	for _, c := range cases {
+		rows = append(rows, []string{c.ID, c.CaseTitle, c.UserID, c.CaseType, c.Date, strconv.Itoa(c.NumberFiles)})
+	}
+	return rows
+}
+
+func documentRows(documents ...Document) [][]string {
+	rows := [][]string{{"ID", "CASE", "FILE", "RELEVANCY", "STORED"}}
+	for _, doc := range documents {
+		rows = append(rows, []string{doc.ID, doc.CaseID, doc.FileName, strconv.FormatFloat(doc.Relevancy, 'f', -1, 64), strconv.FormatBool(doc.Stored)})
+	}
+	return rows
+}
+
+// ctlUser fetches a user with the password cleared, since it is printed
+func ctlUser(userID string) (User, error) {
+	user, err := getUserFromId(userID)
+	if err != nil {
+		return User{}, err
+	}
+	if user.ID == "" {
+		return User{}, fmt.Errorf("user %s not found", userID)
+	}
+	user.Password = ""
+	return user, nil
+}
+
+func ctlListUsers(email string) (ctlResult, error) {
+	var users []User
+	if email != "" {
+		user, err := getUserFromEmail(email)
+		if err != nil {
+			return ctlResult{}, err
+		}
+		if user.ID != "" {
+			users = append(users, user)
+		}
+	} else {
+		var err error
+		if users, err = GetAllUsers(); err != nil {
+			return ctlResult{}, err
+		}
+	}
+
+	for i := range users {
+		users[i].Password = ""
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+
+	return ctlResult{
+		Message: fmt.Sprintf("%d user(s)", len(users)),
+		Object:  users,
+		rows:    userRows(users...),
+	}, nil
+}
+
+func ctlGetUser(args []string, dryRun bool) (ctlResult, error) {
+	user, err := ctlUser(args[0])
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	return ctlResult{Message: "user " + user.ID, Object: user, rows: userRows(user)}, nil
+}
+
+func ctlDeleteUser(args []string, dryRun bool) (ctlResult, error) {
+	user, err := ctlUser(args[0])
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	if !dryRun {
+		if _, err := deleteUserFromId(user.ID, user.Email); err != nil {
+			return ctlResult{}, err
+		}
+		ctlAudit(AuditUserDeleted, AuditEvent{TargetID: user.ID})
+	}
+
+	return ctlResult{Message: ctlAction(dryRun, "deleted", "would delete") + " user " + user.ID, Object: user, rows: userRows(user)}, nil
+}
+
+func ctlEraseUser(args []string, dryRun bool) (ctlResult, error) {
+	user, err := ctlUser(args[0])
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	if dryRun {
+		cases, err := GetCasesByUserId(user.ID)
+		if err != nil {
+			return ctlResult{}, err
+		}
+		return ctlResult{
+			Message: fmt.Sprintf("would erase user %s and %d case(s)", user.ID, len(cases)),
+			Object:  cases,
+			rows:    caseRows(cases...),
+		}, nil
+	}
+
+	report, err := EraseUser(user)
+	if err != nil {
+		return ctlResult{Object: report}, err
+	}
+	ctlAudit(AuditUserErased, AuditEvent{
+		TargetID: user.ID,
+		Details:  auditDetails("report_signature", report.Signature),
+	})
+
+	return ctlResult{
+		Message: fmt.Sprintf("erased user %s, %d case(s) and %d document(s)", user.ID, len(report.CasesDeleted), len(report.DocumentsDeleted)),
+		Object:  report,
+	}, nil
+}
+
+func ctlResetPassword(userID string, password string, dryRun bool) (ctlResult, error) {
+	user, err := ctlUser(userID)
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	generated := password == ""
+	if generated {
+		password = generateRandomString(16)
+	} else if len(password) < 8 {
+		return ctlResult{Message: "--password must be at least 8 characters"}, errCtlUsage
+	}
+
+	if dryRun {
+		return ctlResult{Message: "would reset the password of user " + user.ID}, nil
+	}
+
+	if err := setUserPassword(user.ID, password); err != nil {
+		return ctlResult{}, err
+	}
+	ctlAudit(AuditPasswordReset, AuditEvent{TargetID: user.ID})
+
+	result := ctlResult{Message: "reset the password of user " + user.ID}
+	if generated {
+		// the operator has to pass the generated password on
+		result.Object = map[string]string{"password": password}
+		result.rows = [][]string{{"PASSWORD"}, {password}}
+	}
+	return result, nil
+}
+
+func ctlListCases(userID string) (ctlResult, error) {
+	var cases []Case
+	var err error
+	if userID != "" {
+		cases, err = GetCasesByUserId(userID)
+	} else {
+		cases, err = GetAllCases()
+	}
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	sort.Slice(cases, func(i, j int) bool {
+		return cases[i].ID < cases[j].ID
+	})
+
+	return ctlResult{
+		Message: fmt.Sprintf("%d case(s)", len(cases)),
+		Object:  cases,
+		rows:    caseRows(cases...),
+	}, nil
+}
+
+func ctlCase(caseID string) (Case, error) {
+	myCase, err := GetCaseFromId(caseID)
+	if err != nil {
+		return Case{}, err
+	}
+	if myCase.ID == "" {
+		return Case{}, fmt.Errorf("case %s not found", caseID)
+	}
+	return myCase, nil
+}
+
+func ctlGetCase(args []string, dryRun bool) (ctlResult, error) {
+	myCase, err := ctlCase(args[0])
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	return ctlResult{Message: "case " + myCase.ID, Object: myCase, rows: caseRows(myCase)}, nil
+}
+
+func ctlDeleteCase(args []string, dryRun bool) (ctlResult, error) {
+	myCase, err := ctlCase(args[0])
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	if !dryRun {
+		if _, err := DeleteCaseById(myCase.ID); err != nil {
+			return ctlResult{}, err
+		}
+		ctlAudit(AuditCaseDeleted, AuditEvent{CaseID: myCase.ID, TargetID: myCase.UserID})
+	}
+
+	return ctlResult{Message: ctlAction(dryRun, "deleted", "would delete") + " case " + myCase.ID, Object: myCase, rows: caseRows(myCase)}, nil
+}
+
+// ctlRecount is one case whose number_files disagreed with its documents
+type ctlRecount struct {
+	CaseID string `json:"case_id"`
+	Stored int    `json:"stored"`
+	Actual int    `json:"actual"`
+}
+
+func ctlRecountFiles(cases []Case, dryRun bool) (ctlResult, error) {
+	recounts := []ctlRecount{}
+	rows := [][]string{{"CASE", "STORED", "ACTUAL"}}
+
+	for _, myCase := range cases {
+		documents, err := GetDocumentsByCaseId(myCase.ID)
+		if err != nil {
+			return ctlResult{Object: recounts}, err
+		}
+		if len(documents) == myCase.NumberFiles {
+			continue
+		}
+
+		if !dryRun {
+			if err := SetCaseNumberFiles(myCase.ID, len(documents)); err != nil {
+				return ctlResult{Object: recounts}, err
+			}
+		}
+		recounts = append(recounts, ctlRecount{CaseID: myCase.ID, Stored: myCase.NumberFiles, Actual: len(documents)})
+		rows = append(rows, []string{myCase.ID, strconv.Itoa(myCase.NumberFiles), strconv.Itoa(len(documents))})
+	}
+
+	return ctlResult{
+		Message: fmt.Sprintf("%s number_files on %d of %d case(s)", ctlAction(dryRun, "corrected", "would correct"), len(recounts), len(cases)),
+		Object:  recounts,
+		rows:    rows,
+	}, nil
+}
+
+func ctlExportCase(caseID string, out string, dryRun bool) (ctlResult, error) {
+	if out == "" {
+		return ctlResult{Message: "--out is required"}, errCtlUsage
+	}
+
+	myCase, err := ctlCase(caseID)
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	if dryRun {
+		documents, err := GetDocumentsByCaseId(myCase.ID)
+		if err != nil {
+			return ctlResult{}, err
+		}
+		return ctlResult{
+			Message: fmt.Sprintf("would export case %s with %d document(s) to %s", myCase.ID, len(documents), out),
+			Object:  documents,
+			rows:    documentRows(documents...),
+		}, nil
+	}
+
+	// write to a temporary file so a failed export does not leave a
+	// truncated archive behind
+	f, err := os.CreateTemp(filepath.Dir(out), ".avalonctl-export-*")
+	if err != nil {
+		return ctlResult{}, err
+	}
+	defer os.Remove(f.Name())
+
+	err = WriteCaseExport(myCase, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ctlResult{}, err
+	}
+	if err := os.Rename(f.Name(), out); err != nil {
+		return ctlResult{}, err
+	}
+	ctlAudit(AuditCaseExported, AuditEvent{CaseID: myCase.ID, TargetID: myCase.UserID})
+
+	return ctlResult{
+		Message: fmt.Sprintf("exported case %s to %s", myCase.ID, out),
+		Object:  map[string]string{"case_id": myCase.ID, "path": out},
+	}, nil
+}
+
+func ctlListDocuments(caseID string) (ctlResult, error) {
+	var documents []Document
+	var err error
+	if caseID != "" {
+		documents, err = GetDocumentsByCaseId(caseID)
+	} else {
+		documents, err = GetAllDocuments()
+	}
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	sort.Slice(documents, func(i, j int) bool {
+		if documents[i].CaseID != documents[j].CaseID {
+			return documents[i].CaseID < documents[j].CaseID
+		}
+		return documents[i].ID < documents[j].ID
+	})
+
+	return ctlResult{
+		Message: fmt.Sprintf("%d document(s)", len(documents)),
+		Object:  documents,
+		rows:    documentRows(documents...),
+	}, nil
+}
+
+func ctlDocument(documentID string) (Document, error) {
+	doc, err := GetDocumentById(documentID)
+	if err != nil {
+		return Document{}, err
+	}
+	if doc.ID == "" {
+		return Document{}, fmt.Errorf("document %s not found", documentID)
+	}
+	return doc, nil
+}
+
+func ctlGetDocument(args []string, dryRun bool) (ctlResult, error) {
+	doc, err := ctlDocument(args[0])
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	return ctlResult{Message: "document " + doc.ID, Object: doc, rows: documentRows(doc)}, nil
+}
+
+func ctlDeleteDocument(args []string, dryRun bool) (ctlResult, error) {
+	doc, err := ctlDocument(args[0])
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	if !dryRun {
+		if err := DeleteDocumentById(doc.ID); err != nil {
+			return ctlResult{}, err
+		}
+		ctlAudit(AuditDocumentDelete, AuditEvent{CaseID: doc.CaseID, DocumentID: doc.ID})
+	}
+
+	return ctlResult{Message: ctlAction(dryRun, "deleted", "would delete") + " document " + doc.ID, Object: doc, rows: documentRows(doc)}, nil
+}
+
+func ctlReindexCases(args []string, dryRun bool) (ctlResult, error) {
+	if dryRun {
+		cases, err := GetAllCases()
+		if err != nil {
+			return ctlResult{}, err
+		}
+		return ctlResult{
+			Message: fmt.Sprintf("would reindex %d case(s)", len(cases)),
+			Object:  ReindexResult{Updated: len(cases)},
+		}, nil
+	}
+
+	updated, err := ReindexCases()
+	return ctlResult{
+		Message: fmt.Sprintf("reindexed %d case(s)", updated),
+		Object:  ReindexResult{Updated: updated},
+	}, err
+}
+
+func ctlReindexAuditLog(args []string, dryRun bool) (ctlResult, error) {
+	updated, err := ReindexAuditLog(dryRun)
+	return ctlResult{
+		Message: fmt.Sprintf("%s %d audit event(s)", ctlAction(dryRun, "reindexed", "would reindex"), updated),
+		Object:  ReindexResult{Updated: updated},
+	}, err
+}
+
+func ctlReindexDocuments(args []string, dryRun bool) (ctlResult, error) {
+	if dryRun {
+		documents, err := GetAllDocuments()
+		if err != nil {
+			return ctlResult{}, err
+		}
+		missing := 0
+		for _, doc := range documents {
+			if doc.FileType == "" {
+				missing++
+			}
+		}
+		return ctlResult{
+			Message: fmt.Sprintf("would set file_type on %d document(s)", missing),
+			Object:  ReindexResult{Updated: missing},
+		}, nil
+	}
+
+	updated, err := ReindexDocuments()
+	return ctlResult{
+		Message: fmt.Sprintf("set file_type on %d document(s)", updated),
+		Object:  ReindexResult{Updated: updated},
+	}, err
+}
+
+func ctlSweepUploads(args []string, dryRun bool) (ctlResult, error) {
+	if dryRun {
+		abandoned, err := AbandonedUploadReservations(time.Now())
+		if err != nil {
+			return ctlResult{}, err
+		}
+		expired, err := ExpiredTusUploads(time.Now())
+		if err != nil {
+			return ctlResult{}, err
+		}
+		return ctlResult{
+			Message: fmt.Sprintf("would sweep %d upload reservation(s) and %d resumable upload(s)", len(abandoned), len(expired)),
+			Object: struct {
+				Reservations []UploadReservation `json:"reservations"`
+				Resumable    []TusUpload         `json:"resumable"`
+			}{abandoned, expired},
+		}, nil
+	}
+
+	swept, err := SweepUploadReservations(time.Now())
+	if err != nil {
+		return ctlResult{}, err
+	}
+	sweptResumable, err := SweepTusUploads(time.Now())
+	return ctlResult{
+		Message: fmt.Sprintf("swept %d upload reservation(s) and %d resumable upload(s)", swept, sweptResumable),
+	}, err
+}
+
+func ctlVerifyAuditLog(args []string, dryRun bool) (ctlResult, error) {
+	brokenAt, err := VerifyAuditChain()
+	if err != nil {
+		return ctlResult{}, err
+	}
+
+	verification := AuditVerification{Intact: brokenAt == 0, BrokenAt: brokenAt}
+	if !verification.Intact {
+		return ctlResult{Object: verification}, fmt.Errorf("audit log chain is broken at sequence %d", brokenAt)
+	}
+
+	return ctlResult{Message: "audit log is intact", Object: verification}, nil
+}
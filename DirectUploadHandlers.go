@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func ReserveUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	var reserveUploadsRequest struct {
+		CaseID string          `json:"case_id"`
+		Files  []UploadRequest `json:"files"`
+	}
+
+	if !DecodeJSONBody(w, r, &reserveUploadsRequest) {
+		return
+	}
+
+	reserveUploads(w, r, reserveUploadsRequest.CaseID, reserveUploadsRequest.Files)
+}
+
+// reserveUploads hands out Document IDs and presigned PUT URLs so files can
+// be uploaded straight to storage
+func reserveUploads(w http.ResponseWriter, r *http.Request, caseID string, files []UploadRequest) {
+	fieldErrors := RequireFields("case_id", caseID)
+	fieldErrors = append(fieldErrors, ValidateUploadRequests(files)...)
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	return_case, err := GetCaseFromId(caseID)
+	if err != nil {
+		log.Printf("Error getting case: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
+		return
+	}
+
+	if return_case.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
+		return
+	}
+
+	reservations, err := ReserveUploads(caseID, files)
+	if err != nil {
+		log.Printf("Error reserving uploads: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to reserve uploads")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusCreated, "Uploads reserved successfully", reservations)
+}
+
+func CompleteUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	var completeUploadsRequest struct {
+		CaseID      string   `json:"case_id"`
+		DocumentIDs []string `json:"document_ids"`
+	}
+
+	if !DecodeJSONBody(w, r, &completeUploadsRequest) {
+		return
+	}
+
+	completeUploads(w, r, completeUploadsRequest.CaseID, completeUploadsRequest.DocumentIDs)
+}
+
+// completeUploads verifies reserved uploads and creates their documents.
+// Each document is reported on separately.
+func completeUploads(w http.ResponseWriter, r *http.Request, caseID string, documentIDs []string) {
+	fieldErrors := RequireFields("case_id", caseID)
+	if len(documentIDs) == 0 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "document_ids", Message: "must not be empty"})
+	}
+	if len(documentIDs) > MaxUploadReservations {
+		fieldErrors = append(fieldErrors, FieldError{Field: "document_ids", Message: "must have at most " + strconv.Itoa(MaxUploadReservations) + " IDs"})
+	}
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Uploads completed", CompleteUploads(caseID, documentIDs))
+}
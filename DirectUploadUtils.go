@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	UploadCreated  = "created"
+	UploadNotFound = "not_found"
+	UploadInvalid  = "invalid"
+	UploadRejected = "rejected"
+	UploadFailed   = "failed"
+)
+
+var (
+	// MaxDirectUploadSize defaults to the largest object S3 accepts in a
+	// single PUT
+	MaxDirectUploadSize   int64 = 5 << 30
+	MaxUploadReservations       = 100
+	UploadURLTTL                = 15 * time.Minute
+	// reservations are swept this long after their upload URL expires, so an
+	// upload that started just before the expiry can still be completed
+	UploadReservationGrace = time.Hour
+)
+
+func LoadDirectUploadLimits() {
+	if v := os.Getenv("MAX_DIRECT_UPLOAD_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("Invalid MAX_DIRECT_UPLOAD_SIZE %q: %v", v, err)
+		} else {
+			MaxDirectUploadSize = size
+		}
+	}
+
+	UploadURLTTL = time.Duration(envInt("UPLOAD_URL_TTL_MINUTES", 15)) * time.Minute
+}
+
+// ValidateUploadRequests checks the files of a reservation request
+func ValidateUploadRequests(files []UploadRequest) []FieldError {
+	var fieldErrors []FieldError
+	if len(files) == 0 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "files", Message: "must not be empty"})
+	}
+	if len(files) > MaxUploadReservations {
+		fieldErrors = append(fieldErrors, FieldError{Field: "files", Message: fmt.Sprintf("must have at most %d files", MaxUploadReservations)})
+	}
+
+	for i, file := range files {
+		field := "files[" + strconv.Itoa(i) + "]."
+		if file.FileName == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: field + "file_name", Message: "is required"})
+		} else if _, ok := allowedUploadTypes[strings.ToLower(filepath.Ext(file.FileName))]; !ok {
+			fieldErrors = append(fieldErrors, FieldError{Field: field + "file_name", Message: "has a file type that is not allowed"})
+		}
+		if file.Size <= 0 || file.Size > MaxDirectUploadSize {
+			fieldErrors = append(fieldErrors, FieldError{Field: field + "size", Message: fmt.Sprintf("must be between 1 and %d", MaxDirectUploadSize)})
+		}
+		if digest, err := hex.DecodeString(file.SHA256); err != nil || len(digest) != sha256.Size {
+			fieldErrors = append(fieldErrors, FieldError{Field: field + "sha256", Message: "must be a hex encoded SHA-256 digest"})
+		}
+	}
+
+	return fieldErrors
+}
+
+// ReserveUploads reserves a Document ID and object key for each file and
+// presigns a PUT for it. The URL only accepts the declared size and digest.
+func ReserveUploads(caseID string, files []UploadRequest) ([]UploadReservation, error) {
+	now := time.Now().UTC()
+	reservations := make([]UploadReservation, 0, len(files))
+
+	for _, file := range files {
+		reservation := UploadReservation{
+			ID:        generateRandomString(16),
+			CaseID:    caseID,
+			FileName:  file.FileName,
+			Key:       NewBlobKey(),
+			Size:      file.Size,
+			SHA256:    file.SHA256,
+			CreatedAt: now.Format(time.RFC3339),
+			ExpiresAt: now.Add(UploadURLTTL).Format(time.RFC3339),
+		}
+
+		if err := saveUploadReservation(reservation); err != nil {
+			return nil, err
+		}
+
+		uploadURL, headers, err := presignUpload(reservation)
+		if err != nil {
+			return nil, err
+		}
+		reservation.UploadURL = uploadURL
+		reservation.Headers = headers
+
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, nil
+}
+
+func presignUpload(reservation UploadReservation) (string, map[string]string, error) {
+	digest, err := hex.DecodeString(reservation.SHA256)
+	if err != nil {
+		return "", nil, err
+	}
+
+	req, _ := s3Client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:         &Bucket,
+		Key:            aws.String(reservation.Key),
+		ContentLength:  aws.Int64(reservation.Size),
+		ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(digest)),
+	})
+
+	uploadURL, signed, err := req.PresignRequest(UploadURLTTL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	headers := map[string]string{}
+	for name, values := range signed {
+		if !strings.EqualFold(name, "Host") {
+			headers[http.CanonicalHeaderKey(name)] = strings.Join(values, ",")
+		}
+	}
+
+	return uploadURL, headers, nil
+}
+
+func saveUploadReservation(reservation UploadReservation) error {
+	// presigned URLs are handed out once and not stored
+	reservation.UploadURL = ""
+	reservation.Headers = nil
+
+	av, err := dynamodbattribute.MarshalMap(reservation)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: &UploadReservationsTable,
+	})
+
+	return err
+}
+
+func GetUploadReservationById(reservationID string) (UploadReservation, error) {
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(reservationID),
+			},
+		},
+		TableName: &UploadReservationsTable,
+	})
+	if err != nil || result.Item == nil {
+		return UploadReservation{}, err
+	}
+
+	var reservation UploadReservation
+	err = dynamodbattribute.UnmarshalMap(result.Item, &reservation)
+	return reservation, err
+}
+
+// claimUploadReservation deletes a reservation and reports whether this
+// call removed it, so a reservation completed twice at once only creates
+// one document
+func claimUploadReservation(reservationID string) (bool, error) {
+	_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(reservationID),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id": aws.String("_id"),
+		},
+		TableName: &UploadReservationsTable,
+	})
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// verifyUploadedObject checks that a reserved object exists with the
+// declared size, returning why not as problem. checksum is the digest S3
+// stored for the object, which is empty when the upload did not send one.
+func verifyUploadedObject(reservation UploadReservation) (checksum string, problem string, err error) {
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket:       &Bucket,
+		Key:          aws.String(reservation.Key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) && requestErr.StatusCode() == http.StatusNotFound {
+		return "", "file has not been uploaded", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if size := aws.Int64Value(head.ContentLength); size != reservation.Size {
+		return "", fmt.Sprintf("file is %d bytes but %d were reserved", size, reservation.Size), nil
+	}
+
+	return aws.StringValue(head.ChecksumSHA256), "", nil
+}
+
+// CompleteUploads creates the documents for uploaded reservations of a case.
+// Each reservation succeeds or fails on its own.
+func CompleteUploads(caseID string, reservationIDs []string) UploadCompletion {
+	completion := UploadCompletion{Results: make([]UploadCompletionResult, len(reservationIDs))}
+
+	for i, reservationID := range reservationIDs {
+		result := completeUpload(caseID, reservationID)
+		result.Index = i
+		result.DocumentID = reservationID
+		if result.Status == UploadCreated {
+			completion.Created++
+		} else {
+			completion.Failed++
+		}
+		completion.Results[i] = result
+	}
+
+	return completion
+}
+
+func completeUpload(caseID string, reservationID string) UploadCompletionResult {
+	reservation, err := GetUploadReservationById(reservationID)
+	if err != nil {
+		log.Printf("Error getting upload reservation %s: %v", reservationID, err)
+		return UploadCompletionResult{Status: UploadFailed, Error: "failed to get reservation"}
+	}
+	if reservation.ID == "" || reservation.CaseID != caseID {
+		return UploadCompletionResult{Status: UploadNotFound, Error: "reservation not found"}
+	}
+
+	checksum, problem, err := verifyUploadedObject(reservation)
+	if err != nil {
+		log.Printf("Error checking upload %s: %v", reservation.Key, err)
+		return UploadCompletionResult{Status: UploadFailed, Error: "failed to check uploaded file"}
+	}
+	if problem != "" {
+		return UploadCompletionResult{Status: UploadInvalid, Error: problem}
+	}
+
+	digest, _ := hex.DecodeString(reservation.SHA256)
+	expected := base64.StdEncoding.EncodeToString(digest)
+	if checksum != "" && checksum != expected {
+		return UploadCompletionResult{Status: UploadInvalid, Error: "file does not match the reserved sha256"}
+	}
+
+	// without a stored checksum the file is hashed while it is screened
+	var hasher hash.Hash
+	if checksum == "" {
+		hasher = sha256.New()
+	}
+	if err := ScreenStoredObject(caseID, reservation.FileName, reservation.Key, hasher); err != nil {
+		var rejection *UploadRejection
+		if errors.As(err, &rejection) {
+			if rejection.Code != CodeScanFailed {
+				if _, err := claimUploadReservation(reservation.ID); err != nil {
+					log.Printf("Error removing rejected reservation %s: %v", reservation.ID, err)
+				}
+			}
+			return UploadCompletionResult{Status: UploadRejected, Error: rejection.Message}
+		}
+		log.Printf("Error screening upload %s: %v", reservation.Key, err)
+		return UploadCompletionResult{Status: UploadFailed, Error: "failed to read uploaded file"}
+	}
+	if hasher != nil && base64.StdEncoding.EncodeToString(hasher.Sum(nil)) != expected {
+		return UploadCompletionResult{Status: UploadInvalid, Error: "file does not match the reserved sha256"}
+	}
+
+	claimed, err := claimUploadReservation(reservation.ID)
+	if err != nil {
+		log.Printf("Error claiming upload reservation %s: %v", reservation.ID, err)
+		return UploadCompletionResult{Status: UploadFailed, Error: "failed to complete reservation"}
+	}
+	if !claimed {
+		return UploadCompletionResult{Status: UploadNotFound, Error: "reservation was already completed"}
+	}
+
+	stored := StoredUpload{Key: reservation.Key, Size: reservation.Size, SHA256: strings.ToLower(reservation.SHA256)}
+	document, _, err := RegisterUploadedDocument(reservation.ID, caseID, timestampedUploadKey(caseID, reservation.FileName), stored, DuplicateFlag)
+	if err != nil {
+		log.Printf("Error creating document for upload %s: %v", reservation.ID, err)
+		// put the reservation back so the client can retry
+		if err := saveUploadReservation(reservation); err != nil {
+			log.Printf("Error restoring upload reservation %s: %v", reservation.ID, err)
+		}
+		return UploadCompletionResult{Status: UploadFailed, Error: "failed to create document"}
+	}
+
+	return UploadCompletionResult{Status: UploadCreated, Document: &document}
+}
+
+// AbandonedUploadReservations lists the reservations that were not
+// completed within their grace period
+func AbandonedUploadReservations(now time.Time) ([]UploadReservation, error) {
+	cutoff := now.Add(-UploadReservationGrace).UTC().Format(time.RFC3339)
+	filt := expression.Name("expires_at").LessThan(expression.Value(cutoff))
+
+	expr, err := expression.NewBuilder().WithFilter(filt).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var abandoned []UploadReservation
+	err = dynamo.ScanPages(&dynamodb.ScanInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		TableName:                 &UploadReservationsTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var reservation UploadReservation
+			if err := dynamodbattribute.UnmarshalMap(item, &reservation); err != nil {
+				log.Printf("Error unmarshalling upload reservation: %v", err)
+				continue
+			}
+			abandoned = append(abandoned, reservation)
+		}
+		return true
+	})
+
+	return abandoned, err
+}
+
+// SweepUploadReservations removes abandoned reservations along with anything
+// uploaded for them
+func SweepUploadReservations(now time.Time) (int, error) {
+	abandoned, err := AbandonedUploadReservations(now)
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, reservation := range abandoned {
+		claimed, err := claimUploadReservation(reservation.ID)
+		if err != nil {
+			return swept, err
+		}
+		if !claimed {
+			continue
+		}
+		if err := DeleteFileFromS3(reservation.Key); err != nil {
+			log.Printf("Error deleting abandoned upload %s: %v", reservation.Key, err)
+		}
+		swept++
+	}
+
+	return swept, nil
+}
+
+// StartUploadSweeper sweeps abandoned reservations and expired resumable
+// uploads every interval
+func StartUploadSweeper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			swept, err := SweepUploadReservations(time.Now())
+			if err != nil {
+				log.Printf("Error sweeping upload reservations: %v", err)
+			}
+			if swept > 0 {
+				log.Printf("Swept %d abandoned upload reservation(s)", swept)
+			}
+
+			swept, err = SweepTusUploads(time.Now())
+			if err != nil {
+				log.Printf("Error sweeping resumable uploads: %v", err)
+			}
+			if swept > 0 {
+				log.Printf("Swept %d expired resumable upload(s)", swept)
+			}
+		}
+	}()
+}
@@ -1,750 +1,823 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func GetDocumentsByCaseHandler(w http.ResponseWriter, r *http.Request) {
-	// read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get documents",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	// unmarshal the request body
 	var getDocsByCaseIdRequest struct {
 		CaseID string `json:"case_id"`
 	}
 
-	if err := json.Unmarshal(body, &getDocsByCaseIdRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &getDocsByCaseIdRequest) {
 		return
 	}
 
+	getCaseDocuments(w, r, getDocsByCaseIdRequest.CaseID, DocumentFilter{}, 0)
+}
+
+// ParseDocumentFilter reads document listing options from the query string.
+// The returned bucket size is 0 unless a relevancy summary was requested.
+func ParseDocumentFilter(r *http.Request) (DocumentFilter, float64, []FieldError) {
+	query := r.URL.Query()
+	filter := DocumentFilter{
+		DateFrom: query.Get("date_from"),
+		DateTo:   query.Get("date_to"),
+		Order:    query.Get("order"),
+		Cursor:   query.Get("cursor"),
+	}
+
+	var fieldErrors []FieldError
+	parseFloat := func(field string) *float64 {
+		v := query.Get(field)
+		if v == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: field, Message: "must be a number"})
+			return nil
+		}
+		return &f
+	}
+
+	filter.MinRelevancy = parseFloat("min_relevancy")
+	filter.MaxRelevancy = parseFloat("max_relevancy")
+
+	if v := query.Get("stored"); v != "" {
+		stored, err := strconv.ParseBool(v)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "stored", Message: "must be true or false"})
+		}
+		filter.Stored = &stored
+	}
+
+	for _, d := range []struct{ field, value string }{{"date_from", filter.DateFrom}, {"date_to", filter.DateTo}} {
+		if d.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d.value); err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: d.field, Message: "must be an ISO date (YYYY-MM-DD)"})
+		}
+	}
+
+	if v := query.Get("file_type"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), ".")); t != "" {
+				filter.FileTypes = append(filter.FileTypes, t)
+			}
+		}
+	}
+
+	filter.DuplicateStatus = query.Get("duplicate_status")
+	if filter.DuplicateStatus != "" && filter.DuplicateStatus != DuplicateFlagged && filter.DuplicateStatus != DuplicateLinked {
+		fieldErrors = append(fieldErrors, FieldError{Field: "duplicate_status", Message: "must be flagged or linked"})
+	}
+
+	if filter.Order != "" && filter.Order != "asc" && filter.Order != "desc" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "order", Message: "must be asc or desc"})
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit < 1 || limit > 100 {
+			fieldErrors = append(fieldErrors, FieldError{Field: "limit", Message: "must be an integer between 1 and 100"})
+		}
+		filter.Limit = limit
+	}
+	if _, err := decodeCursor(filter.Cursor); err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "cursor", Message: "is not a valid cursor"})
+	}
+
+	var bucketSize float64
+	if v := query.Get("summary"); v == "true" {
+		bucketSize = 0.1
+		if size := parseFloat("bucket_size"); size != nil {
+			if *size <= 0 {
+				fieldErrors = append(fieldErrors, FieldError{Field: "bucket_size", Message: "must be greater than 0"})
+			}
+			bucketSize = *size
+		}
+	}
+
+	return filter, bucketSize, fieldErrors
+}
+
+func getCaseDocuments(w http.ResponseWriter, r *http.Request, caseID string, filter DocumentFilter, bucketSize float64) {
 	// get case object
-	var return_case Case
-	return_case, err = GetCaseFromId(getDocsByCaseIdRequest.CaseID)
+	return_case, err := GetCaseFromId(caseID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
 		return
 	}
 
 	// check if case exists
 	if return_case.ID == "" {
-		response := ErrorResponse{
-			Message: "Case not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
 		return
 	}
 
-	// get documents by case id
-	var documents []Document
-	documents, err = GetDocumentsByCaseId(getDocsByCaseIdRequest.CaseID)
+	// get documents by case id, most relevant first
+	documents, nextCursor, err := QueryCaseDocuments(caseID, filter)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get documents",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		log.Printf("Error getting documents: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get documents")
 		return
 	}
 
-	response := SuccessResponse{
-		Message: "Documents retrieved successfully",
-		Status:  http.StatusOK,
-		Object:  documents,
+	var summary interface{}
+	if bucketSize > 0 {
+		summary, err = SummarizeDocumentRelevancy(caseID, filter, bucketSize)
+		if err != nil {
+			log.Printf("Error summarizing documents: %v", err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to summarize documents")
+			return
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+
+	WritePage(w, r, "Documents retrieved successfully", documents, nextCursor, summary)
 
 }
 
 func GetDocumentByIDHandler(w http.ResponseWriter, r *http.Request) {
-	// read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get document",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	// unmarshal the request body
 	var getDocByIdRequest struct {
 		ID string `json:"_id"`
 	}
 
-	if err := json.Unmarshal(body, &getDocByIdRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &getDocByIdRequest) {
 		return
 	}
 
+	getDocument(w, r, getDocByIdRequest.ID)
+}
+
+func getDocument(w http.ResponseWriter, r *http.Request, documentID string) {
 	// get document by id
-	var document Document
-	document, err = GetDocumentById(getDocByIdRequest.ID)
+	document, err := GetDocumentById(documentID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get document",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document")
 		return
 	}
 
 	// check if document exists
 	if document.ID == "" {
-		response := ErrorResponse{
-			Message: "Document not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
 		return
 	}
 
 	// return document
-	response := SuccessResponse{
-		Message: "Document retrieved successfully",
-		Status:  http.StatusOK,
-		Object:  document,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	WriteSuccess(w, r, http.StatusOK, "Document retrieved successfully", document)
 
 }
 
 func DeleteDocumentByIDHandler(w http.ResponseWriter, r *http.Request) {
-	// read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to delete document",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	// unmarshal the request body
 	var deleteDocByIdRequest struct {
 		ID string `json:"_id"`
 	}
 
-	if err := json.Unmarshal(body, &deleteDocByIdRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &deleteDocByIdRequest) {
 		return
 	}
 
+	deleteDocument(w, r, deleteDocByIdRequest.ID)
+}
+
+func deleteDocument(w http.ResponseWriter, r *http.Request, documentID string) {
 	// get document by id
-	var document Document
-	document, err = GetDocumentById(deleteDocByIdRequest.ID)
+	document, err := GetDocumentById(documentID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get document",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document")
 		return
 	}
 
 	// check if document exists
 	if document.ID == "" {
-		response := ErrorResponse{
-			Message: "Document not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
 		return
 	}
 
 	// delete document by id
-	err = DeleteDocumentById(deleteDocByIdRequest.ID)
+	err = DeleteDocumentById(documentID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to delete document",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete document")
 		return
 	}
 
-	response := SuccessResponse{
-		Message: "Document deleted successfully",
-		Status:  http.StatusOK,
-		Object:  document,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	RecordAuditEvent(r, AuditDocumentDelete, AuditEvent{
+		CaseID:     document.CaseID,
+		DocumentID: document.ID,
+	})
+
+	WriteSuccess(w, r, http.StatusOK, "Document deleted successfully", document)
 
 }
 
 func DeleteDocumentsByCaseHandler(w http.ResponseWriter, r *http.Request) {
-	// read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to delete documents",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	// unmarshal the request body
 	var deleteDocsByCaseRequest struct {
 		CaseID string `json:"case_id"`
 	}
 
-	if err := json.Unmarshal(body, &deleteDocsByCaseRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &deleteDocsByCaseRequest) {
 		return
 	}
 
+	deleteCaseDocuments(w, r, deleteDocsByCaseRequest.CaseID)
+}
+
+func deleteCaseDocuments(w http.ResponseWriter, r *http.Request, caseID string) {
 	// get case from caseid
-	var return_case Case
-	return_case, err = GetCaseFromId(deleteDocsByCaseRequest.CaseID)
+	return_case, err := GetCaseFromId(caseID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get case",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
 		return
 	}
 
 	// check if case exists
 	if return_case.ID == "" {
-		response := ErrorResponse{
-			Message: "Case not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
 		return
 	}
 
 	// delete documents by case id
 	var documents []Document
-	documents, err = DeleteDocumentsByCaseId(deleteDocsByCaseRequest.CaseID)
+	documents, err = DeleteDocumentsByCaseId(caseID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to delete documents",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete documents")
 		return
 	}
 
-	response := SuccessResponse{
-		Message: "Documents deleted successfully",
-		Status:  http.StatusOK,
-		Object:  documents,
+	for _, doc := range documents {
+		RecordAuditEvent(r, AuditDocumentDelete, AuditEvent{
+			CaseID:     doc.CaseID,
+			DocumentID: doc.ID,
+		})
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+
+	WriteSuccess(w, r, http.StatusOK, "Documents deleted successfully", documents)
 }
 
 func UploadDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	var file_url string
 
-	caseID := r.FormValue("case_id")
+	caseID, err := ReadUploadForm(w, r, "", "file", func(caseID string, name string, content io.Reader) error {
+		// only the first file is stored
+		if file_url != "" {
+			return nil
+		}
 
-	if caseID == "" {
-		response := ErrorResponse{
-			Message: "Case ID is required",
-			Status:  http.StatusBadRequest,
+		fileName := caseID + "/"
+
+		fileName = fileName + name
+		fileName = RemoveSpacesAndColons(fileName)
+
+		stored, err := StoreUpload(caseID, name, fileName, content)
+		if err != nil {
+			return err
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
 
-	file, header, err := r.FormFile("file")
+		file_url = stored.URL
+		return nil
+	})
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to read file",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteUploadRejection(w, r, err)
 		return
 	}
-	defer file.Close()
 
-	// Read file content
-	fileContent, err := io.ReadAll(file)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to read file content",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+	if fieldErrors := RequireFields("case_id", caseID, "file", file_url); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
 		return
 	}
 
-	fileName := caseID + "/"
+	WriteSuccess(w, r, http.StatusOK, "File uploaded successfully", file_url)
+}
 
-	fileName = fileName + header.Filename
-	fileName = RemoveSpacesAndColons(fileName)
+// UploadDocumentsHandler stores every file or none: a file rejected part
+// way through the form removes the ones stored before it
+func UploadDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	var uploads []StoredUpload
 
-	file_url, err := UploadFileToS3(fileName, fileContent)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to upload file to S3",
-			Status:  http.StatusInternalServerError,
+	caseID, err := ReadUploadForm(w, r, "", "files", func(caseID string, name string, content io.Reader) error {
+		stored, err := StoreUpload(caseID, name, timestampedUploadKey(caseID, name), content)
+		if err != nil {
+			return err
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+
+		uploads = append(uploads, stored)
+		return nil
+	})
+	if err != nil {
+		discardStoredUploads(uploads)
+		WriteUploadRejection(w, r, err)
+		return
+	}
+
+	if caseID == "" {
+		WriteValidationError(w, r, []FieldError{{Field: "case_id", Message: "is required"}})
 		return
 	}
 
-	response := SuccessResponse{
-		Message: "File uploaded successfully",
-		Status:  http.StatusOK,
-		Object:  file_url,
+	uploadedFiles := []string{}
+	for _, stored := range uploads {
+		uploadedFiles = append(uploadedFiles, stored.URL)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	if len(uploads) > 0 {
+		CaseAdjustNumberFiles(caseID, len(uploads))
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Files uploaded successfully", uploadedFiles)
 }
 
-func UploadDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+func CreateDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Creating documents")
 
-	caseID := r.FormValue("case_id")
-	if caseID == "" {
-		response := ErrorResponse{
-			Message: "Case ID is required",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	createDocuments(w, r, "", http.StatusOK)
+}
+
+// createDocuments stores each file in the files[] parts of a multipart form
+// and creates its document. caseID is empty when it comes from the form.
+// The on_duplicate query parameter says what to do with files the case
+// already has: flag them for review (the default), link them, or skip them.
+func createDocuments(w http.ResponseWriter, r *http.Request, caseID string, successStatus int) {
+	onDuplicate := r.URL.Query().Get("on_duplicate")
+	if onDuplicate == "" {
+		onDuplicate = DuplicateFlag
+	}
+	if onDuplicate != DuplicateFlag && onDuplicate != DuplicateLink && onDuplicate != DuplicateSkip {
+		WriteValidationError(w, r, []FieldError{{Field: "on_duplicate", Message: "must be flag, link or skip"}})
 		return
 	}
 
-	files := r.MultipartForm.File["files"]
+	// every file is stored before any document is created, so a file
+	// rejected part way through the form leaves nothing behind
+	type upload struct {
+		fileName string
+		stored   StoredUpload
+	}
+	var uploads []upload
 
-	var uploadedFiles []string
+	caseID, err := ReadUploadForm(w, r, caseID, "files[]", func(caseID string, name string, content io.Reader) error {
+		log.Println("Uploading file to S3")
 
-	for _, header := range files {
-		file, err := header.Open()
+		stored, err := StoreUpload(caseID, name, NewBlobKey(), content)
 		if err != nil {
-			response := ErrorResponse{
-				Message: "Failed to read file",
-				Status:  http.StatusInternalServerError,
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
-			return
+			return err
 		}
-		defer file.Close()
 
-		// Read file content
-		fileContent, err := io.ReadAll(file)
+		uploads = append(uploads, upload{fileName: name, stored: stored})
+		return nil
+	})
+	if err != nil {
+		for _, u := range uploads {
+			discardStoredUpload(u.stored.Key)
+		}
+		WriteUploadRejection(w, r, err)
+		return
+	}
+
+	log.Println("Case ID: ", caseID)
+
+	if caseID == "" {
+		WriteValidationError(w, r, []FieldError{{Field: "case_id", Message: "is required"}})
+		return
+	}
+
+	documents := []Document{}
+	skipped := 0
+	for i, u := range uploads {
+		document, skip, err := RegisterUploadedDocument(generateRandomString(16), caseID, timestampedUploadKey(caseID, u.fileName), u.stored, onDuplicate)
 		if err != nil {
-			response := ErrorResponse{
-				Message: "Failed to read file content",
-				Status:  http.StatusInternalServerError,
+			log.Printf("Error uploading document: %v", err)
+			for _, created := range documents {
+				if err := DeleteDocumentById(created.ID); err != nil {
+					log.Printf("Error removing document %s: %v", created.ID, err)
+				}
+			}
+			for _, rest := range uploads[i+1:] {
+				discardStoredUpload(rest.stored.Key)
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to upload document to DynamoDB")
 			return
 		}
 
-		time_now := time.Now().Truncate(0).String()
+		if skip {
+			log.Printf("Skipped %s, a duplicate of document %s", u.fileName, document.ID)
+			skipped++
+			continue
+		}
 
-		fileName := caseID + "/" + time_now
+		log.Printf("Document ID: %s", document.ID)
+		documents = append(documents, document)
+	}
 
-		fileName = RemovePeriods(fileName)
+	log.Println("Number of files: ", len(documents))
 
-		fileName = fileName + header.Filename
+	message := "Documents created successfully"
+	if skipped > 0 {
+		message = fmt.Sprintf("Documents created successfully, skipped %d duplicate(s)", skipped)
+	}
 
-		fileName = RemoveSpacesAndColons(fileName)
+	WriteSuccess(w, r, successStatus, message, documents)
+}
 
-		file_url, err := UploadFileToS3(fileName, fileContent)
-		if err != nil {
-			response := ErrorResponse{
-				Message: "Failed to upload file to S3",
-				Status:  http.StatusInternalServerError,
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+func GetDocumentByIdByFileUrlHandler(w http.ResponseWriter, r *http.Request) {
+	// unmarshal the request body
+	var getDocByFileUrlRequest struct {
+		FileURL string `json:"file_url"`
+		CaseID  string `json:"case_id"`
+	}
 
-		uploadedFiles = append(uploadedFiles, file_url)
+	if !DecodeJSONBody(w, r, &getDocByFileUrlRequest) {
+		return
+	}
 
-		CaseUpdateNumberFiles(caseID)
+	getDocumentIDByFileURL(w, r, getDocByFileUrlRequest.FileURL, getDocByFileUrlRequest.CaseID)
+}
 
+func getDocumentIDByFileURL(w http.ResponseWriter, r *http.Request, fileURL string, caseID string) {
+	document_id, err := GetDocumentIDFromFileURL(fileURL, caseID)
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document by file url")
+		return
 	}
 
-	response := SuccessResponse{
-		Message: "Files uploaded successfully",
-		Status:  http.StatusOK,
-		Object:  uploadedFiles,
+	if document_id == "" {
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
-}
 
-func CreateDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	WriteSuccess(w, r, http.StatusOK, "Document ID retrieved successfully", document_id)
 
-	log.Println("Creating documents")
+}
 
-	caseID := r.FormValue("case_id")
+func UpdateRelevancyByFileUrl(w http.ResponseWriter, r *http.Request) {
+	// unmarshal the request body
+	var updateRelevancyRequest struct {
+		FileURL   string  `json:"file_url"`
+		CaseID    string  `json:"case_id"`
+		Relevancy float64 `json:"relevancy"`
+	}
 
-	log.Println("Case ID: ", caseID)
+	if !DecodeJSONBody(w, r, &updateRelevancyRequest) {
+		return
+	}
 
-	if caseID == "" {
-		response := ErrorResponse{
-			Message: "Case ID is required",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	// get document by file url
+	document_id, err := GetDocumentIDFromFileURL(updateRelevancyRequest.FileURL, updateRelevancyRequest.CaseID)
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document by file url")
 		return
 	}
 
-	log.Println("Case ID: ", caseID)
+	if document_id == "" {
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
+		return
+	}
 
-	files := r.MultipartForm.File["files[]"]
+	updateRelevancy(w, r, document_id, updateRelevancyRequest.Relevancy)
+}
 
-	log.Println("Number of files: ", len(files))
+// BatchUpdateRelevancyHandler applies relevancy scores to many documents and
+// reports the outcome of each one
+func BatchUpdateRelevancyHandler(w http.ResponseWriter, r *http.Request) {
+	var batchRelevancyRequest struct {
+		Updates []RelevancyUpdate `json:"updates"`
+	}
 
-	var documents []Document
+	if !DecodeJSONBody(w, r, &batchRelevancyRequest) {
+		return
+	}
 
-	for _, header := range files {
-		file, err := header.Open()
-		if err != nil {
-			response := ErrorResponse{
-				Message: "Failed to read file",
-				Status:  http.StatusInternalServerError,
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
-			return
+	if len(batchRelevancyRequest.Updates) == 0 {
+		WriteValidationError(w, r, []FieldError{{Field: "updates", Message: "must not be empty"}})
+		return
+	}
+
+	if len(batchRelevancyRequest.Updates) > MaxRelevancyBatch {
+		WriteValidationError(w, r, []FieldError{{Field: "updates", Message: fmt.Sprintf("must have at most %d items", MaxRelevancyBatch)}})
+		return
+	}
+
+	result := BatchUpdateRelevancy(batchRelevancyRequest.Updates)
+	for _, itemResult := range result.Results {
+		if itemResult.Status == "updated" {
+			EmitDocumentWebhookEvent(WebhookDocumentRelevancyUpdated, itemResult.DocumentID)
 		}
-		defer file.Close()
+	}
 
-		// Read file content
+	WriteSuccess(w, r, http.StatusOK, fmt.Sprintf("Updated relevancy for %d of %d documents", result.Updated, len(result.Results)), result)
+}
 
-		log.Println("Reading file content")
+func updateRelevancy(w http.ResponseWriter, r *http.Request, documentID string, relevancy float64) {
+	// update relevancy by document id
+	err := UpdateDocumentRelevancy(documentID, relevancy)
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update relevancy")
+		return
+	}
 
-		fileContent, err := io.ReadAll(file)
-		if err != nil {
-			response := ErrorResponse{
-				Message: "Failed to read file content",
-				Status:  http.StatusInternalServerError,
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-		time_now := time.Now().Truncate(0).String()
+	EmitDocumentWebhookEvent(WebhookDocumentRelevancyUpdated, documentID)
 
-		fileName := caseID + "/" + time_now
+	WriteSuccess(w, r, http.StatusOK, "Relevancy updated successfully", nil)
+}
 
-		fileName = RemovePeriods(fileName)
+func UpdateDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	var updateDocumentRequest struct {
+		ID string `json:"_id"`
+		DocumentUpdate
+	}
 
-		fileName = fileName + header.Filename
+	if !DecodeJSONBody(w, r, &updateDocumentRequest) {
+		return
+	}
 
-		fileName = RemoveSpacesAndColons(fileName)
+	updateDocument(w, r, updateDocumentRequest.ID, updateDocumentRequest.DocumentUpdate)
+}
 
-		log.Println("Uploading file to S3")
+func validateDocumentUpdate(update DocumentUpdate) []FieldError {
+	var fieldErrors []FieldError
 
-		file_url, err := UploadFileToS3(fileName, fileContent)
+	if update.FileName == nil && update.Description == nil && update.Tags == nil && update.Relevancy == nil {
+		return []FieldError{{Field: "file_name", Message: "at least one of file_name, description, tags or relevancy is required"}}
+	}
 
-		CaseUpdateNumberFiles(caseID)
+	if update.FileName != nil {
+		name := *update.FileName
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, "/\\") {
+			fieldErrors = append(fieldErrors, FieldError{Field: "file_name", Message: "must be a non-empty name without slashes"})
+		} else if _, ok := allowedUploadTypes[strings.ToLower(path.Ext(name))]; !ok {
+			fieldErrors = append(fieldErrors, FieldError{Field: "file_name", Message: "must keep an allowed file extension"})
+		}
+	}
 
-		if err != nil {
-			response := ErrorResponse{
-				Message: "Failed to upload file to S3",
-				Status:  http.StatusInternalServerError,
+	if update.Tags != nil {
+		for i, tag := range *update.Tags {
+			if strings.TrimSpace(tag) == "" {
+				fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("tags[%d]", i), Message: "must not be empty"})
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
-			return
 		}
+	}
 
-		document := Document{
-			ID:        generateRandomString(16),
-			FileName:  fileName,
-			CaseID:    caseID,
-			Date:      time.Now().Truncate(0).String(),
-			FileURL:   file_url,
-			Relevancy: 0.0,
-			Stored:    false,
-		}
+	return fieldErrors
+}
 
-		//print the document fields
+func updateDocument(w http.ResponseWriter, r *http.Request, documentID string, update DocumentUpdate) {
+	if fieldErrors := validateDocumentUpdate(update); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
 
-		log.Printf("Document ID: %s", document.ID)
-		log.Printf("Document File Name: %s", document.FileName)
-		log.Printf("Document Case ID: %s", document.CaseID)
-		log.Printf("Document Date: %s", document.Date)
-		log.Printf("Document File URL: %s", document.FileURL)
-		log.Printf("Document Relevancy: %f", document.Relevancy)
-		log.Printf("Document Stored: %t", document.Stored)
+	document, err := UpdateDocument(documentID, update)
+	if err != nil {
+		log.Printf("Error updating document: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update document")
+		return
+	}
 
-		documents = append(documents, document)
+	if document.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
+		return
+	}
 
-		err = UploadDocumentDynamo(document)
+	if update.Relevancy != nil {
+		EmitWebhookEvent(WebhookDocumentRelevancyUpdated, "", document.CaseID, document)
+	}
 
-		if err != nil {
-			response := ErrorResponse{
-				Message: "Failed to upload document to DynamoDB",
-				Status:  http.StatusInternalServerError,
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	WriteSuccess(w, r, http.StatusOK, "Document updated successfully", document)
+}
+
+func MoveDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	var moveDocumentRequest struct {
+		ID     string `json:"_id"`
+		CaseID string `json:"case_id"`
+	}
 
+	if !DecodeJSONBody(w, r, &moveDocumentRequest) {
+		return
 	}
 
-	response := SuccessResponse{
+	relocateDocument(w, r, moveDocumentRequest.ID, moveDocumentRequest.CaseID, false)
+}
 
-		Message: "Documents created successfully",
-		Status:  http.StatusOK,
-		Object:  documents,
+func CopyDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	var copyDocumentRequest struct {
+		ID     string `json:"_id"`
+		CaseID string `json:"case_id"`
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &copyDocumentRequest) {
+		return
+	}
+
+	relocateDocument(w, r, copyDocumentRequest.ID, copyDocumentRequest.CaseID, true)
 }
 
-func GetDocumentByIdByFileUrlHandler(w http.ResponseWriter, r *http.Request) {
-	// read the document url json from the request body
+// relocateDocument moves a document to another case, or copies it when copy
+// is set
+func relocateDocument(w http.ResponseWriter, r *http.Request, documentID string, targetCaseID string, copy bool) {
+	if fieldErrors := RequireFields("case_id", targetCaseID); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
 
-	body, err := io.ReadAll(r.Body)
+	document, err := GetDocumentById(documentID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get document by file url",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document")
 		return
 	}
 
-	// unmarshal the request body
-	var getDocByFileUrlRequest struct {
-		FileURL string `json:"file_url"`
+	if document.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
+		return
 	}
 
-	if err := json.Unmarshal(body, &getDocByFileUrlRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !copy && document.CaseID == targetCaseID {
+		WriteValidationError(w, r, []FieldError{{Field: "case_id", Message: "document is already in this case"}})
 		return
 	}
 
-	document_id, err := GetDocumentIDFromFileURL(getDocByFileUrlRequest.FileURL)
+	target_case, err := GetCaseFromId(targetCaseID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get document by file url",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
 		return
 	}
 
-	if document_id == "" {
-		response := ErrorResponse{
-			Message: "Document not found",
-			Status:  http.StatusNotFound,
+	if target_case.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
+		return
+	}
+
+	// documents only move between cases of the same user
+	source_case, err := GetCaseFromId(document.CaseID)
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
+		return
+	}
+
+	if source_case.UserID != target_case.UserID {
+		WriteValidationError(w, r, []FieldError{{Field: "case_id", Message: "must belong to the same user as the document's case"}})
+		return
+	}
+
+	if copy {
+		copied, err := CopyDocument(document, targetCaseID)
+		if err != nil {
+			log.Printf("Error copying document: %v", err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to copy document")
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+
+		RecordAuditEvent(r, AuditDocumentCopied, AuditEvent{
+			CaseID:     targetCaseID,
+			DocumentID: copied.ID,
+			Details:    auditDetails("source_case_id", document.CaseID, "source_document_id", document.ID),
+		})
+		EmitWebhookEvent(WebhookDocumentCreated, "", targetCaseID, copied)
+
+		WriteSuccess(w, r, http.StatusCreated, "Document copied successfully", copied)
 		return
 	}
 
-	response := SuccessResponse{
-		Message: "Document ID retrieved successfully",
-		Status:  http.StatusOK,
-		Object:  document_id,
+	moved, err := MoveDocument(document, targetCaseID)
+	if err != nil {
+		log.Printf("Error moving document: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to move document")
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	RecordAuditEvent(r, AuditDocumentMoved, AuditEvent{
+		CaseID:     targetCaseID,
+		DocumentID: moved.ID,
+		Details:    auditDetails("source_case_id", document.CaseID),
+	})
 
+	WriteSuccess(w, r, http.StatusOK, "Document moved successfully", moved)
 }
 
-func UpdateRelevancyByFileUrl(w http.ResponseWriter, r *http.Request) {
-	// read the request body
-	body, err := io.ReadAll(r.Body)
+func ResolveDuplicateHandler(w http.ResponseWriter, r *http.Request) {
+	var resolveDuplicateRequest struct {
+		ID     string `json:"_id"`
+		Action string `json:"action"`
+	}
+
+	if !DecodeJSONBody(w, r, &resolveDuplicateRequest) {
+		return
+	}
+
+	resolveDuplicate(w, r, resolveDuplicateRequest.ID, resolveDuplicateRequest.Action)
+}
+
+// resolveDuplicate applies a reviewer's choice to a duplicate document:
+// skip deletes it, link keeps it alongside its original
+func resolveDuplicate(w http.ResponseWriter, r *http.Request, documentID string, action string) {
+	fieldErrors := RequireFields("_id", documentID, "action", action)
+	if action != "" && action != DuplicateSkip && action != DuplicateLink {
+		fieldErrors = append(fieldErrors, FieldError{Field: "action", Message: "must be skip or link"})
+	}
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	document, err := GetDocumentById(documentID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to update relevancy",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document")
 		return
 	}
 
-	// unmarshal the request body
-	var updateRelevancyRequest struct {
-		FileURL   string  `json:"file_url"`
-		Relevancy float64 `json:"relevancy"`
+	if document.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
+		return
 	}
 
-	if err := json.Unmarshal(body, &updateRelevancyRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
+	if document.DuplicateOf == "" {
+		WriteValidationError(w, r, []FieldError{{Field: "_id", Message: "document is not a duplicate"}})
+		return
+	}
+
+	if action == DuplicateSkip {
+		if err := DeleteDocumentById(document.ID); err != nil {
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete document")
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+
+		RecordAuditEvent(r, AuditDocumentDelete, AuditEvent{
+			CaseID:     document.CaseID,
+			DocumentID: document.ID,
+			Details:    auditDetails("duplicate_of", document.DuplicateOf),
+		})
+
+		WriteSuccess(w, r, http.StatusOK, "Duplicate skipped", document)
 		return
 	}
 
-	// get document by file url
-	document_id, err := GetDocumentIDFromFileURL(updateRelevancyRequest.FileURL)
+	linked, err := LinkDuplicate(document)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get document by file url",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		log.Printf("Error linking document %s: %v", document.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to link document")
 		return
 	}
 
-	if document_id == "" {
-		response := ErrorResponse{
-			Message: "Document not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+	RecordAuditEvent(r, AuditDuplicateLinked, AuditEvent{
+		CaseID:     document.CaseID,
+		DocumentID: document.ID,
+		Details:    auditDetails("duplicate_of", document.DuplicateOf),
+	})
+
+	WriteSuccess(w, r, http.StatusOK, "Duplicate linked", linked)
+}
+
+func DownloadDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	// unmarshal the request body
+	var downloadDocRequest struct {
+		ID string `json:"_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &downloadDocRequest) {
 		return
 	}
 
-	// update relevancy by document id
-	err = UpdateDocumentRelevancy(document_id, updateRelevancyRequest.Relevancy)
+	downloadDocument(w, r, downloadDocRequest.ID)
+}
+
+func downloadDocument(w http.ResponseWriter, r *http.Request, documentID string) {
+	// get document by id
+	document, err := GetDocumentById(documentID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to update relevancy",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document")
 		return
 	}
 
-	response := SuccessResponse{
-		Message: "Relevancy updated successfully",
-		Status:  http.StatusOK,
+	// check if document exists
+	if document.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
+		return
+	}
+
+	file, err := DownloadFileFromS3(S3KeyFromURL(document.FileURL))
+	if err != nil {
+		log.Printf("Error downloading document %s: %v", document.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to download document")
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
+	defer file.Close()
+
+	RecordAuditEvent(r, AuditDocumentDownload, AuditEvent{
+		CaseID:     document.CaseID,
+		DocumentID: document.ID,
+	})
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(document.FileName)+"\"")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	io.Copy(w, file)
 }
@@ -2,70 +2,53 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"log"
+	"math"
+	"net/url"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
 )
 
+// GetDocumentsByCaseId returns every document in the case
 func GetDocumentsByCaseId(caseID string) ([]Document, error) {
-	filt := expression.Name("case").Equal(expression.Value(caseID))
-	log.Printf("Case ID: %s", caseID)
-	expr, err := expression.NewBuilder().WithFilter(filt).Build()
-	if err != nil {
-		return []Document{}, err
-	}
-
-	result, err := dynamo.Scan(&dynamodb.ScanInput{
-		ExpressionAttributeNames:  expr.Names(),
-		ExpressionAttributeValues: expr.Values(),
-		FilterExpression:          expr.Filter(),
-		TableName:                 &DocumentsTable,
-	})
-
-	if err != nil {
-		return []Document{}, err
-	}
-
-	if len(result.Items) == 0 {
-		return []Document{}, nil
-	}
-
-	var documents []Document
-
-	for _, i := range result.Items {
-		relevancy, err := strconv.ParseFloat(*i["relevancy"].N, 64)
-
-		if err != nil {
-			return []Document{}, err
-		}
+	documents, _, err := QueryCaseDocuments(caseID, DocumentFilter{})
+	return documents, err
+}
 
-		stored, err := strconv.ParseBool(strconv.FormatBool(*i["stored"].BOOL))
-		if err != nil {
-			return []Document{}, err
-		}
+// GetAllDocuments scans the documents table
+func GetAllDocuments() ([]Document, error) {
+	documents := []Document{}
 
-		doc := Document{
-			ID:        *i["_id"].S,
-			FileName:  *i["file_name"].S,
-			CaseID:    *i["case"].S,
-			Date:      *i["date"].S,
-			FileURL:   *i["file_url"].S,
-			Relevancy: relevancy,
-			Stored:    stored,
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		TableName: &DocumentsTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var doc Document
+			if err := dynamodbattribute.UnmarshalMap(item, &doc); err != nil {
+				log.Printf("Error unmarshalling document: %v", err)
+				continue
+			}
+			documents = append(documents, doc)
 		}
+		return true
+	})
 
-		documents = append(documents, doc)
-	}
-
-	return documents, nil
-
+	return documents, err
 }
 
 func GetDocumentById(documentID string) (Document, error) {
@@ -95,41 +78,59 @@ func GetDocumentById(documentID string) (Document, error) {
 		return Document{}, err
 	}
 
-	relevancy, err := strconv.ParseFloat(*result.Items[0]["relevancy"].N, 64)
-
-	if err != nil {
-		return Document{}, err
-	}
-
-	stored, err := strconv.ParseBool(strconv.FormatBool(*result.Items[0]["stored"].BOOL))
-	if err != nil {
+	var doc Document
+	if err := dynamodbattribute.UnmarshalMap(result.Items[0], &doc); err != nil {
 		return Document{}, err
 	}
 
-	doc := Document{
-		ID:        *result.Items[0]["_id"].S,
-		FileName:  *result.Items[0]["file_name"].S,
-		CaseID:    *result.Items[0]["case"].S,
-		Date:      *result.Items[0]["date"].S,
-		FileURL:   *result.Items[0]["file_url"].S,
-		Relevancy: relevancy,
-		Stored:    stored,
-	}
-
 	return doc, nil
 }
 
+// DeleteDocumentById deletes a document and its versions, takes it off its
+// case's file count and drops their references to the blobs holding their
+// files. Files of documents without a hash are left alone.
 func DeleteDocumentById(documentID string) error {
-	_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+	result, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"_id": {
 				S: &documentID,
 			},
 		},
-		TableName: &DocumentsTable,
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+		TableName:    &DocumentsTable,
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	if c := result.Attributes["case"]; c != nil && c.S != nil {
+		UnindexDocument(*c.S, documentID)
+		CaseAdjustNumberFiles(*c.S, -1)
+	}
+
+	if result.Attributes["processing_status"] != nil {
+		versions := 0
+		if v := result.Attributes["version"]; v != nil && v.N != nil {
+			versions, _ = strconv.Atoi(*v.N)
+		}
+		deleteDocumentText(documentID, versions)
+	}
+
+	// a revised document's references are held by its versions
+	if result.Attributes["version"] != nil {
+		if err := deleteDocumentVersions(documentID); err != nil {
+			log.Printf("Error deleting versions of document %s: %v", documentID, err)
+		}
+		return nil
+	}
+
+	if sha := result.Attributes["sha256"]; sha != nil && sha.S != nil {
+		if err := ReleaseBlob(*sha.S); err != nil {
+			log.Printf("Error releasing blob of document %s: %v", documentID, err)
+		}
+	}
+
+	return nil
 }
 
 func DeleteDocumentsByCaseId(caseID string) ([]Document, error) {
@@ -162,6 +163,87 @@ func UploadFileToS3(fileName string, fileContent []byte) (string, error) {
 	return s3URL, err
 }
 
+// StreamFileToS3 uploads content as it is read. Content larger than
+// UploadPartSize goes up as a multipart upload, which is aborted if reading
+// content fails part way.
+func StreamFileToS3(fileName string, content io.Reader) (string, error) {
+	uploader := s3manager.NewUploaderWithClient(s3Client, func(u *s3manager.Uploader) {
+		u.PartSize = UploadPartSize
+		u.Concurrency = UploadConcurrency
+	})
+
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: &Bucket,
+		Key:    aws.String(fileName),
+		Body:   content,
+	})
+
+	s3URL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", Bucket, fileName)
+
+	return s3URL, err
+}
+
+// StartMultipartUpload begins a multipart upload to fileName and returns its
+// upload ID
+func StartMultipartUpload(fileName string) (string, error) {
+	output, err := s3Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: &Bucket,
+		Key:    aws.String(fileName),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(output.UploadId), nil
+}
+
+// UploadPartToS3 uploads one part of a multipart upload and returns its ETag.
+// Every part but the last must be at least s3manager.MinUploadPartSize.
+func UploadPartToS3(fileName string, uploadID string, partNumber int64, content []byte) (string, error) {
+	output, err := s3Client.UploadPart(&s3.UploadPartInput{
+		Bucket:     &Bucket,
+		Key:        aws.String(fileName),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int64(partNumber),
+		Body:       bytes.NewReader(content),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(output.ETag), nil
+}
+
+// CompleteMultipartUpload joins the parts, given as ETags in part order, into
+// the object and returns its URL
+func CompleteMultipartUpload(fileName string, uploadID string, etags []string) (string, error) {
+	parts := make([]*s3.CompletedPart, len(etags))
+	for i, etag := range etags {
+		parts[i] = &s3.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int64(int64(i + 1))}
+	}
+
+	_, err := s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          &Bucket,
+		Key:             aws.String(fileName),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+
+	s3URL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", Bucket, fileName)
+
+	return s3URL, err
+}
+
+func AbortMultipartUpload(fileName string, uploadID string) error {
+	_, err := s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &Bucket,
+		Key:      aws.String(fileName),
+		UploadId: aws.String(uploadID),
+	})
+
+	return err
+}
+
 func UploadDocumentDynamo(document Document) error {
 
 	fmt.Println(document)
@@ -183,6 +265,9 @@ func UploadDocumentDynamo(document Document) error {
 			"file_url": {
 				S: aws.String(document.FileURL),
 			},
+			"file_type": {
+				S: aws.String(DocumentFileType(document.FileName)),
+			},
 			"relevancy": {
 				N: aws.String(strconv.FormatFloat(document.Relevancy, 'f', -1, 64)),
 			},
@@ -193,39 +278,151 @@ func UploadDocumentDynamo(document Document) error {
 
 		TableName: &DocumentsTable,
 	}
+	if document.Description != "" {
+		input.Item["description"] = &dynamodb.AttributeValue{S: aws.String(document.Description)}
+	}
+	if len(document.Tags) > 0 {
+		input.Item["tags"] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+		for _, tag := range document.Tags {
+			input.Item["tags"].L = append(input.Item["tags"].L, &dynamodb.AttributeValue{S: aws.String(tag)})
+		}
+	}
+	if document.SHA256 != "" {
+		input.Item["sha256"] = &dynamodb.AttributeValue{S: aws.String(document.SHA256)}
+	}
+	if document.DuplicateOf != "" {
+		input.Item["duplicate_of"] = &dynamodb.AttributeValue{S: aws.String(document.DuplicateOf)}
+		input.Item["duplicate_status"] = &dynamodb.AttributeValue{S: aws.String(document.DuplicateStatus)}
+	}
+	if document.ProcessingStatus != "" {
+		input.Item["processing_status"] = &dynamodb.AttributeValue{S: aws.String(document.ProcessingStatus)}
+	}
 
 	_, err := dynamo.PutItem(input)
 
 	return err
 }
 
-func GetDocumentIDFromFileURL(fileURL string) (string, error) {
-	filt := expression.Name("file_url").Equal(expression.Value(fileURL))
-	expr, err := expression.NewBuilder().WithFilter(filt).Build()
+// GetDocumentIDFromFileURL looks up a document ID through the file_url
+// index. It returns an empty string if no document has the URL, or none in
+// caseID when it is given. Duplicates of one upload share its file and so
+// its URL; among them the lookup resolves to the document in caseID, then
+// to the original rather than its flagged or linked duplicates, then to the
+// earliest uploaded.
+func GetDocumentIDFromFileURL(fileURL string, caseID string) (string, error) {
+	keyCond := expression.Key("file_url").Equal(expression.Value(fileURL))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
 	if err != nil {
 		return "", err
 	}
 
-	result, err := dynamo.Scan(&dynamodb.ScanInput{
+	var ids []string
+	err = dynamo.QueryPages(&dynamodb.QueryInput{
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
-		FilterExpression:          expr.Filter(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		IndexName:                 aws.String(DocumentsByFileURLIndex),
 		TableName:                 &DocumentsTable,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			ids = append(ids, aws.StringValue(item["_id"].S))
+		}
+		return true
 	})
+	if err != nil {
+		return "", err
+	}
 
+	if len(ids) == 1 && caseID == "" {
+		return ids[0], nil
+	}
+
+	// the index may not project the attributes the choice needs
+	documents, err := getDocumentsForFileURLChoice(ids)
 	if err != nil {
 		return "", err
 	}
 
-	if len(result.Items) == 0 {
+	var candidates []Document
+	for _, doc := range documents {
+		if caseID == "" || doc.CaseID == caseID {
+			candidates = append(candidates, doc)
+		}
+	}
+	if len(candidates) == 0 {
 		return "", nil
 	}
 
-	if len(result.Items) > 1 {
-		return "", err
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if (a.DuplicateOf == "") != (b.DuplicateOf == "") {
+			return a.DuplicateOf == ""
+		}
+		aDate, aErr := time.Parse(documentDateLayout, a.Date)
+		bDate, bErr := time.Parse(documentDateLayout, b.Date)
+		if aErr == nil && bErr == nil && !aDate.Equal(bDate) {
+			return aDate.Before(bDate)
+		}
+		return a.ID < b.ID
+	})
+
+	return candidates[0].ID, nil
+}
+
+// getDocumentsForFileURLChoice reads the attributes GetDocumentIDFromFileURL
+// chooses by for each document in ids, in BatchGetItem calls of up to 100
+// keys. Documents deleted since the index was read are left out.
+func getDocumentsForFileURLChoice(ids []string) ([]Document, error) {
+	proj := expression.NamesList(expression.Name("_id"), expression.Name("case"), expression.Name("date"), expression.Name("duplicate_of"))
+	expr, err := expression.NewBuilder().WithProjection(proj).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var documents []Document
+	for start := 0; start < len(ids); start += 100 {
+		end := start + 100
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var keys []map[string]*dynamodb.AttributeValue
+		for _, id := range ids[start:end] {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{"_id": {S: aws.String(id)}})
+		}
+
+		request := map[string]*dynamodb.KeysAndAttributes{
+			DocumentsTable: {
+				ExpressionAttributeNames: expr.Names(),
+				Keys:                     keys,
+				ProjectionExpression:     expr.Projection(),
+			},
+		}
+		// keys DynamoDB could not read in one call are retried
+		for attempt := 0; len(request) > 0; attempt++ {
+			if attempt == 5 {
+				return nil, fmt.Errorf("%d documents could not be read", len(request[DocumentsTable].Keys))
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+			}
+
+			result, err := dynamo.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: request})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range result.Responses[DocumentsTable] {
+				var doc Document
+				if err := dynamodbattribute.UnmarshalMap(item, &doc); err != nil {
+					return nil, err
+				}
+				documents = append(documents, doc)
+			}
+			request = result.UnprocessedKeys
+		}
 	}
 
-	return *result.Items[0]["_id"].S, nil
+	return documents, nil
 }
 
 func UpdateDocumentRelevancy(documentID string, relevancy float64) error {
@@ -249,3 +446,773 @@ func UpdateDocumentRelevancy(documentID string, relevancy float64) error {
 
 	return err
 }
+
+// S3KeyFromURL returns the object key for a URL produced by UploadFileToS3
+func S3KeyFromURL(fileURL string) string {
+	prefix := fmt.Sprintf("https://%s.s3.amazonaws.com/", Bucket)
+	return strings.TrimPrefix(fileURL, prefix)
+}
+
+func DownloadFileFromS3(fileName string) (io.ReadCloser, error) {
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &Bucket,
+		Key:    aws.String(fileName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output.Body, nil
+}
+
+// FileSizeInS3 returns the size in bytes of an object
+func FileSizeInS3(fileName string) (int64, error) {
+	output, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &Bucket,
+		Key:    aws.String(fileName),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return aws.Int64Value(output.ContentLength), nil
+}
+
+func DeleteFileFromS3(fileName string) error {
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &Bucket,
+		Key:    aws.String(fileName),
+	})
+
+	return err
+}
+
+func ListS3Keys(prefix string) ([]string, error) {
+	var keys []string
+
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &Bucket,
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, *object.Key)
+		}
+		return true
+	})
+
+	return keys, err
+}
+
+// DocumentFileType returns the lower case extension of a file name without
+// the dot, which is stored as file_type
+func DocumentFileType(fileName string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(fileName)), ".")
+}
+
+// documentQuery builds a query on the case relevancy index for the filter
+func documentQuery(caseID string, filter DocumentFilter) (*dynamodb.QueryInput, error) {
+	keyCond := expression.Key("case").Equal(expression.Value(caseID))
+	switch {
+	case filter.MinRelevancy != nil && filter.MaxRelevancy != nil:
+		keyCond = keyCond.And(expression.Key("relevancy").Between(expression.Value(*filter.MinRelevancy), expression.Value(*filter.MaxRelevancy)))
+	case filter.MinRelevancy != nil:
+		keyCond = keyCond.And(expression.Key("relevancy").GreaterThanEqual(expression.Value(*filter.MinRelevancy)))
+	case filter.MaxRelevancy != nil:
+		keyCond = keyCond.And(expression.Key("relevancy").LessThanEqual(expression.Value(*filter.MaxRelevancy)))
+	}
+
+	var conditions []expression.ConditionBuilder
+	if filter.Stored != nil {
+		conditions = append(conditions, expression.Name("stored").Equal(expression.Value(*filter.Stored)))
+	}
+
+	// dates are stored as time.Time strings, so they compare by their
+	// leading YYYY-MM-DD and the end date is turned into an exclusive bound
+	if filter.DateFrom != "" {
+		conditions = append(conditions, expression.Name("date").GreaterThanEqual(expression.Value(filter.DateFrom)))
+	}
+	if filter.DateTo != "" {
+		end, err := time.Parse("2006-01-02", filter.DateTo)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, expression.Name("date").LessThan(expression.Value(end.AddDate(0, 0, 1).Format("2006-01-02"))))
+	}
+
+	if filter.DuplicateStatus != "" {
+		conditions = append(conditions, expression.Name("duplicate_status").Equal(expression.Value(filter.DuplicateStatus)))
+	}
+
+	if len(filter.FileTypes) == 1 {
+		conditions = append(conditions, expression.Name("file_type").Equal(expression.Value(filter.FileTypes[0])))
+	} else if len(filter.FileTypes) > 1 {
+		var rest []expression.OperandBuilder
+		for _, t := range filter.FileTypes[1:] {
+			rest = append(rest, expression.Value(t))
+		}
+		conditions = append(conditions, expression.Name("file_type").In(expression.Value(filter.FileTypes[0]), rest...))
+	}
+
+	builder := expression.NewBuilder().WithKeyCondition(keyCond)
+	if len(conditions) == 1 {
+		builder = builder.WithFilter(conditions[0])
+	} else if len(conditions) > 1 {
+		builder = builder.WithFilter(expression.And(conditions[0], conditions[1], conditions[2:]...))
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		IndexName:                 aws.String(DocumentsByRelevancyIndex),
+		ScanIndexForward:          aws.Bool(filter.Order == "asc"),
+		ExclusiveStartKey:         startKey,
+		TableName:                 &DocumentsTable,
+	}, nil
+}
+
+// QueryCaseDocuments lists a case's documents through the case relevancy
+// index. It returns a cursor for the next page when filter.Limit is set and
+// more results remain.
+func QueryCaseDocuments(caseID string, filter DocumentFilter) ([]Document, string, error) {
+	input, err := documentQuery(caseID, filter)
+	if err != nil {
+		return []Document{}, "", err
+	}
+
+	documents := []Document{}
+	cursor, err := QueryPage(input, filter.Limit, func(item map[string]*dynamodb.AttributeValue) error {
+		var doc Document
+		if err := dynamodbattribute.UnmarshalMap(item, &doc); err != nil {
+			return err
+		}
+		documents = append(documents, doc)
+		return nil
+	})
+	if err != nil {
+		return []Document{}, "", err
+	}
+
+	return documents, cursor, nil
+}
+
+// SummarizeDocumentRelevancy counts every document matching the filter in
+// relevancy buckets of bucketSize, ignoring the filter's paging
+func SummarizeDocumentRelevancy(caseID string, filter DocumentFilter, bucketSize float64) (RelevancySummary, error) {
+	filter.Limit = 0
+	filter.Cursor = ""
+
+	input, err := documentQuery(caseID, filter)
+	if err != nil {
+		return RelevancySummary{}, err
+	}
+	input.ProjectionExpression = aws.String("relevancy")
+
+	counts := map[int64]int{}
+	summary := RelevancySummary{Buckets: []RelevancyBucket{}}
+	_, err = QueryPage(input, 0, func(item map[string]*dynamodb.AttributeValue) error {
+		var doc struct {
+			Relevancy float64 `dynamodbav:"relevancy"`
+		}
+		if err := dynamodbattribute.UnmarshalMap(item, &doc); err != nil {
+			return err
+		}
+		counts[int64(math.Floor(doc.Relevancy/bucketSize))]++
+		summary.Total++
+		return nil
+	})
+	if err != nil {
+		return RelevancySummary{}, err
+	}
+
+	keys := make([]int64, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, k := range keys {
+		summary.Buckets = append(summary.Buckets, RelevancyBucket{
+			Min:   float64(k) * bucketSize,
+			Max:   float64(k+1) * bucketSize,
+			Count: counts[k],
+		})
+	}
+
+	return summary, nil
+}
+
+// ReindexDocuments sets file_type on every document that is missing it. It
+// returns the number of documents updated.
+func ReindexDocuments() (int, error) {
+	updated := 0
+	var scanErr error
+
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		FilterExpression: aws.String("attribute_not_exists(file_type)"),
+		TableName:        &DocumentsTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var doc Document
+			if err := dynamodbattribute.UnmarshalMap(item, &doc); err != nil {
+				scanErr = err
+				return false
+			}
+
+			_, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":t": {
+						S: aws.String(DocumentFileType(doc.FileName)),
+					},
+				},
+				Key: map[string]*dynamodb.AttributeValue{
+					"_id": {
+						S: aws.String(doc.ID),
+					},
+				},
+				TableName:        &DocumentsTable,
+				UpdateExpression: aws.String("SET file_type = :t"),
+			})
+			if err != nil {
+				scanErr = err
+				return false
+			}
+			updated++
+		}
+		return true
+	})
+	if err != nil {
+		return updated, err
+	}
+
+	return updated, scanErr
+}
+
+// CopyFileInS3 copies an object within the bucket and returns the URL of the
+// copy
+func CopyFileInS3(sourceKey string, destinationKey string) (string, error) {
+	source := (&url.URL{Path: Bucket + "/" + sourceKey}).EscapedPath()
+
+	_, err := s3Client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     &Bucket,
+		CopySource: aws.String(source),
+		Key:        aws.String(destinationKey),
+	})
+
+	s3URL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", Bucket, destinationKey)
+
+	return s3URL, err
+}
+
+// UpdateDocument applies the non-nil fields of update and returns the
+// updated document. It returns an empty Document if it does not exist.
+func UpdateDocument(documentID string, update DocumentUpdate) (Document, error) {
+	doc, err := GetDocumentById(documentID)
+	if err != nil || doc.ID == "" {
+		return doc, err
+	}
+
+	var set expression.UpdateBuilder
+	changed := false
+	if update.FileName != nil {
+		set = set.Set(expression.Name("file_name"), expression.Value(*update.FileName)).
+			Set(expression.Name("file_type"), expression.Value(DocumentFileType(*update.FileName)))
+		doc.FileName = *update.FileName
+		doc.FileType = DocumentFileType(*update.FileName)
+		changed = true
+	}
+	if update.Description != nil {
+		set = set.Set(expression.Name("description"), expression.Value(*update.Description))
+		doc.Description = *update.Description
+		changed = true
+	}
+	if update.Tags != nil {
+		set = set.Set(expression.Name("tags"), expression.Value(*update.Tags))
+		doc.Tags = *update.Tags
+		changed = true
+	}
+	if update.Relevancy != nil {
+		set = set.Set(expression.Name("relevancy"), expression.Value(*update.Relevancy))
+		doc.Relevancy = *update.Relevancy
+		changed = true
+	}
+
+	if !changed {
+		return doc, nil
+	}
+
+	expr, err := expression.NewBuilder().WithUpdate(set).Build()
+	if err != nil {
+		return Document{}, err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(documentID),
+			},
+		},
+		TableName: &DocumentsTable,
+	})
+	if err == nil {
+		IndexDocument(doc)
+	}
+
+	return doc, err
+}
+
+// relocatedKey returns the blob key for a document's file under another
+// case's prefix
+func relocatedKey(doc Document, targetCaseID string) string {
+	return targetCaseID + "/" + strings.TrimPrefix(S3KeyFromURL(doc.FileURL), doc.CaseID+"/")
+}
+
+// relocatedFileName keeps the file name in step with the blob key for
+// documents whose name is the key, as CreateDocumentsHandler stores them
+func relocatedFileName(doc Document, key string) string {
+	if strings.HasPrefix(doc.FileName, doc.CaseID+"/") {
+		return key
+	}
+	return doc.FileName
+}
+
+// MoveDocument moves a document and its file to another case, updating
+// both cases' file counts and removing it from the old case's chat
+// selection. Files under BlobPrefix belong to no case and stay where they
+// are. A file under the old case's prefix moves under the target case's
+// unless other documents share its blob, or the document was revised and
+// its versions refer to it.
+func MoveDocument(doc Document, targetCaseID string) (Document, error) {
+	oldKey := S3KeyFromURL(doc.FileURL)
+	newKey := oldKey
+	newURL := doc.FileURL
+	relocate := doc.Version == 0 && strings.HasPrefix(oldKey, doc.CaseID+"/")
+
+	var err error
+	if relocate && doc.SHA256 != "" {
+		blob, err := GetBlobByHash(doc.SHA256)
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to get blob, %v", err)
+		}
+		relocate = blob.Refs == 1 && blob.Key == oldKey
+	}
+	if relocate {
+		newKey = relocatedKey(doc, targetCaseID)
+		newURL, err = CopyFileInS3(oldKey, newKey)
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to copy file, %v", err)
+		}
+	}
+
+	// the blob follows its file, unless the file was shared in the meantime
+	if relocate && doc.SHA256 != "" {
+		ok, err := MoveBlob(doc.SHA256, oldKey, newKey)
+		if err != nil || !ok {
+			if err := DeleteFileFromS3(newKey); err != nil {
+				log.Printf("Error removing copied file %s: %v", newKey, err)
+			}
+			if err != nil {
+				return Document{}, fmt.Errorf("failed to move blob, %v", err)
+			}
+			relocate, newKey, newURL = false, oldKey, doc.FileURL
+		}
+	}
+
+	moved := doc
+	moved.CaseID = targetCaseID
+	moved.FileURL = newURL
+	if relocate && doc.SHA256 == "" {
+		moved.FileName = relocatedFileName(doc, newKey)
+	} else {
+		moved.FileName = relocatedFileName(doc, targetCaseID+"/"+strings.TrimPrefix(doc.FileName, doc.CaseID+"/"))
+	}
+
+	// the document is checked against the target case's files instead
+	moved.DuplicateOf, moved.DuplicateStatus = "", ""
+	if doc.SHA256 != "" {
+		original, err := FindDocumentByHash(targetCaseID, doc.SHA256, doc.ID)
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to check for duplicates, %v", err)
+		}
+		markDuplicate(&moved, original, false)
+	}
+
+	set := expression.Set(expression.Name("case"), expression.Value(moved.CaseID)).
+		Set(expression.Name("file_url"), expression.Value(moved.FileURL)).
+		Set(expression.Name("file_name"), expression.Value(moved.FileName))
+	if moved.DuplicateOf != "" {
+		set = set.Set(expression.Name("duplicate_of"), expression.Value(moved.DuplicateOf)).
+			Set(expression.Name("duplicate_status"), expression.Value(moved.DuplicateStatus))
+	} else {
+		set = set.Remove(expression.Name("duplicate_of")).Remove(expression.Name("duplicate_status"))
+	}
+
+	expr, err := expression.NewBuilder().WithUpdate(set).Build()
+	if err != nil {
+		return Document{}, err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(doc.ID),
+			},
+		},
+		TableName:        &DocumentsTable,
+		UpdateExpression: expr.Update(),
+	})
+	if err != nil {
+		if oldKey != newKey {
+			undoRelocation(doc.SHA256, oldKey, newKey)
+		}
+		return Document{}, fmt.Errorf("failed to update document, %v", err)
+	}
+
+	if oldKey != newKey {
+		if err := DeleteFileFromS3(oldKey); err != nil {
+			log.Printf("Error deleting moved file %s: %v", oldKey, err)
+		}
+	}
+
+	CaseAdjustNumberFiles(doc.CaseID, -1)
+	CaseAdjustNumberFiles(targetCaseID, 1)
+	IndexMovedDocument(moved, doc.CaseID)
+
+	if err := RemoveSelectedDocs(doc.CaseID, doc.ID, doc.FileURL); err != nil {
+		log.Printf("Error updating selected documents for case %s: %v", doc.CaseID, err)
+	}
+
+	return moved, nil
+}
+
+// undoRelocation removes the copy of a file whose document could not be
+// moved. A blob that was pointed at the copy is pointed back first, and the
+// copy is kept if another document has shared it since.
+func undoRelocation(sha string, oldKey string, newKey string) {
+	if sha != "" {
+		ok, err := MoveBlob(sha, newKey, oldKey)
+		if err != nil || !ok {
+			log.Printf("Error moving blob %s back to %s: %v", sha, oldKey, err)
+			return
+		}
+	}
+	if err := DeleteFileFromS3(newKey); err != nil {
+		log.Printf("Error removing copied file %s: %v", newKey, err)
+	}
+}
+
+// CopyDocument copies a document and its blob into another case. The copy
+// keeps the descriptive metadata but starts unreviewed.
+func CopyDocument(doc Document, targetCaseID string) (Document, error) {
+	copied := Document{
+		ID:          generateRandomString(16),
+		CaseID:      targetCaseID,
+		Date:        time.Now().Truncate(0).String(),
+		Relevancy:   0.0,
+		Stored:      false,
+		Description: doc.Description,
+		Tags:        doc.Tags,
+		SHA256:      doc.SHA256,
+
+		ProcessingStatus: ProcessingPending,
+	}
+	copiedKey := func(key string) string {
+		rest := strings.TrimPrefix(key, doc.CaseID+"/")
+		return RemoveSpacesAndColons(RemovePeriods(targetCaseID+"/"+time.Now().Truncate(0).String()) + rest)
+	}
+
+	// a copy of a shared blob takes another reference instead of a new file
+	newKey := ""
+	if doc.SHA256 == "" {
+		newKey = copiedKey(S3KeyFromURL(doc.FileURL))
+		newURL, err := CopyFileInS3(S3KeyFromURL(doc.FileURL), newKey)
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to copy file, %v", err)
+		}
+		copied.FileURL = newURL
+		copied.FileName = relocatedFileName(doc, newKey)
+	} else {
+		original, err := FindDocumentByHash(targetCaseID, doc.SHA256, "")
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to check for duplicates, %v", err)
+		}
+		if err := AcquireBlob(doc.SHA256); err != nil {
+			return Document{}, fmt.Errorf("failed to share file, %v", err)
+		}
+		copied.FileURL = doc.FileURL
+		copied.FileName = relocatedFileName(doc, copiedKey(doc.FileName))
+		markDuplicate(&copied, original, false)
+	}
+	copied.FileType = DocumentFileType(copied.FileName)
+
+	if err := UploadDocumentDynamo(copied); err != nil {
+		if newKey != "" {
+			if err := DeleteFileFromS3(newKey); err != nil {
+				log.Printf("Error removing copied file %s: %v", newKey, err)
+			}
+		} else {
+			releaseBlobAfterFailure(doc.SHA256)
+		}
+		return Document{}, fmt.Errorf("failed to create document, %v", err)
+	}
+
+	CaseAdjustNumberFiles(targetCaseID, 1)
+	IndexDocument(copied)
+	QueueExtraction(copied)
+
+	return copied, nil
+}
+
+// duplicate handling chosen when an upload's content is already in the case
+const (
+	DuplicateFlag = "flag"
+	DuplicateLink = "link"
+	DuplicateSkip = "skip"
+)
+
+// DuplicateStatus values of a document
+const (
+	DuplicateFlagged = "flagged"
+	DuplicateLinked  = "linked"
+)
+
+// FindDocumentByHash returns a document of the case with the given content,
+// preferring one that is not itself a duplicate. It skips excludeID and
+// returns an empty Document if there is none.
+func FindDocumentByHash(caseID string, sha string, excludeID string) (Document, error) {
+	keyCond := expression.Key("case").Equal(expression.Value(caseID))
+	filt := expression.Name("sha256").Equal(expression.Value(sha))
+
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).WithFilter(filt).Build()
+	if err != nil {
+		return Document{}, err
+	}
+
+	var found Document
+	err = dynamo.QueryPages(&dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		IndexName:                 aws.String(DocumentsByRelevancyIndex),
+		TableName:                 &DocumentsTable,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var doc Document
+			if err := dynamodbattribute.UnmarshalMap(item, &doc); err != nil {
+				log.Printf("Error unmarshalling document: %v", err)
+				continue
+			}
+			if doc.ID == excludeID {
+				continue
+			}
+			if found.ID == "" || (found.DuplicateOf != "" && doc.DuplicateOf == "") {
+				found = doc
+			}
+		}
+		return found.ID == "" || found.DuplicateOf != ""
+	})
+
+	return found, err
+}
+
+// markDuplicate records that doc has the same content as original, if there
+// is one. Linked duplicates have been accepted and need no review.
+func markDuplicate(doc *Document, original Document, linked bool) {
+	if original.ID == "" {
+		return
+	}
+
+	doc.DuplicateOf = original.ID
+	if original.DuplicateOf != "" {
+		doc.DuplicateOf = original.DuplicateOf
+	}
+	doc.DuplicateStatus = DuplicateFlagged
+	if linked {
+		doc.DuplicateStatus = DuplicateLinked
+	}
+}
+
+// LinkDuplicate accepts a flagged duplicate as a separate document that
+// shares its original's file
+func LinkDuplicate(doc Document) (Document, error) {
+	_, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":status": {
+				S: aws.String(DuplicateLinked),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(doc.ID),
+			},
+		},
+		TableName:        &DocumentsTable,
+		UpdateExpression: aws.String("SET duplicate_status = :status"),
+	})
+	if err != nil {
+		return Document{}, err
+	}
+
+	doc.DuplicateStatus = DuplicateLinked
+	return doc, nil
+}
+
+// MaxRelevancyBatch is the most updates accepted in one batch request
+const MaxRelevancyBatch = 1000
+
+// relevancy batches are written in transactions of at most this many items
+const relevancyTransactionSize = 100
+
+// BatchUpdateRelevancy resolves and validates each update and writes the
+// valid ones in transactions. Each transaction only updates documents that
+// exist, and items that fail are reported without failing the rest.
+func BatchUpdateRelevancy(updates []RelevancyUpdate) BatchRelevancyResult {
+	results := make([]RelevancyUpdateResult, len(updates))
+	seen := map[string]bool{}
+	var pending []int
+
+	for i, u := range updates {
+		results[i] = RelevancyUpdateResult{Index: i, DocumentID: u.DocumentID, FileURL: u.FileURL}
+
+		switch {
+		case u.DocumentID == "" && u.FileURL == "":
+			results[i].Status, results[i].Error = "invalid", "document_id or file_url is required"
+			continue
+		case u.Relevancy == nil:
+			results[i].Status, results[i].Error = "invalid", "relevancy is required"
+			continue
+		case math.IsNaN(*u.Relevancy) || math.IsInf(*u.Relevancy, 0):
+			results[i].Status, results[i].Error = "invalid", "relevancy must be a finite number"
+			continue
+		}
+
+		if results[i].DocumentID == "" {
+			documentID, err := GetDocumentIDFromFileURL(u.FileURL, u.CaseID)
+			if err != nil {
+				results[i].Status, results[i].Error = "failed", err.Error()
+				continue
+			}
+			if documentID == "" {
+				results[i].Status, results[i].Error = "not_found", "no document has this file_url"
+				continue
+			}
+			results[i].DocumentID = documentID
+		}
+
+		// a transaction cannot touch the same item twice
+		if seen[results[i].DocumentID] {
+			results[i].Status, results[i].Error = "invalid", "document appears more than once in the batch"
+			continue
+		}
+		seen[results[i].DocumentID] = true
+
+		pending = append(pending, i)
+	}
+
+	updatedAt := time.Now().UTC().Format(time.RFC3339)
+	for start := 0; start < len(pending); start += relevancyTransactionSize {
+		end := start + relevancyTransactionSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		writeRelevancyTransaction(updates, results, pending[start:end], updatedAt)
+	}
+
+	batch := BatchRelevancyResult{Results: results}
+	for _, result := range results {
+		if result.Status == "updated" {
+			batch.Updated++
+		} else {
+			batch.Failed++
+		}
+	}
+
+	return batch
+}
+
+// writeRelevancyTransaction writes the updates at indexes in one
+// transaction, retrying without the items that caused it to be cancelled
+func writeRelevancyTransaction(updates []RelevancyUpdate, results []RelevancyUpdateResult, indexes []int, updatedAt string) {
+	for attempt := 0; attempt < 3 && len(indexes) > 0; attempt++ {
+		var items []*dynamodb.TransactWriteItem
+		for _, i := range indexes {
+			items = append(items, &dynamodb.TransactWriteItem{
+				Update: &dynamodb.Update{
+					ConditionExpression: aws.String("attribute_exists(#I)"),
+					ExpressionAttributeNames: map[string]*string{
+						"#I": aws.String("_id"),
+					},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":r": {
+							N: aws.String(strconv.FormatFloat(*updates[i].Relevancy, 'f', -1, 64)),
+						},
+						":v": {
+							S: aws.String(updates[i].ModelVersion),
+						},
+						":t": {
+							S: aws.String(updatedAt),
+						},
+					},
+					Key: map[string]*dynamodb.AttributeValue{
+						"_id": {
+							S: aws.String(results[i].DocumentID),
+						},
+					},
+					TableName:        &DocumentsTable,
+					UpdateExpression: aws.String("SET relevancy = :r, relevancy_model_version = :v, relevancy_updated_at = :t"),
+				},
+			})
+		}
+
+		_, err := dynamo.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+		if err == nil {
+			for _, i := range indexes {
+				results[i].Status, results[i].Error = "updated", ""
+			}
+			return
+		}
+
+		var canceled *dynamodb.TransactionCanceledException
+		if !errors.As(err, &canceled) || len(canceled.CancellationReasons) != len(indexes) {
+			log.Printf("Error writing relevancy batch: %v", err)
+			for _, i := range indexes {
+				results[i].Status, results[i].Error = "failed", err.Error()
+			}
+			continue
+		}
+
+		var retry []int
+		for n, reason := range canceled.CancellationReasons {
+			i := indexes[n]
+			switch code := aws.StringValue(reason.Code); code {
+			case "None", "":
+				retry = append(retry, i)
+			case "ConditionalCheckFailed":
+				results[i].Status, results[i].Error = "not_found", "document does not exist"
+			default:
+				results[i].Status, results[i].Error = "failed", code
+				if code == "TransactionConflict" || code == "ThrottlingError" {
+					retry = append(retry, i)
+				}
+			}
+		}
+		indexes = retry
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+func GetDocumentVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	var getVersionsRequest struct {
+		ID string `json:"_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &getVersionsRequest) {
+		return
+	}
+
+	getDocumentVersions(w, r, getVersionsRequest.ID)
+}
+
+// getVersionedDocument gets a document for the version routes, writing the
+// error response and returning false if it cannot
+func getVersionedDocument(w http.ResponseWriter, r *http.Request, documentID string) (Document, bool) {
+	document, err := GetDocumentById(documentID)
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document")
+		return Document{}, false
+	}
+
+	if document.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeDocumentNotFound, "Document not found")
+		return Document{}, false
+	}
+
+	return document, true
+}
+
+// getVersion gets one version of a document, writing the error response and
+// returning false if it cannot
+func getVersion(w http.ResponseWriter, r *http.Request, document Document, number int) (DocumentVersion, bool) {
+	if number < 1 {
+		WriteValidationError(w, r, []FieldError{{Field: "version", Message: "must be a positive integer"}})
+		return DocumentVersion{}, false
+	}
+
+	version, err := GetDocumentVersion(document, number)
+	if err != nil {
+		log.Printf("Error getting version %d of document %s: %v", number, document.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document version")
+		return DocumentVersion{}, false
+	}
+
+	if version.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeVersionNotFound, "Document version not found")
+		return DocumentVersion{}, false
+	}
+
+	return version, true
+}
+
+func getDocumentVersions(w http.ResponseWriter, r *http.Request, documentID string) {
+	document, ok := getVersionedDocument(w, r, documentID)
+	if !ok {
+		return
+	}
+
+	versions, err := ListDocumentVersions(document)
+	if err != nil {
+		log.Printf("Error getting versions of document %s: %v", document.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document versions")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Document versions retrieved successfully", versions)
+}
+
+// uploadDocumentVersion stores the file in the file part of a multipart
+// form as the document's new current version
+func uploadDocumentVersion(w http.ResponseWriter, r *http.Request, documentID string) {
+	document, ok := getVersionedDocument(w, r, documentID)
+	if !ok {
+		return
+	}
+
+	var stored StoredUpload
+	var fileName string
+
+	_, err := ReadUploadForm(w, r, document.CaseID, "file", func(caseID string, name string, content io.Reader) error {
+		// only the first file is stored
+		if stored.Key != "" {
+			return nil
+		}
+
+		var err error
+		stored, err = StoreUpload(caseID, name, NewBlobKey(), content)
+		fileName = name
+		return err
+	})
+	if err != nil {
+		WriteUploadRejection(w, r, err)
+		return
+	}
+
+	if stored.Key == "" {
+		WriteValidationError(w, r, []FieldError{{Field: "file", Message: "is required"}})
+		return
+	}
+
+	if stored.SHA256 == document.SHA256 {
+		discardStoredUpload(stored.Key)
+		WriteValidationError(w, r, []FieldError{{Field: "file", Message: "is the same as the current version"}})
+		return
+	}
+
+	key, err := StoreBlob(stored.Key, stored.SHA256, stored.Size)
+	if err != nil {
+		log.Printf("Error storing blob for document %s: %v", document.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to store document version")
+		return
+	}
+
+	updated, err := AddDocumentVersion(document, DocumentVersion{
+		FileName:   timestampedUploadKey(document.CaseID, fileName),
+		Key:        key,
+		Size:       stored.Size,
+		SHA256:     stored.SHA256,
+		UploadedBy: RequestActor(r),
+	})
+	if err != nil {
+		releaseBlobAfterFailure(stored.SHA256)
+		writeVersionError(w, r, document.ID, err)
+		return
+	}
+
+	RecordAuditEvent(r, AuditVersionAdded, AuditEvent{
+		CaseID:     document.CaseID,
+		DocumentID: document.ID,
+		Details:    auditDetails("version", strconv.Itoa(updated.Version)),
+	})
+
+	WriteSuccess(w, r, http.StatusCreated, "Document version created successfully", updated)
+}
+
+func writeVersionError(w http.ResponseWriter, r *http.Request, documentID string, err error) {
+	if errors.Is(err, ErrVersionConflict) {
+		WriteError(w, r, http.StatusConflict, CodeVersionConflict, "Another version of the document was added at the same time")
+		return
+	}
+
+	log.Printf("Error adding version of document %s: %v", documentID, err)
+	WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to add document version")
+}
+
+func DownloadDocumentVersionHandler(w http.ResponseWriter, r *http.Request) {
+	var downloadVersionRequest struct {
+		ID      string `json:"_id"`
+		Version int    `json:"version"`
+	}
+
+	if !DecodeJSONBody(w, r, &downloadVersionRequest) {
+		return
+	}
+
+	downloadDocumentVersion(w, r, downloadVersionRequest.ID, downloadVersionRequest.Version)
+}
+
+func downloadDocumentVersion(w http.ResponseWriter, r *http.Request, documentID string, number int) {
+	document, ok := getVersionedDocument(w, r, documentID)
+	if !ok {
+		return
+	}
+
+	version, ok := getVersion(w, r, document, number)
+	if !ok {
+		return
+	}
+
+	file, err := DownloadFileFromS3(version.Key)
+	if err != nil {
+		log.Printf("Error downloading document %s version %d: %v", document.ID, number, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to download document version")
+		return
+	}
+	defer file.Close()
+
+	RecordAuditEvent(r, AuditDocumentDownload, AuditEvent{
+		CaseID:     document.CaseID,
+		DocumentID: document.ID,
+		Details:    auditDetails("version", strconv.Itoa(number)),
+	})
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(version.FileName)+"\"")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, file)
+}
+
+func RestoreDocumentVersionHandler(w http.ResponseWriter, r *http.Request) {
+	var restoreVersionRequest struct {
+		ID      string `json:"_id"`
+		Version int    `json:"version"`
+	}
+
+	if !DecodeJSONBody(w, r, &restoreVersionRequest) {
+		return
+	}
+
+	restoreDocumentVersion(w, r, restoreVersionRequest.ID, restoreVersionRequest.Version)
+}
+
+// restoreDocumentVersion makes an earlier version current again by adding a
+// new version with its file, so the history is kept
+func restoreDocumentVersion(w http.ResponseWriter, r *http.Request, documentID string, number int) {
+	document, ok := getVersionedDocument(w, r, documentID)
+	if !ok {
+		return
+	}
+
+	if number == currentVersion(document) {
+		WriteValidationError(w, r, []FieldError{{Field: "version", Message: "is already the current version"}})
+		return
+	}
+
+	version, ok := getVersion(w, r, document, number)
+	if !ok {
+		return
+	}
+
+	restored, err := RestoreDocumentVersion(document, version, RequestActor(r))
+	if err != nil {
+		writeVersionError(w, r, document.ID, err)
+		return
+	}
+
+	RecordAuditEvent(r, AuditVersionRestored, AuditEvent{
+		CaseID:     document.CaseID,
+		DocumentID: document.ID,
+		Details:    auditDetails("version", strconv.Itoa(restored.Version), "restored_from", strconv.Itoa(number)),
+	})
+
+	WriteSuccess(w, r, http.StatusOK, "Document version restored successfully", restored)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+// ErrVersionConflict is returned when another version was added to a
+// document at the same time
+var ErrVersionConflict = errors.New("document version changed")
+
+// Each version holds one reference to the blob of its file. A document that
+// was never revised has no version rows and holds the reference itself;
+// its first revision hands that reference to a row for version 1.
+
+func documentVersionID(documentID string, number int) string {
+	return fmt.Sprintf("%s#%d", documentID, number)
+}
+
+// currentVersion is the number of a document's current version
+func currentVersion(doc Document) int {
+	return max(doc.Version, 1)
+}
+
+// documentDateLayout is how time.Time.String formats the document date
+const documentDateLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// versionFromDocument describes the version a document holds now
+func versionFromDocument(doc Document) (DocumentVersion, error) {
+	key := S3KeyFromURL(doc.FileURL)
+	size, err := FileSizeInS3(key)
+	if err != nil {
+		return DocumentVersion{}, err
+	}
+
+	uploadedAt := doc.Date
+	if date, err := time.Parse(documentDateLayout, doc.Date); err == nil {
+		uploadedAt = date.UTC().Format(time.RFC3339)
+	}
+
+	return DocumentVersion{
+		ID:                    documentVersionID(doc.ID, currentVersion(doc)),
+		DocumentID:            doc.ID,
+		Number:                currentVersion(doc),
+		FileName:              doc.FileName,
+		Key:                   key,
+		Size:                  size,
+		SHA256:                doc.SHA256,
+		UploadedAt:            uploadedAt,
+		Relevancy:             doc.Relevancy,
+		RelevancyModelVersion: doc.RelevancyModelVersion,
+		RelevancyUpdatedAt:    doc.RelevancyUpdatedAt,
+	}, nil
+}
+
+// putDocumentVersion writes a version that must not exist yet
+func putDocumentVersion(version DocumentVersion) error {
+	av, err := dynamodbattribute.MarshalMap(version)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		ConditionExpression: aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id": aws.String("_id"),
+		},
+		Item:      av,
+		TableName: &DocumentVersionsTable,
+	})
+
+	return err
+}
+
+func deleteDocumentVersion(id string) error {
+	_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(id),
+			},
+		},
+		TableName: &DocumentVersionsTable,
+	})
+
+	return err
+}
+
+// ListDocumentVersions returns every version of a document, oldest first.
+// A document that was never revised has just the one it holds.
+func ListDocumentVersions(doc Document) ([]DocumentVersion, error) {
+	if doc.Version == 0 {
+		version, err := versionFromDocument(doc)
+		if err != nil {
+			return []DocumentVersion{}, err
+		}
+		return []DocumentVersion{version}, nil
+	}
+
+	versions, err := queryDocumentVersions(doc.ID)
+	if err != nil {
+		return []DocumentVersion{}, err
+	}
+
+	// the current version's scores are kept on the document until it is
+	// replaced
+	for i := range versions {
+		if versions[i].Number == doc.Version {
+			versions[i].Relevancy = doc.Relevancy
+			versions[i].RelevancyModelVersion = doc.RelevancyModelVersion
+			versions[i].RelevancyUpdatedAt = doc.RelevancyUpdatedAt
+		}
+	}
+
+	return versions, nil
+}
+
+func queryDocumentVersions(documentID string) ([]DocumentVersion, error) {
+	keyCond := expression.Key("document_id").Equal(expression.Value(documentID))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return []DocumentVersion{}, err
+	}
+
+	versions := []DocumentVersion{}
+	err = dynamo.QueryPages(&dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		IndexName:                 &VersionsByDocumentIndex,
+		TableName:                 &DocumentVersionsTable,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var version DocumentVersion
+			if err := dynamodbattribute.UnmarshalMap(item, &version); err != nil {
+				log.Printf("Error unmarshalling document version: %v", err)
+				continue
+			}
+			versions = append(versions, version)
+		}
+		return true
+	})
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Number < versions[j].Number
+	})
+
+	return versions, err
+}
+
+// GetDocumentVersion returns one version of a document, or an empty
+// DocumentVersion if it has no such version
+func GetDocumentVersion(doc Document, number int) (DocumentVersion, error) {
+	if doc.Version == 0 {
+		if number != 1 {
+			return DocumentVersion{}, nil
+		}
+		return versionFromDocument(doc)
+	}
+
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(documentVersionID(doc.ID, number)),
+			},
+		},
+		TableName: &DocumentVersionsTable,
+	})
+	if err != nil || result.Item == nil {
+		return DocumentVersion{}, err
+	}
+
+	var version DocumentVersion
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &version); err != nil {
+		return DocumentVersion{}, err
+	}
+
+	if number == doc.Version {
+		version.Relevancy = doc.Relevancy
+		version.RelevancyModelVersion = doc.RelevancyModelVersion
+		version.RelevancyUpdatedAt = doc.RelevancyUpdatedAt
+	}
+
+	return version, nil
+}
+
+// AddDocumentVersion makes version the document's current version and
+// returns the updated document. The caller has already taken the version's
+// blob reference and releases it if this fails. The document takes the
+// version's file, scores and duplicate status, and is marked as not stored
+// so its new content is processed again.
+func AddDocumentVersion(doc Document, version DocumentVersion) (Document, error) {
+	previous := currentVersion(doc)
+	version.ID = documentVersionID(doc.ID, previous+1)
+	version.DocumentID = doc.ID
+	version.Number = previous + 1
+	version.UploadedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if doc.Version == 0 {
+		first, err := versionFromDocument(doc)
+		if err != nil {
+			return Document{}, fmt.Errorf("failed to read current file, %v", err)
+		}
+		// a concurrent revision may have written it already
+		if err := putDocumentVersion(first); err != nil && !isConditionFailed(err) {
+			return Document{}, err
+		}
+	}
+
+	if err := putDocumentVersion(version); err != nil {
+		if isConditionFailed(err) {
+			return Document{}, ErrVersionConflict
+		}
+		return Document{}, err
+	}
+
+	updated := doc
+	updated.Version = version.Number
+	updated.FileName = version.FileName
+	updated.FileURL = fmt.Sprintf("https://%s.s3.amazonaws.com/%s", Bucket, version.Key)
+	updated.FileType = DocumentFileType(version.FileName)
+	updated.SHA256 = version.SHA256
+	updated.Stored = false
+	updated.ProcessingStatus = ProcessingPending
+	updated.ProcessingError, updated.ProcessedAt, updated.PageCount = "", "", 0
+	updated.OCRStatus, updated.OCRError, updated.OCRPageCount, updated.OCRConfidence = "", "", 0, 0
+	updated.Relevancy = version.Relevancy
+	updated.RelevancyModelVersion = version.RelevancyModelVersion
+	updated.RelevancyUpdatedAt = version.RelevancyUpdatedAt
+
+	// the new content is checked against the case's files again
+	updated.DuplicateOf, updated.DuplicateStatus = "", ""
+	if version.SHA256 != "" {
+		original, err := FindDocumentByHash(doc.CaseID, version.SHA256, doc.ID)
+		if err != nil {
+			deleteVersionAfterFailure(version.ID)
+			return Document{}, fmt.Errorf("failed to check for duplicates, %v", err)
+		}
+		if original.DuplicateOf != doc.ID {
+			markDuplicate(&updated, original, false)
+		}
+	}
+
+	set := expression.Set(expression.Name("version"), expression.Value(updated.Version)).
+		Set(expression.Name("file_name"), expression.Value(updated.FileName)).
+		Set(expression.Name("file_url"), expression.Value(updated.FileURL)).
+		Set(expression.Name("file_type"), expression.Value(updated.FileType)).
+		Set(expression.Name("stored"), expression.Value(false)).
+		Set(expression.Name("processing_status"), expression.Value(updated.ProcessingStatus)).
+		Remove(expression.Name("processing_error")).
+		Remove(expression.Name("processed_at")).
+		Remove(expression.Name("page_count")).
+		Remove(expression.Name("ocr_status")).
+		Remove(expression.Name("ocr_error")).
+		Remove(expression.Name("ocr_page_count")).
+		Remove(expression.Name("ocr_confidence")).
+		Set(expression.Name("relevancy"), expression.Value(updated.Relevancy))
+	optional := []struct{ name, value string }{
+		{"sha256", updated.SHA256},
+		{"relevancy_model_version", updated.RelevancyModelVersion},
+		{"relevancy_updated_at", updated.RelevancyUpdatedAt},
+		{"duplicate_of", updated.DuplicateOf},
+		{"duplicate_status", updated.DuplicateStatus},
+	}
+	for _, attr := range optional {
+		if attr.value != "" {
+			set = set.Set(expression.Name(attr.name), expression.Value(attr.value))
+		} else {
+			set = set.Remove(expression.Name(attr.name))
+		}
+	}
+
+	cond := expression.Name("version").AttributeNotExists()
+	if doc.Version != 0 {
+		cond = expression.Name("version").Equal(expression.Value(doc.Version))
+	}
+
+	expr, err := expression.NewBuilder().WithUpdate(set).WithCondition(cond).Build()
+	if err != nil {
+		deleteVersionAfterFailure(version.ID)
+		return Document{}, err
+	}
+
+	result, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(doc.ID),
+			},
+		},
+		ReturnValues:     aws.String(dynamodb.ReturnValueAllOld),
+		TableName:        &DocumentsTable,
+		UpdateExpression: expr.Update(),
+	})
+	if err != nil {
+		deleteVersionAfterFailure(version.ID)
+		if isConditionFailed(err) {
+			return Document{}, ErrVersionConflict
+		}
+		return Document{}, err
+	}
+
+	IndexNewVersion(updated)
+	QueueExtraction(updated)
+
+	var replaced Document
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &replaced); err != nil {
+		log.Printf("Error reading replaced version of document %s: %v", doc.ID, err)
+		return updated, nil
+	}
+	if err := keepVersionRelevancy(documentVersionID(doc.ID, previous), replaced); err != nil {
+		log.Printf("Error keeping relevancy of document %s version %d: %v", doc.ID, previous, err)
+	}
+
+	return updated, nil
+}
+
+// keepVersionRelevancy copies the scores a document had into the row of the
+// version it just replaced
+func keepVersionRelevancy(id string, doc Document) error {
+	set := expression.Set(expression.Name("relevancy"), expression.Value(doc.Relevancy))
+	if doc.RelevancyModelVersion != "" {
+		set = set.Set(expression.Name("relevancy_model_version"), expression.Value(doc.RelevancyModelVersion))
+	}
+	if doc.RelevancyUpdatedAt != "" {
+		set = set.Set(expression.Name("relevancy_updated_at"), expression.Value(doc.RelevancyUpdatedAt))
+	}
+
+	expr, err := expression.NewBuilder().WithUpdate(set).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(id),
+			},
+		},
+		TableName:        &DocumentVersionsTable,
+		UpdateExpression: expr.Update(),
+	})
+
+	return err
+}
+
+func deleteVersionAfterFailure(id string) {
+	if err := deleteDocumentVersion(id); err != nil {
+		log.Printf("Error deleting document version %s: %v", id, err)
+	}
+}
+
+// RestoreDocumentVersion makes a copy of an earlier version the document's
+// current version. The copy shares the earlier version's file and keeps its
+// scores.
+func RestoreDocumentVersion(doc Document, earlier DocumentVersion, restoredBy string) (Document, error) {
+	if earlier.SHA256 != "" {
+		if err := AcquireBlob(earlier.SHA256); err != nil {
+			return Document{}, fmt.Errorf("failed to share file, %v", err)
+		}
+	}
+
+	restored, err := AddDocumentVersion(doc, DocumentVersion{
+		FileName:              earlier.FileName,
+		Key:                   earlier.Key,
+		Size:                  earlier.Size,
+		SHA256:                earlier.SHA256,
+		UploadedBy:            restoredBy,
+		RestoredFrom:          earlier.Number,
+		Relevancy:             earlier.Relevancy,
+		RelevancyModelVersion: earlier.RelevancyModelVersion,
+		RelevancyUpdatedAt:    earlier.RelevancyUpdatedAt,
+	})
+	if err != nil && earlier.SHA256 != "" {
+		releaseBlobAfterFailure(earlier.SHA256)
+	}
+
+	return restored, err
+}
+
+// deleteDocumentVersions deletes the versions of a deleted document and
+// releases their blobs
+func deleteDocumentVersions(documentID string) error {
+	versions, err := queryDocumentVersions(documentID)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if err := deleteDocumentVersion(version.ID); err != nil {
+			return err
+		}
+		if version.SHA256 == "" {
+			continue
+		}
+		if err := ReleaseBlob(version.SHA256); err != nil {
+			log.Printf("Error releasing blob of document %s version %d: %v", documentID, version.Number, err)
+		}
+	}
+
+	return nil
+}
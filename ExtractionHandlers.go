@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+func GetDocumentTextHandler(w http.ResponseWriter, r *http.Request) {
+	var getTextRequest struct {
+		ID string `json:"_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &getTextRequest) {
+		return
+	}
+
+	getDocumentText(w, r, getTextRequest.ID)
+}
+
+func getDocumentText(w http.ResponseWriter, r *http.Request, documentID string) {
+	document, ok := getVersionedDocument(w, r, documentID)
+	if !ok {
+		return
+	}
+
+	if document.ProcessingStatus != ProcessingProcessed {
+		WriteError(w, r, http.StatusNotFound, CodeTextNotAvailable, "Document text is not available")
+		return
+	}
+
+	text, err := GetDocumentText(document)
+	if err != nil {
+		log.Printf("Error getting text of document %s: %v", document.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get document text")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Document text retrieved successfully", text)
+}
+
+func ExtractDocumentTextHandler(w http.ResponseWriter, r *http.Request) {
+	var extractTextRequest struct {
+		ID string `json:"_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &extractTextRequest) {
+		return
+	}
+
+	extractDocumentText(w, r, extractTextRequest.ID)
+}
+
+// extractDocumentText queues a document's text to be extracted again
+func extractDocumentText(w http.ResponseWriter, r *http.Request, documentID string) {
+	document, ok := getVersionedDocument(w, r, documentID)
+	if !ok {
+		return
+	}
+
+	if document.ProcessingStatus == ProcessingRunning {
+		WriteError(w, r, http.StatusConflict, CodeExtractionInProgress, "Document text is already being extracted")
+		return
+	}
+
+	queued, err := RequeueExtraction(document)
+	if err != nil {
+		if isConditionFailed(err) {
+			WriteError(w, r, http.StatusConflict, CodeVersionConflict, "The document changed while its text was being queued")
+			return
+		}
+		log.Printf("Error queueing extraction of document %s: %v", document.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to queue text extraction")
+		return
+	}
+
+	WriteSuccess(w, r, http.StatusAccepted, "Text extraction queued", queued)
+}
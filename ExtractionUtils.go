@@ -0,0 +1,837 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+// processing statuses of a document's text extraction
+const (
+	ProcessingPending     = "pending"
+	ProcessingRunning     = "processing"
+	ProcessingProcessed   = "processed"
+	ProcessingFailed      = "failed"
+	ProcessingUnsupported = "unsupported"
+)
+
+// ExtractedTextPrefix is the S3 prefix the extracted text of each document
+// version is stored under, as a DocumentText in JSON
+const ExtractedTextPrefix = "text/"
+
+var (
+	extractionQueue = make(chan Document, 1000)
+
+	// files larger than this are not read for text
+	maxExtractionBytes int64 = 100 << 20
+)
+
+func extractedTextKey(documentID string, version int) string {
+	return fmt.Sprintf("%s%s/%d.json", ExtractedTextPrefix, documentID, max(version, 1))
+}
+
+// QueueExtraction hands a document to the extraction workers. When the queue
+// is full the document stays pending until the next start or backfill.
+func QueueExtraction(doc Document) {
+	select {
+	case extractionQueue <- doc:
+	default:
+		log.Printf("Extraction queue full, document %s left pending", doc.ID)
+	}
+}
+
+// StartExtractionWorkers starts the workers that extract document text, and
+// queues the documents left pending or unfinished by the last run
+func StartExtractionWorkers(workers int) {
+	maxExtractionBytes = int64(envInt("EXTRACTION_MAX_MB", 100)) << 20
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for doc := range extractionQueue {
+				extractDocument(doc)
+			}
+		}()
+	}
+
+	go func() {
+		documents, err := DocumentsAwaitingExtraction(false)
+		if err != nil {
+			log.Printf("Error finding documents awaiting extraction: %v", err)
+		}
+		for _, doc := range documents {
+			extractionQueue <- doc
+		}
+	}()
+}
+
+// DocumentsAwaitingExtraction returns the documents that are pending or were
+// left processing. With unprocessed set it also returns documents that
+// have never been queued, such as those uploaded before extraction existed,
+// and those whose scans waited for an OCR engine, and marks them pending.
+func DocumentsAwaitingExtraction(unprocessed bool) ([]Document, error) {
+	filter := expression.Name("processing_status").In(expression.Value(ProcessingPending), expression.Value(ProcessingRunning))
+	if unprocessed {
+		filter = filter.Or(expression.Name("processing_status").AttributeNotExists()).
+			Or(expression.Name("ocr_status").Equal(expression.Value(OCRUnavailable)))
+	}
+	expr, err := expression.NewBuilder().WithFilter(filter).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var documents []Document
+	var scanErr error
+	err = dynamo.ScanPages(&dynamodb.ScanInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		TableName:                 &DocumentsTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var doc Document
+			if err := dynamodbattribute.UnmarshalMap(item, &doc); err != nil {
+				scanErr = err
+				return false
+			}
+			if doc.ProcessingStatus != ProcessingPending && doc.ProcessingStatus != ProcessingRunning {
+				if err := setProcessingStatus(doc, ProcessingPending); err != nil {
+					if isConditionFailed(err) {
+						continue
+					}
+					scanErr = err
+					return false
+				}
+				doc.ProcessingStatus = ProcessingPending
+			}
+			documents = append(documents, doc)
+		}
+		return true
+	})
+	if err != nil {
+		return documents, err
+	}
+
+	return documents, scanErr
+}
+
+// sameVersion is the condition that a document still exists with the
+// version it had when it was read
+func sameVersion(doc Document) expression.ConditionBuilder {
+	version := expression.Name("version").AttributeNotExists()
+	if doc.Version != 0 {
+		version = expression.Name("version").Equal(expression.Value(doc.Version))
+	}
+	return expression.Name("_id").AttributeExists().And(version)
+}
+
+// setProcessingStatus moves a document to a status on which extraction has
+// not yet produced anything
+func setProcessingStatus(doc Document, status string) error {
+	set := expression.Set(expression.Name("processing_status"), expression.Value(status)).
+		Remove(expression.Name("processing_error"))
+	cond := sameVersion(doc)
+	if status == ProcessingRunning {
+		cond = cond.And(expression.Name("processing_status").In(expression.Value(ProcessingPending), expression.Value(ProcessingRunning)))
+	}
+
+	return updateProcessing(doc.ID, set, cond)
+}
+
+func updateProcessing(documentID string, set expression.UpdateBuilder, cond expression.ConditionBuilder) error {
+	expr, err := expression.NewBuilder().WithUpdate(set).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(documentID),
+			},
+		},
+		TableName:        &DocumentsTable,
+		UpdateExpression: expr.Update(),
+	})
+	return err
+}
+
+// RequeueExtraction marks a document pending again and queues it, as after
+// an extractor is fixed or a failure is resolved
+func RequeueExtraction(doc Document) (Document, error) {
+	if err := setProcessingStatus(doc, ProcessingPending); err != nil {
+		return Document{}, err
+	}
+
+	doc.ProcessingStatus = ProcessingPending
+	doc.ProcessingError = ""
+	QueueExtraction(doc)
+	return doc, nil
+}
+
+// extractDocument extracts the text of a document's current version,
+// reading scanned pages and images by OCR. The document is claimed first,
+// and every update is conditional on the version so a revision uploaded
+// meanwhile is not overwritten with stale text.
+func extractDocument(doc Document) {
+	fileType := DocumentFileType(doc.FileName)
+	extract, ok := textExtractors[fileType]
+	if !ok && !ocrImageTypes[fileType] {
+		if err := setProcessingStatus(doc, ProcessingUnsupported); err != nil && !isConditionFailed(err) {
+			log.Printf("Error marking document %s unsupported: %v", doc.ID, err)
+		}
+		return
+	}
+
+	if err := setProcessingStatus(doc, ProcessingRunning); err != nil {
+		if !isConditionFailed(err) {
+			log.Printf("Error claiming document %s for extraction: %v", doc.ID, err)
+		}
+		return
+	}
+
+	pages, ocr, err := readDocumentPages(doc, fileType, extract)
+	if err == nil && ocrImageTypes[fileType] && ocr.status != OCRProcessed {
+		// an image has no text without OCR
+		err = ocr.err
+		if ocr.status == OCRUnavailable {
+			set := expression.Set(expression.Name("processing_status"), expression.Value(ProcessingUnsupported)).
+				Set(expression.Name("ocr_status"), expression.Value(OCRUnavailable)).
+				Remove(expression.Name("processing_error"))
+			if err := updateProcessing(doc.ID, set, sameVersion(doc)); err != nil && !isConditionFailed(err) {
+				log.Printf("Error marking document %s waiting for OCR: %v", doc.ID, err)
+			}
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Error extracting text of document %s: %v", doc.ID, err)
+		set := expression.Set(expression.Name("processing_status"), expression.Value(ProcessingFailed)).
+			Set(expression.Name("processing_error"), expression.Value(err.Error()))
+		if ocr.status != "" {
+			set = set.Set(expression.Name("ocr_status"), expression.Value(ocr.status))
+		}
+		if err := updateProcessing(doc.ID, set, sameVersion(doc)); err != nil && !isConditionFailed(err) {
+			log.Printf("Error marking extraction of document %s failed: %v", doc.ID, err)
+		}
+		return
+	}
+
+	text := DocumentText{
+		DocumentID:  doc.ID,
+		Version:     currentVersion(doc),
+		SHA256:      doc.SHA256,
+		ExtractedAt: time.Now().UTC().Format(time.RFC3339),
+		Pages:       pages,
+	}
+
+	body, err := json.Marshal(text)
+	if err != nil {
+		log.Printf("Error encoding text of document %s: %v", doc.ID, err)
+		return
+	}
+	if _, err := UploadFileToS3(extractedTextKey(doc.ID, text.Version), body); err != nil {
+		log.Printf("Error storing text of document %s: %v", doc.ID, err)
+		if err := setProcessingStatus(doc, ProcessingPending); err != nil && !isConditionFailed(err) {
+			log.Printf("Error returning document %s to pending: %v", doc.ID, err)
+		}
+		return
+	}
+
+	set := expression.Set(expression.Name("processing_status"), expression.Value(ProcessingProcessed)).
+		Set(expression.Name("stored"), expression.Value(true)).
+		Set(expression.Name("page_count"), expression.Value(len(pages))).
+		Set(expression.Name("processed_at"), expression.Value(text.ExtractedAt)).
+		Remove(expression.Name("processing_error"))
+	if ocr.err != nil {
+		log.Printf("Error reading scanned pages of document %s: %v", doc.ID, ocr.err)
+	}
+	set = setOCROutcome(set, ocr)
+	if err := updateProcessing(doc.ID, set, sameVersion(doc)); err != nil {
+		if !isConditionFailed(err) {
+			log.Printf("Error marking document %s processed: %v", doc.ID, err)
+		}
+		return
+	}
+
+	IndexDocumentText(doc, pages)
+	EmitDocumentWebhookEvent(WebhookDocumentProcessed, doc.ID)
+}
+
+// setOCROutcome adds the OCR attributes of a processed document to an
+// update, removing those left from an earlier run
+func setOCROutcome(set expression.UpdateBuilder, ocr ocrOutcome) expression.UpdateBuilder {
+	if ocr.status == "" {
+		return set.Remove(expression.Name("ocr_status")).
+			Remove(expression.Name("ocr_error")).
+			Remove(expression.Name("ocr_page_count")).
+			Remove(expression.Name("ocr_confidence"))
+	}
+
+	set = set.Set(expression.Name("ocr_status"), expression.Value(ocr.status))
+	if ocr.err != nil {
+		set = set.Set(expression.Name("ocr_error"), expression.Value(ocr.err.Error()))
+	} else {
+		set = set.Remove(expression.Name("ocr_error"))
+	}
+	if ocr.pages > 0 {
+		set = set.Set(expression.Name("ocr_page_count"), expression.Value(ocr.pages)).
+			Set(expression.Name("ocr_confidence"), expression.Value(ocr.confidence))
+	} else {
+		set = set.Remove(expression.Name("ocr_page_count")).
+			Remove(expression.Name("ocr_confidence"))
+	}
+	return set
+}
+
+// readDocumentPages downloads a document's file, runs its extractor and
+// reads any scanned pages by OCR. A panic on a malformed file fails the one
+// document rather than the worker.
+func readDocumentPages(doc Document, fileType string, extract func([]byte) ([]string, error)) (pages []DocumentPage, ocr ocrOutcome, err error) {
+	key := S3KeyFromURL(doc.FileURL)
+	size, err := FileSizeInS3(key)
+	if err != nil {
+		return nil, ocrOutcome{}, fmt.Errorf("failed to read file size, %v", err)
+	}
+	if size > maxExtractionBytes {
+		return nil, ocrOutcome{}, fmt.Errorf("file is larger than the %d MB extraction limit", maxExtractionBytes>>20)
+	}
+
+	file, err := DownloadFileFromS3(key)
+	if err != nil {
+		return nil, ocrOutcome{}, fmt.Errorf("failed to download file, %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxExtractionBytes))
+	if err != nil {
+		return nil, ocrOutcome{}, fmt.Errorf("failed to download file, %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			pages, ocr, err = nil, ocrOutcome{}, fmt.Errorf("malformed file, %v", r)
+		}
+	}()
+
+	if extract != nil {
+		texts, err := extract(data)
+		if err != nil {
+			return nil, ocrOutcome{}, err
+		}
+		for i, text := range texts {
+			pages = append(pages, DocumentPage{Number: i + 1, Text: text})
+		}
+	}
+
+	pages, ocr = recognizeScannedPages(fileType, data, pages)
+	return pages, ocr, nil
+}
+
+// GetDocumentText reads the extracted text of a document's current version.
+// It returns an empty DocumentText if the document has not been processed.
+func GetDocumentText(doc Document) (DocumentText, error) {
+	if doc.ProcessingStatus != ProcessingProcessed {
+		return DocumentText{}, nil
+	}
+
+	file, err := DownloadFileFromS3(extractedTextKey(doc.ID, currentVersion(doc)))
+	if err != nil {
+		return DocumentText{}, err
+	}
+	defer file.Close()
+
+	var text DocumentText
+	if err := json.NewDecoder(file).Decode(&text); err != nil {
+		return DocumentText{}, err
+	}
+	return text, nil
+}
+
+// deleteDocumentText removes the extracted text of every version of a
+// document
+func deleteDocumentText(documentID string, versions int) {
+	for version := 1; version <= max(versions, 1); version++ {
+		if err := DeleteFileFromS3(extractedTextKey(documentID, version)); err != nil {
+			log.Printf("Error deleting extracted text of document %s version %d: %v", documentID, version, err)
+		}
+	}
+}
+
+// textExtractors maps a document's file type to the function that splits
+// its file into the plain text of each page
+var textExtractors = map[string]func(data []byte) ([]string, error){
+	"pdf":  ExtractPDFText,
+	"docx": ExtractDOCXText,
+	"html": ExtractHTMLText,
+	"htm":  ExtractHTMLText,
+	"rtf":  ExtractRTFText,
+	"txt":  ExtractPlainText,
+	"csv":  ExtractPlainText,
+	"eml":  ExtractPlainText,
+}
+
+// windows1252High holds the characters Windows-1252 puts at 0x80 to 0x9F,
+// where Latin-1 has control codes
+var windows1252High = []rune("€\u0081‚ƒ„…†‡ˆ‰Š‹Œ\u008DŽ\u008F\u0090‘’“”•–—˜™š›œ\u009DžŸ")
+
+func decodeWindows1252(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		if c >= 0x80 && c <= 0x9F {
+			runes[i] = windows1252High[c-0x80]
+		} else {
+			runes[i] = rune(c)
+		}
+	}
+	return string(runes)
+}
+
+// decodeText reads UTF-8, falling back to Windows-1252 for older files
+func decodeText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return decodeWindows1252(data)
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+func collapseBlankLines(s string) string {
+	return blankLines.ReplaceAllString(s, "\n\n")
+}
+
+// ExtractPlainText splits a text file into pages at form feeds
+func ExtractPlainText(data []byte) ([]string, error) {
+	text := strings.ReplaceAll(decodeText(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	pages := strings.Split(text, "\f")
+	for i, page := range pages {
+		pages[i] = strings.TrimSpace(page)
+	}
+	return pages, nil
+}
+
+// htmlBlockTags start a new line in the extracted text
+var htmlBlockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true, "dd": true,
+	"div": true, "dl": true, "dt": true, "figcaption": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hr": true, "li": true, "main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "title": true, "tr": true, "ul": true,
+}
+
+// htmlSkippedTags have content that is not text
+var htmlSkippedTags = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "svg": true,
+}
+
+var (
+	htmlTagName   = regexp.MustCompile(`^</?\s*([a-zA-Z][a-zA-Z0-9]*)`)
+	htmlPageBreak = regexp.MustCompile(`(?i)(page-)?break-(before|after)\s*:\s*(always|page)`)
+	whitespaceRun = regexp.MustCompile(`[ \t\r\n\f]+`)
+)
+
+// ExtractHTMLText returns the visible text of an HTML file. CSS page breaks
+// set in style attributes split it into pages.
+func ExtractHTMLText(data []byte) ([]string, error) {
+	source := decodeText(data)
+	var pages []string
+	var page, line strings.Builder
+
+	flushLine := func() {
+		if text := strings.TrimSpace(html.UnescapeString(whitespaceRun.ReplaceAllString(line.String(), " "))); text != "" {
+			page.WriteString(text)
+			page.WriteByte('\n')
+		}
+		line.Reset()
+	}
+	flushPage := func() {
+		flushLine()
+		pages = append(pages, strings.TrimSpace(collapseBlankLines(page.String())))
+		page.Reset()
+	}
+
+	for i := 0; i < len(source); {
+		if source[i] != '<' {
+			next := strings.IndexByte(source[i:], '<')
+			if next < 0 {
+				next = len(source) - i
+			}
+			line.WriteString(source[i : i+next])
+			i += next
+			continue
+		}
+
+		if strings.HasPrefix(source[i:], "<!--") {
+			end := strings.Index(source[i:], "-->")
+			if end < 0 {
+				break
+			}
+			i += end + 3
+			continue
+		}
+
+		end := strings.IndexByte(source[i:], '>')
+		if end < 0 {
+			break
+		}
+		tag := source[i : i+end+1]
+		i += end + 1
+
+		m := htmlTagName.FindStringSubmatch(tag)
+		if m == nil {
+			continue
+		}
+		name := strings.ToLower(m[1])
+		closing := strings.HasPrefix(tag, "</")
+
+		if htmlSkippedTags[name] && !closing && !strings.HasSuffix(tag, "/>") {
+			close := strings.Index(strings.ToLower(source[i:]), "</"+name)
+			if close < 0 {
+				break
+			}
+			i += close
+			continue
+		}
+
+		breaks := htmlPageBreak.FindAllStringSubmatch(tag, -1)
+		for _, b := range breaks {
+			if strings.EqualFold(b[2], "before") && !closing {
+				flushPage()
+			}
+		}
+		if htmlBlockTags[name] {
+			flushLine()
+			if name == "p" && closing {
+				page.WriteByte('\n')
+			}
+		} else if name == "td" || name == "th" {
+			line.WriteByte(' ')
+		}
+		for _, b := range breaks {
+			if strings.EqualFold(b[2], "after") && !closing {
+				// the break follows the element, which is not tracked, so it
+				// is taken at its start
+				flushPage()
+			}
+		}
+	}
+	flushPage()
+
+	return pages, nil
+}
+
+// rtfSkippedDestinations hold formatting data rather than document text
+var rtfSkippedDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true, "pict": true,
+	"header": true, "headerl": true, "headerr": true, "headerf": true,
+	"footer": true, "footerl": true, "footerr": true, "footerf": true,
+	"object": true, "themedata": true, "colorschememapping": true, "datastore": true,
+	"latentstyles": true, "listtable": true, "listoverridetable": true, "rsidtbl": true,
+	"generator": true, "xmlnstbl": true, "mmathPr": true, "fldinst": true, "filetbl": true,
+	"revtbl": true, "bkmkstart": true, "bkmkend": true, "pgdsctbl": true, "operator": true,
+}
+
+var rtfSymbols = map[string]string{
+	"par": "\n", "line": "\n", "row": "\n", "cell": " ", "tab": "\t",
+	"emdash": "—", "endash": "–", "bullet": "•", "lquote": "‘",
+	"rquote": "’", "ldblquote": "“", "rdblquote": "”", "emspace": " ", "enspace": " ",
+}
+
+// ExtractRTFText returns the text of an RTF file, split into pages at its
+// explicit page breaks
+func ExtractRTFText(data []byte) ([]string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(`{\rtf`)) {
+		return nil, fmt.Errorf("not an RTF file")
+	}
+
+	type group struct {
+		skip      bool
+		skipChars int
+	}
+	stack := []group{{skipChars: 1}}
+	current := func() *group { return &stack[len(stack)-1] }
+
+	var pages []string
+	var page strings.Builder
+	var pendingBytes []byte
+	pendingSkip := 0
+
+	flushBytes := func() {
+		if len(pendingBytes) > 0 {
+			page.WriteString(decodeWindows1252(pendingBytes))
+			pendingBytes = pendingBytes[:0]
+		}
+	}
+	write := func(s string) {
+		flushBytes()
+		if !current().skip {
+			page.WriteString(s)
+		}
+	}
+	flushPage := func() {
+		flushBytes()
+		pages = append(pages, strings.TrimSpace(collapseBlankLines(page.String())))
+		page.Reset()
+	}
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch c {
+		case '{':
+			flushBytes()
+			stack = append(stack, *current())
+			i++
+			continue
+		case '}':
+			flushBytes()
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			i++
+			continue
+		case '\r', '\n':
+			i++
+			continue
+		case '\\':
+		default:
+			if pendingSkip > 0 {
+				pendingSkip--
+			} else if !current().skip {
+				pendingBytes = append(pendingBytes, c)
+			}
+			i++
+			continue
+		}
+
+		// a control word or symbol
+		i++
+		if i >= len(data) {
+			break
+		}
+		c = data[i]
+		switch {
+		case c == '\'':
+			if i+2 < len(data) {
+				var b [1]byte
+				if _, err := fmt.Sscanf(string(data[i+1:i+3]), "%02x", &b[0]); err == nil {
+					if pendingSkip > 0 {
+						pendingSkip--
+					} else if !current().skip {
+						pendingBytes = append(pendingBytes, b[0])
+					}
+				}
+			}
+			i += 3
+			continue
+		case c == '*':
+			// an ignorable destination, which this reader never understands
+			current().skip = true
+			i++
+			continue
+		case c == '~':
+			write(" ")
+			i++
+			continue
+		case c == '_':
+			write("-")
+			i++
+			continue
+		case c == '\r' || c == '\n':
+			write("\n")
+			i++
+			continue
+		case !unicode.IsLetter(rune(c)):
+			if pendingSkip > 0 {
+				pendingSkip--
+			} else {
+				write(string(c))
+			}
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(data) && ((data[i] >= 'a' && data[i] <= 'z') || (data[i] >= 'A' && data[i] <= 'Z')) {
+			i++
+		}
+		word := string(data[start:i])
+		param, hasParam := 0, false
+		numStart := i
+		if i < len(data) && data[i] == '-' {
+			i++
+		}
+		for i < len(data) && data[i] >= '0' && data[i] <= '9' {
+			i++
+			hasParam = true
+		}
+		if hasParam {
+			fmt.Sscanf(string(data[numStart:i]), "%d", &param)
+		} else {
+			i = numStart
+		}
+		if i < len(data) && data[i] == ' ' {
+			i++
+		}
+
+		switch {
+		case rtfSkippedDestinations[word]:
+			current().skip = true
+		case word == "uc" && hasParam:
+			current().skipChars = param
+		case word == "u" && hasParam:
+			if param < 0 {
+				param += 65536
+			}
+			write(string(rune(param)))
+			pendingSkip = current().skipChars
+		case word == "page" || word == "pagebb":
+			if !current().skip {
+				flushPage()
+			}
+		default:
+			if symbol, ok := rtfSymbols[word]; ok {
+				write(symbol)
+			}
+		}
+	}
+	flushPage()
+
+	return pages, nil
+}
+
+// endCell replaces the separators trailing text with sep
+func endCell(text *strings.Builder, trailing string, sep byte) {
+	trimmed := strings.TrimRight(text.String(), trailing)
+	text.Reset()
+	text.WriteString(trimmed)
+	text.WriteByte(sep)
+}
+
+// ExtractDOCXText returns the body text of a DOCX file. Pages break where
+// Word last laid them out, or at explicit page breaks for files Word never
+// saved.
+func ExtractDOCXText(data []byte) ([]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var document *zip.File
+	for _, f := range archive.File {
+		if f.Name == "word/document.xml" {
+			document = f
+		}
+	}
+	if document == nil {
+		return nil, fmt.Errorf("word/document.xml not found")
+	}
+
+	content, err := document.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	// text is gathered in segments split by each kind of page break, then
+	// joined on whichever kind the file has
+	type segment struct {
+		text     string
+		rendered bool
+	}
+	var segments []segment
+	var text strings.Builder
+	hasRendered := false
+	breakPage := func(rendered bool) {
+		segments = append(segments, segment{text: text.String(), rendered: rendered})
+		text.Reset()
+	}
+
+	decoder := xml.NewDecoder(content)
+	inText := false
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteByte('\t')
+			case "cr":
+				text.WriteByte('\n')
+			case "br":
+				isPage := false
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "type" && attr.Value == "page" {
+						isPage = true
+					}
+				}
+				if isPage {
+					breakPage(false)
+				} else {
+					text.WriteByte('\n')
+				}
+			case "lastRenderedPageBreak":
+				hasRendered = true
+				breakPage(true)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteByte('\n')
+			case "tc":
+				// cells are separated by tabs and rows by newlines
+				endCell(&text, "\n", '\t')
+			case "tr":
+				endCell(&text, "\t", '\n')
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+			}
+		}
+	}
+	breakPage(false)
+
+	var pages []string
+	var page strings.Builder
+	for i, s := range segments {
+		page.WriteString(s.text)
+		last := i == len(segments)-1
+		if last || s.rendered == hasRendered {
+			pages = append(pages, strings.TrimSpace(collapseBlankLines(page.String())))
+			page.Reset()
+		} else {
+			// a break of the other kind still ends the line
+			page.WriteByte('\n')
+		}
+	}
+
+	return pages, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExtractHTMLText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want []string
+	}{
+		{
+			name: "blocks and entities",
+			html: `<html><body><h1>Heading</h1><p>One &amp; <b>two</b><br>three</p><ul><li>a</li><li>b</li></ul></body></html>`,
+			want: []string{"Heading\nOne & two\nthree\n\na\nb"},
+		},
+		{
+			name: "scripts and styles are skipped",
+			html: `<style>p { color: red }</style><script>var x = "<p>hidden</p>"</script><p>shown</p>`,
+			want: []string{"shown"},
+		},
+		{
+			name: "css page breaks",
+			html: `<p>first</p><div style="page-break-before: always">second</div>`,
+			want: []string{"first", "second"},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ExtractHTMLText([]byte(test.html))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExtractRTFText(t *testing.T) {
+	tests := []struct {
+		name string
+		rtf  string
+		want []string
+	}{
+		{
+			name: "formatting and escapes",
+			rtf:  `{\rtf1\ansi{\fonttbl{\f0 Times;}}{\*\generator Writer;}\f0 Hello \b bold\b0  caf\'e9\par Second\tab line}`,
+			want: []string{"Hello bold café\nSecond\tline"},
+		},
+		{
+			name: "page breaks",
+			rtf:  `{\rtf1\ansi first\page second\page third}`,
+			want: []string{"first", "second", "third"},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ExtractRTFText([]byte(test.rtf))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExtractDOCXText(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{
+			name: "explicit page breaks",
+			body: `<w:p><w:r><w:t>First</w:t></w:r><w:r><w:tab/><w:t>page</w:t></w:r></w:p>` +
+				`<w:p><w:r><w:br w:type="page"/><w:t>Second</w:t></w:r></w:p>`,
+			want: []string{"First\tpage", "Second"},
+		},
+		{
+			name: "rendered page breaks win over explicit ones",
+			body: `<w:p><w:r><w:t>One</w:t><w:br w:type="page"/><w:t>still one</w:t></w:r></w:p>` +
+				`<w:p><w:r><w:lastRenderedPageBreak/><w:t>Two</w:t><w:br/><w:t>lines</w:t></w:r></w:p>`,
+			want: []string{"One\nstill one", "Two\nlines"},
+		},
+		{
+			name: "tables",
+			body: `<w:tbl><w:tr><w:tc><w:p><w:r><w:t>A</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>B</w:t></w:r></w:p></w:tc></w:tr>` +
+				`<w:tr><w:tc><w:p><w:r><w:t>C</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>D</w:t></w:r></w:p></w:tc></w:tr></w:tbl>`,
+			want: []string{"A\tB\nC\tD"},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ExtractDOCXText(docxFixture(t, test.body))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// docxFixture zips body into the smallest DOCX the extractor reads
+func docxFixture(t *testing.T, body string) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	w, err := archive.Create("word/document.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` + body + `</w:body></w:document>`))
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
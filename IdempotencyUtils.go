@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	idempotencyInProgress = "in_progress"
+	idempotencyCompleted  = "completed"
+
+	// responses larger than this are not stored, since DynamoDB items are
+	// limited to 400KB
+	maxIdempotentResponseSize = 300 << 10
+)
+
+// IdempotencyRecord is the stored outcome of the first request made with an
+// Idempotency-Key. ExpiresAt is the table's TTL attribute.
+type IdempotencyRecord struct {
+	Key         string `json:"_id"`
+	Fingerprint string `json:"fingerprint"`
+	State       string `json:"state"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+	CreatedAt   string `json:"created_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+// IdempotencyTTL is how long a key and its response are kept, set in hours
+// by IDEMPOTENCY_TTL_HOURS
+func IdempotencyTTL() time.Duration {
+	if v := os.Getenv("IDEMPOTENCY_TTL_HOURS"); v != "" {
+		hours, err := strconv.Atoi(v)
+		if err == nil && hours > 0 {
+			return time.Duration(hours) * time.Hour
+		}
+		log.Printf("Invalid IDEMPOTENCY_TTL_HOURS %q", v)
+	}
+	return 24 * time.Hour
+}
+
+// requestFingerprint hashes the method, path and body of a request.
+// Multipart bodies are hashed by their parts rather than their bytes, since
+// clients pick a new boundary on every retry.
+func requestFingerprint(r *http.Request, body io.Reader) string {
+	return fingerprint(r.Method, r.URL.Path, r.Header.Get("Content-Type"), body)
+}
+
+func fingerprint(method string, path string, contentType string, body io.Reader) string {
+	h := sha256.New()
+	io.WriteString(h, method+" "+path+"\n")
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		io.Copy(h, body)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	var parts []string
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		contentHash := sha256.New()
+		io.Copy(contentHash, part)
+		parts = append(parts, part.FormName()+"\x00"+part.FileName()+"\x00"+hex.EncodeToString(contentHash.Sum(nil)))
+	}
+	sort.Strings(parts)
+	io.WriteString(h, strings.Join(parts, "\n"))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// streamingFingerprint fingerprints a multipart body as the handler reads
+// it, so uploads are neither buffered nor spooled to disk first
+type streamingFingerprint struct {
+	body io.Reader
+	pw   *io.PipeWriter
+	done chan string
+}
+
+// fingerprintWhileReading replaces r.Body with a reader that feeds
+// everything the handler reads into requestFingerprint
+func fingerprintWhileReading(r *http.Request, body io.Reader) *streamingFingerprint {
+	pr, pw := io.Pipe()
+	f := &streamingFingerprint{pw: pw, done: make(chan string, 1)}
+	method, path, contentType := r.Method, r.URL.Path, r.Header.Get("Content-Type")
+	go func() {
+		sum := fingerprint(method, path, contentType, pr)
+		// a malformed body stops the parts early; keep reading so the
+		// handler's reads never block
+		io.Copy(io.Discard, pr)
+		f.done <- sum
+	}()
+
+	f.body = io.TeeReader(body, pw)
+	r.Body = io.NopCloser(f.body)
+	return f
+}
+
+// finish reads whatever the handler left of the body and returns the
+// fingerprint of the whole body, or an error if it could not be read
+func (f *streamingFingerprint) finish() (string, error) {
+	_, err := io.Copy(io.Discard, f.body)
+	if err != nil {
+		f.pw.CloseWithError(err)
+		<-f.done
+		return "", err
+	}
+	f.pw.Close()
+	return <-f.done, nil
+}
+
+// secretResponseFields are left out of stored responses, so a retry
+// replays the response without them
+var secretResponseFields = map[string]bool{"password": true, "secret": true, "token": true}
+
+// redactSecrets removes secretResponseFields from a JSON response body at
+// any depth. Bodies that are not JSON are returned unchanged.
+func redactSecrets(body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return body
+	}
+
+	redacted := false
+	var redact func(v interface{})
+	redact = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for field, child := range v {
+				if secretResponseFields[field] {
+					delete(v, field)
+					redacted = true
+					continue
+				}
+				redact(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				redact(child)
+			}
+		}
+	}
+	redact(value)
+	if !redacted {
+		return body
+	}
+
+	stored, err := json.Marshal(value)
+	if err != nil {
+		return body
+	}
+	return append(stored, '\n')
+}
+
+// claimIdempotencyKey stores an in-progress record for the key unless an
+// unexpired one exists, in which case it returns the existing record
+func claimIdempotencyKey(key string, fingerprint string) (IdempotencyRecord, bool, error) {
+	now := time.Now().UTC()
+	record := IdempotencyRecord{
+		Key:         key,
+		Fingerprint: fingerprint,
+		State:       idempotencyInProgress,
+		CreatedAt:   now.Format(time.RFC3339),
+		ExpiresAt:   now.Add(IdempotencyTTL()).Unix(),
+	}
+
+	av, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	// DynamoDB removes expired items lazily, so an expired record can be
+	// claimed again
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		ConditionExpression: aws.String("attribute_not_exists(#K) OR expires_at < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#K": aws.String("_id"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+		Item:      av,
+		TableName: &IdempotencyTable,
+	})
+	if err == nil {
+		return record, true, nil
+	}
+
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		return IdempotencyRecord{}, false, err
+	}
+
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(key),
+			},
+		},
+		TableName: &IdempotencyTable,
+	})
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	var existing IdempotencyRecord
+	err = dynamodbattribute.UnmarshalMap(result.Item, &existing)
+	return existing, false, err
+}
+
+func completeIdempotencyKey(record IdempotencyRecord) error {
+	record.State = idempotencyCompleted
+
+	av, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: &IdempotencyTable,
+	})
+
+	return err
+}
+
+func writeIdempotentBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		WriteError(w, r, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, "Request exceeds the upload limit")
+		return
+	}
+	WriteError(w, r, http.StatusBadRequest, CodeInvalidBody, "Failed to read request body")
+}
+
+func releaseIdempotencyKey(key string) error {
+	_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(key),
+			},
+		},
+		TableName: &IdempotencyTable,
+	})
+
+	return err
+}
+
+// DeleteIdempotencyRecords deletes the records of keys the user sent and the
+// stored responses that mention the user's ID or email, such as those of an
+// admin creating or updating them. It returns the number deleted.
+func DeleteIdempotencyRecords(user User) (int, error) {
+	var keys []string
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		ProjectionExpression: aws.String("#K, #B"),
+		ExpressionAttributeNames: map[string]*string{
+			"#K": aws.String("_id"),
+			"#B": aws.String("body"),
+		},
+		TableName: &IdempotencyTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var record IdempotencyRecord
+			if err := dynamodbattribute.UnmarshalMap(item, &record); err != nil {
+				log.Printf("Error unmarshalling idempotency record: %v", err)
+				continue
+			}
+			if strings.HasPrefix(record.Key, user.ID+":") ||
+				bytes.Contains(record.Body, []byte(user.ID)) ||
+				(user.Email != "" && bytes.Contains(record.Body, []byte(user.Email))) {
+				keys = append(keys, record.Key)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range keys {
+		if err := releaseIdempotencyKey(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// idempotencyRecorder keeps a copy of the response so it can be stored
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.body.Len()+len(b) > maxIdempotentResponseSize {
+		rec.overflow = true
+	} else {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Idempotent lets clients retry a creation route safely by sending an
+// Idempotency-Key header. The first response for a key is stored for
+// IdempotencyTTL, without secretResponseFields, and replayed for retries
+// with the same payload. A retry with a different payload, or one made
+// while the first request is still running, gets a 409. Requests without
+// the header are not affected.
+func Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			WriteValidationError(w, r, []FieldError{{Field: "Idempotency-Key", Message: "must be at most 255 characters"}})
+			return
+		}
+
+		// keys are scoped to the caller so clients cannot collide
+		scopedKey := RequestActor(r) + ":" + key
+		body := http.MaxBytesReader(w, r.Body, MaxUploadRequestSize)
+		multipartBody := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/")
+
+		// JSON bodies are small enough to fingerprint before the handler
+		// runs. Uploads are fingerprinted as they stream through it.
+		requestHash := ""
+		if !multipartBody {
+			content, err := io.ReadAll(body)
+			if err != nil {
+				writeIdempotentBodyError(w, r, err)
+				return
+			}
+			requestHash = requestFingerprint(r, bytes.NewReader(content))
+			r.Body = io.NopCloser(bytes.NewReader(content))
+		}
+
+		record, claimed, err := claimIdempotencyKey(scopedKey, requestHash)
+		if err != nil {
+			log.Printf("Error claiming idempotency key: %v", err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to check Idempotency-Key")
+			return
+		}
+
+		if !claimed {
+			// a retry of an upload is read through once to compare it
+			if multipartBody && record.State == idempotencyCompleted {
+				requestHash = requestFingerprint(r, body)
+			}
+
+			switch {
+			case record.State != idempotencyCompleted:
+				WriteError(w, r, http.StatusConflict, CodeRequestInProgress, "A request with this Idempotency-Key is still being processed")
+			case record.Fingerprint != requestHash:
+				WriteError(w, r, http.StatusConflict, CodeIdempotencyConflict, "Idempotency-Key was already used with a different request")
+			default:
+				w.Header().Set("Content-Type", record.ContentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.Status)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		var streaming *streamingFingerprint
+		if multipartBody {
+			streaming = fingerprintWhileReading(r, body)
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		var readErr error
+		if streaming != nil {
+			record.Fingerprint, readErr = streaming.finish()
+		}
+
+		// server errors, oversized responses and bodies that could not be
+		// read through are not kept, so the client can retry them
+		if rec.status >= http.StatusInternalServerError || rec.status == 0 || rec.overflow || readErr != nil {
+			if err := releaseIdempotencyKey(scopedKey); err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+			return
+		}
+
+		record.Status = rec.status
+		record.ContentType = rec.Header().Get("Content-Type")
+		record.Body = redactSecrets(rec.body.Bytes())
+		if err := completeIdempotencyKey(record); err != nil {
+			log.Printf("Error storing idempotent response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func multipartRequest(t *testing.T, files map[string]string) (*bytes.Buffer, string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("case_id", "c1")
+	for name, content := range files {
+		part, err := writer.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, content)
+	}
+	writer.Close()
+	return &body, writer.FormDataContentType()
+}
+
+func TestFingerprintWhileReadingMatchesWholeBody(t *testing.T) {
+	files := map[string]string{"a.txt": strings.Repeat("a", 1<<16), "b.txt": "bee"}
+	body, contentType := multipartRequest(t, files)
+	raw := body.Bytes()
+
+	want := httptest.NewRequest("POST", "/uploadDocuments", nil)
+	want.Header.Set("Content-Type", contentType)
+	wantHash := requestFingerprint(want, bytes.NewReader(raw))
+
+	// a retry picks a new boundary but sends the same parts
+	retryBody, retryType := multipartRequest(t, files)
+	retry := httptest.NewRequest("POST", "/uploadDocuments", nil)
+	retry.Header.Set("Content-Type", retryType)
+	if got := requestFingerprint(retry, retryBody); got != wantHash {
+		t.Errorf("retry fingerprint %s, want %s", got, wantHash)
+	}
+
+	// the handler may stop reading part way; finish reads the rest
+	for _, read := range []int{0, 100, len(raw)} {
+		r := httptest.NewRequest("POST", "/uploadDocuments", nil)
+		r.Header.Set("Content-Type", contentType)
+		source := bytes.NewReader(raw)
+		streaming := fingerprintWhileReading(r, source)
+		if _, err := io.CopyN(io.Discard, r.Body, int64(read)); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := streaming.finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != wantHash {
+			t.Errorf("after reading %d bytes fingerprint %s, want %s", read, got, wantHash)
+		}
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	body := []byte(`{"message":"Webhook created","object":{"_id":"w1","secret":"s3cret","events":[{"token":"t"}],"size":12345678901234567}}` + "\n")
+	got := string(redactSecrets(body))
+	for _, secret := range []string{"s3cret", `"token"`, `"secret"`} {
+		if strings.Contains(got, secret) {
+			t.Errorf("stored body %s still holds %s", got, secret)
+		}
+	}
+	if !strings.Contains(got, `"_id":"w1"`) || !strings.Contains(got, "12345678901234567") {
+		t.Errorf("stored body %s lost other fields", got)
+	}
+
+	plain := []byte(`{"message":"Case created","object":{"_id":"c1"}}`)
+	if got := redactSecrets(plain); !bytes.Equal(got, plain) {
+		t.Errorf("body without secrets changed to %s", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+var mailer Mailer
+
+// Mailer delivers account emails such as address verification links
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// LogMailer writes each message to the server log instead of sending it
+type LogMailer struct{}
+
+func (LogMailer) Send(to string, subject string, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// SMTPMailer sends plain text messages through an SMTP relay
+type SMTPMailer struct {
+	Address  string
+	From     string
+	Username string
+	Password string
+}
+
+func (m SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Address)
+		if err != nil {
+			return fmt.Errorf("failed to parse SMTP address, %v", err)
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	message := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(m.Address, auth, m.From, []string{to}, []byte(message)); err != nil {
+		return fmt.Errorf("failed to send email, %v", err)
+	}
+
+	return nil
+}
+
+// InitMailer returns an SMTP mailer when SMTP_ADDRESS is set and a mailer
+// that only logs otherwise
+func InitMailer() Mailer {
+	address := os.Getenv("SMTP_ADDRESS")
+	if address == "" {
+		log.Printf("SMTP_ADDRESS not set, emails will be logged")
+		return LogMailer{}
+	}
+
+	return SMTPMailer{
+		Address:  address,
+		From:     os.Getenv("SMTP_FROM"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+}
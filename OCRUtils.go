@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ocrEngine OCREngine
+
+// OCR statuses of a document
+const (
+	OCRProcessed   = "processed"
+	OCRFailed      = "failed"
+	OCRUnavailable = "unavailable"
+)
+
+// ocrImageTypes are the uploaded file types read entirely by OCR
+var ocrImageTypes = map[string]bool{
+	"png": true, "jpg": true, "jpeg": true, "gif": true,
+	"bmp": true, "webp": true, "tif": true, "tiff": true,
+}
+
+// scannedPageText is the fewest characters of text a PDF page needs for it
+// not to be taken as a scan, which may still carry a stamped page number
+const scannedPageText = 20
+
+// OCRPage is the text an engine read from one page of an image
+type OCRPage struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+}
+
+// OCREngine reads the text of scanned pages. An image may hold several
+// pages, as a multipage TIFF does.
+type OCREngine interface {
+	Recognize(image []byte) ([]OCRPage, error)
+}
+
+// FakeOCREngine returns the same text for every page it is given, for tests
+// and for development without an engine installed
+type FakeOCREngine struct {
+	Text       string
+	Confidence float64
+	Err        error
+}
+
+func (e FakeOCREngine) Recognize(image []byte) ([]OCRPage, error) {
+	if e.Err != nil {
+		return nil, e.Err
+	}
+	return []OCRPage{{Text: e.Text, Confidence: e.Confidence}}, nil
+}
+
+// TesseractEngine runs a locally installed tesseract on each image
+type TesseractEngine struct {
+	Path      string
+	Languages string
+	Timeout   time.Duration
+}
+
+func (e TesseractEngine) Recognize(image []byte) ([]OCRPage, error) {
+	input, err := os.CreateTemp("", "avalon-ocr-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file, %v", err)
+	}
+	defer os.Remove(input.Name())
+
+	if _, err := input.Write(image); err != nil {
+		input.Close()
+		return nil, fmt.Errorf("failed to write temporary file, %v", err)
+	}
+	if err := input.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write temporary file, %v", err)
+	}
+
+	ctx := context.Background()
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+
+	args := []string{input.Name(), "stdout"}
+	if e.Languages != "" {
+		args = append(args, "-l", e.Languages)
+	}
+	args = append(args, "tsv")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("tesseract timed out after %s", e.Timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tesseract failed, %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseTesseractTSV(out)
+}
+
+// parseTesseractTSV rebuilds page text from tesseract's TSV output, one row
+// per word with its page, block, paragraph and line. A page's confidence is
+// the mean of its words'.
+func parseTesseractTSV(out []byte) ([]OCRPage, error) {
+	type pageWords struct {
+		text       strings.Builder
+		confidence float64
+		words      int
+		line       string
+		block      string
+	}
+	var pages []*pageWords
+
+	for i, row := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimRight(row, "\r"), "\t")
+		if i == 0 || len(fields) < 12 {
+			continue
+		}
+
+		pageNumber, err := strconv.Atoi(fields[1])
+		if err != nil || pageNumber < 1 {
+			continue
+		}
+		for len(pages) < pageNumber {
+			pages = append(pages, &pageWords{})
+		}
+		page := pages[pageNumber-1]
+
+		word := strings.TrimSpace(fields[11])
+		confidence, err := strconv.ParseFloat(fields[10], 64)
+		if fields[0] != "5" || word == "" || err != nil || confidence < 0 {
+			continue
+		}
+
+		block := fields[2]
+		line := strings.Join(fields[2:5], ".")
+		switch {
+		case page.words == 0:
+		case block != page.block:
+			page.text.WriteString("\n\n")
+		case line != page.line:
+			page.text.WriteByte('\n')
+		default:
+			page.text.WriteByte(' ')
+		}
+		page.text.WriteString(word)
+		page.block, page.line = block, line
+		page.confidence += confidence
+		page.words++
+	}
+
+	if len(pages) == 0 {
+		return nil, errors.New("tesseract returned no pages")
+	}
+
+	result := make([]OCRPage, len(pages))
+	for i, page := range pages {
+		result[i].Text = page.text.String()
+		if page.words > 0 {
+			result[i].Confidence = page.confidence / float64(page.words)
+		}
+	}
+	return result, nil
+}
+
+// InitOCREngine returns the engine named by OCR_ENGINE: "tesseract", which
+// is the default when the binary is on the PATH, "fake", or "none". With no
+// engine scanned pages are marked unavailable until one is configured.
+func InitOCREngine() OCREngine {
+	name := os.Getenv("OCR_ENGINE")
+	switch name {
+	case "none":
+		return nil
+	case "fake":
+		return FakeOCREngine{Text: "OCR text", Confidence: 90}
+	case "", "tesseract":
+	default:
+		log.Printf("Unknown OCR_ENGINE %q, scanned documents will not be read", name)
+		return nil
+	}
+
+	path := os.Getenv("TESSERACT_PATH")
+	if path == "" {
+		var err error
+		if path, err = exec.LookPath("tesseract"); err != nil {
+			log.Printf("tesseract not found, scanned documents will not be read")
+			return nil
+		}
+	}
+
+	languages := os.Getenv("OCR_LANGUAGES")
+	if languages == "" {
+		languages = "eng"
+	}
+
+	return TesseractEngine{
+		Path:      path,
+		Languages: languages,
+		Timeout:   time.Duration(envInt("OCR_TIMEOUT_SECONDS", 120)) * time.Second,
+	}
+}
+
+// ocrOutcome sums up the OCR of a document's pages
+type ocrOutcome struct {
+	status     string
+	pages      int
+	confidence float64
+	err        error
+}
+
+// recognizeScannedPages reads by OCR an image upload, or the pages of a PDF
+// that carry too little text to have been typed. OCRed pages replace the
+// extracted ones.
+func recognizeScannedPages(fileType string, data []byte, pages []DocumentPage) ([]DocumentPage, ocrOutcome) {
+	var images map[int][]byte
+	var imageErr error
+	if ocrImageTypes[fileType] {
+		images = map[int][]byte{1: data}
+	} else if fileType == "pdf" {
+		var scanned []int
+		for _, page := range pages {
+			if countNonSpace(page.Text) < scannedPageText {
+				scanned = append(scanned, page.Number)
+			}
+		}
+		if len(scanned) == 0 {
+			return pages, ocrOutcome{}
+		}
+
+		images, imageErr = PDFPageImages(data, scanned)
+		if len(images) == 0 && imageErr != nil {
+			return pages, ocrOutcome{status: OCRFailed, err: imageErr}
+		}
+	}
+	if len(images) == 0 {
+		return pages, ocrOutcome{}
+	}
+
+	if ocrEngine == nil {
+		return pages, ocrOutcome{status: OCRUnavailable}
+	}
+
+	// pages whose images could not be read are reported with the rest
+	outcome := ocrOutcome{status: OCRProcessed, err: imageErr}
+	numbers := make([]int, 0, len(images))
+	for number := range images {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	for _, number := range numbers {
+		recognized, err := ocrEngine.Recognize(images[number])
+		if err != nil {
+			outcome.status = OCRFailed
+			outcome.err = fmt.Errorf("OCR of page %d failed, %v", number, err)
+			break
+		}
+
+		// an image upload takes as many pages as the engine read from it
+		if ocrImageTypes[fileType] {
+			pages = nil
+			for i, page := range recognized {
+				pages = append(pages, DocumentPage{Number: i + 1, Text: page.Text, OCR: true, Confidence: page.Confidence})
+				outcome.confidence += page.Confidence
+				outcome.pages++
+			}
+			continue
+		}
+
+		var text []string
+		confidence := 0.0
+		for _, page := range recognized {
+			text = append(text, page.Text)
+			confidence += page.Confidence
+		}
+		if len(recognized) > 0 {
+			confidence /= float64(len(recognized))
+		}
+		pages[number-1] = DocumentPage{Number: number, Text: strings.Join(text, "\n\n"), OCR: true, Confidence: confidence}
+		outcome.confidence += confidence
+		outcome.pages++
+	}
+
+	if outcome.pages > 0 {
+		outcome.confidence /= float64(outcome.pages)
+	}
+	return pages, outcome
+}
+
+func countNonSpace(s string) int {
+	n := 0
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// scannedTestPDF builds a two page PDF: the first page is typed text and
+// the second only a 2x2 grayscale image, as a scanner would produce
+func scannedTestPDF() []byte {
+	typed := "BT /F1 12 Tf 72 720 Td (This page was typed and carries plenty of text) Tj ET"
+	scan := "q 200 0 0 200 72 500 cm /Im0 Do Q"
+	pixels := "\x00\xff\xff\x00"
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 5 0 R >> >> /Contents 6 0 R >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /XObject << /Im0 7 0 R >> >> /Contents 8 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(typed), typed),
+		fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width 2 /Height 2 /ColorSpace /DeviceGray /BitsPerComponent 8 /Length %d >>\nstream\n%s\nendstream", len(pixels), pixels),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(scan), scan),
+	}
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
+
+func withOCREngine(t *testing.T, engine OCREngine) {
+	previous := ocrEngine
+	ocrEngine = engine
+	t.Cleanup(func() { ocrEngine = previous })
+}
+
+func extractTestPDF(t *testing.T, data []byte) []DocumentPage {
+	texts, err := ExtractPDFText(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pages []DocumentPage
+	for i, text := range texts {
+		pages = append(pages, DocumentPage{Number: i + 1, Text: text})
+	}
+	return pages
+}
+
+func TestRecognizeScannedPDFPage(t *testing.T) {
+	withOCREngine(t, FakeOCREngine{Text: "Scanned affidavit of service", Confidence: 87})
+
+	data := scannedTestPDF()
+	pages := extractTestPDF(t, data)
+	if len(pages) != 2 || !strings.Contains(pages[0].Text, "typed") || strings.TrimSpace(pages[1].Text) != "" {
+		t.Fatalf("extracted pages = %+v, want a typed page and an empty scan", pages)
+	}
+
+	images, err := PDFPageImages(data, []int{2})
+	if err != nil || !bytes.HasPrefix(images[2], []byte("\x89PNG")) {
+		t.Fatalf("PDFPageImages = %d bytes, %v, want a PNG of page 2", len(images[2]), err)
+	}
+
+	pages, outcome := recognizeScannedPages("pdf", data, pages)
+	if outcome.status != OCRProcessed || outcome.pages != 1 || outcome.confidence != 87 || outcome.err != nil {
+		t.Errorf("outcome = %+v, want one page processed at 87", outcome)
+	}
+	if pages[0].OCR || !strings.Contains(pages[0].Text, "typed") {
+		t.Errorf("typed page = %+v, want it left as extracted", pages[0])
+	}
+	want := DocumentPage{Number: 2, Text: "Scanned affidavit of service", OCR: true, Confidence: 87}
+	if pages[1] != want {
+		t.Errorf("scanned page = %+v, want %+v", pages[1], want)
+	}
+}
+
+func TestRecognizeScannedImage(t *testing.T) {
+	withOCREngine(t, FakeOCREngine{Text: "Photographed receipt", Confidence: 72})
+
+	pages, outcome := recognizeScannedPages("png", []byte("\x89PNG\r\n\x1a\n"), nil)
+	want := []DocumentPage{{Number: 1, Text: "Photographed receipt", OCR: true, Confidence: 72}}
+	if len(pages) != 1 || pages[0] != want[0] {
+		t.Errorf("pages = %+v, want %+v", pages, want)
+	}
+	if outcome.status != OCRProcessed || outcome.pages != 1 {
+		t.Errorf("outcome = %+v, want one page processed", outcome)
+	}
+}
+
+func TestRecognizeScannedPagesWithoutEngine(t *testing.T) {
+	data := scannedTestPDF()
+
+	withOCREngine(t, nil)
+	pages, outcome := recognizeScannedPages("pdf", data, extractTestPDF(t, data))
+	if outcome.status != OCRUnavailable || pages[1].OCR {
+		t.Errorf("without an engine: outcome = %+v, page = %+v, want unavailable", outcome, pages[1])
+	}
+
+	withOCREngine(t, FakeOCREngine{Err: errors.New("engine crashed")})
+	pages, outcome = recognizeScannedPages("pdf", data, extractTestPDF(t, data))
+	if outcome.status != OCRFailed || outcome.err == nil || pages[1].OCR {
+		t.Errorf("with a failing engine: outcome = %+v, page = %+v, want failed", outcome, pages[1])
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed openapi.json
+var openAPISpecJSON []byte
+
+var openAPISpec map[string]interface{}
+
+func LoadOpenAPISpec() error {
+	return json.Unmarshal(openAPISpecJSON, &openAPISpec)
+}
+
+func OpenAPISpecHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpecJSON)
+}
+
+// Router records the patterns registered on it so they can be checked
+// against the spec
+type Router struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func NewRouter() *Router {
+	return &Router{ServeMux: http.NewServeMux()}
+}
+
+func (router *Router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	router.patterns = append(router.patterns, pattern)
+	router.ServeMux.HandleFunc(pattern, handler)
+}
+
+func (router *Router) Patterns() []string {
+	return router.patterns
+}
+
+func specPaths() map[string]interface{} {
+	paths, _ := openAPISpec["paths"].(map[string]interface{})
+	return paths
+}
+
+// CheckSpecCoverage compares the registered routes with the operations in
+// the spec and describes every route that appears in only one of them
+func CheckSpecCoverage(patterns []string) []string {
+	registered := map[string]bool{}
+	var problems []string
+
+	for _, pattern := range patterns {
+		method, path, _ := strings.Cut(pattern, " ")
+		key := strings.ToLower(method) + " " + path
+		registered[key] = true
+
+		operations, _ := specPaths()[path].(map[string]interface{})
+		if _, ok := operations[strings.ToLower(method)]; !ok {
+			problems = append(problems, fmt.Sprintf("route %s is not in the spec", pattern))
+		}
+	}
+
+	for path, operations := range specPaths() {
+		for method := range operations.(map[string]interface{}) {
+			if !registered[method+" "+path] {
+				problems = append(problems, fmt.Sprintf("spec operation %s %s has no route", strings.ToUpper(method), path))
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// findOperation returns the spec operation matching a request, preferring
+// the path template with the most literal segments
+func findOperation(method string, path string) map[string]interface{} {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	var best map[string]interface{}
+	bestLiterals := -1
+
+	for template, operations := range specPaths() {
+		parts := strings.Split(strings.Trim(template, "/"), "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+
+		literals := 0
+		matched := true
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				if segments[i] == "" {
+					matched = false
+					break
+				}
+				continue
+			}
+			if part != segments[i] {
+				matched = false
+				break
+			}
+			literals++
+		}
+
+		if !matched || literals <= bestLiterals {
+			continue
+		}
+
+		operation, ok := operations.(map[string]interface{})[strings.ToLower(method)].(map[string]interface{})
+		if ok {
+			best = operation
+			bestLiterals = literals
+		}
+	}
+
+	return best
+}
+
+func jsonSchemaAt(node interface{}, keys ...string) map[string]interface{} {
+	for _, key := range keys {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[key]
+	}
+	schema, _ := node.(map[string]interface{})
+	return schema
+}
+
+func resolveSchema(schema map[string]interface{}) map[string]interface{} {
+	for {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema
+		}
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schema = jsonSchemaAt(openAPISpec, "components", "schemas", name)
+		if schema == nil {
+			return map[string]interface{}{}
+		}
+	}
+}
+
+// ValidateSchema checks a decoded JSON value against the subset of JSON
+// Schema used by openapi.json
+func ValidateSchema(schema map[string]interface{}, value interface{}, field string) []FieldError {
+	schema = resolveSchema(schema)
+	var errs []FieldError
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range allOf {
+			if sub, ok := s.(map[string]interface{}); ok {
+				errs = append(errs, ValidateSchema(sub, value, field)...)
+			}
+		}
+	}
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable || schema["type"] == nil {
+			return errs
+		}
+		return append(errs, FieldError{Field: field, Message: "must not be null"})
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, FieldError{Field: field, Message: "must be an object"})
+		}
+		errs = append(errs, validateObject(schema, obj, field)...)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(errs, FieldError{Field: field, Message: "must be an array"})
+		}
+		if itemSchema := jsonSchemaAt(schema, "items"); itemSchema != nil {
+			for i, item := range items {
+				errs = append(errs, ValidateSchema(itemSchema, item, fmt.Sprintf("%s[%d]", field, i))...)
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return append(errs, FieldError{Field: field, Message: "must be a string"})
+		}
+		if schema["format"] == "date-time" && s != "" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				errs = append(errs, FieldError{Field: field, Message: "must be an RFC 3339 timestamp"})
+			}
+		}
+		if minLength, ok := schema["minLength"].(float64); ok && float64(len(s)) < minLength {
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("must be at least %d characters", int(minLength))})
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return append(errs, FieldError{Field: field, Message: "must be a number"})
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return append(errs, FieldError{Field: field, Message: "must be an integer"})
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return append(errs, FieldError{Field: field, Message: "must be a boolean"})
+		}
+	case nil:
+		if obj, ok := value.(map[string]interface{}); ok {
+			errs = append(errs, validateObject(schema, obj, field)...)
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if e == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, FieldError{Field: field, Message: "is not an allowed value"})
+		}
+	}
+
+	return errs
+}
+
+func validateObject(schema map[string]interface{}, obj map[string]interface{}, field string) []FieldError {
+	var errs []FieldError
+	prefix := ""
+	if field != "" {
+		prefix = field + "."
+	}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, present := obj[name]; !present {
+				errs = append(errs, FieldError{Field: prefix + name, Message: "is required"})
+			}
+		}
+	}
+
+	properties := jsonSchemaAt(schema, "properties")
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if propSchema := jsonSchemaAt(properties, key); propSchema != nil {
+			errs = append(errs, ValidateSchema(propSchema, obj[key], prefix+key)...)
+			continue
+		}
+		if schema["type"] == nil {
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				errs = append(errs, FieldError{Field: prefix + key, Message: "is not a known field"})
+			}
+		case map[string]interface{}:
+			errs = append(errs, ValidateSchema(additional, obj[key], prefix+key)...)
+		}
+	}
+
+	return errs
+}
+
+func formatFieldErrors(errs []FieldError) string {
+	parts := make([]string, len(errs))
+	for i, e := range errs {
+		parts[i] = e.Field + " " + e.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ValidateRequestBody checks a JSON request body against its operation's
+// request schema. It returns nil for operations without a JSON body.
+func ValidateRequestBody(operation map[string]interface{}, body []byte) []FieldError {
+	schema := jsonSchemaAt(operation, "requestBody", "content", "application/json", "schema")
+	if schema == nil {
+		return nil
+	}
+
+	if required, _ := jsonSchemaAt(operation, "requestBody")["required"].(bool); !required && len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	// malformed JSON is left for the handler to report as invalid_json
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil
+	}
+
+	return ValidateSchema(schema, value, "")
+}
+
+// responseRecorder copies JSON responses so they can be checked against the
+// spec after the handler returns
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") && rec.body.Len() < 1<<20 {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func checkResponse(operation map[string]interface{}, r *http.Request, rec *responseRecorder) {
+	for _, problem := range responseDrift(operation, rec.status, rec.body.Bytes()) {
+		log.Printf("OpenAPI drift: %s %s %s", r.Method, r.URL.Path, problem)
+	}
+}
+
+// responseDrift lists the ways a JSON response differs from what the
+// operation documents for its status
+func responseDrift(operation map[string]interface{}, status int, body []byte) []string {
+	if len(body) == 0 {
+		return nil
+	}
+
+	schema := jsonSchemaAt(operation, "responses", fmt.Sprint(status), "content", "application/json", "schema")
+	if schema == nil {
+		return []string{fmt.Sprintf("returned undocumented status %d", status)}
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return []string{fmt.Sprintf("returned invalid JSON: %v", err)}
+	}
+
+	if errs := ValidateSchema(schema, value, ""); len(errs) > 0 {
+		return []string{fmt.Sprintf("%d response: %s", status, formatFieldErrors(errs))}
+	}
+	return nil
+}
+
+// MaxJSONRequestSize caps the JSON bodies ValidateRequests reads.
+// MAX_JSON_REQUEST_SIZE overrides it.
+var MaxJSONRequestSize int64 = 10 << 20
+
+// ValidateRequests rejects JSON bodies that do not match the spec. When
+// OPENAPI_VALIDATE_RESPONSES is set it also logs responses that drift from
+// the spec.
+func ValidateRequests(next http.Handler) http.Handler {
+	checkResponses := os.Getenv("OPENAPI_VALIDATE_RESPONSES") == "true"
+	maxBody := int64(envInt("MAX_JSON_REQUEST_SIZE", int(MaxJSONRequestSize)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation := findOperation(r.Method, r.URL.Path)
+		if operation == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// only JSON bodies are read here; uploads are left to stream
+		if jsonSchemaAt(operation, "requestBody", "content", "application/json", "schema") != nil {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				WriteError(w, r, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, "Request body is too large")
+				return
+			}
+			if err != nil {
+				WriteError(w, r, http.StatusBadRequest, CodeInvalidBody, "Failed to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			if errs := ValidateRequestBody(operation, body); len(errs) > 0 {
+				WriteValidationError(w, r, errs)
+				return
+			}
+		}
+
+		if !checkResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		checkResponse(operation, r, rec)
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutesMatchSpec(t *testing.T) {
+	for _, problem := range CheckSpecCoverage(Routes().Patterns()) {
+		t.Error(problem)
+	}
+}
+
+func TestValidateRequestsLimitsJSONBodies(t *testing.T) {
+	t.Setenv("MAX_JSON_REQUEST_SIZE", "64")
+
+	called := false
+	handler := ValidateRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	body := `{"email":"a@example.com","password":"` + strings.Repeat("x", 128) + `"}`
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/login", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body returned %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if called {
+		t.Error("oversized body reached the handler")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/login", strings.NewReader(`{"email":"a@example.com","password":"x"}`)))
+	if !called {
+		t.Errorf("small body was rejected with %d", rec.Code)
+	}
+}
+
+// serveJSON runs a request through the routes and middleware the server
+// uses and fails the test when the response drifts from the spec
+func serveJSON(t *testing.T, handler http.Handler, method, path, token string, body interface{}) (int, Response) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	return serveRequest(t, handler, httptest.NewRequest(method, path, reader), token)
+}
+
+func serveRequest(t *testing.T, handler http.Handler, r *http.Request, token string) (int, Response) {
+	t.Helper()
+
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	operation := findOperation(r.Method, r.URL.Path)
+	if operation == nil {
+		t.Fatalf("%s %s is not in the spec", r.Method, r.URL.Path)
+	}
+	for _, problem := range responseDrift(operation, rec.Code, rec.Body.Bytes()) {
+		t.Errorf("%s %s %s", r.Method, r.URL.Path, problem)
+	}
+
+	var response Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s returned %d with a body that is not JSON: %q", r.Method, r.URL.Path, rec.Code, rec.Body.String())
+	}
+	return rec.Code, response
+}
+
+func TestHandlerResponsesMatchSpec(t *testing.T) {
+	t.Setenv("SESSION_SIGNING_KEY", "secret")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	useFakeAWS(t)
+	handler := WithRequestID(ValidateRequests(Routes()))
+
+	status, response := serveJSON(t, handler, "POST", "/v1/users", "", User{
+		Email: "ada@example.com", Password: "correct horse", FirstName: "Ada", LastName: "Lovelace",
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("create user returned %d: %s", status, response.Message)
+	}
+
+	status, _ = serveJSON(t, handler, "POST", "/v1/sessions", "", LoginUser{Email: "ada@example.com", Password: "wrong"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login with the wrong password returned %d", status)
+	}
+
+	status, response = serveJSON(t, handler, "POST", "/v1/sessions", "", LoginUser{Email: "ada@example.com", Password: "correct horse"})
+	if status != http.StatusOK {
+		t.Fatalf("login returned %d: %s", status, response.Message)
+	}
+	userID := response.Object.(map[string]interface{})["_id"].(string)
+	token := response.Object.(map[string]interface{})["token"].(string)
+
+	status, response = serveJSON(t, handler, "POST", "/v1/cases", token, Case{
+		CaseTitle: "Smith v. Jones", AttorneyFirstName: "Ada", AttorneyLastName: "Lovelace",
+		CaseInfo: "Contract dispute", CaseType: "civil", City: "Boston", Date: "2024-03-01",
+		JudgeName: "Judge Judy", State: "MA", UserID: userID,
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("create case returned %d: %s %v", status, response.Message, response.Errors)
+	}
+	caseID := response.Object.(map[string]interface{})["_id"].(string)
+
+	status, response = serveJSON(t, handler, "POST", "/v1/cases", token, map[string]interface{}{"case_title": 7})
+	if status != http.StatusBadRequest || len(response.Errors) == 0 {
+		t.Errorf("create case with a bad body returned %d with errors %v", status, response.Errors)
+	}
+
+	for _, path := range []string{
+		"/v1/users/" + userID,
+		"/v1/users/" + userID + "/cases",
+		"/v1/cases/" + caseID,
+		"/v1/cases/" + caseID + "/history",
+		"/v1/cases/" + caseID + "/documents",
+		"/v1/cases/" + caseID + "/chat",
+		"/v1/webhooks?owner_type=user&owner_id=" + userID,
+	} {
+		if status, response = serveJSON(t, handler, "GET", path, token, nil); status != http.StatusOK {
+			t.Errorf("GET %s returned %d: %s", path, status, response.Message)
+		}
+	}
+
+	if status, _ = serveJSON(t, handler, "GET", "/v1/cases/missing", token, nil); status != http.StatusNotFound {
+		t.Errorf("missing case returned %d", status)
+	}
+	if status, _ = serveJSON(t, handler, "GET", "/v1/documents/missing", token, nil); status != http.StatusNotFound {
+		t.Errorf("missing document returned %d", status)
+	}
+	if status, _ = serveJSON(t, handler, "GET", "/v1/webhooks?owner_type=user&owner_id="+userID, "", nil); status != http.StatusForbidden {
+		t.Errorf("webhooks without a session returned %d", status)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("case_id", caseID)
+	part, _ := form.CreateFormFile("file", "notes.txt")
+	part.Write([]byte("the witness was at home"))
+	form.Close()
+	r := httptest.NewRequest("POST", "/uploadDocument", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if status, response = serveRequest(t, handler, r, token); status != http.StatusOK {
+		t.Errorf("upload returned %d: %s", status, response.Message)
+	}
+
+	body.Reset()
+	form = multipart.NewWriter(&body)
+	part, _ = form.CreateFormFile("files[]", "notes.txt")
+	part.Write([]byte("the witness was at home"))
+	form.Close()
+	r = httptest.NewRequest("POST", "/v1/cases/"+caseID+"/documents", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if status, response = serveRequest(t, handler, r, token); status != http.StatusCreated {
+		t.Errorf("create documents returned %d: %s", status, response.Message)
+	}
+
+	status, response = serveJSON(t, handler, "GET", "/v1/cases/"+caseID+"/documents", token, nil)
+	documents, _ := response.Object.([]interface{})
+	if status != http.StatusOK || len(documents) != 1 {
+		t.Fatalf("case documents returned %d with %d documents", status, len(documents))
+	}
+	documentID := documents[0].(map[string]interface{})["_id"].(string)
+	for _, path := range []string{
+		"/v1/documents/" + documentID,
+		"/v1/documents/" + documentID + "/versions",
+	} {
+		if status, response = serveJSON(t, handler, "GET", path, token, nil); status != http.StatusOK {
+			t.Errorf("GET %s returned %d: %s", path, status, response.Message)
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/v1/admin/audit-events", nil)
+	r.Header.Set("X-Admin-Token", "admin-secret")
+	if status, response = serveRequest(t, handler, r, ""); status != http.StatusOK {
+		t.Errorf("audit log returned %d: %s", status, response.Message)
+	}
+	r = httptest.NewRequest("GET", "/v1/admin/audit-events?start=yesterday", nil)
+	r.Header.Set("X-Admin-Token", "admin-secret")
+	if status, _ = serveRequest(t, handler, r, ""); status != http.StatusBadRequest {
+		t.Errorf("audit log with a bad start returned %d", status)
+	}
+	if status, _ = serveJSON(t, handler, "GET", "/v1/admin/audit-events", token, nil); status != http.StatusForbidden {
+		t.Errorf("audit log without the admin token returned %d", status)
+	}
+
+	status, response = serveJSON(t, handler, "DELETE", "/v1/cases/"+caseID, token, nil)
+	if status != http.StatusOK {
+		t.Errorf("delete case returned %d: %s", status, response.Message)
+	}
+}
+
+func TestResponseDriftReportsMismatches(t *testing.T) {
+	operation := findOperation("POST", "/v1/cases")
+
+	if problems := responseDrift(operation, http.StatusTeapot, []byte(`{"message":"short and stout","status":418}`)); len(problems) != 1 {
+		t.Errorf("undocumented status gave %v", problems)
+	}
+	if problems := responseDrift(operation, http.StatusCreated, []byte(`{"message":"Case created","status":201,"object":{"_id":7}}`)); len(problems) != 1 {
+		t.Errorf("wrongly typed case gave %v", problems)
+	}
+	if problems := responseDrift(operation, http.StatusCreated, nil); len(problems) != 0 {
+		t.Errorf("empty body gave %v", problems)
+	}
+}
@@ -0,0 +1,1400 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// A small PDF reader for text extraction. Objects are found by scanning for
+// "N G obj" instead of trusting the cross-reference table, which is often
+// damaged in files produced by scanners and older tools, and object
+// streams are unpacked so newer files read the same way.
+
+type pdfName string
+
+type pdfKeyword string
+
+type pdfRef struct {
+	num int
+	gen int
+}
+
+type pdfDict map[string]interface{}
+
+type pdfStream struct {
+	dict pdfDict
+	raw  []byte
+}
+
+// maxPDFStreamSize bounds each decompressed stream
+const maxPDFStreamSize = 64 << 20
+
+var errPDFEncrypted = errors.New("encrypted PDF files are not supported")
+
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		switch {
+		case isPDFSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// token returns the next number, string, name or keyword. Delimiters such
+// as "[" and "<<" are returned as keywords.
+func (l *pdfLexer) token() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, io.EOF
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '(':
+		return l.literalString(), nil
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		return pdfKeyword("<<"), nil
+	case c == '>' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+		l.pos += 2
+		return pdfKeyword(">>"), nil
+	case c == '<':
+		return l.hexString(), nil
+	case c == '/':
+		return l.name(), nil
+	case c == '[' || c == ']' || c == '{' || c == '}':
+		l.pos++
+		return pdfKeyword(c), nil
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	if l.pos == start {
+		// a stray delimiter such as ")" or ">"
+		l.pos++
+		return pdfKeyword(l.data[start:l.pos]), nil
+	}
+
+	word := string(l.data[start:l.pos])
+	if strings.IndexFunc(word, func(r rune) bool { return !strings.ContainsRune("+-.0123456789", r) }) < 0 {
+		if n, err := strconv.ParseFloat(word, 64); err == nil {
+			return n, nil
+		}
+	}
+	return pdfKeyword(word), nil
+}
+
+func (l *pdfLexer) literalString() []byte {
+	l.pos++
+	var out []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return out
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					n := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						n = n*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(n)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func (l *pdfLexer) hexString() []byte {
+	l.pos++
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	hex.Decode(out, digits)
+	return out
+}
+
+func (l *pdfLexer) name() pdfName {
+	l.pos++
+	var out []byte
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		c := l.data[l.pos]
+		if c == '#' && l.pos+2 < len(l.data) {
+			if b, err := hex.DecodeString(string(l.data[l.pos+1 : l.pos+3])); err == nil {
+				out = append(out, b[0])
+				l.pos += 3
+				continue
+			}
+		}
+		out = append(out, c)
+		l.pos++
+	}
+	return pdfName(out)
+}
+
+// object reads one complete object: arrays and dictionaries are read whole
+// and "N G R" becomes a pdfRef. Other keywords are returned as they are.
+func (l *pdfLexer) object() (interface{}, error) {
+	tok, err := l.token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case pdfKeyword:
+		switch t {
+		case "[":
+			var array []interface{}
+			for {
+				l.skipSpace()
+				if l.pos < len(l.data) && l.data[l.pos] == ']' {
+					l.pos++
+					return array, nil
+				}
+				v, err := l.object()
+				if err != nil {
+					return array, err
+				}
+				array = append(array, v)
+			}
+		case "<<":
+			dict := pdfDict{}
+			for {
+				key, err := l.token()
+				if err != nil {
+					return dict, err
+				}
+				if key == pdfKeyword(">>") {
+					return dict, nil
+				}
+				name, ok := key.(pdfName)
+				if !ok {
+					continue
+				}
+				v, err := l.object()
+				if err != nil {
+					return dict, err
+				}
+				dict[string(name)] = v
+			}
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	case float64:
+		save := l.pos
+		if gen, err := l.token(); err == nil {
+			if g, ok := gen.(float64); ok {
+				if r, err := l.token(); err == nil && r == pdfKeyword("R") {
+					return pdfRef{num: int(t), gen: int(g)}, nil
+				}
+			}
+		}
+		l.pos = save
+	}
+
+	return tok, nil
+}
+
+type pdfFile struct {
+	data      []byte
+	offsets   map[int]int
+	objects   map[int]interface{}
+	resolving map[int]bool
+	trailers  []pdfDict
+}
+
+var (
+	pdfObjectHeader   = regexp.MustCompile(`(\d+)[ \t\r\n\f\x00]+(\d+)[ \t\r\n\f\x00]+obj\b`)
+	pdfInlineImageEnd = regexp.MustCompile(`[ \t\r\n\f\x00]EI([ \t\r\n\f\x00]|$)`)
+)
+
+// openPDF indexes the objects of a PDF file
+func openPDF(data []byte) (*pdfFile, error) {
+	if !bytes.Contains(data[:min(len(data), 1024)], []byte("%PDF-")) {
+		return nil, errors.New("not a PDF file")
+	}
+
+	f := &pdfFile{
+		data:      data,
+		offsets:   map[int]int{},
+		objects:   map[int]interface{}{},
+		resolving: map[int]bool{},
+	}
+
+	// later definitions win, as incremental updates are appended
+	for _, m := range pdfObjectHeader.FindAllSubmatchIndex(data, -1) {
+		if m[0] > 0 && !isPDFSpace(data[m[0]-1]) {
+			continue
+		}
+		num, err := strconv.Atoi(string(data[m[2]:m[3]]))
+		if err != nil {
+			continue
+		}
+		f.offsets[num] = m[1]
+	}
+
+	for i := 0; ; {
+		idx := bytes.Index(data[i:], []byte("trailer"))
+		if idx < 0 {
+			break
+		}
+		l := &pdfLexer{data: data, pos: i + idx + len("trailer")}
+		if dict, ok := nextObject(l).(pdfDict); ok {
+			f.trailers = append(f.trailers, dict)
+		}
+		i += idx + len("trailer")
+	}
+
+	nums := make([]int, 0, len(f.offsets))
+	for num := range f.offsets {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	// cross-reference streams stand in for trailers, and object streams hold
+	// objects that have no header of their own
+	for _, num := range nums {
+		stream, ok := f.object(num).(*pdfStream)
+		if !ok {
+			continue
+		}
+		switch stream.dict["Type"] {
+		case pdfName("XRef"):
+			f.trailers = append(f.trailers, stream.dict)
+		case pdfName("ObjStm"):
+			f.loadObjectStream(stream)
+		}
+	}
+
+	for _, trailer := range f.trailers {
+		if trailer["Encrypt"] != nil {
+			return nil, errPDFEncrypted
+		}
+	}
+
+	return f, nil
+}
+
+func nextObject(l *pdfLexer) interface{} {
+	v, _ := l.object()
+	return v
+}
+
+// object returns an object by number, or nil if there is none
+func (f *pdfFile) object(num int) interface{} {
+	if v, ok := f.objects[num]; ok {
+		return v
+	}
+	offset, ok := f.offsets[num]
+	if !ok || f.resolving[num] {
+		return nil
+	}
+
+	f.resolving[num] = true
+	v := f.parseAt(offset)
+	delete(f.resolving, num)
+
+	f.objects[num] = v
+	return v
+}
+
+func (f *pdfFile) parseAt(offset int) interface{} {
+	l := &pdfLexer{data: f.data, pos: offset}
+	v := nextObject(l)
+
+	dict, ok := v.(pdfDict)
+	if !ok {
+		return v
+	}
+	if tok, err := l.token(); err != nil || tok != pdfKeyword("stream") {
+		return dict
+	}
+
+	start := l.pos
+	if start < len(f.data) && f.data[start] == '\r' {
+		start++
+	}
+	if start < len(f.data) && f.data[start] == '\n' {
+		start++
+	}
+
+	end := -1
+	if length, ok := f.resolve(dict["Length"]).(float64); ok && length >= 0 {
+		end = start + int(length)
+		if end > len(f.data) || !bytes.HasPrefix(bytes.TrimLeft(f.data[end:min(end+32, len(f.data))], " \t\r\n\f\x00"), []byte("endstream")) {
+			end = -1
+		}
+	}
+	if end < 0 {
+		idx := bytes.Index(f.data[start:], []byte("endstream"))
+		if idx < 0 {
+			end = len(f.data)
+		} else {
+			end = start + idx
+			for end > start && (f.data[end-1] == '\n' || f.data[end-1] == '\r') {
+				end--
+			}
+		}
+	}
+
+	return &pdfStream{dict: dict, raw: f.data[start:end]}
+}
+
+func (f *pdfFile) loadObjectStream(stream *pdfStream) {
+	data, err := decodePDFStream(f, stream)
+	if err != nil {
+		return
+	}
+
+	n, _ := f.resolve(stream.dict["N"]).(float64)
+	first, _ := f.resolve(stream.dict["First"]).(float64)
+	header := &pdfLexer{data: data}
+	for i := 0; i < int(n); i++ {
+		num, _ := nextObject(header).(float64)
+		offset, _ := nextObject(header).(float64)
+		if _, ok := f.offsets[int(num)]; ok {
+			continue
+		}
+		if pos := int(first) + int(offset); pos >= 0 && pos < len(data) {
+			f.objects[int(num)] = nextObject(&pdfLexer{data: data, pos: pos})
+		}
+	}
+}
+
+// resolve follows a reference, returning other values as they are
+func (f *pdfFile) resolve(v interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = f.object(ref.num)
+	}
+	return nil
+}
+
+func (f *pdfFile) dict(v interface{}) pdfDict {
+	switch d := f.resolve(v).(type) {
+	case pdfDict:
+		return d
+	case *pdfStream:
+		return d.dict
+	}
+	return nil
+}
+
+func (f *pdfFile) array(v interface{}) []interface{} {
+	a, _ := f.resolve(v).([]interface{})
+	return a
+}
+
+// decodePDFStream applies a stream's filters
+func decodePDFStream(f *pdfFile, stream *pdfStream) ([]byte, error) {
+	filters := []interface{}{f.resolve(stream.dict["Filter"])}
+	params := []interface{}{f.resolve(stream.dict["DecodeParms"])}
+	if a, ok := filters[0].([]interface{}); ok {
+		filters = a
+		params, _ = params[0].([]interface{})
+	}
+
+	data := stream.raw
+	for i, filter := range filters {
+		var param pdfDict
+		if i < len(params) {
+			param = f.dict(params[i])
+		}
+
+		var err error
+		switch f.resolve(filter) {
+		case nil:
+			continue
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			data, err = inflatePDF(data)
+			if err == nil && param != nil {
+				data, err = unpredictPDF(data, param)
+			}
+		case pdfName("ASCIIHexDecode"), pdfName("AHx"):
+			l := &pdfLexer{data: append([]byte{'<'}, data...)}
+			data = l.hexString()
+		case pdfName("ASCII85Decode"), pdfName("A85"):
+			data, err = decodeASCII85PDF(data)
+		default:
+			return nil, fmt.Errorf("unsupported filter %v", filter)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+func inflatePDF(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	out, err := io.ReadAll(io.LimitReader(reader, maxPDFStreamSize))
+	// streams cut short by a bad length still give their text
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	return out, nil
+}
+
+// unpredictPDF reverses the PNG predictors used on object and cross
+// reference streams
+func unpredictPDF(data []byte, params pdfDict) ([]byte, error) {
+	predictor, _ := params["Predictor"].(float64)
+	if predictor < 10 {
+		return data, nil
+	}
+
+	columns := 1
+	if c, ok := params["Columns"].(float64); ok && c > 0 {
+		columns = int(c)
+	}
+	colors := 1
+	if c, ok := params["Colors"].(float64); ok && c > 0 {
+		colors = int(c)
+	}
+	bits := 8
+	if b, ok := params["BitsPerComponent"].(float64); ok && b > 0 {
+		bits = int(b)
+	}
+	bpp := max(1, colors*bits/8)
+	rowSize := (columns*colors*bits + 7) / 8
+
+	var out []byte
+	prev := make([]byte, rowSize)
+	for len(data) >= rowSize+1 {
+		kind, row := data[0], append([]byte(nil), data[1:rowSize+1]...)
+		data = data[rowSize+1:]
+		for i := range row {
+			var left, up, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			up = prev[i]
+			switch kind {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				p := int(left) + int(up) - int(upLeft)
+				pa, pb, pc := abs(p-int(left)), abs(p-int(up)), abs(p-int(upLeft))
+				switch {
+				case pa <= pb && pa <= pc:
+					row[i] += left
+				case pb <= pc:
+					row[i] += up
+				default:
+					row[i] += upLeft
+				}
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+
+	return out, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func decodeASCII85PDF(data []byte) ([]byte, error) {
+	var out []byte
+	var group []byte
+	flush := func(n int) {
+		for len(group) < 5 {
+			group = append(group, 'u')
+		}
+		var v uint32
+		for _, c := range group {
+			v = v*85 + uint32(c-'!')
+		}
+		b := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+		out = append(out, b[:n]...)
+		group = group[:0]
+	}
+
+	for _, c := range data {
+		switch {
+		case c == '~':
+			if len(group) > 0 {
+				flush(len(group) - 1)
+			}
+			return out, nil
+		case c == 'z' && len(group) == 0:
+			out = append(out, 0, 0, 0, 0)
+		case c >= '!' && c <= 'u':
+			group = append(group, c)
+			if len(group) == 5 {
+				flush(4)
+			}
+		case isPDFSpace(c):
+		default:
+			return nil, errors.New("invalid ASCII85 data")
+		}
+	}
+
+	return out, nil
+}
+
+// pdfPage is a page dictionary with the resources it inherits
+type pdfPage struct {
+	dict      pdfDict
+	resources pdfDict
+}
+
+// pages returns the pages in document order
+func (f *pdfFile) pages() []pdfPage {
+	var root pdfDict
+	for i := len(f.trailers) - 1; i >= 0 && root == nil; i-- {
+		root = f.dict(f.trailers[i]["Root"])
+	}
+
+	var pages []pdfPage
+	seen := map[interface{}]bool{}
+	var walk func(node interface{}, resources pdfDict, depth int)
+	walk = func(node interface{}, resources pdfDict, depth int) {
+		if ref, ok := node.(pdfRef); ok {
+			if seen[ref] {
+				return
+			}
+			seen[ref] = true
+		}
+		dict := f.dict(node)
+		if dict == nil || depth > 64 {
+			return
+		}
+		if r := f.dict(dict["Resources"]); r != nil {
+			resources = r
+		}
+		if kids := f.array(dict["Kids"]); dict["Type"] == pdfName("Pages") || kids != nil {
+			for _, kid := range kids {
+				walk(kid, resources, depth+1)
+			}
+			return
+		}
+		pages = append(pages, pdfPage{dict: dict, resources: resources})
+	}
+	if root != nil {
+		walk(root["Pages"], nil, 0)
+	}
+	if len(pages) > 0 {
+		return pages
+	}
+
+	// without a usable page tree, take the page objects in number order
+	nums := make([]int, 0, len(f.offsets)+len(f.objects))
+	for num := range f.offsets {
+		nums = append(nums, num)
+	}
+	for num := range f.objects {
+		if _, ok := f.offsets[num]; !ok {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		if dict := f.dict(pdfRef{num: num}); dict != nil && dict["Type"] == pdfName("Page") {
+			pages = append(pages, pdfPage{dict: dict, resources: f.dict(dict["Resources"])})
+		}
+	}
+	return pages
+}
+
+// contents joins a page's content streams
+func (f *pdfFile) contents(page pdfDict) []byte {
+	var parts []interface{}
+	switch c := f.resolve(page["Contents"]).(type) {
+	case *pdfStream:
+		parts = []interface{}{c}
+	case []interface{}:
+		parts = c
+	}
+
+	var out []byte
+	for _, part := range parts {
+		stream, ok := f.resolve(part).(*pdfStream)
+		if !ok {
+			continue
+		}
+		data, err := decodePDFStream(f, stream)
+		if err != nil {
+			continue
+		}
+		out = append(out, data...)
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// ExtractPDFText returns the text of each page of a PDF. Pages drawn only
+// as images come back empty.
+func ExtractPDFText(data []byte) ([]string, error) {
+	f, err := openPDF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := f.pages()
+	if len(pages) == 0 {
+		return nil, errors.New("no pages found")
+	}
+
+	texts := make([]string, len(pages))
+	for i, page := range pages {
+		w := &pdfTextWriter{file: f, fonts: map[interface{}]*pdfFont{}}
+		w.run(f.contents(page.dict), page.resources, 0)
+		texts[i] = w.String()
+	}
+	return texts, nil
+}
+
+// pdfTextWriter follows the text operators of a content stream, starting a
+// new line when the text moves up or down the page
+type pdfTextWriter struct {
+	file  *pdfFile
+	fonts map[interface{}]*pdfFont
+	out   strings.Builder
+
+	font     *pdfFont
+	fontSize float64
+	leading  float64
+	scale    float64
+	y        float64
+	shownY   float64
+	shown    bool
+	space    bool
+}
+
+func (w *pdfTextWriter) String() string {
+	lines := strings.Split(w.out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(collapseBlankLines(strings.Join(lines, "\n")))
+}
+
+func (w *pdfTextWriter) show(s []byte) {
+	decoded := decodeWindows1252(s)
+	if w.font != nil {
+		decoded = w.font.decode(s)
+	}
+	if decoded == "" {
+		return
+	}
+
+	threshold := math.Max(1, 0.5*w.fontSize*math.Abs(w.scale))
+	if w.shown && math.Abs(w.y-w.shownY) > threshold {
+		w.out.WriteByte('\n')
+	} else if w.shown && w.space && !w.endsWithSpace() {
+		w.out.WriteByte(' ')
+	}
+	w.out.WriteString(decoded)
+	w.shownY = w.y
+	w.shown = true
+	w.space = false
+}
+
+func (w *pdfTextWriter) endsWithSpace() bool {
+	s := w.out.String()
+	return s == "" || strings.HasSuffix(s, " ") || strings.HasSuffix(s, "\n")
+}
+
+func pdfNumber(operands []interface{}, i int) float64 {
+	if i < len(operands) {
+		if n, ok := operands[i].(float64); ok {
+			return n
+		}
+	}
+	return 0
+}
+
+// run interprets a content stream with the given resources. Form XObjects
+// are followed into, up to a few levels deep.
+func (w *pdfTextWriter) run(content []byte, resources pdfDict, depth int) {
+	l := &pdfLexer{data: content}
+	var operands []interface{}
+
+	for {
+		v, err := l.object()
+		if err != nil {
+			return
+		}
+		op, ok := v.(pdfKeyword)
+		if !ok {
+			operands = append(operands, v)
+			continue
+		}
+
+		switch op {
+		case "BT":
+			w.y, w.scale = 0, 1
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[0].(pdfName); ok {
+					w.font = w.loadFont(resources, name)
+				}
+			}
+			w.fontSize = pdfNumber(operands, 1)
+		case "TL":
+			w.leading = pdfNumber(operands, 0)
+		case "Td", "TD":
+			ty := pdfNumber(operands, 1)
+			w.y += ty * w.scale
+			if op == "TD" {
+				w.leading = -ty
+			}
+			if ty == 0 {
+				w.space = true
+			}
+		case "Tm":
+			w.scale = pdfNumber(operands, 3)
+			if w.scale == 0 {
+				w.scale = 1
+			}
+			w.y = pdfNumber(operands, 5)
+			w.space = true
+		case "T*":
+			w.y -= w.leading * w.scale
+		case "Tj":
+			if s, ok := lastOperand(operands).([]byte); ok {
+				w.show(s)
+			}
+		case "'", "\"":
+			w.y -= w.leading * w.scale
+			if s, ok := lastOperand(operands).([]byte); ok {
+				w.show(s)
+			}
+		case "TJ":
+			array, _ := lastOperand(operands).([]interface{})
+			for _, item := range array {
+				switch item := item.(type) {
+				case []byte:
+					w.show(item)
+				case float64:
+					// a wide negative adjustment is a word gap
+					if item < -200 {
+						w.space = true
+					}
+				}
+			}
+		case "Do":
+			if name, ok := lastOperand(operands).(pdfName); ok && depth < 8 {
+				w.runForm(resources, name, depth)
+			}
+		case "ID":
+			// skip inline image data up to EI
+			idx := pdfInlineImageEnd.FindIndex(content[l.pos:])
+			if idx == nil {
+				return
+			}
+			l.pos += idx[1]
+		}
+		operands = operands[:0]
+	}
+}
+
+func lastOperand(operands []interface{}) interface{} {
+	if len(operands) == 0 {
+		return nil
+	}
+	return operands[len(operands)-1]
+}
+
+func (w *pdfTextWriter) runForm(resources pdfDict, name pdfName, depth int) {
+	xobjects := w.file.dict(resources["XObject"])
+	stream, ok := w.file.resolve(xobjects[string(name)]).(*pdfStream)
+	if !ok || stream.dict["Subtype"] != pdfName("Form") {
+		return
+	}
+
+	content, err := decodePDFStream(w.file, stream)
+	if err != nil {
+		return
+	}
+
+	formResources := w.file.dict(stream.dict["Resources"])
+	if formResources == nil {
+		formResources = resources
+	}
+	w.run(content, formResources, depth+1)
+}
+
+func (w *pdfTextWriter) loadFont(resources pdfDict, name pdfName) *pdfFont {
+	ref := w.file.dict(resources["Font"])[string(name)]
+	key := interface{}(ref)
+	if _, ok := ref.(pdfRef); !ok {
+		key = string(name)
+	}
+	if font, ok := w.fonts[key]; ok {
+		return font
+	}
+
+	font := newPDFFont(w.file, w.file.dict(ref))
+	w.fonts[key] = font
+	return font
+}
+
+// pdfFont turns the character codes of a font into text, through its
+// ToUnicode map when it has one and its encoding otherwise
+type pdfFont struct {
+	codeLength int
+	toUnicode  map[string]string
+	encoding   [256]string
+	composite  bool
+}
+
+func newPDFFont(f *pdfFile, dict pdfDict) *pdfFont {
+	font := &pdfFont{codeLength: 1}
+	for i := range font.encoding {
+		font.encoding[i] = decodeWindows1252([]byte{byte(i)})
+	}
+	if dict == nil {
+		return font
+	}
+
+	if dict["Subtype"] == pdfName("Type0") {
+		font.composite = true
+		font.codeLength = 2
+	}
+
+	if stream, ok := f.resolve(dict["ToUnicode"]).(*pdfStream); ok {
+		if data, err := decodePDFStream(f, stream); err == nil {
+			font.parseCMap(data)
+		}
+	}
+
+	if encoding := f.dict(dict["Encoding"]); encoding != nil {
+		code := 0
+		for _, item := range f.array(encoding["Differences"]) {
+			switch item := f.resolve(item).(type) {
+			case float64:
+				code = int(item)
+			case pdfName:
+				if code >= 0 && code < 256 {
+					if text, ok := pdfGlyphText(string(item)); ok {
+						font.encoding[code] = text
+					}
+				}
+				code++
+			}
+		}
+	}
+
+	return font
+}
+
+func (font *pdfFont) parseCMap(data []byte) {
+	font.toUnicode = map[string]string{}
+	l := &pdfLexer{data: data}
+
+	utf16Text := func(b []byte) string {
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		return string(utf16.Decode(units))
+	}
+
+	for {
+		tok, err := l.object()
+		if err != nil {
+			return
+		}
+		switch tok {
+		case pdfKeyword("begincodespacerange"):
+			if lo, ok := nextObject(l).([]byte); ok && len(lo) > 0 {
+				font.codeLength = len(lo)
+			}
+		case pdfKeyword("beginbfchar"):
+			for {
+				src, ok := nextObject(l).([]byte)
+				if !ok {
+					break
+				}
+				if dst, ok := nextObject(l).([]byte); ok {
+					font.toUnicode[string(src)] = utf16Text(dst)
+				}
+			}
+		case pdfKeyword("beginbfrange"):
+			for {
+				lo, ok := nextObject(l).([]byte)
+				if !ok {
+					break
+				}
+				hi, _ := nextObject(l).([]byte)
+				dst := nextObject(l)
+				if len(hi) != len(lo) || len(lo) > 4 {
+					continue
+				}
+
+				start, end := bytesToUint(lo), bytesToUint(hi)
+				if end < start || end-start > 0xFFFF {
+					continue
+				}
+				for code := start; code <= end; code++ {
+					src := string(uintToBytes(code, len(lo)))
+					switch dst := dst.(type) {
+					case []byte:
+						if len(dst) < 2 {
+							continue
+						}
+						// the last unit counts up through the range
+						next := append([]byte(nil), dst...)
+						last := bytesToUint(next[len(next)-2:]) + (code - start)
+						next[len(next)-2], next[len(next)-1] = byte(last>>8), byte(last)
+						font.toUnicode[src] = utf16Text(next)
+					case []interface{}:
+						if i := int(code - start); i < len(dst) {
+							if b, ok := dst[i].([]byte); ok {
+								font.toUnicode[src] = utf16Text(b)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func bytesToUint(b []byte) uint32 {
+	var n uint32
+	for _, c := range b {
+		n = n<<8 | uint32(c)
+	}
+	return n
+}
+
+func uintToBytes(n uint32, length int) []byte {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	return b
+}
+
+func (font *pdfFont) decode(s []byte) string {
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		n := min(font.codeLength, len(s)-i)
+		code := s[i : i+n]
+		if text, ok := font.toUnicode[string(code)]; ok {
+			out.WriteString(text)
+		} else if text, ok := font.toUnicode[string(s[i:i+1])]; ok && n > 1 {
+			out.WriteString(text)
+			n = 1
+		} else if !font.composite {
+			out.WriteString(font.encoding[s[i]])
+			n = 1
+		}
+		i += n
+	}
+	return out.String()
+}
+
+// pdfGlyphs maps the Adobe glyph names of the Latin character set to text
+var pdfGlyphs = func() map[string]string {
+	glyphs := map[string]string{}
+
+	ascii := strings.Fields("space exclam quotedbl numbersign dollar percent ampersand quotesingle parenleft parenright asterisk plus comma hyphen period slash zero one two three four five six seven eight nine colon semicolon less equal greater question at")
+	for i, name := range ascii {
+		glyphs[name] = string(rune(' ' + i))
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		glyphs[string(c)] = string(c)
+		glyphs[string(c+'a'-'A')] = string(c + 'a' - 'A')
+	}
+	for i, name := range strings.Fields("bracketleft backslash bracketright asciicircum underscore grave") {
+		glyphs[name] = string(rune('[' + i))
+	}
+	for i, name := range strings.Fields("braceleft bar braceright asciitilde") {
+		glyphs[name] = string(rune('{' + i))
+	}
+
+	latin1 := strings.Fields("nbspace exclamdown cent sterling currency yen brokenbar section dieresis copyright ordfeminine guillemotleft logicalnot sfthyphen registered macron degree plusminus twosuperior threesuperior acute mu paragraph periodcentered cedilla onesuperior ordmasculine guillemotright onequarter onehalf threequarters questiondown Agrave Aacute Acircumflex Atilde Adieresis Aring AE Ccedilla Egrave Eacute Ecircumflex Edieresis Igrave Iacute Icircumflex Idieresis Eth Ntilde Ograve Oacute Ocircumflex Otilde Odieresis multiply Oslash Ugrave Uacute Ucircumflex Udieresis Yacute Thorn germandbls agrave aacute acircumflex atilde adieresis aring ae ccedilla egrave eacute ecircumflex edieresis igrave iacute icircumflex idieresis eth ntilde ograve oacute ocircumflex otilde odieresis divide oslash ugrave uacute ucircumflex udieresis yacute thorn ydieresis")
+	for i, name := range latin1 {
+		glyphs[name] = string(rune(0xA0 + i))
+	}
+
+	for name, text := range map[string]string{
+		"quoteleft": "‘", "quoteright": "’", "quotedblleft": "“", "quotedblright": "”",
+		"quotesinglbase": "‚", "quotedblbase": "„", "guilsinglleft": "‹", "guilsinglright": "›",
+		"bullet": "•", "endash": "–", "emdash": "—", "ellipsis": "…", "minus": "−",
+		"dagger": "†", "daggerdbl": "‡", "trademark": "™", "perthousand": "‰", "fraction": "⁄",
+		"Euro": "€", "florin": "ƒ", "OE": "Œ", "oe": "œ", "Scaron": "Š", "scaron": "š",
+		"Zcaron": "Ž", "zcaron": "ž", "Ydieresis": "Ÿ", "Lslash": "Ł", "lslash": "ł",
+		"dotlessi": "ı", "circumflex": "ˆ", "tilde": "˜", "caron": "ˇ", "ring": "˚",
+		"breve": "˘", "dotaccent": "˙", "hungarumlaut": "˝", "ogonek": "˛",
+		"fi": "fi", "fl": "fl", "ff": "ff", "ffi": "ffi", "ffl": "ffl",
+	} {
+		glyphs[name] = text
+	}
+
+	return glyphs
+}()
+
+// pdfGlyphText returns the text of a glyph name, including the uniXXXX and
+// uXXXX forms and names with a variant suffix such as "a.sc"
+func pdfGlyphText(name string) (string, bool) {
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	if text, ok := pdfGlyphs[name]; ok {
+		return text, true
+	}
+
+	hexDigits := ""
+	switch {
+	case strings.HasPrefix(name, "uni") && len(name) >= 7:
+		hexDigits = name[3:7]
+	case strings.HasPrefix(name, "u") && len(name) >= 5 && len(name) <= 7:
+		hexDigits = name[1:]
+	}
+	if hexDigits != "" {
+		if n, err := strconv.ParseUint(hexDigits, 16, 32); err == nil {
+			return string(rune(n)), true
+		}
+	}
+
+	return "", false
+}
+
+// PDFPageImages returns the largest image on each of the given pages,
+// numbered from 1, as JPEG or PNG data an OCR engine can read. Pages with
+// no image are left out, and so are those whose image is in an unsupported
+// encoding, which the error names.
+func PDFPageImages(data []byte, numbers []int) (map[int][]byte, error) {
+	f, err := openPDF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := f.pages()
+	images := map[int][]byte{}
+	var firstErr error
+	for _, n := range numbers {
+		if n < 1 || n > len(pages) {
+			continue
+		}
+		stream := f.largestImage(pages[n-1].resources, 0)
+		if stream == nil {
+			continue
+		}
+		image, err := encodePDFImage(f, stream)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("page %d, %v", n, err)
+			}
+			continue
+		}
+		images[n] = image
+	}
+	return images, firstErr
+}
+
+// largestImage finds the image XObject with the most pixels in a set of
+// resources, looking inside form XObjects
+func (f *pdfFile) largestImage(resources pdfDict, depth int) *pdfStream {
+	var best *pdfStream
+	bestArea := 0.0
+	for _, v := range f.dict(resources["XObject"]) {
+		stream, ok := f.resolve(v).(*pdfStream)
+		if !ok {
+			continue
+		}
+
+		candidate := stream
+		switch stream.dict["Subtype"] {
+		case pdfName("Image"):
+		case pdfName("Form"):
+			if depth >= 4 {
+				continue
+			}
+			if candidate = f.largestImage(f.dict(stream.dict["Resources"]), depth+1); candidate == nil {
+				continue
+			}
+		default:
+			continue
+		}
+
+		width, _ := f.resolve(candidate.dict["Width"]).(float64)
+		height, _ := f.resolve(candidate.dict["Height"]).(float64)
+		if area := width * height; area > bestArea {
+			best, bestArea = candidate, area
+		}
+	}
+	return best
+}
+
+// encodePDFImage turns an image XObject into a file: JPEG and JPEG 2000 data
+// is passed through and raw pixels are encoded as PNG
+func encodePDFImage(f *pdfFile, stream *pdfStream) ([]byte, error) {
+	var filters []pdfName
+	switch filter := f.resolve(stream.dict["Filter"]).(type) {
+	case pdfName:
+		filters = []pdfName{filter}
+	case []interface{}:
+		for _, item := range filter {
+			if name, ok := f.resolve(item).(pdfName); ok {
+				filters = append(filters, name)
+			}
+		}
+	}
+
+	if len(filters) > 0 {
+		switch last := filters[len(filters)-1]; last {
+		case "DCTDecode", "DCT", "JPXDecode":
+			if len(filters) > 1 {
+				return nil, fmt.Errorf("unsupported image filters %v", filters)
+			}
+			return stream.raw, nil
+		case "CCITTFaxDecode", "CCF", "JBIG2Decode":
+			return nil, fmt.Errorf("unsupported image filter %s", last)
+		}
+	}
+
+	pixels, err := decodePDFStream(f, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	width, _ := f.resolve(stream.dict["Width"]).(float64)
+	height, _ := f.resolve(stream.dict["Height"]).(float64)
+	bits := 8
+	if b, ok := f.resolve(stream.dict["BitsPerComponent"]).(float64); ok && b > 0 {
+		bits = int(b)
+	}
+	components, baseComponents, palette := 1, 0, []byte(nil)
+	if mask, _ := f.resolve(stream.dict["ImageMask"]).(bool); mask {
+		bits = 1
+	} else {
+		components, baseComponents, palette = f.colorSpace(stream.dict["ColorSpace"])
+	}
+	if width < 1 || height < 1 || width*height > 100<<20 || bits > 16 {
+		return nil, fmt.Errorf("unsupported image of %vx%v at %d bits", width, height, bits)
+	}
+
+	invert := false
+	if decode := f.array(stream.dict["Decode"]); len(decode) >= 2 && components == 1 && palette == nil {
+		first, _ := f.resolve(decode[0]).(float64)
+		invert = first == 1
+	}
+
+	w, h := int(width), int(height)
+	rowBits := w * components * bits
+	rowBytes := (rowBits + 7) / 8
+	maxSample := float64(int(1)<<bits - 1)
+	sample := func(y, i int) int {
+		bit := y*rowBytes*8 + i*bits
+		v := 0
+		for b := 0; b < bits; b++ {
+			byteIndex := (bit + b) / 8
+			if byteIndex >= len(pixels) {
+				return 0
+			}
+			v = v<<1 | int(pixels[byteIndex]>>(7-uint((bit+b)%8))&1)
+		}
+		return v
+	}
+	scale := func(v int) uint8 {
+		return uint8(float64(v) * 255 / maxSample)
+	}
+
+	var img image.Image
+	if components == 1 && palette == nil {
+		gray := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := scale(sample(y, x))
+				if invert {
+					v = 255 - v
+				}
+				gray.Pix[y*gray.Stride+x] = v
+			}
+		}
+		img = gray
+	} else {
+		rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var c [4]uint8
+				if palette != nil {
+					index := sample(y, x) * baseComponents
+					for i := 0; i < baseComponents && index+i < len(palette); i++ {
+						c[i] = palette[index+i]
+					}
+					c = toRGB(c, baseComponents)
+				} else {
+					for i := 0; i < components && i < 4; i++ {
+						c[i] = scale(sample(y, x*components+i))
+					}
+					c = toRGB(c, components)
+				}
+				rgba.Set(x, y, color.RGBA{R: c[0], G: c[1], B: c[2], A: 255})
+			}
+		}
+		img = rgba
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// toRGB converts gray, RGB or CMYK components to RGB
+func toRGB(c [4]uint8, components int) [4]uint8 {
+	switch components {
+	case 1:
+		return [4]uint8{c[0], c[0], c[0]}
+	case 4:
+		k := 255 - int(c[3])
+		return [4]uint8{
+			uint8((255 - int(c[0])) * k / 255),
+			uint8((255 - int(c[1])) * k / 255),
+			uint8((255 - int(c[2])) * k / 255),
+		}
+	}
+	return c
+}
+
+// colorSpace returns the number of components of an image's color space.
+// Indexed spaces also return their base's components and the palette.
+func (f *pdfFile) colorSpace(v interface{}) (components int, baseComponents int, palette []byte) {
+	switch cs := f.resolve(v).(type) {
+	case pdfName:
+		switch cs {
+		case "DeviceRGB", "CalRGB", "RGB", "Lab":
+			return 3, 0, nil
+		case "DeviceCMYK", "CMYK":
+			return 4, 0, nil
+		}
+	case []interface{}:
+		if len(cs) == 0 {
+			break
+		}
+		switch f.resolve(cs[0]) {
+		case pdfName("ICCBased"):
+			if len(cs) > 1 {
+				if n, ok := f.resolve(f.dict(cs[1])["N"]).(float64); ok && n >= 1 && n <= 4 {
+					return int(n), 0, nil
+				}
+			}
+		case pdfName("CalRGB"), pdfName("Lab"):
+			return 3, 0, nil
+		case pdfName("Indexed"), pdfName("I"):
+			if len(cs) < 4 {
+				break
+			}
+			base, _, _ := f.colorSpace(cs[1])
+			switch lookup := f.resolve(cs[3]).(type) {
+			case []byte:
+				palette = lookup
+			case *pdfStream:
+				palette, _ = decodePDFStream(f, lookup)
+			}
+			return 1, base, palette
+		}
+	}
+	return 1, 0, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractPDFText(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages []string
+		want  []string
+	}{
+		{
+			name:  "lines",
+			pages: []string{"BT /F1 12 Tf 72 720 Td (Hello) Tj ( world) Tj 0 -14 Td (Next line) Tj ET"},
+			want:  []string{"Hello world\nNext line"},
+		},
+		{
+			name: "one string per page",
+			pages: []string{
+				"BT /F1 12 Tf 72 720 Td (First page) Tj ET",
+				"BT /F1 12 Tf 72 720 Td [(Sec) -20 (ond)] TJ ET",
+				"",
+			},
+			want: []string{"First page", "Second", ""},
+		},
+		{
+			name:  "escapes",
+			pages: []string{`BT /F1 12 Tf 72 720 Td (\(a\) b\\c) Tj ET`},
+			want:  []string{`(a) b\c`},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ExtractPDFText(pdfFixture(test.pages...))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if _, err := ExtractPDFText([]byte("not a pdf")); err == nil {
+		t.Errorf("expected an error for a file that is not a PDF")
+	}
+}
+
+// pdfFixture builds an uncompressed PDF with one page per content stream
+func pdfFixture(contents ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	buf.WriteString("1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n")
+
+	kids := make([]string, len(contents))
+	for i := range contents {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	fmt.Fprintf(&buf, "2 0 obj << /Type /Pages /Kids [%s] /Count %d >> endobj\n", strings.Join(kids, " "), len(contents))
+	buf.WriteString("3 0 obj << /Type /Font /Subtype /Type1 /BaseFont /Helvetica >> endobj\n")
+
+	for i, content := range contents {
+		fmt.Fprintf(&buf, "%d 0 obj << /Type /Page /Parent 2 0 R /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >> endobj\n", 4+2*i, 5+2*i)
+		fmt.Fprintf(&buf, "%d 0 obj << /Length %d >> stream\n%s\nendstream endobj\n", 5+2*i, len(content), content)
+	}
+
+	fmt.Fprintf(&buf, "trailer << /Root 1 0 R /Size %d >>\n%%%%EOF\n", 4+2*len(contents))
+	return buf.Bytes()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Passwords are stored as PBKDF2-SHA256 hashes in the form
+// pbkdf2-sha256$<iterations>$<salt>$<hash>, with the salt and hash base64
+// encoded. Passwords stored in plain text before hashing was added are
+// still accepted and rehashed on the next login.
+
+const passwordHashScheme = "pbkdf2-sha256"
+
+// PasswordHashIterations is the PBKDF2 work factor for new hashes
+var PasswordHashIterations = 600000
+
+// pbkdf2SHA256 derives a 32 byte key as in RFC 8018
+func pbkdf2SHA256(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// HashPassword returns the stored form of password
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, PasswordHashIterations)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, PasswordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// isPasswordHash reports whether stored is a hash rather than a legacy
+// plain text password
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, passwordHashScheme+"$")
+}
+
+// CheckPassword reports whether password matches the stored hash, or the
+// stored plain text for accounts that have not logged in since hashing was
+// added. It takes the same time however much of the password matches.
+func CheckPassword(stored string, password string) bool {
+	if stored == "" {
+		return false
+	}
+	if !isPasswordHash(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations), want) == 1
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914 section 11 and the widely published SHA-256 variants of the
+	// RFC 6070 vectors
+	for _, tc := range []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	} {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iterations)); got != tc.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tc.password, tc.salt, tc.iterations, got, tc.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	defer func(iterations int) { PasswordHashIterations = iterations }(PasswordHashIterations)
+	PasswordHashIterations = 1000
+
+	stored, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "pbkdf2-sha256$1000$") || strings.Contains(stored, "correct horse") {
+		t.Errorf("HashPassword stored %q", stored)
+	}
+	if again, _ := HashPassword("correct horse"); again == stored {
+		t.Error("two hashes of one password share a salt")
+	}
+
+	for _, tc := range []struct {
+		stored, password string
+		want             bool
+	}{
+		{stored, "correct horse", true},
+		{stored, "correct horsE", false},
+		{stored, "", false},
+		{"legacy plain text", "legacy plain text", true},
+		{"legacy plain text", "legacy", false},
+		{"", "", false},
+		{"pbkdf2-sha256$x$c2FsdA$aGFzaA", "anything", false},
+	} {
+		if got := CheckPassword(tc.stored, tc.password); got != tc.want {
+			t.Errorf("CheckPassword(%q, %q) = %v, want %v", tc.stored, tc.password, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+func ExportUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	var exportUserRequest struct {
+		ID string `json:"_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &exportUserRequest) {
+		return
+	}
+
+	exportUserData(w, r, exportUserRequest.ID)
+}
+
+func exportUserData(w http.ResponseWriter, r *http.Request, userID string) {
+	if !IsAdminRequest(r) {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Admin token required")
+		return
+	}
+
+	user, err := getUserFromId(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get user")
+		return
+	}
+
+	if user.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	}
+
+	// the archive is built in a temporary file so a failure can still be
+	// reported instead of sending a truncated archive
+	f, err := os.CreateTemp("", "avalon-export-*.zip")
+	if err != nil {
+		log.Printf("Error creating export file: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to export user data")
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := WriteUserExport(user, f); err != nil {
+		log.Printf("Error exporting user %s: %v", user.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to export user data")
+		return
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("Error reading export of user %s: %v", user.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to export user data")
+		return
+	}
+
+	RecordAuditEvent(r, AuditUserExported, AuditEvent{
+		TargetID: user.ID,
+	})
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"avalon-export-%s.zip\"", user.ID))
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Error sending export of user %s: %v", user.ID, err)
+	}
+}
+
+func EraseUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	var eraseUserRequest struct {
+		ID string `json:"_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &eraseUserRequest) {
+		return
+	}
+
+	eraseUserData(w, r, eraseUserRequest.ID)
+}
+
+func eraseUserData(w http.ResponseWriter, r *http.Request, userID string) {
+	if !IsAdminRequest(r) {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Admin token required")
+		return
+	}
+
+	user, err := getUserFromId(userID)
+	if err != nil {
+		log.Printf("Error getting user: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get user")
+		return
+	}
+
+	if user.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	}
+
+	report, err := EraseUser(user)
+	if err != nil {
+		log.Printf("Error erasing user %s: %v, partial report: %+v", user.ID, err, report)
+		// the partial report tells the caller what is already gone; running
+		// the erasure again finishes the rest
+		report.Errors = append(report.Errors, err.Error())
+		writeResponse(w, Response{
+			Message:   "Failed to erase user data",
+			Status:    http.StatusInternalServerError,
+			Code:      CodeInternal,
+			Object:    report,
+			RequestID: RequestID(r),
+		})
+		return
+	}
+
+	RecordAuditEvent(r, AuditUserErased, AuditEvent{
+		TargetID: user.ID,
+		Details:  auditDetails("report_signature", report.Signature),
+	})
+
+	WriteSuccess(w, r, http.StatusOK, "User data erased successfully", report)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const erasedSender = "Deleted User"
+
+// SignErasureReport computes an HMAC-SHA256 over the report with its
+// signature field cleared, keyed by REPORT_SIGNING_KEY
+func SignErasureReport(report ErasureReport) (string, error) {
+	key := os.Getenv("REPORT_SIGNING_KEY")
+	if key == "" {
+		return "", fmt.Errorf("REPORT_SIGNING_KEY is not set")
+	}
+
+	report.Signature = ""
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func writeJSONToZip(archive *zip.Writer, name string, v interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// WriteUserExport writes a zip archive containing the user's profile,
+// cases, document metadata, the blobs and extracted text of every document
+// version, and chats
+func WriteUserExport(user User, w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	user.Password = ""
+	if err := writeJSONToZip(archive, "user.json", user); err != nil {
+		return err
+	}
+
+	cases, err := GetCasesByUserId(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONToZip(archive, "cases.json", cases); err != nil {
+		return err
+	}
+
+	var documents []Document
+	var chats []Chat
+	for _, c := range cases {
+		caseDocuments, err := GetDocumentsByCaseId(c.ID)
+		if err != nil {
+			return err
+		}
+		documents = append(documents, caseDocuments...)
+
+		chat, err := GetChatFromCaseId(c.ID)
+		if err != nil {
+			return err
+		}
+		if chat.ID != "" {
+			chats = append(chats, chat)
+		}
+	}
+
+	if err := writeJSONToZip(archive, "documents.json", documents); err != nil {
+		return err
+	}
+	if err := writeJSONToZip(archive, "chats.json", chats); err != nil {
+		return err
+	}
+
+	if err := writeDocumentContentsToZip(archive, documents); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// writeDocumentContentsToZip adds the earlier versions of the documents to
+// versions.json, the blob of every version under files/ and the extracted
+// text of every version under text/<document>/<version>.json. Duplicates
+// and versions sharing a blob share its one entry.
+func writeDocumentContentsToZip(archive *zip.Writer, documents []Document) error {
+	versions := []DocumentVersion{}
+	var keys []string
+	for _, doc := range documents {
+		keys = append(keys, S3KeyFromURL(doc.FileURL))
+		if doc.Version == 0 {
+			continue
+		}
+
+		docVersions, err := queryDocumentVersions(doc.ID)
+		if err != nil {
+			return err
+		}
+		for _, version := range docVersions {
+			versions = append(versions, version)
+			keys = append(keys, version.Key)
+		}
+	}
+
+	if err := writeJSONToZip(archive, "versions.json", versions); err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for _, key := range keys {
+		if written[key] {
+			continue
+		}
+		written[key] = true
+
+		if err := copyS3ObjectToZip(archive, key, "files/"+key, false); err != nil {
+			return err
+		}
+	}
+
+	for _, doc := range documents {
+		for version := 1; version <= currentVersion(doc); version++ {
+			name := fmt.Sprintf("text/%s/%d.json", doc.ID, version)
+			if err := copyS3ObjectToZip(archive, extractedTextKey(doc.ID, version), name, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyS3ObjectToZip copies an object into the archive as name. With optional
+// set, a missing object is skipped, as versions that were never extracted
+// have no text.
+func copyS3ObjectToZip(archive *zip.Writer, key string, name string, optional bool) error {
+	body, err := DownloadFileFromS3(key)
+	var aerr awserr.Error
+	if optional && errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s, %v", key, err)
+	}
+	defer body.Close()
+
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, body)
+	return err
+}
+
+// WriteCaseExport writes a zip archive containing the case, its change
+// history, document metadata, the blobs and extracted text of every document
+// version, and chat
+func WriteCaseExport(myCase Case, w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	if err := writeJSONToZip(archive, "case.json", myCase); err != nil {
+		return err
+	}
+
+	history, err := GetCaseHistory(myCase.ID)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONToZip(archive, "history.json", history); err != nil {
+		return err
+	}
+
+	documents, err := GetDocumentsByCaseId(myCase.ID)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONToZip(archive, "documents.json", documents); err != nil {
+		return err
+	}
+
+	chat, err := GetChatFromCaseId(myCase.ID)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONToZip(archive, "chat.json", chat); err != nil {
+		return err
+	}
+
+	if err := writeDocumentContentsToZip(archive, documents); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// EraseUser deletes the user's cases with their history, documents, files
+// and chats, releases the blobs their documents referenced, deletes the
+// user's webhooks and their deliveries, clears the payloads of their events
+// from their organization's webhook deliveries, deletes stored idempotent
+// responses holding their data, anonymizes the user's messages in chats they
+// do not own and deletes the user record. Deleting a document also deletes
+// its versions, extracted text and search index entries. On error the
+// report covers what was erased before it.
+func EraseUser(user User) (ErasureReport, error) {
+	report := ErasureReport{
+		UserID:                  user.ID,
+		Email:                   user.Email,
+		RequestedAt:             time.Now().Format(time.RFC3339),
+		CasesDeleted:            []string{},
+		DocumentsDeleted:        []string{},
+		BlobsDeleted:            []string{},
+		ChatsDeleted:            []string{},
+		ChatsAnonymized:         []string{},
+		WebhooksDeleted:         []string{},
+		DeliveryPayloadsCleared: []string{},
+		Errors:                  []string{},
+	}
+
+	cases, err := GetCasesByUserId(user.ID)
+	if err != nil {
+		return report, err
+	}
+
+	for _, c := range cases {
+		documents, err := DeleteDocumentsByCaseId(c.ID)
+		if err != nil {
+			return report, err
+		}
+		for _, doc := range documents {
+			report.DocumentsDeleted = append(report.DocumentsDeleted, doc.ID)
+		}
+
+		// deleting the documents released their blobs; what is left under
+		// the case's prefixes is its own, apart from blobs other cases share
+		shared, err := BlobKeysWithPrefix(c.ID + "/")
+		if err != nil {
+			return report, err
+		}
+
+		for _, prefix := range []string{c.ID + "/", QuarantinePrefix + c.ID + "/"} {
+			keys, err := ListS3Keys(prefix)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("list %s: %v", prefix, err))
+				continue
+			}
+			for _, key := range keys {
+				if shared[key] {
+					continue
+				}
+				if err := DeleteFileFromS3(key); err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("delete %s: %v", key, err))
+					continue
+				}
+				report.BlobsDeleted = append(report.BlobsDeleted, key)
+			}
+		}
+
+		if err := DeleteChatById(c.ID); err != nil {
+			return report, err
+		}
+		report.ChatsDeleted = append(report.ChatsDeleted, c.ID)
+
+		deleted, err := DeleteCaseHistory(c.ID)
+		report.HistoryDeleted += deleted
+		if err != nil {
+			return report, err
+		}
+
+		if _, err := DeleteCaseById(c.ID); err != nil {
+			return report, err
+		}
+		report.CasesDeleted = append(report.CasesDeleted, c.ID)
+	}
+
+	webhooks, err := GetWebhooksByOwner(WebhookOwnerUser, user.ID)
+	if err != nil {
+		return report, err
+	}
+
+	for _, webhook := range webhooks {
+		if err := DeleteWebhookDeliveries(webhook.ID); err != nil {
+			return report, err
+		}
+		if err := DeleteWebhookById(webhook.ID); err != nil {
+			return report, err
+		}
+		report.WebhooksDeleted = append(report.WebhooksDeleted, webhook.ID)
+	}
+
+	// organization webhooks keep their deliveries, without the payloads of
+	// events about the user
+	if user.Organization != "" {
+		orgWebhooks, err := GetWebhooksByOwner(WebhookOwnerOrganization, user.Organization)
+		if err != nil {
+			return report, err
+		}
+		for _, webhook := range orgWebhooks {
+			cleared, err := ClearDeliveryPayloads(webhook.ID, user.ID)
+			report.DeliveryPayloadsCleared = append(report.DeliveryPayloadsCleared, cleared...)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	deleted, err := DeleteIdempotencyRecords(user)
+	report.IdempotencyRecordsDeleted = deleted
+	if err != nil {
+		return report, err
+	}
+
+	chats, err := GetAllChats()
+	if err != nil {
+		return report, err
+	}
+
+	for _, chat := range chats {
+		changed := 0
+		for i, m := range chat.Messages {
+			if m.Sender == user.ID || m.Sender == user.Email {
+				chat.Messages[i].Sender = erasedSender
+				changed++
+			}
+		}
+		if changed == 0 {
+			continue
+		}
+
+		if err := ReplaceChatMessages(chat.ID, chat.Messages); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("anonymize chat %s: %v", chat.ID, err))
+			continue
+		}
+		report.ChatsAnonymized = append(report.ChatsAnonymized, chat.ID)
+		report.MessagesAnonymized += changed
+	}
+
+	if _, err := deleteUserFromId(user.ID, user.Email); err != nil {
+		return report, err
+	}
+
+	report.CompletedAt = time.Now().Format(time.RFC3339)
+
+	report.Signature, err = SignErasureReport(report)
+	if err != nil {
+		log.Printf("Error signing erasure report: %v", err)
+		report.Errors = append(report.Errors, "report could not be signed")
+	}
+
+	return report, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Handlers for the /v1 resource routes. Each one takes its IDs from the path
+// and shares the implementation behind the legacy POST routes.
+
+func GetUserResourceHandler(w http.ResponseWriter, r *http.Request) {
+	getUser(w, r, r.PathValue("id"))
+}
+
+func UpdateUserResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var update UserProfileUpdate
+	if !DecodeJSONBody(w, r, &update) {
+		return
+	}
+
+	updateUserProfile(w, r, r.PathValue("id"), update)
+}
+
+func VerifyEmailResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var verifyEmailRequest struct {
+		Token string `json:"token"`
+	}
+	if !DecodeJSONBody(w, r, &verifyEmailRequest) {
+		return
+	}
+
+	verifyEmail(w, r, r.PathValue("id"), verifyEmailRequest.Token)
+}
+
+func ChangePasswordResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var change PasswordChange
+	if !DecodeJSONBody(w, r, &change) {
+		return
+	}
+
+	updatePassword(w, r, r.PathValue("id"), change)
+}
+
+func DeleteUserResourceHandler(w http.ResponseWriter, r *http.Request) {
+	deleteUser(w, r, r.PathValue("id"), "")
+}
+
+// CreateCaseResourceHandler also applies the update rules to the date, state
+// and case type, so listings can sort and filter on them. The legacy
+// /createCase route keeps accepting the values it always has.
+func CreateCaseResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var myCase Case
+	if !DecodeJSONBody(w, r, &myCase) {
+		return
+	}
+
+	fieldErrors := requireCaseFields(myCase)
+	if len(fieldErrors) == 0 {
+		fieldErrors = ValidateCaseUpdate(CaseUpdate{
+			CaseType: &myCase.CaseType,
+			Date:     &myCase.Date,
+			State:    &myCase.State,
+		})
+	}
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	createCase(w, r, myCase)
+}
+
+func GetUserCasesResourceHandler(w http.ResponseWriter, r *http.Request) {
+	filter, fieldErrors := ParseCaseFilter(r)
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	getUserCases(w, r, r.PathValue("id"), filter)
+}
+
+func DeleteUserCasesResourceHandler(w http.ResponseWriter, r *http.Request) {
+	deleteUserCases(w, r, r.PathValue("id"))
+}
+
+func ExportUserDataResourceHandler(w http.ResponseWriter, r *http.Request) {
+	exportUserData(w, r, r.PathValue("id"))
+}
+
+func EraseUserDataResourceHandler(w http.ResponseWriter, r *http.Request) {
+	eraseUserData(w, r, r.PathValue("id"))
+}
+
+func GetCaseResourceHandler(w http.ResponseWriter, r *http.Request) {
+	getCase(w, r, r.PathValue("id"))
+}
+
+func UpdateCaseResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var update CaseUpdate
+	if !DecodeJSONBody(w, r, &update) {
+		return
+	}
+
+	updateCase(w, r, r.PathValue("id"), update)
+}
+
+func GetCaseHistoryResourceHandler(w http.ResponseWriter, r *http.Request) {
+	getCaseHistory(w, r, r.PathValue("id"))
+}
+
+func DeleteCaseResourceHandler(w http.ResponseWriter, r *http.Request) {
+	deleteCase(w, r, r.PathValue("id"))
+}
+
+func GetCaseDocumentsResourceHandler(w http.ResponseWriter, r *http.Request) {
+	filter, bucketSize, fieldErrors := ParseDocumentFilter(r)
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	getCaseDocuments(w, r, r.PathValue("id"), filter, bucketSize)
+}
+
+func CreateCaseDocumentsResourceHandler(w http.ResponseWriter, r *http.Request) {
+	createDocuments(w, r, r.PathValue("id"), http.StatusCreated)
+}
+
+func ReserveUploadsResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var reserveUploadsRequest struct {
+		Files []UploadRequest `json:"files"`
+	}
+
+	if !DecodeJSONBody(w, r, &reserveUploadsRequest) {
+		return
+	}
+
+	reserveUploads(w, r, r.PathValue("id"), reserveUploadsRequest.Files)
+}
+
+func CompleteUploadsResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var completeUploadsRequest struct {
+		DocumentIDs []string `json:"document_ids"`
+	}
+
+	if !DecodeJSONBody(w, r, &completeUploadsRequest) {
+		return
+	}
+
+	completeUploads(w, r, r.PathValue("id"), completeUploadsRequest.DocumentIDs)
+}
+
+func DeleteCaseDocumentsResourceHandler(w http.ResponseWriter, r *http.Request) {
+	deleteCaseDocuments(w, r, r.PathValue("id"))
+}
+
+func SearchCaseDocumentsResourceHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var limit int
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			WriteValidationError(w, r, []FieldError{{Field: "limit", Message: "must be an integer between 1 and 100"}})
+			return
+		}
+	}
+
+	searchCaseDocuments(w, r, r.PathValue("id"), query.Get("q"), limit, query.Get("cursor"))
+}
+
+func GetCaseChatResourceHandler(w http.ResponseWriter, r *http.Request) {
+	getCaseChat(w, r, r.PathValue("id"))
+}
+
+func CreateChatMessageResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var message Message
+	if !DecodeJSONBody(w, r, &message) {
+		return
+	}
+
+	postChatMessage(w, r, r.PathValue("id"), message, http.StatusCreated)
+}
+
+func StreamCaseChatResourceHandler(w http.ResponseWriter, r *http.Request) {
+	streamCaseChat(w, r, r.PathValue("id"))
+}
+
+func SetTypingResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var setTypingRequest struct {
+		Typing bool `json:"typing"`
+	}
+
+	if !DecodeJSONBody(w, r, &setTypingRequest) {
+		return
+	}
+
+	setTyping(w, r, r.PathValue("id"), setTypingRequest.Typing)
+}
+
+// FindDocumentsResourceHandler looks up a document ID by its file_url query
+// parameter
+func FindDocumentsResourceHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	fileURL := query.Get("file_url")
+	if fileURL == "" {
+		WriteValidationError(w, r, []FieldError{{Field: "file_url", Message: "is required"}})
+		return
+	}
+
+	getDocumentIDByFileURL(w, r, fileURL, query.Get("case_id"))
+}
+
+func GetDocumentResourceHandler(w http.ResponseWriter, r *http.Request) {
+	getDocument(w, r, r.PathValue("id"))
+}
+
+func UpdateDocumentResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var update DocumentUpdate
+	if !DecodeJSONBody(w, r, &update) {
+		return
+	}
+
+	updateDocument(w, r, r.PathValue("id"), update)
+}
+
+func MoveDocumentResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var moveDocumentRequest struct {
+		CaseID string `json:"case_id"`
+	}
+	if !DecodeJSONBody(w, r, &moveDocumentRequest) {
+		return
+	}
+
+	relocateDocument(w, r, r.PathValue("id"), moveDocumentRequest.CaseID, false)
+}
+
+func CopyDocumentResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var copyDocumentRequest struct {
+		CaseID string `json:"case_id"`
+	}
+	if !DecodeJSONBody(w, r, &copyDocumentRequest) {
+		return
+	}
+
+	relocateDocument(w, r, r.PathValue("id"), copyDocumentRequest.CaseID, true)
+}
+
+func ResolveDuplicateResourceHandler(w http.ResponseWriter, r *http.Request) {
+	var resolveDuplicateRequest struct {
+		Action string `json:"action"`
+	}
+	if !DecodeJSONBody(w, r, &resolveDuplicateRequest) {
+		return
+	}
+
+	resolveDuplicate(w, r, r.PathValue("id"), resolveDuplicateRequest.Action)
+}
+
+func GetDocumentVersionsResourceHandler(w http.ResponseWriter, r *http.Request) {
+	getDocumentVersions(w, r, r.PathValue("id"))
+}
+
+func UploadDocumentVersionResourceHandler(w http.ResponseWriter, r *http.Request) {
+	uploadDocumentVersion(w, r, r.PathValue("id"))
+}
+
+// versionNumber reads the number path value, writing a validation error and
+// returning false if it is not a positive integer
+func versionNumber(w http.ResponseWriter, r *http.Request) (int, bool) {
+	number, err := strconv.Atoi(r.PathValue("number"))
+	if err != nil || number < 1 {
+		WriteValidationError(w, r, []FieldError{{Field: "number", Message: "must be a positive integer"}})
+		return 0, false
+	}
+	return number, true
+}
+
+func DownloadDocumentVersionResourceHandler(w http.ResponseWriter, r *http.Request) {
+	if number, ok := versionNumber(w, r); ok {
+		downloadDocumentVersion(w, r, r.PathValue("id"), number)
+	}
+}
+
+func RestoreDocumentVersionResourceHandler(w http.ResponseWriter, r *http.Request) {
+	if number, ok := versionNumber(w, r); ok {
+		restoreDocumentVersion(w, r, r.PathValue("id"), number)
+	}
+}
+
+func GetDocumentTextResourceHandler(w http.ResponseWriter, r *http.Request) {
+	getDocumentText(w, r, r.PathValue("id"))
+}
+
+func ExtractDocumentTextResourceHandler(w http.ResponseWriter, r *http.Request) {
+	extractDocumentText(w, r, r.PathValue("id"))
+}
+
+func DeleteDocumentResourceHandler(w http.ResponseWriter, r *http.Request) {
+	deleteDocument(w, r, r.PathValue("id"))
+}
+
+func DownloadDocumentResourceHandler(w http.ResponseWriter, r *http.Request) {
+	downloadDocument(w, r, r.PathValue("id"))
+}
+
+func QueryAuditLogResourceHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	queryAuditLog(w, r, AuditFilter{
+		ActorID: query.Get("actor_id"),
+		CaseID:  query.Get("case_id"),
+		Type:    query.Get("type"),
+		Start:   query.Get("start"),
+		End:     query.Get("end"),
+	})
+}
+
+func GetWebhooksResourceHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	getWebhooks(w, r, query.Get("owner_type"), query.Get("owner_id"))
+}
+
+func GetWebhookResourceHandler(w http.ResponseWriter, r *http.Request) {
+	getWebhook(w, r, r.PathValue("id"))
+}
+
+func DeleteWebhookResourceHandler(w http.ResponseWriter, r *http.Request) {
+	deleteWebhook(w, r, r.PathValue("id"))
+}
+
+func GetWebhookDeliveriesResourceHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var limit int64
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.ParseInt(v, 10, 64); err != nil || limit < 1 {
+			WriteValidationError(w, r, []FieldError{{Field: "limit", Message: "must be an integer between 1 and 100"}})
+			return
+		}
+	}
+
+	getWebhookDeliveries(w, r, r.PathValue("id"), query.Get("status"), limit, query.Get("cursor"))
+}
+
+func RedeliverWebhookResourceHandler(w http.ResponseWriter, r *http.Request) {
+	redeliverWebhook(w, r, r.PathValue("id"), r.PathValue("delivery_id"))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Stable error codes returned in the code field of error responses
+const (
+	CodeInvalidBody          = "invalid_body"
+	CodeInvalidJSON          = "invalid_json"
+	CodeValidationFailed     = "validation_failed"
+	CodeInvalidCredentials   = "invalid_credentials"
+	CodeInvalidToken         = "invalid_token"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeEmailTaken           = "email_taken"
+	CodeForbidden            = "forbidden"
+	CodeUserNotFound         = "user_not_found"
+	CodeCaseNotFound         = "case_not_found"
+	CodeDocumentNotFound     = "document_not_found"
+	CodeVersionNotFound      = "version_not_found"
+	CodeVersionConflict      = "version_conflict"
+	CodeTextNotAvailable     = "text_not_available"
+	CodeExtractionInProgress = "extraction_in_progress"
+	CodeChatNotFound         = "chat_not_found"
+	CodeWebhookNotFound      = "webhook_not_found"
+	CodeDeliveryNotFound     = "delivery_not_found"
+	CodeUploadNotFound       = "upload_not_found"
+	CodeOffsetMismatch       = "offset_mismatch"
+	CodeUnsupportedVersion   = "unsupported_version"
+	CodeNoCases              = "no_cases"
+	CodeRequestTooLarge      = "request_too_large"
+	CodeFileTooLarge         = "file_too_large"
+	CodeUnsupportedFile      = "unsupported_file_type"
+	CodeFileInfected         = "file_infected"
+	CodeScanFailed           = "scan_failed"
+	CodeIdempotencyConflict  = "idempotency_conflict"
+	CodeRequestInProgress    = "request_in_progress"
+	CodeInternal             = "internal_error"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID tags each request with the caller's X-Request-ID or a new
+// random one and echoes it in the response headers
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			requestID = generateRandomString(20)
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func RequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDKey{}).(string)
+	return requestID
+}
+
+func writeResponse(w http.ResponseWriter, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.Status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func WriteSuccess(w http.ResponseWriter, r *http.Request, status int, message string, object interface{}) {
+	writeResponse(w, Response{
+		Message:   message,
+		Status:    status,
+		Object:    object,
+		RequestID: RequestID(r),
+	})
+}
+
+// WritePage writes one page of a listing along with the cursor for the next
+// page, which is empty on the last page, and an optional summary of the
+// whole listing
+func WritePage(w http.ResponseWriter, r *http.Request, message string, object interface{}, nextCursor string, summary interface{}) {
+	writeResponse(w, Response{
+		Message:    message,
+		Status:     http.StatusOK,
+		Object:     object,
+		NextCursor: nextCursor,
+		Summary:    summary,
+		RequestID:  RequestID(r),
+	})
+}
+
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	writeResponse(w, Response{
+		Message:   message,
+		Status:    status,
+		Code:      code,
+		RequestID: RequestID(r),
+	})
+}
+
+func WriteValidationError(w http.ResponseWriter, r *http.Request, fieldErrors []FieldError) {
+	writeResponse(w, Response{
+		Message:   "Request validation failed",
+		Status:    http.StatusBadRequest,
+		Code:      CodeValidationFailed,
+		Errors:    fieldErrors,
+		RequestID: RequestID(r),
+	})
+}
+
+// DecodeJSONBody reads the request body into v. It writes an error response
+// and returns false if the body cannot be read or is not valid JSON.
+func DecodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidBody, "Failed to read request body")
+		return false
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		log.Printf("Error unmarshalling request body: %v", err)
+
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			WriteValidationError(w, r, []FieldError{{
+				Field:   typeErr.Field,
+				Message: "must be a " + typeErr.Type.String(),
+			}})
+			return false
+		}
+
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidJSON, "Request body is not valid JSON")
+		return false
+	}
+
+	return true
+}
+
+// RequireFields takes alternating field names and values and returns an
+// error for each field whose value is empty
+func RequireFields(pairs ...string) []FieldError {
+	var fieldErrors []FieldError
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			fieldErrors = append(fieldErrors, FieldError{
+				Field:   pairs[i],
+				Message: "is required",
+			})
+		}
+	}
+	return fieldErrors
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var scanner Scanner
+
+// ErrScanSizeLimit is returned when content is larger than clamd's
+// StreamMaxLength
+var ErrScanSizeLimit = errors.New("content exceeds the clamd stream size limit")
+
+type ScanResult struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature"`
+}
+
+// Scanner checks uploaded content for malware before it is stored
+type Scanner interface {
+	Scan(fileName string, content io.Reader) (ScanResult, error)
+}
+
+// NoopScanner reports every file as clean
+type NoopScanner struct{}
+
+func (NoopScanner) Scan(fileName string, content io.Reader) (ScanResult, error) {
+	return ScanResult{}, nil
+}
+
+// ClamAVScanner streams content to a clamd daemon using the INSTREAM command
+type ClamAVScanner struct {
+	Address   string
+	Timeout   time.Duration
+	ChunkSize int
+}
+
+func (c ClamAVScanner) Scan(fileName string, content io.Reader) (ScanResult, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.Address, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, c.Address, c.Timeout)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed to connect to clamd, %v", err)
+	}
+	defer conn.Close()
+
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("failed to start stream, %v", err)
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 64 << 10
+	}
+
+	buf := make([]byte, chunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := content.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return ScanResult{}, streamWriteError(conn, fmt.Errorf("failed to write chunk size, %v", err))
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return ScanResult{}, streamWriteError(conn, fmt.Errorf("failed to write chunk, %v", err))
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, fmt.Errorf("failed to read content, %v", readErr)
+		}
+	}
+
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return ScanResult{}, fmt.Errorf("failed to end stream, %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, fmt.Errorf("failed to read clamd reply, %v", err)
+	}
+
+	return parseClamAVReply(reply)
+}
+
+// streamWriteError returns ErrScanSizeLimit when clamd closed the stream
+// because it went over the size limit, and err otherwise
+func streamWriteError(conn net.Conn, err error) error {
+	reply, readErr := io.ReadAll(io.LimitReader(conn, 1024))
+	if readErr != nil && len(reply) == 0 {
+		return err
+	}
+	if _, replyErr := parseClamAVReply(string(reply)); errors.Is(replyErr, ErrScanSizeLimit) {
+		return ErrScanSizeLimit
+	}
+	return err
+}
+
+// parseClamAVReply interprets replies such as "stream: OK" and
+// "stream: Eicar-Test-Signature FOUND"
+func parseClamAVReply(reply string) (ScanResult, error) {
+	reply = strings.TrimRight(reply, "\x00\n")
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{
+			Infected:  true,
+			Signature: strings.TrimSuffix(reply, " FOUND"),
+		}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return ScanResult{}, ErrScanSizeLimit
+	default:
+		return ScanResult{}, fmt.Errorf("unexpected clamd reply, %s", reply)
+	}
+}
+
+// InitScanner returns a ClamAV scanner when CLAMAV_ADDRESS is set and a
+// no-op scanner otherwise
+func InitScanner() Scanner {
+	address := os.Getenv("CLAMAV_ADDRESS")
+	if address == "" {
+		log.Printf("CLAMAV_ADDRESS not set, uploads will not be scanned")
+		return NoopScanner{}
+	}
+
+	return ClamAVScanner{
+		Address: address,
+		Timeout: 30 * time.Second,
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseClamAVReply(t *testing.T) {
+	tests := []struct {
+		reply     string
+		infected  bool
+		signature string
+		err       error
+	}{
+		{reply: "stream: OK\x00"},
+		{reply: "stream: Eicar-Test-Signature FOUND\x00", infected: true, signature: "Eicar-Test-Signature"},
+		{reply: "INSTREAM size limit exceeded. ERROR\x00", err: ErrScanSizeLimit},
+	}
+
+	for _, test := range tests {
+		result, err := parseClamAVReply(test.reply)
+		if !errors.Is(err, test.err) {
+			t.Errorf("parseClamAVReply(%q) error = %v, want %v", test.reply, err, test.err)
+		}
+		if result.Infected != test.infected || result.Signature != test.signature {
+			t.Errorf("parseClamAVReply(%q) = %+v", test.reply, result)
+		}
+	}
+
+	if _, err := parseClamAVReply("stream: lstat() failed. ERROR"); err == nil || errors.Is(err, ErrScanSizeLimit) {
+		t.Errorf("unexpected error for a failed scan, %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func SearchCaseDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	var searchRequest struct {
+		CaseID string `json:"case_id"`
+		Query  string `json:"query"`
+		Limit  int    `json:"limit"`
+		Cursor string `json:"cursor"`
+	}
+
+	if !DecodeJSONBody(w, r, &searchRequest) {
+		return
+	}
+
+	searchCaseDocuments(w, r, searchRequest.CaseID, searchRequest.Query, searchRequest.Limit, searchRequest.Cursor)
+}
+
+// searchCaseDocuments writes a page of the documents of a case matching a
+// query, best match first
+func searchCaseDocuments(w http.ResponseWriter, r *http.Request, caseID string, query string, limit int, cursor string) {
+	var fieldErrors []FieldError
+
+	parsed, err := ParseSearchQuery(query)
+	if err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "query", Message: strings.TrimPrefix(err.Error(), ErrInvalidQuery.Error()+": ")})
+	}
+	if limit < 0 || limit > 100 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "limit", Message: "must be between 1 and 100"})
+	}
+	offset, err := decodeSearchCursor(cursor)
+	if err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "cursor", Message: "is not a valid cursor"})
+	}
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	if limit == 0 {
+		limit = 20
+	}
+
+	return_case, err := GetCaseFromId(caseID)
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
+		return
+	}
+
+	// check if case exists
+	if return_case.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
+		return
+	}
+
+	hits, total, err := SearchCase(caseID, parsed, offset, limit)
+	if err != nil {
+		log.Printf("Error searching case %s: %v", caseID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to search documents")
+		return
+	}
+
+	nextCursor := ""
+	if offset+limit < total {
+		nextCursor, err = encodeCursor(map[string]*dynamodb.AttributeValue{
+			"offset": {N: aws.String(strconv.Itoa(offset + limit))},
+		})
+		if err != nil {
+			log.Printf("Error encoding search cursor: %v", err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to search documents")
+			return
+		}
+	}
+
+	WritePage(w, r, "Documents searched successfully", hits, nextCursor, SearchSummary{Total: total})
+}
+
+// decodeSearchCursor returns the number of hits a search cursor skips.
+// Search results are not stored, so a cursor is only an offset into them.
+func decodeSearchCursor(cursor string) (int, error) {
+	key, err := decodeCursor(cursor)
+	if err != nil || key == nil {
+		return 0, err
+	}
+
+	offset := key["offset"]
+	if offset == nil || offset.N == nil {
+		return 0, errors.New("cursor has no offset")
+	}
+	n, err := strconv.Atoi(*offset.N)
+	if err != nil || n < 0 {
+		return 0, errors.New("cursor has an invalid offset")
+	}
+	return n, nil
+}
@@ -0,0 +1,1022 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Full-text search keeps an inverted index per case on local disk, covering
+// each document's metadata and extracted text. Updates go through one
+// indexer goroutine in the order they were made. A case whose index file is
+// missing, as on a new server, is rebuilt from DynamoDB and the stored text
+// the first time it is used.
+
+// searchIndexFormat is stored in each index file so that a change to the
+// layout rebuilds old files instead of misreading them
+const searchIndexFormat = 1
+
+// search fields, in the order snippets are shown
+const (
+	SearchFieldFileName    = "file_name"
+	SearchFieldDescription = "description"
+	SearchFieldTags        = "tags"
+	SearchFieldFileType    = "file_type"
+	SearchFieldText        = "text"
+)
+
+// searchFieldAliases maps the field names a query may use to the indexed
+// fields
+var searchFieldAliases = map[string]string{
+	"file_name": SearchFieldFileName, "filename": SearchFieldFileName, "name": SearchFieldFileName,
+	"description": SearchFieldDescription,
+	"tags":        SearchFieldTags, "tag": SearchFieldTags,
+	"file_type": SearchFieldFileType, "type": SearchFieldFileType,
+	"text": SearchFieldText, "content": SearchFieldText,
+}
+
+// file name matches count for more than matches in the body
+var searchFieldBoost = map[string]float64{
+	SearchFieldFileName:    2,
+	SearchFieldDescription: 1.5,
+	SearchFieldTags:        1.5,
+}
+
+const (
+	maxWildcardTerms  = 500
+	maxSearchSnippets = 3
+	snippetContext    = 80
+)
+
+var (
+	searchIndexDir = "search-index"
+
+	searchIndexes   = map[string]*caseIndex{}
+	searchIndexesMu sync.Mutex
+
+	searchUpdates   []searchUpdate
+	searchUpdatesMu sync.Mutex
+	searchWake      = make(chan struct{}, 1)
+)
+
+// ErrInvalidQuery is wrapped by the errors ParseSearchQuery returns
+var ErrInvalidQuery = errors.New("invalid query")
+
+// caseIndex is the inverted index of one case's documents
+type caseIndex struct {
+	mu     sync.RWMutex
+	loaded bool
+
+	Format    int
+	Documents map[string]*indexedDocument
+	// term, then document ID, then each place the term appears
+	Terms map[string]map[string][]termHit
+}
+
+// indexedDocument holds the text of each field of a document, which
+// snippets are cut from
+type indexedDocument struct {
+	ID       string
+	FileName string
+	Fields   []indexedField
+}
+
+type indexedField struct {
+	Name string
+	Page int
+	Text string
+}
+
+// termHit is one occurrence of a term: the field it is in, its position
+// among the field's words, and its byte range in the field's text
+type termHit struct {
+	Field    int
+	Position int
+	Start    int
+	End      int
+}
+
+type searchToken struct {
+	term       string
+	start, end int
+}
+
+// tokenizeSearchText splits text into lower case words of letters and
+// digits. Apostrophes inside a word are dropped, so "O'Brien" is "obrien".
+func tokenizeSearchText(text string, keepWildcards bool) []searchToken {
+	var tokens []searchToken
+	var term strings.Builder
+	start := -1
+
+	flush := func(end int) {
+		if start >= 0 && term.Len() > 0 {
+			tokens = append(tokens, searchToken{term: term.String(), start: start, end: end})
+		}
+		term.Reset()
+		start = -1
+	}
+
+	for i, r := range text {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || (keepWildcards && (r == '*' || r == '?')):
+			if start < 0 {
+				start = i
+			}
+			term.WriteRune(unicode.ToLower(r))
+		case (r == '\'' || r == '’') && start >= 0:
+			// part of the word when a letter follows
+			next, _ := utf8.DecodeRuneInString(text[i+utf8.RuneLen(r):])
+			if !unicode.IsLetter(next) {
+				flush(i)
+			}
+		default:
+			flush(i)
+		}
+	}
+	flush(len(text))
+
+	return tokens
+}
+
+// searchFields lists the fields a document is indexed under
+func searchFields(doc Document, pages []DocumentPage) []indexedField {
+	fields := []indexedField{{Name: SearchFieldFileName, Text: doc.FileName}}
+	if doc.Description != "" {
+		fields = append(fields, indexedField{Name: SearchFieldDescription, Text: doc.Description})
+	}
+	if len(doc.Tags) > 0 {
+		fields = append(fields, indexedField{Name: SearchFieldTags, Text: strings.Join(doc.Tags, ", ")})
+	}
+	fields = append(fields, indexedField{Name: SearchFieldFileType, Text: DocumentFileType(doc.FileName)})
+	for _, page := range pages {
+		fields = append(fields, indexedField{Name: SearchFieldText, Page: page.Number, Text: page.Text})
+	}
+	return fields
+}
+
+func (idx *caseIndex) add(doc Document, pages []DocumentPage) {
+	idx.remove(doc.ID)
+
+	indexed := &indexedDocument{ID: doc.ID, FileName: doc.FileName, Fields: searchFields(doc, pages)}
+	idx.Documents[doc.ID] = indexed
+
+	for f, field := range indexed.Fields {
+		for position, token := range tokenizeSearchText(field.Text, false) {
+			postings := idx.Terms[token.term]
+			if postings == nil {
+				postings = map[string][]termHit{}
+				idx.Terms[token.term] = postings
+			}
+			postings[doc.ID] = append(postings[doc.ID], termHit{Field: f, Position: position, Start: token.start, End: token.end})
+		}
+	}
+}
+
+func (idx *caseIndex) remove(documentID string) {
+	indexed, ok := idx.Documents[documentID]
+	if !ok {
+		return
+	}
+
+	for _, field := range indexed.Fields {
+		for _, token := range tokenizeSearchText(field.Text, false) {
+			if postings := idx.Terms[token.term]; postings != nil {
+				delete(postings, documentID)
+				if len(postings) == 0 {
+					delete(idx.Terms, token.term)
+				}
+			}
+		}
+	}
+	delete(idx.Documents, documentID)
+}
+
+// pages returns the extracted text a document was indexed with
+func (idx *caseIndex) pages(documentID string) []DocumentPage {
+	indexed, ok := idx.Documents[documentID]
+	if !ok {
+		return nil
+	}
+
+	var pages []DocumentPage
+	for _, field := range indexed.Fields {
+		if field.Name == SearchFieldText {
+			pages = append(pages, DocumentPage{Number: field.Page, Text: field.Text})
+		}
+	}
+	return pages
+}
+
+func searchIndexPath(caseID string) string {
+	return filepath.Join(searchIndexDir, filepath.Base(caseID)+".gob")
+}
+
+// openCaseIndex returns a case's index, loading it from disk or rebuilding
+// it on first use
+func openCaseIndex(caseID string) (*caseIndex, error) {
+	searchIndexesMu.Lock()
+	idx, ok := searchIndexes[caseID]
+	if !ok {
+		idx = &caseIndex{}
+		searchIndexes[caseID] = idx
+	}
+	searchIndexesMu.Unlock()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.loaded {
+		return idx, nil
+	}
+
+	if err := idx.load(caseID); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Rebuilding search index of case %s: %v", caseID, err)
+		}
+		if err := idx.rebuild(caseID); err != nil {
+			return nil, err
+		}
+		if err := idx.save(caseID); err != nil {
+			log.Printf("Error saving search index of case %s: %v", caseID, err)
+		}
+	}
+	idx.loaded = true
+
+	return idx, nil
+}
+
+func (idx *caseIndex) load(caseID string) error {
+	file, err := os.Open(searchIndexPath(caseID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var stored caseIndex
+	if err := gob.NewDecoder(file).Decode(&stored); err != nil {
+		return err
+	}
+	if stored.Format != searchIndexFormat {
+		return fmt.Errorf("index format %d is not %d", stored.Format, searchIndexFormat)
+	}
+
+	idx.Format, idx.Documents, idx.Terms = stored.Format, stored.Documents, stored.Terms
+	if idx.Documents == nil {
+		idx.Documents = map[string]*indexedDocument{}
+	}
+	if idx.Terms == nil {
+		idx.Terms = map[string]map[string][]termHit{}
+	}
+	return nil
+}
+
+// save writes the index to a temporary file and renames it into place, so
+// a crash leaves the old index rather than a partial one
+func (idx *caseIndex) save(caseID string) error {
+	if err := os.MkdirAll(searchIndexDir, 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(searchIndexDir, filepath.Base(caseID)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := gob.NewEncoder(file).Encode(idx); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), searchIndexPath(caseID))
+}
+
+// rebuild indexes a case's documents from DynamoDB and their stored text
+func (idx *caseIndex) rebuild(caseID string) error {
+	idx.Format = searchIndexFormat
+	idx.Documents = map[string]*indexedDocument{}
+	idx.Terms = map[string]map[string][]termHit{}
+
+	documents, err := GetDocumentsByCaseId(caseID)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range documents {
+		// listings leave out some attributes, so each document is read whole
+		full, err := GetDocumentById(doc.ID)
+		if err != nil {
+			return err
+		}
+		if full.ID == "" {
+			continue
+		}
+		text, err := GetDocumentText(full)
+		if err != nil {
+			log.Printf("Error reading text of document %s for search: %v", full.ID, err)
+		}
+		idx.add(full, text.Pages)
+	}
+	return nil
+}
+
+// searchUpdate is a change to a case's index
+type searchUpdate struct {
+	caseID string
+	apply  func(idx *caseIndex)
+	drop   bool
+}
+
+func queueSearchUpdate(update searchUpdate) {
+	searchUpdatesMu.Lock()
+	searchUpdates = append(searchUpdates, update)
+	searchUpdatesMu.Unlock()
+
+	select {
+	case searchWake <- struct{}{}:
+	default:
+	}
+}
+
+// StartSearchIndexer starts the goroutine that applies index updates
+func StartSearchIndexer(dir string) {
+	if dir != "" {
+		searchIndexDir = dir
+	}
+
+	go func() {
+		for range searchWake {
+			for {
+				searchUpdatesMu.Lock()
+				if len(searchUpdates) == 0 {
+					searchUpdatesMu.Unlock()
+					break
+				}
+				update := searchUpdates[0]
+				searchUpdates = searchUpdates[1:]
+				searchUpdatesMu.Unlock()
+
+				applySearchUpdate(update)
+			}
+		}
+	}()
+}
+
+func applySearchUpdate(update searchUpdate) {
+	if update.drop {
+		searchIndexesMu.Lock()
+		delete(searchIndexes, update.caseID)
+		searchIndexesMu.Unlock()
+		if err := os.Remove(searchIndexPath(update.caseID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting search index of case %s: %v", update.caseID, err)
+		}
+		return
+	}
+
+	idx, err := openCaseIndex(update.caseID)
+	if err != nil {
+		log.Printf("Error opening search index of case %s: %v", update.caseID, err)
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	update.apply(idx)
+	if err := idx.save(update.caseID); err != nil {
+		log.Printf("Error saving search index of case %s: %v", update.caseID, err)
+	}
+}
+
+// IndexDocument adds a document's metadata to its case's index, keeping the
+// text already indexed for it
+func IndexDocument(doc Document) {
+	queueSearchUpdate(searchUpdate{caseID: doc.CaseID, apply: func(idx *caseIndex) {
+		idx.add(doc, idx.pages(doc.ID))
+	}})
+}
+
+// IndexDocumentText indexes a document with the text extracted from its
+// current version. The document is read again first, so text that lost a
+// race with a deletion or a new version is not indexed.
+func IndexDocumentText(doc Document, pages []DocumentPage) {
+	queueSearchUpdate(searchUpdate{caseID: doc.CaseID, apply: func(idx *caseIndex) {
+		current, err := GetDocumentById(doc.ID)
+		if err != nil {
+			log.Printf("Error getting document %s for search: %v", doc.ID, err)
+			return
+		}
+		if current.ID == "" || current.CaseID != doc.CaseID || currentVersion(current) != currentVersion(doc) {
+			return
+		}
+		idx.add(current, pages)
+	}})
+}
+
+// IndexNewVersion indexes a revised document without its old text, which
+// is replaced once the new version is extracted
+func IndexNewVersion(doc Document) {
+	queueSearchUpdate(searchUpdate{caseID: doc.CaseID, apply: func(idx *caseIndex) {
+		idx.add(doc, nil)
+	}})
+}
+
+// IndexMovedDocument moves a document from one case's index to another's,
+// taking its stored text with it
+func IndexMovedDocument(doc Document, fromCaseID string) {
+	UnindexDocument(fromCaseID, doc.ID)
+	queueSearchUpdate(searchUpdate{caseID: doc.CaseID, apply: func(idx *caseIndex) {
+		full, err := GetDocumentById(doc.ID)
+		if err != nil || full.ID == "" {
+			log.Printf("Error getting moved document %s for search: %v", doc.ID, err)
+			return
+		}
+		text, err := GetDocumentText(full)
+		if err != nil {
+			log.Printf("Error reading text of document %s for search: %v", doc.ID, err)
+		}
+		idx.add(full, text.Pages)
+	}})
+}
+
+// UnindexDocument removes a document from its case's index
+func UnindexDocument(caseID string, documentID string) {
+	queueSearchUpdate(searchUpdate{caseID: caseID, apply: func(idx *caseIndex) {
+		idx.remove(documentID)
+	}})
+}
+
+// DropCaseIndex deletes the index of a deleted case
+func DropCaseIndex(caseID string) {
+	queueSearchUpdate(searchUpdate{caseID: caseID, drop: true})
+}
+
+// searchMatch is where a query matched within a document
+type searchMatch struct {
+	field      int
+	start, end int
+}
+
+type searchResult struct {
+	score   float64
+	matches []searchMatch
+}
+
+// searchNode is a parsed query
+type searchNode interface {
+	eval(idx *caseIndex) map[string]*searchResult
+}
+
+type termNode struct {
+	field string
+	term  string
+}
+
+type phraseNode struct {
+	field string
+	terms []string
+}
+
+type andNode struct{ children []searchNode }
+
+type orNode struct{ children []searchNode }
+
+type notNode struct{ child searchNode }
+
+// hits returns where a term, which may hold * and ? wildcards, appears in
+// each document, limited to one field when field is set
+func (idx *caseIndex) hits(term string, field string) map[string][]termHit {
+	terms := []string{term}
+	if strings.ContainsAny(term, "*?") {
+		terms = terms[:0]
+		for candidate := range idx.Terms {
+			if wildcardMatch(term, candidate) {
+				terms = append(terms, candidate)
+				if len(terms) >= maxWildcardTerms {
+					break
+				}
+			}
+		}
+	}
+
+	result := map[string][]termHit{}
+	for _, t := range terms {
+		for documentID, hits := range idx.Terms[t] {
+			fields := idx.Documents[documentID].Fields
+			for _, hit := range hits {
+				if field == "" || fields[hit.Field].Name == field {
+					result[documentID] = append(result[documentID], hit)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// idf weighs a match by how few of the case's documents it is found in
+func (idx *caseIndex) idf(documents int) float64 {
+	return math.Log(1 + float64(len(idx.Documents))/float64(max(documents, 1)))
+}
+
+func (idx *caseIndex) score(documentID string, field int) float64 {
+	if boost, ok := searchFieldBoost[idx.Documents[documentID].Fields[field].Name]; ok {
+		return boost
+	}
+	return 1
+}
+
+func (n termNode) eval(idx *caseIndex) map[string]*searchResult {
+	hits := idx.hits(n.term, n.field)
+	idf := idx.idf(len(hits))
+
+	results := map[string]*searchResult{}
+	for documentID, docHits := range hits {
+		result := &searchResult{}
+		for _, hit := range docHits {
+			result.matches = append(result.matches, searchMatch{field: hit.Field, start: hit.Start, end: hit.End})
+			result.score += idf * idx.score(documentID, hit.Field)
+		}
+		results[documentID] = result
+	}
+	return results
+}
+
+func (n phraseNode) eval(idx *caseIndex) map[string]*searchResult {
+	if len(n.terms) == 1 {
+		return termNode{field: n.field, term: n.terms[0]}.eval(idx)
+	}
+
+	type place struct{ field, position int }
+	hitsByTerm := make([]map[string][]termHit, len(n.terms))
+	for i, term := range n.terms {
+		hitsByTerm[i] = idx.hits(term, n.field)
+	}
+
+	results := map[string]*searchResult{}
+	for documentID, firstHits := range hitsByTerm[0] {
+		// where each later term of the phrase appears in the document
+		later := make([]map[place]termHit, len(n.terms))
+		for i := 1; i < len(n.terms); i++ {
+			later[i] = map[place]termHit{}
+			for _, hit := range hitsByTerm[i][documentID] {
+				later[i][place{hit.Field, hit.Position}] = hit
+			}
+		}
+
+		result := &searchResult{}
+		for _, first := range firstHits {
+			last, found := first, true
+			for i := 1; i < len(n.terms) && found; i++ {
+				last, found = later[i][place{first.Field, first.Position + i}]
+			}
+			if found {
+				result.matches = append(result.matches, searchMatch{field: first.Field, start: first.Start, end: last.End})
+				result.score += idx.score(documentID, first.Field)
+			}
+		}
+		if len(result.matches) > 0 {
+			results[documentID] = result
+		}
+	}
+
+	idf := idx.idf(len(results))
+	for _, result := range results {
+		result.score *= idf * float64(len(n.terms))
+	}
+	return results
+}
+
+func (n andNode) eval(idx *caseIndex) map[string]*searchResult {
+	var results map[string]*searchResult
+	var excluded []map[string]*searchResult
+
+	for _, child := range n.children {
+		// NOT only narrows the other terms of an AND
+		if not, ok := child.(notNode); ok {
+			excluded = append(excluded, not.child.eval(idx))
+			continue
+		}
+
+		childResults := child.eval(idx)
+		if results == nil {
+			results = childResults
+			continue
+		}
+		for documentID, result := range results {
+			other, ok := childResults[documentID]
+			if !ok {
+				delete(results, documentID)
+				continue
+			}
+			result.score += other.score
+			result.matches = append(result.matches, other.matches...)
+		}
+	}
+
+	// a query of only NOT terms matches every other document
+	if results == nil {
+		results = map[string]*searchResult{}
+		for documentID := range idx.Documents {
+			results[documentID] = &searchResult{}
+		}
+	}
+	for _, exclude := range excluded {
+		for documentID := range exclude {
+			delete(results, documentID)
+		}
+	}
+	return results
+}
+
+func (n orNode) eval(idx *caseIndex) map[string]*searchResult {
+	results := map[string]*searchResult{}
+	for _, child := range n.children {
+		for documentID, other := range child.eval(idx) {
+			result, ok := results[documentID]
+			if !ok {
+				results[documentID] = other
+				continue
+			}
+			result.score += other.score
+			result.matches = append(result.matches, other.matches...)
+		}
+	}
+	return results
+}
+
+func (n notNode) eval(idx *caseIndex) map[string]*searchResult {
+	return andNode{children: []searchNode{n}}.eval(idx)
+}
+
+// wildcardMatch matches a term against a pattern where * stands for any
+// run of characters and ? for any one
+func wildcardMatch(pattern string, term string) bool {
+	p, t := []rune(pattern), []rune(term)
+	star, mark := -1, 0
+	i, j := 0, 0
+	for j < len(t) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == t[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, mark = i, j
+			i++
+		case star >= 0:
+			i = star + 1
+			mark++
+			j = mark
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// ParseSearchQuery parses a query. Words must all match unless joined by
+// OR; NOT or a leading - excludes, quotes match a phrase, parentheses
+// group, * and ? are wildcards within a word, and field:word or
+// field:"phrase" searches one field.
+func ParseSearchQuery(query string) (searchNode, error) {
+	tokens, err := lexSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: query is empty", ErrInvalidQuery)
+	}
+
+	p := &queryParser{tokens: tokens}
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+	field  string
+}
+
+func lexSearchQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, queryToken{text: string(c)})
+			i++
+		default:
+			start := i
+			field := ""
+			if c != '"' {
+				for i < len(query) && !strings.ContainsRune(" \t\n\r()\"", rune(query[i])) {
+					i++
+				}
+				word := query[start:i]
+				// a colon after anything but a name, as in 10:30, is punctuation
+				if colon := strings.IndexByte(word, ':'); colon > 0 && isFieldName(strings.TrimLeft(word[:colon], "-")) {
+					name, ok := searchFieldAliases[strings.ToLower(strings.TrimLeft(word[:colon], "-"))]
+					if !ok {
+						return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidQuery, strings.TrimLeft(word[:colon], "-"))
+					}
+					field = name
+					negated := strings.HasPrefix(word, "-")
+					if colon == len(word)-1 && i < len(query) && query[i] == '"' {
+						// field:"phrase", handled below
+						if negated {
+							tokens = append(tokens, queryToken{text: "NOT"})
+						}
+						start = i
+						c = '"'
+					} else {
+						text := word[colon+1:]
+						if negated {
+							tokens = append(tokens, queryToken{text: "NOT"})
+						}
+						tokens = append(tokens, queryToken{text: text, field: field})
+						continue
+					}
+				} else {
+					tokens = append(tokens, queryToken{text: word})
+					continue
+				}
+			}
+
+			end := strings.IndexByte(query[start+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unclosed quote", ErrInvalidQuery)
+			}
+			tokens = append(tokens, queryToken{text: query[start+1 : start+1+end], quoted: true, field: field})
+			i = start + end + 2
+		}
+	}
+	return tokens, nil
+}
+
+func isFieldName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].field == "" && p.tokens[p.pos].text == text
+}
+
+func (p *queryParser) or() (searchNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []searchNode{left}
+	for p.peek("OR") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return orNode{children: children}, nil
+}
+
+func (p *queryParser) and() (searchNode, error) {
+	var children []searchNode
+	for p.pos < len(p.tokens) && !p.peek(")") && !p.peek("OR") {
+		if p.peek("AND") {
+			p.pos++
+			// like OR, AND needs a term on each side
+			if len(children) == 0 || p.pos >= len(p.tokens) || p.peek(")") || p.peek("OR") || p.peek("AND") {
+				return nil, fmt.Errorf("%w: AND needs a search term on each side", ErrInvalidQuery)
+			}
+			continue
+		}
+		child, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+
+	switch len(children) {
+	case 0:
+		return nil, fmt.Errorf("%w: expected a search term", ErrInvalidQuery)
+	case 1:
+		if _, ok := children[0].(notNode); !ok {
+			return children[0], nil
+		}
+	}
+	return andNode{children: children}, nil
+}
+
+func (p *queryParser) unary() (searchNode, error) {
+	if p.peek("NOT") || p.peek("-") {
+		p.pos++
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("%w: NOT needs a search term", ErrInvalidQuery)
+		}
+		child, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if child == nil {
+			return nil, fmt.Errorf("%w: NOT needs a search term", ErrInvalidQuery)
+		}
+		return notNode{child: child}, nil
+	}
+
+	token := p.tokens[p.pos]
+	if !token.quoted && token.field == "" && strings.HasPrefix(token.text, "-") && len(token.text) > 1 {
+		p.tokens[p.pos].text = token.text[1:]
+		child, err := p.unary()
+		if err != nil || child == nil {
+			return child, err
+		}
+		return notNode{child: child}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *queryParser) primary() (searchNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("%w: expected a search term", ErrInvalidQuery)
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	if !token.quoted && token.field == "" && token.text == "(" {
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("%w: missing )", ErrInvalidQuery)
+		}
+		p.pos++
+		return node, nil
+	}
+
+	var terms []string
+	for _, t := range tokenizeSearchText(token.text, true) {
+		if strings.Trim(t.term, "*?") == "" {
+			return nil, fmt.Errorf("%w: %q matches every word", ErrInvalidQuery, t.term)
+		}
+		terms = append(terms, t.term)
+	}
+	switch len(terms) {
+	case 0:
+		// punctuation alone matches nothing and is left out
+		return nil, nil
+	case 1:
+		return termNode{field: token.field, term: terms[0]}, nil
+	}
+	return phraseNode{field: token.field, terms: terms}, nil
+}
+
+// SearchCase runs a query against a case's documents, best match first,
+// and returns the total number of matches with the requested page of hits
+func SearchCase(caseID string, query searchNode, offset int, limit int) ([]SearchHit, int, error) {
+	idx, err := openCaseIndex(caseID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	results := query.eval(idx)
+	ids := make([]string, 0, len(results))
+	for documentID := range results {
+		ids = append(ids, documentID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := results[ids[i]], results[ids[j]]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		return ids[i] < ids[j]
+	})
+
+	hits := []SearchHit{}
+	for _, documentID := range ids[min(offset, len(ids)):min(offset+limit, len(ids))] {
+		indexed := idx.Documents[documentID]
+		hits = append(hits, SearchHit{
+			DocumentID: documentID,
+			FileName:   indexed.FileName,
+			Score:      math.Round(results[documentID].score*1000) / 1000,
+			Snippets:   searchSnippets(indexed, results[documentID].matches),
+		})
+	}
+	return hits, len(ids), nil
+}
+
+// searchSnippets cuts a passage around the first matches of each field and
+// page, with every match in it marked. The text is escaped as HTML so the
+// marks can be shown as they are.
+func searchSnippets(indexed *indexedDocument, matches []searchMatch) []SearchSnippet {
+	byField := map[int][]searchMatch{}
+	var fields []int
+	for _, match := range matches {
+		if _, ok := byField[match.field]; !ok {
+			fields = append(fields, match.field)
+		}
+		byField[match.field] = append(byField[match.field], match)
+	}
+	sort.Ints(fields)
+
+	snippets := []SearchSnippet{}
+	for _, f := range fields[:min(len(fields), maxSearchSnippets)] {
+		field := indexed.Fields[f]
+		fieldMatches := byField[f]
+		sort.Slice(fieldMatches, func(i, j int) bool { return fieldMatches[i].start < fieldMatches[j].start })
+
+		start := snippetBoundary(field.Text, fieldMatches[0].start-snippetContext, false)
+		end := snippetBoundary(field.Text, fieldMatches[0].end+snippetContext, true)
+
+		var text strings.Builder
+		if start > 0 {
+			text.WriteString("…")
+		}
+		pos := start
+		for _, match := range fieldMatches {
+			if match.start < pos || match.end > end {
+				continue
+			}
+			text.WriteString(html.EscapeString(field.Text[pos:match.start]))
+			text.WriteString("<mark>" + html.EscapeString(field.Text[match.start:match.end]) + "</mark>")
+			pos = match.end
+		}
+		text.WriteString(html.EscapeString(field.Text[pos:end]))
+		if end < len(field.Text) {
+			text.WriteString("…")
+		}
+
+		snippets = append(snippets, SearchSnippet{
+			Field: field.Name,
+			Page:  field.Page,
+			Text:  strings.Join(strings.Fields(text.String()), " "),
+		})
+	}
+	return snippets
+}
+
+// snippetBoundary moves a cut point in text to the nearest space outside
+// the context, or to the start or end of the text
+func snippetBoundary(text string, at int, forward bool) int {
+	if at <= 0 {
+		return 0
+	}
+	if at >= len(text) {
+		return len(text)
+	}
+
+	if forward {
+		if i := strings.IndexAny(text[at:], " \n\t"); i >= 0 {
+			return at + i
+		}
+		return len(text)
+	}
+	if i := strings.LastIndexAny(text[:at], " \n\t"); i >= 0 {
+		return i + 1
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseSearchQueryRejectsIncompleteQueries(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"NOT",
+		"-",
+		"--",
+		"foo -",
+		"foo NOT",
+		"foo AND NOT",
+		"NOT NOT",
+		"foo OR NOT",
+		"foo AND",
+		"AND foo",
+		"foo AND AND bar",
+		"foo AND OR bar",
+		"(foo AND)",
+		"foo OR",
+		"OR foo",
+		"(foo",
+		"foo)",
+		`"foo`,
+		"*",
+		"title:foo",
+	} {
+		if _, err := ParseSearchQuery(query); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("ParseSearchQuery(%q) error = %v, want ErrInvalidQuery", query, err)
+		}
+	}
+}
+
+func TestParseSearchQueryAcceptsValidQueries(t *testing.T) {
+	for _, query := range []string{
+		"foo",
+		"foo bar",
+		"foo AND bar",
+		"foo OR bar",
+		"foo -bar",
+		"foo NOT bar",
+		"NOT NOT foo",
+		"(foo OR bar) AND NOT baz",
+		`"breach of contract"`,
+		`name:"doe v roe"`,
+		"-tag:draft foo",
+		"contr* 10:30",
+	} {
+		if _, err := ParseSearchQuery(query); err != nil {
+			t.Errorf("ParseSearchQuery(%q) error = %v", query, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSessionToken(t *testing.T) {
+	t.Setenv("SESSION_SIGNING_KEY", "secret")
+
+	token, err := IssueSessionToken("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("X-User-ID", "u2")
+	if got := AuthenticatedUserID(r); got != "u1" {
+		t.Errorf("AuthenticatedUserID = %q, want u1", got)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged, _ := IssueSessionToken("u2")
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for _, bad := range []string{"", payload, forgedPayload + "." + signature, token + "x"} {
+		if got := verifySessionToken(bad); got != "" {
+			t.Errorf("verifySessionToken(%q) = %q, want no user", bad, got)
+		}
+	}
+
+	t.Setenv("SESSION_SIGNING_KEY", "other")
+	if got := verifySessionToken(token); got != "" {
+		t.Errorf("token signed with another key verified as %q", got)
+	}
+}
+
+func TestRequestActorIgnoresClaimedUser(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User-ID", "u1")
+	if got := RequestActor(r); got != "" {
+		t.Errorf("RequestActor = %q for an unauthenticated request", got)
+	}
+
+	r.Header.Set("X-Admin-Token", "admin-secret")
+	if got := RequestActor(r); got != auditAdminActor {
+		t.Errorf("RequestActor = %q, want %q", got, auditAdminActor)
+	}
+}
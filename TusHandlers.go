@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tusResumable marks a response as tus and rejects requests for another
+// protocol version
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		WriteError(w, r, http.StatusPreconditionFailed, CodeUnsupportedVersion, "Tus-Resumable must be "+TusVersion)
+		return false
+	}
+	return true
+}
+
+func writeTusUploadHeaders(w http.ResponseWriter, upload TusUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if expires, err := time.Parse(time.RFC3339, upload.ExpiresAt); err == nil {
+		w.Header().Set("Upload-Expires", expires.Format(http.TimeFormat))
+	}
+}
+
+// getTusUpload looks up the upload named in the path, writing an error if
+// there is none
+func getTusUpload(w http.ResponseWriter, r *http.Request) (TusUpload, bool) {
+	upload, err := GetTusUploadById(r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error getting upload: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get upload")
+		return TusUpload{}, false
+	}
+
+	if upload.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeUploadNotFound, "Upload not found")
+		return TusUpload{}, false
+	}
+
+	return upload, true
+}
+
+func TusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(MaxResumableUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateTusUploadHandler starts a resumable upload. Upload-Metadata must carry
+// the case_id and filename; the returned Location is where chunks are sent.
+func CreateTusUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+
+	var fieldErrors []FieldError
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "Upload-Length", Message: "must be a positive number of bytes"})
+	}
+
+	metadata, err := ParseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "Upload-Metadata", Message: err.Error()})
+	}
+
+	caseID, fileName := metadata["case_id"], metadata["filename"]
+	if fileName != "" {
+		fileName = filepath.Base(fileName)
+	}
+	if err == nil {
+		fieldErrors = append(fieldErrors, RequireFields("case_id", caseID, "filename", fileName)...)
+	}
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	if length > MaxResumableUploadSize {
+		WriteError(w, r, http.StatusRequestEntityTooLarge, CodeFileTooLarge, "Upload-Length must be at most "+strconv.FormatInt(MaxResumableUploadSize, 10))
+		return
+	}
+
+	if _, ok := allowedUploadTypes[strings.ToLower(filepath.Ext(fileName))]; !ok {
+		WriteError(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedFile, "File type "+strconv.Quote(filepath.Ext(fileName))+" is not allowed")
+		return
+	}
+
+	return_case, err := GetCaseFromId(caseID)
+	if err != nil {
+		log.Printf("Error getting case: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get case")
+		return
+	}
+
+	if return_case.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeCaseNotFound, "Case not found")
+		return
+	}
+
+	upload, err := CreateTusUpload(caseID, fileName, length)
+	if err != nil {
+		log.Printf("Error creating upload: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create upload")
+		return
+	}
+
+	writeTusUploadHeaders(w, upload)
+	w.Header().Set("Location", "/v1/tus/"+upload.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func HeadTusUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+
+	upload, ok := getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	writeTusUploadHeaders(w, upload)
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchTusUploadHandler stores a chunk at Upload-Offset. When the last byte
+// arrives the file is screened and registered as a Document whose ID is the
+// upload ID.
+func PatchTusUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		WriteError(w, r, http.StatusUnsupportedMediaType, CodeInvalidBody, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		WriteValidationError(w, r, []FieldError{{Field: "Upload-Offset", Message: "must be a number of bytes"}})
+		return
+	}
+
+	upload, ok := getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if offset != upload.Offset {
+		writeTusUploadHeaders(w, upload)
+		WriteError(w, r, http.StatusConflict, CodeOffsetMismatch, "Upload-Offset must be "+strconv.FormatInt(upload.Offset, 10))
+		return
+	}
+
+	remaining := upload.Length - upload.Offset
+	if r.ContentLength > remaining {
+		WriteError(w, r, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, "Chunk is longer than the rest of the upload")
+		return
+	}
+
+	if remaining > 0 {
+		upload, err = AppendTusUpload(upload, io.LimitReader(r.Body, remaining))
+		if errors.Is(err, ErrTusOffsetConflict) {
+			WriteError(w, r, http.StatusConflict, CodeOffsetMismatch, "Upload offset changed while the chunk was stored")
+			return
+		}
+		if err != nil {
+			log.Printf("Error storing chunk of upload %s: %v", upload.ID, err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to store chunk")
+			return
+		}
+	}
+
+	if upload.Offset == upload.Length && upload.DocumentID == "" {
+		upload, err = FinishTusUpload(upload)
+		var rejection *UploadRejection
+		if errors.As(err, &rejection) {
+			WriteUploadRejection(w, r, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Error finishing upload %s: %v", upload.ID, err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to register document")
+			return
+		}
+	}
+
+	writeTusUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func DeleteTusUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+
+	upload, ok := getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := TerminateTusUpload(upload); err != nil {
+		log.Printf("Error terminating upload %s: %v", upload.ID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to terminate upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
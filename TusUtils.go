@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+// resumable uploads follow the tus 1.0.0 protocol, https://tus.io
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,termination,expiration"
+)
+
+var (
+	MaxResumableUploadSize int64 = 5 << 30
+	ResumableUploadTTL           = 24 * time.Hour
+	// TusPrefix holds the bytes of each upload that do not yet fill a part
+	TusPrefix = "tus/"
+)
+
+// ErrTusOffsetConflict is returned when an upload's offset moved while a
+// chunk was being stored, because two PATCH requests ran at once
+var ErrTusOffsetConflict = errors.New("upload offset changed")
+
+// TusUpload tracks a resumable upload. Bytes are stored as parts of an S3
+// multipart upload of UploadPartSize each; the bytes past the last part are
+// kept as a tail object until a part fills up. The upload ID becomes the
+// Document ID once the upload finishes.
+type TusUpload struct {
+	ID         string   `json:"_id"`
+	CaseID     string   `json:"case_id"`
+	FileName   string   `json:"file_name"`
+	Key        string   `json:"key"`
+	Length     int64    `json:"length"`
+	Offset     int64    `json:"offset"`
+	S3UploadID string   `json:"s3_upload_id"`
+	Parts      []string `json:"parts"`
+	TailSize   int64    `json:"tail_size"`
+	DocumentID string   `json:"document_id,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at"`
+}
+
+func LoadResumableUploadLimits() {
+	if v := os.Getenv("MAX_RESUMABLE_UPLOAD_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("Invalid MAX_RESUMABLE_UPLOAD_SIZE %q: %v", v, err)
+		} else {
+			MaxResumableUploadSize = size
+		}
+	}
+
+	ResumableUploadTTL = time.Duration(envInt("RESUMABLE_UPLOAD_TTL_HOURS", 24)) * time.Hour
+}
+
+// ParseTusMetadata decodes an Upload-Metadata header of comma separated keys
+// and base64 values
+func ParseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("metadata key is empty")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+func tusTailKey(uploadID string) string {
+	return TusPrefix + uploadID + "/tail"
+}
+
+func CreateTusUpload(caseID string, fileName string, length int64) (TusUpload, error) {
+	now := time.Now().UTC()
+	upload := TusUpload{
+		ID:        generateRandomString(16),
+		CaseID:    caseID,
+		FileName:  fileName,
+		Key:       NewBlobKey(),
+		Length:    length,
+		Parts:     []string{},
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(ResumableUploadTTL).Format(time.RFC3339),
+	}
+
+	s3UploadID, err := StartMultipartUpload(upload.Key)
+	if err != nil {
+		return TusUpload{}, err
+	}
+	upload.S3UploadID = s3UploadID
+
+	av, err := dynamodbattribute.MarshalMap(upload)
+	if err != nil {
+		return TusUpload{}, err
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: &TusUploadsTable,
+	})
+
+	return upload, err
+}
+
+func GetTusUploadById(uploadID string) (TusUpload, error) {
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(uploadID),
+			},
+		},
+		TableName: &TusUploadsTable,
+	})
+	if err != nil || result.Item == nil {
+		return TusUpload{}, err
+	}
+
+	var upload TusUpload
+	err = dynamodbattribute.UnmarshalMap(result.Item, &upload)
+	return upload, err
+}
+
+// saveTusUpload stores an upload's progress if its offset is still
+// expectedOffset
+func saveTusUpload(upload TusUpload, expectedOffset int64) error {
+	av, err := dynamodbattribute.MarshalMap(upload)
+	if err != nil {
+		return err
+	}
+
+	cond := expression.Name("offset").Equal(expression.Value(expectedOffset))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		Item:                      av,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		TableName:                 &TusUploadsTable,
+	})
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrTusOffsetConflict
+	}
+
+	return err
+}
+
+func deleteTusUpload(uploadID string) error {
+	_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(uploadID),
+			},
+		},
+		TableName: &TusUploadsTable,
+	})
+
+	return err
+}
+
+// AppendTusUpload stores a chunk read from body at the upload's offset. A
+// chunk cut short by a dropped connection keeps whatever arrived, so the
+// client can resume from the returned offset. Once every byte is in, the
+// parts are joined into the object.
+func AppendTusUpload(upload TusUpload, body io.Reader) (TusUpload, error) {
+	var buf bytes.Buffer
+
+	hadTail := upload.TailSize > 0
+	if hadTail {
+		tail, err := DownloadFileFromS3(tusTailKey(upload.ID))
+		if err != nil {
+			return upload, err
+		}
+		_, err = io.Copy(&buf, tail)
+		tail.Close()
+		if err != nil {
+			return upload, err
+		}
+		if int64(buf.Len()) != upload.TailSize {
+			return upload, fmt.Errorf("tail of upload %s is %d bytes, expected %d", upload.ID, buf.Len(), upload.TailSize)
+		}
+	}
+
+	// a tail stored before UPLOAD_PART_SIZE was lowered fills a larger part
+	partSize := max(UploadPartSize, upload.TailSize)
+	partsSize := upload.Offset - upload.TailSize
+	for {
+		_, readErr := io.CopyN(&buf, body, partSize-int64(buf.Len()))
+
+		// a full part is sent at once unless it is the last, which waits for
+		// the multipart upload to be completed
+		if int64(buf.Len()) == partSize && partsSize+partSize < upload.Length {
+			etag, err := UploadPartToS3(upload.Key, upload.S3UploadID, int64(len(upload.Parts)+1), buf.Bytes())
+			if err != nil {
+				return upload, err
+			}
+
+			expectedOffset := upload.Offset
+			partsSize += partSize
+			upload.Parts = append(upload.Parts, etag)
+			upload.Offset = partsSize
+			upload.TailSize = 0
+			if err := saveTusUpload(upload, expectedOffset); err != nil {
+				return upload, err
+			}
+			if hadTail {
+				discardTusTail(upload.ID)
+				hadTail = false
+			}
+			partSize = UploadPartSize
+			buf.Reset()
+		}
+
+		if partsSize+int64(buf.Len()) == upload.Length {
+			break
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				log.Printf("Upload %s chunk ended early: %v", upload.ID, readErr)
+			}
+			break
+		}
+	}
+
+	var err error
+	switch received := partsSize + int64(buf.Len()); {
+	case received == upload.Length:
+		upload, err = assembleTusUpload(upload, buf.Bytes())
+	case received != upload.Offset:
+		upload, err = storeTusTail(upload, partsSize, buf.Bytes())
+	}
+
+	if err == nil && hadTail && upload.TailSize == 0 {
+		discardTusTail(upload.ID)
+	}
+
+	return upload, err
+}
+
+// discardTusTail removes a tail once its bytes went into a part
+func discardTusTail(uploadID string) {
+	if err := DeleteFileFromS3(tusTailKey(uploadID)); err != nil {
+		log.Printf("Error deleting tail of upload %s: %v", uploadID, err)
+	}
+}
+
+// storeTusTail keeps the bytes past the last part until a part fills up
+func storeTusTail(upload TusUpload, partsSize int64, tail []byte) (TusUpload, error) {
+	if _, err := UploadFileToS3(tusTailKey(upload.ID), tail); err != nil {
+		return upload, err
+	}
+
+	expectedOffset := upload.Offset
+	upload.TailSize = int64(len(tail))
+	upload.Offset = partsSize + upload.TailSize
+	return upload, saveTusUpload(upload, expectedOffset)
+}
+
+// assembleTusUpload sends the last part and completes the multipart upload
+func assembleTusUpload(upload TusUpload, last []byte) (TusUpload, error) {
+	if len(last) > 0 {
+		etag, err := UploadPartToS3(upload.Key, upload.S3UploadID, int64(len(upload.Parts)+1), last)
+		if err != nil {
+			return upload, err
+		}
+		upload.Parts = append(upload.Parts, etag)
+	}
+
+	if _, err := CompleteMultipartUpload(upload.Key, upload.S3UploadID, upload.Parts); err != nil {
+		return upload, err
+	}
+
+	expectedOffset := upload.Offset
+	upload.Offset = upload.Length
+	upload.TailSize = 0
+	return upload, saveTusUpload(upload, expectedOffset)
+}
+
+// FinishTusUpload screens a fully received upload and registers its document
+// against the case. Rejected files are removed along with the upload.
+func FinishTusUpload(upload TusUpload) (TusUpload, error) {
+	digest := sha256.New()
+	if err := ScreenStoredObject(upload.CaseID, upload.FileName, upload.Key, digest); err != nil {
+		var rejection *UploadRejection
+		if errors.As(err, &rejection) && rejection.Code != CodeScanFailed {
+			if err := deleteTusUpload(upload.ID); err != nil {
+				log.Printf("Error deleting rejected upload %s: %v", upload.ID, err)
+			}
+		}
+		return upload, err
+	}
+
+	stored := StoredUpload{Key: upload.Key, Size: upload.Length, SHA256: hex.EncodeToString(digest.Sum(nil))}
+	document, _, err := RegisterUploadedDocument(upload.ID, upload.CaseID, timestampedUploadKey(upload.CaseID, upload.FileName), stored, DuplicateFlag)
+	if err != nil {
+		return upload, err
+	}
+
+	upload.DocumentID = document.ID
+	return upload, saveTusUpload(upload, upload.Offset)
+}
+
+// TerminateTusUpload discards an upload and the bytes stored for it. Files
+// that were already registered as documents are left alone.
+func TerminateTusUpload(upload TusUpload) error {
+	if upload.Offset < upload.Length {
+		if err := AbortMultipartUpload(upload.Key, upload.S3UploadID); err != nil {
+			return err
+		}
+		if upload.TailSize > 0 {
+			if err := DeleteFileFromS3(tusTailKey(upload.ID)); err != nil {
+				return err
+			}
+		}
+	} else if upload.DocumentID == "" {
+		if err := DeleteFileFromS3(upload.Key); err != nil {
+			return err
+		}
+	}
+
+	return deleteTusUpload(upload.ID)
+}
+
+// ExpiredTusUploads lists the uploads past their Upload-Expires time
+func ExpiredTusUploads(now time.Time) ([]TusUpload, error) {
+	filt := expression.Name("expires_at").LessThan(expression.Value(now.UTC().Format(time.RFC3339)))
+
+	expr, err := expression.NewBuilder().WithFilter(filt).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []TusUpload
+	err = dynamo.ScanPages(&dynamodb.ScanInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		TableName:                 &TusUploadsTable,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var upload TusUpload
+			if err := dynamodbattribute.UnmarshalMap(item, &upload); err != nil {
+				log.Printf("Error unmarshalling upload: %v", err)
+				continue
+			}
+			expired = append(expired, upload)
+		}
+		return true
+	})
+
+	return expired, err
+}
+
+// SweepTusUploads terminates expired uploads
+func SweepTusUploads(now time.Time) (int, error) {
+	expired, err := ExpiredTusUploads(now)
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, upload := range expired {
+		if err := TerminateTusUpload(upload); err != nil {
+			log.Printf("Error terminating expired upload %s: %v", upload.ID, err)
+			continue
+		}
+		swept++
+	}
+
+	return swept, nil
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+var (
+	MaxUploadFileSize    int64 = 50 << 20
+	MaxUploadRequestSize int64 = 250 << 20
+	// files larger than UploadPartSize are stored as S3 multipart uploads,
+	// UploadConcurrency parts at a time, which bounds the memory held for
+	// each file to about UploadPartSize * UploadConcurrency
+	UploadPartSize    int64 = 8 << 20
+	UploadConcurrency       = 2
+	QuarantinePrefix        = "quarantine/"
+)
+
+// sniffLength is how much of an upload is read ahead to detect its type
+const sniffLength = 4096
+
+// errUploadTooLarge stops a file that passes MaxUploadFileSize mid-stream
+var errUploadTooLarge = errors.New("upload exceeds the file size limit")
+
+// allowedUploadTypes maps each accepted file extension to the content types
+// that sniffing may report for it
+var allowedUploadTypes = map[string][]string{
+	".pdf":  {"application/pdf"},
+	".docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	".png":  {"image/png"},
+	".jpg":  {"image/jpeg"},
+	".jpeg": {"image/jpeg"},
+	".gif":  {"image/gif"},
+	".bmp":  {"image/bmp"},
+	".webp": {"image/webp"},
+	".tif":  {"image/tiff"},
+	".tiff": {"image/tiff"},
+	".eml":  {"message/rfc822", "text/plain"},
+	".msg":  {"application/vnd.ms-outlook"},
+	".txt":  {"text/plain"},
+	".csv":  {"text/plain"},
+	".html": {"text/html", "text/plain"},
+	".htm":  {"text/html", "text/plain"},
+	".rtf":  {"application/rtf"},
+}
+
+// UploadRejection is returned when an uploaded file fails validation
+type UploadRejection struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *UploadRejection) Error() string {
+	return e.Message
+}
+
+func LoadUploadLimits() {
+	if v := os.Getenv("MAX_UPLOAD_FILE_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("Invalid MAX_UPLOAD_FILE_SIZE %q: %v", v, err)
+		} else {
+			MaxUploadFileSize = size
+		}
+	}
+
+	if v := os.Getenv("MAX_UPLOAD_REQUEST_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("Invalid MAX_UPLOAD_REQUEST_SIZE %q: %v", v, err)
+		} else {
+			MaxUploadRequestSize = size
+		}
+	}
+
+	if v := os.Getenv("UPLOAD_PART_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < s3manager.MinUploadPartSize {
+			log.Printf("Invalid UPLOAD_PART_SIZE %q, must be at least %d", v, s3manager.MinUploadPartSize)
+		} else {
+			UploadPartSize = size
+		}
+	}
+}
+
+// ReadUploadForm caps the request body at MaxUploadRequestSize and walks its
+// multipart form as it arrives. Each part named fileField is passed to onFile
+// as it streams once the case ID is known, either from caseID or from a
+// case_id field earlier in the form. Files sent before the case_id field are
+// spooled to temporary files and passed on when it arrives. It returns the
+// case ID.
+func ReadUploadForm(w http.ResponseWriter, r *http.Request, caseID string, fileField string, onFile func(caseID string, fileName string, content io.Reader) error) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadRequestSize)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return caseID, &UploadRejection{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidBody,
+			Message: "Failed to parse multipart form",
+		}
+	}
+
+	form := uploadForm{caseID: caseID, fromPath: caseID != "", fileField: fileField, onFile: onFile}
+	defer form.removeSpooled()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return form.caseID, nil
+		}
+		if err != nil {
+			return form.caseID, uploadReadRejection(err)
+		}
+
+		if err := form.readPart(part); err != nil {
+			return form.caseID, err
+		}
+	}
+}
+
+// uploadForm is the state of a form being read by ReadUploadForm
+type uploadForm struct {
+	caseID    string
+	fromPath  bool
+	fileField string
+	onFile    func(caseID string, fileName string, content io.Reader) error
+	spooled   []spooledUpload
+}
+
+// spooledUpload is a file that arrived before the case_id field
+type spooledUpload struct {
+	fileName string
+	file     *os.File
+}
+
+func (f *uploadForm) readPart(part *multipart.Part) error {
+	// closing drains whatever the handler did not read
+	defer part.Close()
+
+	switch {
+	case part.FormName() == "case_id" && part.FileName() == "" && !f.fromPath:
+		value, err := io.ReadAll(io.LimitReader(part, 1024))
+		if err != nil {
+			return uploadReadRejection(err)
+		}
+		f.caseID = string(value)
+		return f.sendSpooled()
+	case part.FormName() == f.fileField && part.FileName() != "":
+		if f.caseID == "" {
+			return f.spool(part)
+		}
+		return f.onFile(f.caseID, part.FileName(), part)
+	}
+
+	return nil
+}
+
+// spool copies a file to disk until the case ID is known. The request body
+// limit bounds how much can be spooled.
+func (f *uploadForm) spool(part *multipart.Part) error {
+	file, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return err
+	}
+	f.spooled = append(f.spooled, spooledUpload{fileName: part.FileName(), file: file})
+
+	if _, err := io.Copy(file, part); err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return err
+		}
+		return uploadReadRejection(err)
+	}
+	return nil
+}
+
+// sendSpooled passes the spooled files to onFile in the order they arrived
+func (f *uploadForm) sendSpooled() error {
+	if f.caseID == "" {
+		return nil
+	}
+
+	spooled := f.spooled
+	f.spooled = nil
+	defer removeSpooledUploads(spooled)
+
+	for _, upload := range spooled {
+		if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := f.onFile(f.caseID, upload.fileName, upload.file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *uploadForm) removeSpooled() {
+	removeSpooledUploads(f.spooled)
+}
+
+func removeSpooledUploads(spooled []spooledUpload) {
+	for _, upload := range spooled {
+		upload.file.Close()
+		os.Remove(upload.file.Name())
+	}
+}
+
+// uploadReadRejection reports a failure to read the request body
+func uploadReadRejection(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &UploadRejection{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeRequestTooLarge,
+			Message: fmt.Sprintf("Request exceeds the %d byte upload limit", MaxUploadRequestSize),
+		}
+	}
+
+	return &UploadRejection{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidBody,
+		Message: "Failed to read multipart form",
+	}
+}
+
+// timestampedUploadKey is the object key for a file uploaded to a case
+func timestampedUploadKey(caseID string, fileName string) string {
+	key := RemovePeriods(caseID + "/" + time.Now().Truncate(0).String())
+	return RemoveSpacesAndColons(key + fileName)
+}
+
+// SniffContentType detects the content type of an upload, extending
+// http.DetectContentType with the office, email and image formats it does
+// not recognise
+func SniffContentType(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("II*\x00")), bytes.HasPrefix(content, []byte("MM\x00*")):
+		return "image/tiff"
+	case bytes.HasPrefix(content, []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")):
+		return "application/vnd.ms-outlook"
+	case bytes.HasPrefix(content, []byte(`{\rtf`)):
+		return "application/rtf"
+	}
+
+	detected := http.DetectContentType(content)
+	mediaType := strings.TrimSpace(strings.Split(detected, ";")[0])
+
+	if mediaType == "application/zip" {
+		reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return mediaType
+		}
+		for _, f := range reader.File {
+			if f.Name == "word/document.xml" {
+				return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+			}
+		}
+		return mediaType
+	}
+
+	if mediaType == "text/plain" && looksLikeEmail(content) {
+		return "message/rfc822"
+	}
+
+	return mediaType
+}
+
+func looksLikeEmail(content []byte) bool {
+	head := content
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	lower := strings.ToLower(string(head))
+	return strings.Contains(lower, "from:") && (strings.Contains(lower, "subject:") || strings.Contains(lower, "message-id:"))
+}
+
+// ValidateUploadType checks that a file's extension is allowed and that its
+// sniffed content type matches it
+func ValidateUploadType(fileName string, contentType string) error {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	allowed, ok := allowedUploadTypes[ext]
+	if !ok {
+		return &UploadRejection{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    CodeUnsupportedFile,
+			Message: fmt.Sprintf("File type %q is not allowed", ext),
+		}
+	}
+
+	for _, t := range allowed {
+		if t == contentType {
+			return nil
+		}
+	}
+
+	return &UploadRejection{
+		Status:  http.StatusUnsupportedMediaType,
+		Code:    CodeUnsupportedFile,
+		Message: fmt.Sprintf("File %s has extension %s but content type %s", fileName, ext, contentType),
+	}
+}
+
+// StoredUpload describes a file written to storage by StoreUpload
+type StoredUpload struct {
+	Key         string
+	URL         string
+	Size        int64
+	ContentType string
+	// hex SHA-256 of the file
+	SHA256 string
+}
+
+// uploadSource counts the bytes read from an upload and stops it once it
+// passes the size limit
+type uploadSource struct {
+	reader   io.Reader
+	limit    int64
+	size     int64
+	tooLarge bool
+	err      error
+}
+
+func (s *uploadSource) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	s.size += int64(n)
+	if s.size > s.limit {
+		s.tooLarge = true
+		return n, errUploadTooLarge
+	}
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// markerWriter watches a stream for a byte sequence, which may be split
+// across writes
+type markerWriter struct {
+	marker []byte
+	tail   []byte
+	found  bool
+}
+
+func (m *markerWriter) Write(p []byte) (int, error) {
+	if m.found {
+		return len(p), nil
+	}
+
+	window := append(m.tail, p...)
+	m.found = bytes.Contains(window, m.marker)
+	if keep := len(m.marker) - 1; len(window) > keep {
+		window = window[len(window)-keep:]
+	}
+	m.tail = append(m.tail[:0], window...)
+
+	return len(p), nil
+}
+
+type scanOutcome struct {
+	result ScanResult
+	err    error
+}
+
+// StoreUpload streams a file into storage under key while validating it and
+// running it through the configured scanner, holding only the sniffed
+// header and the multipart buffers in memory. Files that fail validation or
+// scanning are removed again; infected files are moved to the quarantine
+// prefix.
+func StoreUpload(caseID string, fileName string, key string, content io.Reader) (StoredUpload, error) {
+	if _, ok := allowedUploadTypes[strings.ToLower(filepath.Ext(fileName))]; !ok {
+		return StoredUpload{}, ValidateUploadType(fileName, "")
+	}
+
+	source := &uploadSource{reader: content, limit: MaxUploadFileSize}
+	buffered := bufio.NewReaderSize(source, sniffLength)
+	head, _ := buffered.Peek(sniffLength)
+	if rejection := storeUploadRejection(fileName, source); rejection != nil {
+		return StoredUpload{}, rejection
+	}
+
+	contentType, docx, err := sniffUploadType(fileName, head)
+	if err != nil {
+		return StoredUpload{}, err
+	}
+
+	scanReader, scanWriter := io.Pipe()
+	scanned := make(chan scanOutcome, 1)
+	go func() {
+		result, err := scanner.Scan(fileName, scanReader)
+		// keep draining so a scanner that stops early does not stall the upload
+		io.Copy(io.Discard, scanReader)
+		scanned <- scanOutcome{result, err}
+	}()
+
+	digest := sha256.New()
+	copies := io.MultiWriter(scanWriter, digest)
+	if docx != nil {
+		copies = io.MultiWriter(scanWriter, digest, docx)
+	}
+
+	fileURL, uploadErr := StreamFileToS3(key, io.TeeReader(buffered, copies))
+	scanWriter.CloseWithError(uploadErr)
+	outcome := <-scanned
+
+	if rejection := storeUploadRejection(fileName, source); rejection != nil {
+		return StoredUpload{}, rejection
+	}
+	if uploadErr != nil {
+		log.Printf("Error uploading file %s: %v", fileName, uploadErr)
+		return StoredUpload{}, &UploadRejection{
+			Status:  http.StatusInternalServerError,
+			Code:    CodeInternal,
+			Message: "Failed to upload file to S3",
+		}
+	}
+
+	if err := screenStoredUpload(caseID, fileName, key, docx, outcome); err != nil {
+		return StoredUpload{}, err
+	}
+
+	return StoredUpload{
+		Key:         key,
+		URL:         fileURL,
+		Size:        source.size,
+		ContentType: contentType,
+		SHA256:      hex.EncodeToString(digest.Sum(nil)),
+	}, nil
+}
+
+// ScreenStoredObject runs the upload checks on a file that was written to
+// storage directly, reading it back from key. Rejected files are removed as
+// StoreUpload would. When digest is not nil the whole file is read into it.
+func ScreenStoredObject(caseID string, fileName string, key string, digest hash.Hash) error {
+	body, err := DownloadFileFromS3(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	buffered := bufio.NewReaderSize(body, sniffLength)
+	head, err := buffered.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	_, docx, err := sniffUploadType(fileName, head)
+	if err != nil {
+		discardStoredUpload(key)
+		return err
+	}
+
+	var copies []io.Writer
+	if docx != nil {
+		copies = append(copies, docx)
+	}
+	if digest != nil {
+		copies = append(copies, digest)
+	}
+
+	var content io.Reader = buffered
+	if len(copies) > 0 {
+		content = io.TeeReader(buffered, io.MultiWriter(copies...))
+	}
+
+	result, scanErr := scanner.Scan(fileName, content)
+	if len(copies) > 0 && scanErr == nil {
+		// the scanner may not have read to the end
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			return err
+		}
+	}
+
+	return screenStoredUpload(caseID, fileName, key, docx, scanOutcome{result, scanErr})
+}
+
+// sniffUploadType validates a file's type from its first sniffLength bytes.
+// A DOCX is a zip holding word/document.xml, which the header alone cannot
+// show, so for those it also returns a writer that must see the whole file.
+func sniffUploadType(fileName string, head []byte) (string, *markerWriter, error) {
+	contentType := SniffContentType(head)
+
+	var docx *markerWriter
+	if strings.EqualFold(filepath.Ext(fileName), ".docx") && contentType == "application/zip" {
+		docx = &markerWriter{marker: []byte("word/document.xml")}
+		contentType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	}
+
+	if err := ValidateUploadType(fileName, contentType); err != nil {
+		return "", nil, err
+	}
+
+	return contentType, docx, nil
+}
+
+// screenStoredUpload acts on the checks made while a stored file was read:
+// it removes files that are not really DOCX or could not be scanned, and
+// moves infected files to the quarantine prefix
+func screenStoredUpload(caseID string, fileName string, key string, docx *markerWriter, outcome scanOutcome) error {
+	if docx != nil && !docx.found {
+		discardStoredUpload(key)
+		return &UploadRejection{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    CodeUnsupportedFile,
+			Message: fmt.Sprintf("File %s has extension .docx but content type application/zip", fileName),
+		}
+	}
+
+	if errors.Is(outcome.err, ErrScanSizeLimit) {
+		discardStoredUpload(key)
+		return &UploadRejection{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeFileTooLarge,
+			Message: fmt.Sprintf("File %s exceeds the malware scanner's size limit", fileName),
+		}
+	}
+
+	if outcome.err != nil {
+		log.Printf("Error scanning file %s: %v", fileName, outcome.err)
+		discardStoredUpload(key)
+		return &UploadRejection{
+			Status:  http.StatusServiceUnavailable,
+			Code:    CodeScanFailed,
+			Message: "Failed to scan file",
+		}
+	}
+
+	if !outcome.result.Infected {
+		return nil
+	}
+
+	log.Printf("Infected upload %s for case %s: %s", fileName, caseID, outcome.result.Signature)
+
+	quarantineName := RemoveSpacesAndColons(QuarantinePrefix + caseID + "/" + generateRandomString(8) + "-" + fileName)
+	if _, err := CopyFileInS3(key, quarantineName); err != nil {
+		log.Printf("Error quarantining file %s: %v", fileName, err)
+	}
+	discardStoredUpload(key)
+
+	return &UploadRejection{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeFileInfected,
+		Message: fmt.Sprintf("File %s failed malware scan: %s", fileName, outcome.result.Signature),
+	}
+}
+
+// storeUploadRejection reports a file that passed the size limit or a body
+// that could not be read while it was streaming
+func storeUploadRejection(fileName string, source *uploadSource) error {
+	if source.tooLarge {
+		return &UploadRejection{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeFileTooLarge,
+			Message: fmt.Sprintf("File %s exceeds the %d byte limit", fileName, MaxUploadFileSize),
+		}
+	}
+	if source.err != nil {
+		return uploadReadRejection(source.err)
+	}
+	return nil
+}
+
+// discardStoredUploads removes files stored for a request that failed
+func discardStoredUploads(uploads []StoredUpload) {
+	for _, stored := range uploads {
+		discardStoredUpload(stored.Key)
+	}
+}
+
+func discardStoredUpload(key string) {
+	if err := DeleteFileFromS3(key); err != nil {
+		log.Printf("Error deleting rejected upload %s: %v", key, err)
+	}
+}
+
+// RegisterUploadedDocument creates the document for a file already stored
+// and screened, and counts it on the case, as /createDocuments does. The
+// file is kept as a shared blob. When the case already has a document with
+// the same content, onDuplicate says whether the new one is flagged, linked
+// or skipped; a skipped upload returns the existing document and true.
+func RegisterUploadedDocument(documentID string, caseID string, fileName string, stored StoredUpload, onDuplicate string) (Document, bool, error) {
+	key, err := StoreBlob(stored.Key, stored.SHA256, stored.Size)
+	if err != nil {
+		return Document{}, false, err
+	}
+
+	original, err := FindDocumentByHash(caseID, stored.SHA256, "")
+	if err != nil {
+		releaseBlobAfterFailure(stored.SHA256)
+		return Document{}, false, err
+	}
+
+	if original.ID != "" && onDuplicate == DuplicateSkip {
+		releaseBlobAfterFailure(stored.SHA256)
+		return original, true, nil
+	}
+
+	document := Document{
+		ID:        documentID,
+		FileName:  fileName,
+		CaseID:    caseID,
+		Date:      time.Now().Truncate(0).String(),
+		FileURL:   fmt.Sprintf("https://%s.s3.amazonaws.com/%s", Bucket, key),
+		Relevancy: 0.0,
+		Stored:    false,
+		SHA256:    stored.SHA256,
+
+		ProcessingStatus: ProcessingPending,
+	}
+	markDuplicate(&document, original, onDuplicate == DuplicateLink)
+
+	if err := UploadDocumentDynamo(document); err != nil {
+		releaseBlobAfterFailure(stored.SHA256)
+		return Document{}, false, err
+	}
+
+	CaseUpdateNumberFiles(caseID)
+	EmitWebhookEvent(WebhookDocumentCreated, "", caseID, document)
+	IndexDocument(document)
+	QueueExtraction(document)
+
+	return document, false, nil
+}
+
+func releaseBlobAfterFailure(sha string) {
+	if err := ReleaseBlob(sha); err != nil {
+		log.Printf("Error releasing blob %s: %v", sha, err)
+	}
+}
+
+// WriteUploadRejection writes the response for a validation or scanning
+// error returned by ReadUploadForm or StoreUpload
+func WriteUploadRejection(w http.ResponseWriter, r *http.Request, err error) {
+	var rejection *UploadRejection
+	if errors.As(err, &rejection) {
+		WriteError(w, r, rejection.Status, rejection.Code, rejection.Message)
+		return
+	}
+
+	WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to validate file")
+}
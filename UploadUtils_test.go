@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestReadUploadFormSpoolsFilesBeforeCaseID(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, file := range []struct{ name, content string }{{"a.txt", "first"}, {"b.txt", "second"}} {
+		part, _ := form.CreateFormFile("files", file.name)
+		part.Write([]byte(file.content))
+	}
+	form.WriteField("case_id", "case-1")
+	part, _ := form.CreateFormFile("files", "c.txt")
+	part.Write([]byte("third"))
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/uploadDocuments", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+
+	var got []string
+	caseID, err := ReadUploadForm(httptest.NewRecorder(), r, "", "files", func(caseID string, name string, content io.Reader) error {
+		data, err := io.ReadAll(content)
+		got = append(got, caseID+":"+name+":"+string(data))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ReadUploadForm returned %v", err)
+	}
+	if caseID != "case-1" {
+		t.Errorf("case ID = %q", caseID)
+	}
+
+	want := []string{"case-1:a.txt:first", "case-1:b.txt:second", "case-1:c.txt:third"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+}
@@ -1,374 +1,379 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
+	"errors"
 	"log"
-
 	"net/http"
+	"net/mail"
+	"strings"
 )
 
+// publicUser clears the password hash from a user sent to a client
+func publicUser(user User) User {
+	user.Password = ""
+	return user
+}
+
 func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Request method: %s, Request URL: %s", r.Method, r.URL)
 
 	var user User
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	log.Printf("Request body read successfully: %s", body)
-
-	if err := json.Unmarshal(body, &user); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &user) {
 		return
 	}
 
-	log.Printf("Request body unmarshalled successfully: %+v", user)
+	log.Printf("Request body unmarshalled successfully: %s", user.Email)
 
-	err = createUser(user)
+	err := createUser(user)
 
 	log.Printf("User Created")
 
 	if err != nil {
 		log.Printf("Error creating user: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to create user",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create user")
 		return
 	}
 
-	log.Printf("User created successfully: %+v", user)
+	log.Printf("User created successfully: %s", user.Email)
 
-	response := SuccessResponse{
-		Message: "User created successfully",
-		Status:  http.StatusCreated,
-		Object:  user,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+	WriteSuccess(w, r, http.StatusCreated, "User created successfully", publicUser(user))
 }
 
 func AuthorizeUserHandler(w http.ResponseWriter, r *http.Request) {
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	var loginUser LoginUser
-
-	if err := json.Unmarshal(body, &loginUser); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &loginUser) {
 		return
 	}
 
-	var user User
-
-	log.Printf("Request body unmarshalled successfully: %+v", loginUser)
+	log.Printf("Request body unmarshalled successfully: %s", loginUser.Email)
 
-	user, err = getUserFromEmail(loginUser.Email)
-
-	log.Printf("User: %+v", user)
+	user, err := getUserFromEmail(loginUser.Email)
 
 	if err != nil {
 		log.Printf("Error getting user: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to get user",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get user")
 		return
 	}
 
 	if user.ID == "" {
 		log.Printf("User not found: %s", loginUser.Email)
-		response := ErrorResponse{
-			Message: "User not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		RecordAuditEvent(r, AuditLoginFailure, AuditEvent{
+			Details: auditDetails("email", loginUser.Email, "reason", "user_not_found"),
+		})
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
 		return
 	}
 
-
-	if loginUser.Password != user.Password {
+	if !CheckPassword(user.Password, loginUser.Password) {
 		log.Printf("Passwords do not match")
-		response := ErrorResponse{
-			Message: "Passwords do not match",
-			Status:  http.StatusUnauthorized,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(response)
+		RecordAuditEvent(r, AuditLoginFailure, AuditEvent{
+			TargetID: user.ID,
+			Details:  auditDetails("email", loginUser.Email, "reason", "password_mismatch"),
+		})
+		WriteError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Passwords do not match")
 		return
 	}
 
-	response := SuccessResponse{
-		Message: "User authorized successfully",
-		Status:  http.StatusOK,
-		Object:  user,
+	RecordAuditEvent(r, AuditLoginSuccess, AuditEvent{
+		ActorID:  user.ID,
+		TargetID: user.ID,
+	})
+
+	// passwords stored before hashing are hashed once they are known
+	if !isPasswordHash(user.Password) {
+		if err := setUserPassword(user.ID, loginUser.Password); err != nil {
+			log.Printf("Error hashing password of user %s: %v", user.ID, err)
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
 
-}
+	if user.Token, err = IssueSessionToken(user.ID); err != nil {
+		log.Printf("Error issuing session token: %v", err)
+	}
 
-func GetUserHandler(w http.ResponseWriter, r *http.Request) {
-	var user User
+	WriteSuccess(w, r, http.StatusOK, "User authorized successfully", publicUser(user))
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
+}
 
+func GetUserHandler(w http.ResponseWriter, r *http.Request) {
 	var getUserRequest struct {
 		ID string `json:"_id"`
 	}
 
-	if err := json.Unmarshal(body, &getUserRequest); err != nil {
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &getUserRequest) {
 		return
 	}
 
-	user, err = getUserFromId(getUserRequest.ID)
+	getUser(w, r, getUserRequest.ID)
+}
+
+func getUser(w http.ResponseWriter, r *http.Request, userID string) {
+	user, err := getUserFromId(userID)
 	if err != nil {
-		response := ErrorResponse{
-			Message: "Failed to get user",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get user")
 		return
 	}
 
 	//check if user exists
 	if user.ID == "" {
-		response := ErrorResponse{
-			Message: "User not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
 		return
 	}
-	
+
 	// return user
-	response := SuccessResponse{
-		Message: "User retrieved successfully",
-		Status:  http.StatusOK,
-		Object:  user,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	WriteSuccess(w, r, http.StatusOK, "User retrieved successfully", publicUser(user))
 }
 
 func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
 	var deleteUserRequest struct {
-		ID string `json:"_id"`
+		ID    string `json:"_id"`
 		Email string `json:"email"`
 	}
 
-	if err := json.Unmarshal(body, &deleteUserRequest); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &deleteUserRequest) {
 		return
 	}
 
 	log.Printf("Request body unmarshalled successfully: %+v", deleteUserRequest)
 
-	var user User
+	deleteUser(w, r, deleteUserRequest.ID, deleteUserRequest.Email)
+}
 
-	user, err = deleteUserFromId(deleteUserRequest.ID, deleteUserRequest.Email)
+func deleteUser(w http.ResponseWriter, r *http.Request, userID string, email string) {
+	user, err := deleteUserFromId(userID, email)
 	if err != nil {
 		log.Printf("Error deleting user: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to delete user",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete user")
 		return
 	}
 
 	//check if user
 	if user.ID == "" {
-		log.Printf("User not found: %s", deleteUserRequest.Email)
-		response := ErrorResponse{
-			Message: "User not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		log.Printf("User not found: %s", email)
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
 		return
 	}
 
-	log.Printf("User deleted successfully: %s", deleteUserRequest.Email)
+	log.Printf("User deleted successfully: %s", email)
 
-	response := SuccessResponse{
-		Message: "User deleted successfully",
-		Status:  http.StatusOK,
-		Object:  user,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	RecordAuditEvent(r, AuditUserDeleted, AuditEvent{
+		TargetID: user.ID,
+	})
+
+	WriteSuccess(w, r, http.StatusOK, "User deleted successfully", publicUser(user))
 }
 
 func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
-	var user User
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+	var updateUserRequest struct {
+		ID       string   `json:"_id"`
+		Password *string  `json:"password"`
+		Cases    []string `json:"cases"`
+		UserProfileUpdate
 	}
 
 	//parse request body into user object
-	if err := json.Unmarshal(body, &user); err != nil {
-		log.Printf("Error unmarshalling request body: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to read request body",
-			Status:  http.StatusBadRequest,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if !DecodeJSONBody(w, r, &updateUserRequest) {
+		return
+	}
+
+	if fieldErrors := RequireFields("_id", updateUserRequest.ID); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	// passwords only change through /changePassword. The field is rejected
+	// without looking at the stored one so the response says nothing about it.
+	if updateUserRequest.Password != nil {
+		WriteValidationError(w, r, []FieldError{{Field: "password", Message: "must be changed through /changePassword"}})
+		return
+	}
+
+	// a user's cases are the cases with their user_id, not a stored list
+	if updateUserRequest.Cases != nil {
+		WriteValidationError(w, r, []FieldError{{Field: "cases", Message: "cannot be changed; set a case's user_id instead"}})
 		return
 	}
 
-	//check to see if all fields are filled
-	if user.ID == "" || user.Email == "" || user.FirstName == "" || user.LastName == "" || user.Organization == "" || user.Password == "" || user.ProfilePicture == "" {
-		log.Printf("Error: All fields must be filled")
-		response := ErrorResponse{
-			Message: "All fields must be filled",
-			Status:  http.StatusBadRequest,
+	updateUserProfile(w, r, updateUserRequest.ID, updateUserRequest.UserProfileUpdate)
+}
+
+func validateUserProfileUpdate(update UserProfileUpdate) []FieldError {
+	var fieldErrors []FieldError
+
+	if update.Email != nil {
+		if _, err := mail.ParseAddress(*update.Email); err != nil || !strings.Contains(*update.Email, "@") {
+			fieldErrors = append(fieldErrors, FieldError{Field: "email", Message: "must be a valid email address"})
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	}
+	if update.FirstName != nil && strings.TrimSpace(*update.FirstName) == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "first_name", Message: "must not be empty"})
+	}
+	if update.LastName != nil && strings.TrimSpace(*update.LastName) == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "last_name", Message: "must not be empty"})
+	}
+
+	return fieldErrors
+}
+
+func updateUserProfile(w http.ResponseWriter, r *http.Request, userID string, update UserProfileUpdate) {
+	if fieldErrors := validateUserProfileUpdate(update); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
 		return
 	}
 
-	var return_user User
+	// "Ann <ann@example.com>" is stored as ann@example.com
+	if update.Email != nil {
+		addr, _ := mail.ParseAddress(*update.Email)
+		update.Email = &addr.Address
+	}
+
+	// check the new email is free before changing anything
+	if update.Email != nil {
+		existing, err := getUserFromEmail(*update.Email)
+		if err != nil {
+			log.Printf("Error getting user: %v", err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update user")
+			return
+		}
+		if existing.ID != "" && existing.ID != userID {
+			WriteError(w, r, http.StatusConflict, CodeEmailTaken, "Email is already in use")
+			return
+		}
+	}
 
 	//update user
-	return_user, err = updateUser(user)
+	return_user, err := updateUserFields(userID, update)
 	if err != nil {
 		log.Printf("Error updating user: %v", err)
-		response := ErrorResponse{
-			Message: "Failed to update user",
-			Status:  http.StatusInternalServerError,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to update user")
 		return
 	}
 
 	//check if user exists:
 	if return_user.ID == "" {
-		log.Printf("User not found: %s", user.Email)
-		response := ErrorResponse{
-			Message: "User not found",
-			Status:  http.StatusNotFound,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		log.Printf("User not found: %s", userID)
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
 		return
 	}
 
+	if update.Email != nil && *update.Email != return_user.Email {
+		err := requestEmailChange(return_user, *update.Email)
+		if errors.Is(err, ErrEmailTaken) {
+			WriteError(w, r, http.StatusConflict, CodeEmailTaken, "Email is already in use")
+			return
+		}
+		if err != nil {
+			log.Printf("Error requesting email change: %v", err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to send email verification")
+			return
+		}
+
+		return_user.PendingEmail = *update.Email
+		RecordAuditEvent(r, AuditEmailChangeRequested, AuditEvent{
+			TargetID: return_user.ID,
+			Details:  auditDetails("pending_email", *update.Email),
+		})
+	}
+
 	//return success
-	response := SuccessResponse{
-		Message: "User updated successfully",
-		Status:  http.StatusOK,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
-}
\ No newline at end of file
+	WriteSuccess(w, r, http.StatusOK, "User updated successfully", publicUser(return_user))
+}
+
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var verifyEmailRequest struct {
+		ID    string `json:"_id"`
+		Token string `json:"token"`
+	}
+
+	if !DecodeJSONBody(w, r, &verifyEmailRequest) {
+		return
+	}
+
+	verifyEmail(w, r, verifyEmailRequest.ID, verifyEmailRequest.Token)
+}
+
+func verifyEmail(w http.ResponseWriter, r *http.Request, userID string, token string) {
+	if fieldErrors := RequireFields("token", token); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	user, err := confirmEmailChange(userID, token)
+	switch {
+	case errors.Is(err, ErrInvalidToken):
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidToken, "Verification token is invalid or expired")
+		return
+	case errors.Is(err, ErrEmailTaken):
+		WriteError(w, r, http.StatusConflict, CodeEmailTaken, "Email is already in use")
+		return
+	case err != nil:
+		log.Printf("Error verifying email: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to verify email")
+		return
+	}
+
+	if user.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	}
+
+	RecordAuditEvent(r, AuditEmailChanged, AuditEvent{
+		TargetID: user.ID,
+		Details:  auditDetails("email", user.Email),
+	})
+
+	WriteSuccess(w, r, http.StatusOK, "Email verified successfully", publicUser(user))
+}
+
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var changePasswordRequest struct {
+		ID string `json:"_id"`
+		PasswordChange
+	}
+
+	if !DecodeJSONBody(w, r, &changePasswordRequest) {
+		return
+	}
+
+	updatePassword(w, r, changePasswordRequest.ID, changePasswordRequest.PasswordChange)
+}
+
+func updatePassword(w http.ResponseWriter, r *http.Request, userID string, change PasswordChange) {
+	fieldErrors := RequireFields(
+		"current_password", change.CurrentPassword,
+		"new_password", change.NewPassword,
+	)
+	if change.NewPassword != "" && len(change.NewPassword) < 8 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "new_password", Message: "must be at least 8 characters"})
+	}
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	user, err := changePassword(userID, change.CurrentPassword, change.NewPassword)
+	if errors.Is(err, ErrInvalidCredentials) {
+		RecordAuditEvent(r, AuditLoginFailure, AuditEvent{
+			TargetID: userID,
+			Details:  auditDetails("reason", "password_change_mismatch"),
+		})
+		WriteError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Current password does not match")
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing password: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to change password")
+		return
+	}
+
+	if user.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	}
+
+	RecordAuditEvent(r, AuditPasswordChange, AuditEvent{
+		ActorID:  user.ID,
+		TargetID: user.ID,
+	})
+
+	WriteSuccess(w, r, http.StatusOK, "Password changed successfully", nil)
+}
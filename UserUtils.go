@@ -1,18 +1,29 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
 )
 
 func createUser(user User) error {
-	//print user
-	log.Printf("User: %+v", user)
+	passwordHash, err := HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
 
-	_, err := dynamo.PutItem(&dynamodb.PutItemInput{
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
 		Item: map[string]*dynamodb.AttributeValue{
 			"_id": {
 				S: aws.String(generateRandomString(16)),
@@ -33,7 +44,7 @@ func createUser(user User) error {
 				S: aws.String(user.Organization),
 			},
 			"password": {
-				S: aws.String(user.Password),
+				S: aws.String(passwordHash),
 			},
 			"profile_picture": {
 				S: aws.String(user.ProfilePicture),
@@ -145,6 +156,9 @@ func getUserFromId(id string) (User, error) {
 		Password:       *new_result["password"].S,
 		ProfilePicture: *new_result["profile_picture"].S,
 	}
+	if pendingEmail, ok := new_result["pending_email"]; ok && pendingEmail.S != nil {
+		user.PendingEmail = *pendingEmail.S
+	}
 
 	log.Printf("User: %+v", user)
 
@@ -176,60 +190,258 @@ func deleteUserFromId(id string, email string) (user User, err error) {
 	return user, err
 }
 
-func updateUser(user User) ( User,  error) {
-	//get user by id
-	var return_user User
+var (
+	ErrEmailTaken         = errors.New("email is already in use")
+	ErrInvalidToken       = errors.New("verification token is invalid or expired")
+	ErrInvalidCredentials = errors.New("current password does not match")
+)
 
-	var err error
+// EmailVerificationTTL is how long an email change link stays valid
+var EmailVerificationTTL = 24 * time.Hour
 
-	log.Printf("FromUpdateUser Before User: %+v", user)
-	return_user, err = getUserFromId(user.ID)
-	log.Printf("FromUpdateUser AFter User: %+v", return_user)
-	if err != nil {
-		return return_user, err
+// updateUserFields applies the non-nil profile fields of update and returns
+// the updated user. It returns an empty User if the user does not exist.
+func updateUserFields(userID string, update UserProfileUpdate) (User, error) {
+	user, err := getUserFromId(userID)
+	if err != nil || user.ID == "" {
+		return user, err
+	}
+
+	fields := []struct {
+		name    string
+		current *string
+		value   *string
+	}{
+		{"first_name", &user.FirstName, update.FirstName},
+		{"last_name", &user.LastName, update.LastName},
+		{"organization", &user.Organization, update.Organization},
+		{"profile_picture", &user.ProfilePicture, update.ProfilePicture},
+	}
+
+	var set expression.UpdateBuilder
+	changed := false
+	for _, f := range fields {
+		if f.value == nil || *f.value == *f.current {
+			continue
+		}
+		set = set.Set(expression.Name(f.name), expression.Value(*f.value))
+		*f.current = *f.value
+		changed = true
+	}
+
+	if !changed {
+		return user, nil
 	}
-	if return_user.ID == "" {
-		return return_user, err
+
+	expr, err := expression.NewBuilder().WithUpdate(set).Build()
+	if err != nil {
+		return User{}, err
 	}
 
 	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
-		ExpressionAttributeNames: map[string]*string{
-			"#A": aws.String("first_name"),
-			"#B": aws.String("last_name"),
-			"#C": aws.String("organization"),
-			"#D": aws.String("profile_picture"),
-			"#E": aws.String("email"),
-			"#F":  aws.String("password"),
-		},
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":first_name": {
-				S: aws.String(user.FirstName),
-			},
-			":last_name": {
-				S: aws.String(user.LastName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(userID),
 			},
-			":organization": {
-				S: aws.String(user.Organization),
+		},
+		TableName: &UsersTable,
+	})
+
+	return user, err
+}
+
+func hashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestEmailChange stores newEmail as the user's pending email and mails a
+// verification token to it. The email on the account only changes once the
+// token is confirmed.
+func requestEmailChange(user User, newEmail string) error {
+	existing, err := getUserFromEmail(newEmail)
+	if err != nil {
+		return err
+	}
+	if existing.ID != "" {
+		return ErrEmailTaken
+	}
+
+	token := generateRandomString(32)
+	expiresAt := time.Now().UTC().Add(EmailVerificationTTL).Format(time.RFC3339)
+
+	update := expression.
+		Set(expression.Name("pending_email"), expression.Value(newEmail)).
+		Set(expression.Name("email_token_hash"), expression.Value(hashVerificationToken(token))).
+		Set(expression.Name("email_token_expires"), expression.Value(expiresAt))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(user.ID),
 			},
-			":profile_picture": {
-				S: aws.String(user.ProfilePicture),
+		},
+		TableName: &UsersTable,
+	})
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Use this code to confirm %s as the email for your Avalon account: %s\n\nThe code expires at %s.", newEmail, token, expiresAt)
+	if appURL := os.Getenv("APP_URL"); appURL != "" {
+		body += fmt.Sprintf("\n\n%s/verify-email?user_id=%s&token=%s", strings.TrimRight(appURL, "/"), user.ID, token)
+	}
+
+	return mailer.Send(newEmail, "Confirm your new email address", body)
+}
+
+// confirmEmailChange moves the pending email onto the account if token
+// matches the one sent by requestEmailChange
+func confirmEmailChange(userID string, token string) (User, error) {
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(userID),
 			},
-			":email": {
-				S: aws.String(user.Email),
+		},
+		TableName: &UsersTable,
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if result.Item == nil {
+		return User{}, nil
+	}
+
+	var pending struct {
+		PendingEmail string `dynamodbav:"pending_email"`
+		TokenHash    string `dynamodbav:"email_token_hash"`
+		ExpiresAt    string `dynamodbav:"email_token_expires"`
+	}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &pending); err != nil {
+		return User{}, err
+	}
+
+	if pending.PendingEmail == "" || pending.TokenHash == "" {
+		return User{}, ErrInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hashVerificationToken(token)), []byte(pending.TokenHash)) != 1 {
+		return User{}, ErrInvalidToken
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, pending.ExpiresAt); err != nil || time.Now().After(expiresAt) {
+		return User{}, ErrInvalidToken
+	}
+
+	existing, err := getUserFromEmail(pending.PendingEmail)
+	if err != nil {
+		return User{}, err
+	}
+	if existing.ID != "" && existing.ID != userID {
+		return User{}, ErrEmailTaken
+	}
+
+	update := expression.
+		Set(expression.Name("email"), expression.Value(pending.PendingEmail)).
+		Remove(expression.Name("pending_email")).
+		Remove(expression.Name("email_token_hash")).
+		Remove(expression.Name("email_token_expires"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(userID),
 			},
+		},
+		TableName: &UsersTable,
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return getUserFromId(userID)
+}
+
+// changePassword replaces the user's password after checking the current one
+func changePassword(userID string, currentPassword string, newPassword string) (User, error) {
+	user, err := getUserFromId(userID)
+	if err != nil || user.ID == "" {
+		return user, err
+	}
+
+	if !CheckPassword(user.Password, currentPassword) {
+		return User{}, ErrInvalidCredentials
+	}
+
+	err = setUserPassword(userID, newPassword)
+
+	user.Password = ""
+	return user, err
+}
+
+// setUserPassword replaces the password without checking the current one
+func setUserPassword(userID string, password string) error {
+	passwordHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#P": aws.String("password"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":password": {
-				S: aws.String(user.Password),
+				S: aws.String(passwordHash),
 			},
 		},
 		Key: map[string]*dynamodb.AttributeValue{
 			"_id": {
-				S: aws.String(user.ID),
+				S: aws.String(userID),
 			},
 		},
 		TableName:        &UsersTable,
-		UpdateExpression: aws.String("SET #A = :first_name, #B = :last_name, #C = :organization, #D = :profile_picture, #E = :email, #F = :password"),
+		UpdateExpression: aws.String("SET #P = :password"),
+	})
+
+	return err
+}
+
+// GetAllUsers scans the users table
+func GetAllUsers() ([]User, error) {
+	users := []User{}
+
+	err := dynamo.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(UsersTable),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var user User
+			if err := dynamodbattribute.UnmarshalMap(item, &user); err != nil {
+				log.Printf("Error unmarshalling user: %v", err)
+				continue
+			}
+			users = append(users, user)
+		}
+		return true
 	})
 
-	return return_user, err
+	return users, err
 }
-	
\ No newline at end of file
@@ -2,8 +2,18 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"math/big"
+	"net/http"
+	"os"
 	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 )
 
 func generateRandomString(length int) string {
@@ -33,3 +43,81 @@ func RemovePeriods(input string) string {
 
 	return input
 }
+
+// IsAdminRequest reports whether the request carries the admin token
+// configured in ADMIN_TOKEN
+func IsAdminRequest(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) == 1
+}
+
+func encodeCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	var plain map[string]interface{}
+	if err := dynamodbattribute.UnmarshalMap(key, &plain); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(plain)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode cursor, %v", err)
+	}
+
+	var plain map[string]interface{}
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return nil, fmt.Errorf("failed to decode cursor, %v", err)
+	}
+
+	return dynamodbattribute.MarshalMap(plain)
+}
+
+// QueryPage runs a query, passing each item to fn, until limit items have
+// been read or the results run out. A limit of 0 reads every result. It
+// returns the cursor for the next page, which is empty on the last page.
+func QueryPage(input *dynamodb.QueryInput, limit int64, fn func(map[string]*dynamodb.AttributeValue) error) (string, error) {
+	var read int64
+	for {
+		if limit > 0 {
+			input.Limit = aws.Int64(limit - read)
+		}
+
+		result, err := dynamo.Query(input)
+		if err != nil {
+			return "", err
+		}
+
+		for _, item := range result.Items {
+			if err := fn(item); err != nil {
+				return "", err
+			}
+			read++
+		}
+
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+		if len(result.LastEvaluatedKey) == 0 {
+			return "", nil
+		}
+		if limit > 0 && read >= limit {
+			return encodeCursor(result.LastEvaluatedKey)
+		}
+	}
+}
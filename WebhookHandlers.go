@@ -0,0 +1,325 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var webhook Webhook
+	if !DecodeJSONBody(w, r, &webhook) {
+		return
+	}
+
+	createWebhook(w, r, webhook)
+}
+
+func validateWebhook(webhook Webhook) []FieldError {
+	fieldErrors := RequireFields(
+		"owner_type", webhook.OwnerType,
+		"owner_id", webhook.OwnerID,
+		"url", webhook.URL,
+	)
+
+	if webhook.OwnerType != "" && webhook.OwnerType != WebhookOwnerUser && webhook.OwnerType != WebhookOwnerOrganization {
+		fieldErrors = append(fieldErrors, FieldError{Field: "owner_type", Message: "must be user or organization"})
+	}
+	if webhook.URL != "" {
+		if err := ValidateWebhookURL(webhook.URL); err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "url", Message: err.Error()})
+		}
+	}
+
+	if len(webhook.Events) == 0 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "events", Message: "must not be empty"})
+	}
+	for i, event := range webhook.Events {
+		known := false
+		for _, eventType := range WebhookEventTypes {
+			known = known || event == eventType
+		}
+		if !known {
+			fieldErrors = append(fieldErrors, FieldError{Field: "events[" + strconv.Itoa(i) + "]", Message: "is not a known event type"})
+		}
+	}
+
+	return fieldErrors
+}
+
+// authorizeWebhookOwner writes a 403 and returns false unless the request
+// may manage the owner's webhooks
+func authorizeWebhookOwner(w http.ResponseWriter, r *http.Request, ownerType string, ownerID string) bool {
+	allowed, err := canManageWebhooks(r, ownerType, ownerID)
+	if err != nil {
+		log.Printf("Error authorizing webhook owner: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to authorize webhook owner")
+		return false
+	}
+	if !allowed {
+		WriteError(w, r, http.StatusForbidden, CodeForbidden, "Not allowed to manage this owner's webhooks")
+		return false
+	}
+	return true
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request, webhook Webhook) {
+	if fieldErrors := validateWebhook(webhook); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	if !authorizeWebhookOwner(w, r, webhook.OwnerType, webhook.OwnerID) {
+		return
+	}
+
+	if webhook.OwnerType == WebhookOwnerUser {
+		user, err := getUserFromId(webhook.OwnerID)
+		if err != nil {
+			log.Printf("Error getting user: %v", err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get user")
+			return
+		}
+		if user.ID == "" {
+			WriteError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
+			return
+		}
+	}
+
+	created, err := CreateWebhook(webhook)
+	if err != nil {
+		log.Printf("Error creating webhook: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create webhook")
+		return
+	}
+
+	// the secret is only shown here
+	WriteSuccess(w, r, http.StatusCreated, "Webhook created successfully", created)
+}
+
+func GetWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var getWebhooksRequest struct {
+		OwnerType string `json:"owner_type"`
+		OwnerID   string `json:"owner_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &getWebhooksRequest) {
+		return
+	}
+
+	getWebhooks(w, r, getWebhooksRequest.OwnerType, getWebhooksRequest.OwnerID)
+}
+
+func getWebhooks(w http.ResponseWriter, r *http.Request, ownerType string, ownerID string) {
+	if fieldErrors := RequireFields("owner_type", ownerType, "owner_id", ownerID); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	if !authorizeWebhookOwner(w, r, ownerType, ownerID) {
+		return
+	}
+
+	webhooks, err := GetWebhooksByOwner(ownerType, ownerID)
+	if err != nil {
+		log.Printf("Error getting webhooks: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get webhooks")
+		return
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	WriteSuccess(w, r, http.StatusOK, "Webhooks retrieved successfully", webhooks)
+}
+
+func getWebhook(w http.ResponseWriter, r *http.Request, webhookID string) {
+	webhook, err := GetWebhookById(webhookID)
+	if err != nil {
+		log.Printf("Error getting webhook: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get webhook")
+		return
+	}
+
+	if webhook.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeWebhookNotFound, "Webhook not found")
+		return
+	}
+
+	if !authorizeWebhookOwner(w, r, webhook.OwnerType, webhook.OwnerID) {
+		return
+	}
+
+	webhook.Secret = ""
+	WriteSuccess(w, r, http.StatusOK, "Webhook retrieved successfully", webhook)
+}
+
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var deleteWebhookRequest struct {
+		ID string `json:"_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &deleteWebhookRequest) {
+		return
+	}
+
+	deleteWebhook(w, r, deleteWebhookRequest.ID)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request, webhookID string) {
+	webhook, err := GetWebhookById(webhookID)
+	if err != nil {
+		log.Printf("Error getting webhook: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get webhook")
+		return
+	}
+
+	if webhook.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeWebhookNotFound, "Webhook not found")
+		return
+	}
+
+	if !authorizeWebhookOwner(w, r, webhook.OwnerType, webhook.OwnerID) {
+		return
+	}
+
+	if err := DeleteWebhookById(webhook.ID); err != nil {
+		log.Printf("Error deleting webhook: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete webhook")
+		return
+	}
+
+	webhook.Secret = ""
+	WriteSuccess(w, r, http.StatusOK, "Webhook deleted successfully", webhook)
+}
+
+func GetWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	var getDeliveriesRequest struct {
+		WebhookID string `json:"webhook_id"`
+		Status    string `json:"status"`
+		Limit     int64  `json:"limit"`
+		Cursor    string `json:"cursor"`
+	}
+
+	if !DecodeJSONBody(w, r, &getDeliveriesRequest) {
+		return
+	}
+
+	getWebhookDeliveries(w, r, getDeliveriesRequest.WebhookID, getDeliveriesRequest.Status, getDeliveriesRequest.Limit, getDeliveriesRequest.Cursor)
+}
+
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request, webhookID string, status string, limit int64, cursor string) {
+	var fieldErrors []FieldError
+	switch status {
+	case "", DeliverySucceeded, DeliveryFailed, DeliveryDeadLetter, DeliveryRedelivered:
+	default:
+		fieldErrors = append(fieldErrors, FieldError{Field: "status", Message: "must be succeeded, failed, dead_letter or redelivered"})
+	}
+	if limit < 0 || limit > 100 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "limit", Message: "must be between 1 and 100"})
+	}
+	if _, err := decodeCursor(cursor); err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "cursor", Message: "is not a valid cursor"})
+	}
+	if len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+	if limit == 0 {
+		limit = 50
+	}
+
+	webhook, err := GetWebhookById(webhookID)
+	if err != nil {
+		log.Printf("Error getting webhook: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get webhook")
+		return
+	}
+
+	if webhook.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeWebhookNotFound, "Webhook not found")
+		return
+	}
+
+	if !authorizeWebhookOwner(w, r, webhook.OwnerType, webhook.OwnerID) {
+		return
+	}
+
+	deliveries, next, err := QueryWebhookDeliveries(webhook.ID, status, limit, cursor)
+	if err != nil {
+		log.Printf("Error getting webhook deliveries: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get webhook deliveries")
+		return
+	}
+
+	WritePage(w, r, "Webhook deliveries retrieved successfully", deliveries, next, nil)
+}
+
+func RedeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var redeliverRequest struct {
+		WebhookID  string `json:"webhook_id"`
+		DeliveryID string `json:"delivery_id"`
+	}
+
+	if !DecodeJSONBody(w, r, &redeliverRequest) {
+		return
+	}
+
+	redeliverWebhook(w, r, redeliverRequest.WebhookID, redeliverRequest.DeliveryID)
+}
+
+// redeliverWebhook sends a dead letter to its webhook again
+func redeliverWebhook(w http.ResponseWriter, r *http.Request, webhookID string, deliveryID string) {
+	if fieldErrors := RequireFields("webhook_id", webhookID, "delivery_id", deliveryID); len(fieldErrors) > 0 {
+		WriteValidationError(w, r, fieldErrors)
+		return
+	}
+
+	webhook, err := GetWebhookById(webhookID)
+	if err != nil {
+		log.Printf("Error getting webhook: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get webhook")
+		return
+	}
+
+	if webhook.ID == "" {
+		WriteError(w, r, http.StatusNotFound, CodeWebhookNotFound, "Webhook not found")
+		return
+	}
+
+	if !authorizeWebhookOwner(w, r, webhook.OwnerType, webhook.OwnerID) {
+		return
+	}
+
+	delivery, err := GetWebhookDeliveryById(deliveryID)
+	if err != nil {
+		log.Printf("Error getting webhook delivery: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to get webhook delivery")
+		return
+	}
+
+	if delivery.ID == "" || delivery.WebhookID != webhook.ID {
+		WriteError(w, r, http.StatusNotFound, CodeDeliveryNotFound, "Delivery not found")
+		return
+	}
+
+	if delivery.Status != DeliveryDeadLetter {
+		WriteValidationError(w, r, []FieldError{{Field: "delivery_id", Message: "is not a dead letter"}})
+		return
+	}
+
+	if delivery.Payload == "" {
+		WriteValidationError(w, r, []FieldError{{Field: "delivery_id", Message: "has no payload; it was cleared when a user was erased"}})
+		return
+	}
+
+	if err := RedeliverWebhook(webhook, delivery); err != nil {
+		log.Printf("Error redelivering webhook: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to redeliver webhook")
+		return
+	}
+
+	delivery.Status = DeliveryRedelivered
+	WriteSuccess(w, r, http.StatusAccepted, "Delivery queued for redelivery", delivery)
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+const (
+	WebhookCaseCreated              = "case.created"
+	WebhookCaseDeleted              = "case.deleted"
+	WebhookDocumentCreated          = "document.created"
+	WebhookDocumentRelevancyUpdated = "document.relevancy_updated"
+	WebhookDocumentProcessed        = "document.processed"
+	WebhookChatMessageAdded         = "chat.message_added"
+
+	WebhookOwnerUser         = "user"
+	WebhookOwnerOrganization = "organization"
+
+	DeliverySucceeded   = "succeeded"
+	DeliveryFailed      = "failed"
+	DeliveryDeadLetter  = "dead_letter"
+	DeliveryRedelivered = "redelivered"
+)
+
+var WebhookEventTypes = []string{
+	WebhookCaseCreated,
+	WebhookCaseDeleted,
+	WebhookDocumentCreated,
+	WebhookDocumentRelevancyUpdated,
+	WebhookDocumentProcessed,
+	WebhookChatMessageAdded,
+}
+
+// webhookJob is one attempt at delivering an event to a webhook
+type webhookJob struct {
+	webhook Webhook
+	event   WebhookEvent
+	payload []byte
+	attempt int
+}
+
+var (
+	webhookQueue      = make(chan webhookJob, 1000)
+	webhookHTTPClient = &http.Client{
+		Timeout: 10 * time.Second,
+		// the address is checked as it is dialed, after DNS resolution, so a
+		// host that later resolves to an internal address is still refused
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: func(network string, address string, c syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					return checkWebhookIP(net.ParseIP(host))
+				},
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+	}
+)
+
+func envInt(name string, fallback int) int {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Invalid %s %q", name, v)
+	}
+	return fallback
+}
+
+// WebhookMaxAttempts is how many times an event is tried before it is moved
+// to the dead-letter queue, set by WEBHOOK_MAX_ATTEMPTS
+func WebhookMaxAttempts() int {
+	return envInt("WEBHOOK_MAX_ATTEMPTS", 6)
+}
+
+// webhookBackoff is the wait before the given retry: 30 seconds doubling on
+// each attempt, capped at an hour. WEBHOOK_RETRY_BASE_SECONDS changes the
+// starting delay.
+func webhookBackoff(attempt int) time.Duration {
+	delay := time.Duration(envInt("WEBHOOK_RETRY_BASE_SECONDS", 30)) * time.Second
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// SignWebhookPayload returns the X-Avalon-Signature header value. Receivers
+// recompute the HMAC-SHA256 of "<t>.<body>" with their secret and compare it
+// to v1, and reject old timestamps to prevent replays.
+func SignWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// blockedWebhookNets are ranges webhooks may not reach besides the loopback,
+// private, link-local and multicast ones net.IP reports: "this network",
+// carrier-grade NAT, where some clouds serve instance metadata, and NAT64
+var blockedWebhookNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// checkWebhookIP refuses addresses inside the server's own network, such as
+// localhost, private ranges and the 169.254.169.254 metadata service
+func checkWebhookIP(ip net.IP) error {
+	if ip == nil {
+		return fmt.Errorf("must resolve to an IP address")
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("must not point to a loopback, private or link-local address")
+	}
+	for _, n := range blockedWebhookNets {
+		if n.Contains(ip) {
+			return fmt.Errorf("must not point to a loopback, private or link-local address")
+		}
+	}
+	return nil
+}
+
+// ValidateWebhookURL accepts absolute http and https URLs whose host
+// resolves only to public addresses. Deliveries check the address again
+// when they connect.
+func ValidateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("must be an absolute http or https URL")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("host could not be resolved")
+	}
+	for _, addr := range addrs {
+		if err := checkWebhookIP(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canManageWebhooks reports whether a request may create or read the
+// webhooks of an owner: admins, the user themselves, and members of the
+// organization. Users are identified by their session token.
+func canManageWebhooks(r *http.Request, ownerType string, ownerID string) (bool, error) {
+	if IsAdminRequest(r) {
+		return true, nil
+	}
+
+	userID := AuthenticatedUserID(r)
+	if userID == "" || ownerID == "" {
+		return false, nil
+	}
+
+	switch ownerType {
+	case WebhookOwnerUser:
+		return userID == ownerID, nil
+	case WebhookOwnerOrganization:
+		user, err := getUserFromId(userID)
+		if err != nil {
+			return false, err
+		}
+		return user.Organization != "" && user.Organization == ownerID, nil
+	}
+	return false, nil
+}
+
+func CreateWebhook(webhook Webhook) (Webhook, error) {
+	webhook.ID = generateRandomString(16)
+	webhook.Secret = generateRandomString(32)
+	webhook.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	av, err := dynamodbattribute.MarshalMap(webhook)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: &WebhooksTable,
+	})
+
+	return webhook, err
+}
+
+func GetWebhookById(webhookID string) (Webhook, error) {
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(webhookID),
+			},
+		},
+		TableName: &WebhooksTable,
+	})
+	if err != nil || result.Item == nil {
+		return Webhook{}, err
+	}
+
+	var webhook Webhook
+	err = dynamodbattribute.UnmarshalMap(result.Item, &webhook)
+	return webhook, err
+}
+
+func DeleteWebhookById(webhookID string) error {
+	_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(webhookID),
+			},
+		},
+		TableName: &WebhooksTable,
+	})
+
+	return err
+}
+
+// DeleteWebhookDeliveries deletes every recorded delivery of a webhook,
+// including its dead-letter queue
+func DeleteWebhookDeliveries(webhookID string) error {
+	deliveries, _, err := QueryWebhookDeliveries(webhookID, "", 0, "")
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		_, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				"_id": {
+					S: aws.String(delivery.ID),
+				},
+			},
+			TableName: &WebhookDeliveriesTable,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ClearDeliveryPayloads removes the payload from each delivery of a webhook
+// whose event was about the user, keeping the record of the attempt. It
+// returns the IDs of the deliveries cleared.
+func ClearDeliveryPayloads(webhookID string, userID string) ([]string, error) {
+	cleared := []string{}
+
+	deliveries, _, err := QueryWebhookDeliveries(webhookID, "", 0, "")
+	if err != nil {
+		return cleared, err
+	}
+
+	for _, delivery := range deliveries {
+		if delivery.Payload == "" {
+			continue
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal([]byte(delivery.Payload), &event); err == nil && event.UserID != userID {
+			continue
+		}
+
+		_, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				"_id": {
+					S: aws.String(delivery.ID),
+				},
+			},
+			UpdateExpression: aws.String("REMOVE payload"),
+			TableName:        &WebhookDeliveriesTable,
+		})
+		if err != nil {
+			return cleared, err
+		}
+		cleared = append(cleared, delivery.ID)
+	}
+
+	return cleared, nil
+}
+
+// GetWebhooksByOwner returns the webhooks of one owner, or of any of the
+// given owners when several are passed as ownerType/ownerID pairs
+func GetWebhooksByOwner(owners ...string) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	for i := 0; i+1 < len(owners); i += 2 {
+		if owners[i+1] == "" {
+			continue
+		}
+
+		keyCond := expression.Key("owner_id").Equal(expression.Value(owners[i+1])).
+			And(expression.Key("owner_type").Equal(expression.Value(owners[i])))
+		expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = QueryPage(&dynamodb.QueryInput{
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			IndexName:                 &WebhooksByOwnerIndex,
+			KeyConditionExpression:    expr.KeyCondition(),
+			TableName:                 &WebhooksTable,
+		}, 0, func(item map[string]*dynamodb.AttributeValue) error {
+			var webhook Webhook
+			if err := dynamodbattribute.UnmarshalMap(item, &webhook); err != nil {
+				log.Printf("Error unmarshalling webhook: %v", err)
+				return nil
+			}
+			webhooks = append(webhooks, webhook)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return webhooks, nil
+}
+
+func saveWebhookDelivery(delivery WebhookDelivery) error {
+	av, err := dynamodbattribute.MarshalMap(delivery)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Duration(envInt("WEBHOOK_DELIVERY_TTL_DAYS", 30)) * 24 * time.Hour
+	av["expires_at"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)),
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: &WebhookDeliveriesTable,
+	})
+
+	return err
+}
+
+func GetWebhookDeliveryById(deliveryID string) (WebhookDelivery, error) {
+	result, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"_id": {
+				S: aws.String(deliveryID),
+			},
+		},
+		TableName: &WebhookDeliveriesTable,
+	})
+	if err != nil || result.Item == nil {
+		return WebhookDelivery{}, err
+	}
+
+	var delivery WebhookDelivery
+	err = dynamodbattribute.UnmarshalMap(result.Item, &delivery)
+	return delivery, err
+}
+
+// QueryWebhookDeliveries returns a webhook's delivery attempts, newest first.
+// A status of "dead_letter" lists the webhook's dead-letter queue.
+func QueryWebhookDeliveries(webhookID string, status string, limit int64, cursor string) ([]WebhookDelivery, string, error) {
+	builder := expression.NewBuilder().WithKeyCondition(expression.Key("webhook_id").Equal(expression.Value(webhookID)))
+	if status != "" {
+		builder = builder.WithFilter(expression.Name("status").Equal(expression.Value(status)))
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, "", err
+	}
+
+	startKey, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	input := &dynamodb.QueryInput{
+		ExclusiveStartKey:         startKey,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		IndexName:                 &DeliveriesByWebhookIndex,
+		KeyConditionExpression:    expr.KeyCondition(),
+		ScanIndexForward:          aws.Bool(false),
+		TableName:                 &WebhookDeliveriesTable,
+	}
+
+	deliveries := []WebhookDelivery{}
+	next, err := QueryPage(input, limit, func(item map[string]*dynamodb.AttributeValue) error {
+		var delivery WebhookDelivery
+		if err := dynamodbattribute.UnmarshalMap(item, &delivery); err != nil {
+			return err
+		}
+		deliveries = append(deliveries, delivery)
+		return nil
+	})
+
+	return deliveries, next, err
+}
+
+func webhookSubscribed(webhook Webhook, eventType string) bool {
+	for _, e := range webhook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// EmitWebhookEvent queues an event for every webhook subscribed to it by the
+// case owner or the owner's organization. userID may be empty when the case
+// still exists, in which case the owner is looked up. It returns at once;
+// lookups and deliveries happen in the background.
+func EmitWebhookEvent(eventType string, userID string, caseID string, data interface{}) {
+	event := WebhookEvent{
+		ID:        generateRandomString(20),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		UserID:    userID,
+		CaseID:    caseID,
+		Data:      data,
+	}
+
+	go func() {
+		if event.UserID == "" {
+			myCase, err := GetCaseFromId(caseID)
+			if err != nil {
+				log.Printf("Error getting case for webhook event %s: %v", event.ID, err)
+				return
+			}
+			event.UserID = myCase.UserID
+		}
+
+		user, err := getUserFromId(event.UserID)
+		if err != nil {
+			log.Printf("Error getting user for webhook event %s: %v", event.ID, err)
+			return
+		}
+
+		webhooks, err := GetWebhooksByOwner(
+			WebhookOwnerUser, event.UserID,
+			WebhookOwnerOrganization, user.Organization,
+		)
+		if err != nil {
+			log.Printf("Error getting webhooks for event %s: %v", event.ID, err)
+			return
+		}
+
+		var payload []byte
+		for _, webhook := range webhooks {
+			if !webhookSubscribed(webhook, eventType) {
+				continue
+			}
+			if payload == nil {
+				if payload, err = json.Marshal(event); err != nil {
+					log.Printf("Error encoding webhook event %s: %v", event.ID, err)
+					return
+				}
+			}
+			webhookQueue <- webhookJob{webhook: webhook, event: event, payload: payload, attempt: 1}
+		}
+	}()
+}
+
+// EmitDocumentWebhookEvent is EmitWebhookEvent for a document that is only
+// known by ID. The event carries the document as stored.
+func EmitDocumentWebhookEvent(eventType string, documentID string) {
+	go func() {
+		doc, err := GetDocumentById(documentID)
+		if err != nil || doc.ID == "" {
+			log.Printf("Error getting document %s for webhook event: %v", documentID, err)
+			return
+		}
+		EmitWebhookEvent(eventType, "", doc.CaseID, doc)
+	}()
+}
+
+// StartWebhookWorkers starts the goroutines that deliver queued events.
+// Retries wait in memory, so events still waiting for a retry when the
+// server stops are lost; failed attempts are recorded either way.
+func StartWebhookWorkers(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range webhookQueue {
+				deliverWebhook(job)
+			}
+		}()
+	}
+}
+
+func deliverWebhook(job webhookJob) {
+	delivery := WebhookDelivery{
+		ID:          generateRandomString(20),
+		WebhookID:   job.webhook.ID,
+		EventID:     job.event.ID,
+		EventType:   job.event.Type,
+		Attempt:     job.attempt,
+		AttemptedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	start := time.Now()
+	status, err := postWebhook(job.webhook, job.event, job.payload)
+	delivery.DurationMs = time.Since(start).Milliseconds()
+	delivery.ResponseStatus = status
+
+	switch {
+	case err == nil:
+		delivery.Status = DeliverySucceeded
+	case job.attempt < WebhookMaxAttempts():
+		delay := webhookBackoff(job.attempt)
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+		delivery.NextAttemptAt = time.Now().Add(delay).UTC().Format(time.RFC3339)
+
+		next := job
+		next.attempt++
+		time.AfterFunc(delay, func() {
+			webhookQueue <- next
+		})
+	default:
+		delivery.Status = DeliveryDeadLetter
+		delivery.Error = err.Error()
+		delivery.Payload = string(job.payload)
+	}
+
+	if err := saveWebhookDelivery(delivery); err != nil {
+		log.Printf("Error recording webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// postWebhook sends the payload and returns the response status. Any status
+// outside 2xx is an error.
+func postWebhook(webhook Webhook, event WebhookEvent, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Avalon-Webhooks/1.0")
+	req.Header.Set("X-Avalon-Event", event.Type)
+	req.Header.Set("X-Avalon-Delivery", event.ID)
+	req.Header.Set("X-Avalon-Signature", SignWebhookPayload(webhook.Secret, time.Now().Unix(), payload))
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// RedeliverWebhook queues a dead letter again from its first attempt and
+// marks it redelivered so it leaves the dead-letter queue
+func RedeliverWebhook(webhook Webhook, delivery WebhookDelivery) error {
+	var event WebhookEvent
+	if err := json.Unmarshal([]byte(delivery.Payload), &event); err != nil {
+		return fmt.Errorf("failed to decode dead letter payload, %v", err)
+	}
+
+	delivery.Status = DeliveryRedelivered
+	if err := saveWebhookDelivery(delivery); err != nil {
+		return err
+	}
+
+	job := webhookJob{webhook: webhook, event: event, payload: []byte(delivery.Payload), attempt: 1}
+	go func() {
+		webhookQueue <- job
+	}()
+	return nil
+}
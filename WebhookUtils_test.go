@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateWebhookURLRejectsInternalAddresses(t *testing.T) {
+	for _, rawURL := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"https://10.0.0.5/hook",
+		"https://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://100.100.100.200/",
+		"http://0.0.0.0/",
+		"http://[::1]/hook",
+		"http://[fd00:ec2::254]/",
+		"http://[::ffff:127.0.0.1]/",
+	} {
+		if err := ValidateWebhookURL(rawURL); err == nil {
+			t.Errorf("ValidateWebhookURL(%q) accepted an internal address", rawURL)
+		}
+	}
+
+	for _, rawURL := range []string{"https://93.184.216.34/hook", "https://[2606:4700::1111]/hook"} {
+		if err := ValidateWebhookURL(rawURL); err != nil {
+			t.Errorf("ValidateWebhookURL(%q) = %v, want accepted", rawURL, err)
+		}
+	}
+}
+
+func TestPostWebhookRefusesInternalAddresses(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	_, err := postWebhook(Webhook{URL: server.URL, Secret: "s"}, WebhookEvent{ID: "e1", Type: WebhookCaseCreated}, []byte("{}"))
+	if err == nil || called {
+		t.Errorf("delivery to %s: err = %v, reached = %v, want refused", server.URL, err, called)
+	}
+}
+
+func TestCanManageWebhooksIgnoresClaimedUser(t *testing.T) {
+	t.Setenv("SESSION_SIGNING_KEY", "secret")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+
+	r := httptest.NewRequest("GET", "/v1/webhooks", nil)
+	r.Header.Set("X-User-ID", "u1")
+	if allowed, err := canManageWebhooks(r, WebhookOwnerUser, "u1"); err != nil || allowed {
+		t.Errorf("claimed user: allowed = %v, err = %v, want refused", allowed, err)
+	}
+
+	token, err := IssueSessionToken("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if allowed, err := canManageWebhooks(r, WebhookOwnerUser, "u1"); err != nil || !allowed {
+		t.Errorf("own webhooks: allowed = %v, err = %v, want allowed", allowed, err)
+	}
+	if allowed, err := canManageWebhooks(r, WebhookOwnerUser, "u2"); err != nil || allowed {
+		t.Errorf("another user's webhooks: allowed = %v, err = %v, want refused", allowed, err)
+	}
+
+	r = httptest.NewRequest("GET", "/v1/webhooks", nil)
+	r.Header.Set("X-Admin-Token", "admin-secret")
+	if allowed, err := canManageWebhooks(r, WebhookOwnerOrganization, "acme"); err != nil || !allowed {
+		t.Errorf("admin: allowed = %v, err = %v, want allowed", allowed, err)
+	}
+}
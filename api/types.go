@@ -0,0 +1,449 @@
+// Package api holds the request and response types shared by the Avalon
+// server and its Go client.
+package api
+
+// User is a user account. Password is only sent to create a user;
+// responses leave it out.
+type User struct {
+	ID             string   `json:"_id"`
+	Email          string   `json:"email"`
+	Cases          []string `json:"cases"`
+	FirstName      string   `json:"first_name"`
+	LastName       string   `json:"last_name"`
+	Organization   string   `json:"organization"`
+	Password       string   `json:"password,omitempty"`
+	ProfilePicture string   `json:"profile_picture"`
+	PendingEmail   string   `json:"pending_email,omitempty"`
+	// Token is the session token returned by login and is never stored
+	Token string `json:"token,omitempty"`
+}
+
+type LoginUser struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// UserProfileUpdate holds the fields of a partial profile update. Nil fields
+// are left unchanged. A new email is held as pending until it is verified.
+type UserProfileUpdate struct {
+	Email          *string `json:"email,omitempty"`
+	FirstName      *string `json:"first_name,omitempty"`
+	LastName       *string `json:"last_name,omitempty"`
+	Organization   *string `json:"organization,omitempty"`
+	ProfilePicture *string `json:"profile_picture,omitempty"`
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type Case struct {
+	ID                string `json:"_id"`
+	CaseTitle         string `json:"case_title"`
+	AttorneyFirstName string `json:"attorney_first_name"`
+	AttorneyLastName  string `json:"attorney_last_name"`
+	CaseInfo          string `json:"case_info"`
+	CaseType          string `json:"case_type"`
+	City              string `json:"city"`
+	Date              string `json:"date"`
+	JudgeName         string `json:"judge_name"`
+	NumberFiles       int    `json:"number_files"`
+	State             string `json:"state"`
+	UserID            string `json:"user_id"`
+}
+
+// CaseUpdate holds the fields of a partial case update. Nil fields are left
+// unchanged. UserID may only repeat the case's owner; cases cannot be moved
+// to another user.
+type CaseUpdate struct {
+	CaseTitle         *string `json:"case_title,omitempty"`
+	AttorneyFirstName *string `json:"attorney_first_name,omitempty"`
+	AttorneyLastName  *string `json:"attorney_last_name,omitempty"`
+	CaseInfo          *string `json:"case_info,omitempty"`
+	CaseType          *string `json:"case_type,omitempty"`
+	City              *string `json:"city,omitempty"`
+	Date              *string `json:"date,omitempty"`
+	JudgeName         *string `json:"judge_name,omitempty"`
+	State             *string `json:"state,omitempty"`
+	UserID            *string `json:"user_id,omitempty"`
+}
+
+type FieldChange struct {
+	Field    string `json:"field"`
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+type CaseChange struct {
+	ID        string        `json:"_id"`
+	CaseID    string        `json:"case_id"`
+	ChangedBy string        `json:"changed_by"`
+	ChangedAt string        `json:"changed_at"`
+	Changes   []FieldChange `json:"changes"`
+}
+
+// CaseFilter holds the options for listing a user's cases. Sort is "date"
+// or "title" and defaults to date. Order is "asc" or "desc" and defaults to
+// newest first for dates and A to Z for titles. Each word of Query must
+// match a whole word of the case's title or info.
+type CaseFilter struct {
+	CaseType  string
+	State     string
+	City      string
+	JudgeName string
+	DateFrom  string
+	DateTo    string
+	Query     string
+	Sort      string
+	Order     string
+	Limit     int64
+	Cursor    string
+}
+
+type Document struct {
+	ID        string  `json:"_id"`
+	FileName  string  `json:"file_name"`
+	CaseID    string  `json:"case"`
+	Date      string  `json:"date"`
+	FileURL   string  `json:"file_url"`
+	Relevancy float64 `json:"relevancy"`
+	Stored    bool    `json:"stored"`
+	// set by the scoring pipeline through the batch relevancy endpoint
+	RelevancyModelVersion string `json:"relevancy_model_version,omitempty"`
+	RelevancyUpdatedAt    string `json:"relevancy_updated_at,omitempty"`
+	FileType              string `json:"file_type,omitempty"`
+	// descriptive metadata set by reviewers
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// hex SHA-256 of the file, which names the shared blob it is stored in
+	SHA256 string `json:"sha256,omitempty"`
+	// set when another document in the case already has the same content;
+	// DuplicateStatus is "flagged" until a reviewer links it
+	DuplicateOf     string `json:"duplicate_of,omitempty"`
+	DuplicateStatus string `json:"duplicate_status,omitempty"`
+	// number of the current version, unset until a document gets a second
+	// one
+	Version int `json:"version,omitempty"`
+	// text extraction of the current version: "pending", "processing",
+	// "processed", "failed" or "unsupported". Stored is set once it is
+	// processed.
+	ProcessingStatus string `json:"processing_status,omitempty"`
+	ProcessingError  string `json:"processing_error,omitempty"`
+	ProcessedAt      string `json:"processed_at,omitempty"`
+	PageCount        int    `json:"page_count,omitempty"`
+	// OCR of scanned pages and images: "processed", "failed" or
+	// "unavailable" when no engine is configured. Empty when no page needed
+	// it. OCRConfidence is the mean of the OCRed pages' confidence.
+	OCRStatus     string  `json:"ocr_status,omitempty"`
+	OCRError      string  `json:"ocr_error,omitempty"`
+	OCRPageCount  int     `json:"ocr_page_count,omitempty"`
+	OCRConfidence float64 `json:"ocr_confidence,omitempty"`
+}
+
+// DocumentText is the plain text extracted from a document's current
+// version, split at its page boundaries
+type DocumentText struct {
+	DocumentID  string         `json:"document_id"`
+	Version     int            `json:"version"`
+	SHA256      string         `json:"sha256,omitempty"`
+	ExtractedAt string         `json:"extracted_at"`
+	Pages       []DocumentPage `json:"pages"`
+}
+
+// DocumentPage is the text of one page, numbered from 1. Pages read by OCR
+// carry the engine's confidence from 0 to 100.
+type DocumentPage struct {
+	Number     int     `json:"number"`
+	Text       string  `json:"text"`
+	OCR        bool    `json:"ocr,omitempty"`
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// SearchHit is a document matching a search of its case, with passages
+// around its matches. Score orders hits and is only comparable within one
+// search.
+type SearchHit struct {
+	DocumentID string          `json:"document_id"`
+	FileName   string          `json:"file_name"`
+	Score      float64         `json:"score"`
+	Snippets   []SearchSnippet `json:"snippets"`
+}
+
+// SearchSnippet is a passage of one field of a document, HTML escaped, with
+// each match wrapped in <mark>. Page is set for passages of the text.
+type SearchSnippet struct {
+	Field string `json:"field"`
+	Page  int    `json:"page,omitempty"`
+	Text  string `json:"text"`
+}
+
+// SearchSummary counts every document a search matched
+type SearchSummary struct {
+	Total int `json:"total"`
+}
+
+// DocumentVersion is one revision of a document's file. Relevancy is scored
+// per version: the current version's is the document's, and a version keeps
+// the scores it had when it was replaced.
+type DocumentVersion struct {
+	ID         string `json:"_id"`
+	DocumentID string `json:"document_id"`
+	Number     int    `json:"number"`
+	FileName   string `json:"file_name"`
+	Key        string `json:"key"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256,omitempty"`
+	// the session user who uploaded or restored the version, or "admin"
+	UploadedBy string `json:"uploaded_by,omitempty"`
+	UploadedAt string `json:"uploaded_at"`
+	// set on versions created by restoring an earlier one
+	RestoredFrom          int     `json:"restored_from,omitempty"`
+	Relevancy             float64 `json:"relevancy"`
+	RelevancyModelVersion string  `json:"relevancy_model_version,omitempty"`
+	RelevancyUpdatedAt    string  `json:"relevancy_updated_at,omitempty"`
+}
+
+// DocumentUpdate holds the fields of a partial document update. Nil fields
+// are left unchanged.
+type DocumentUpdate struct {
+	FileName    *string   `json:"file_name,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Tags        *[]string `json:"tags,omitempty"`
+	Relevancy   *float64  `json:"relevancy,omitempty"`
+}
+
+// DocumentFilter holds the options for listing a case's documents, which
+// are always sorted by relevancy. Order is "asc" or "desc" and defaults to
+// most relevant first. DateFrom and DateTo are inclusive ISO dates.
+type DocumentFilter struct {
+	MinRelevancy *float64
+	MaxRelevancy *float64
+	Stored       *bool
+	DateFrom     string
+	DateTo       string
+	FileTypes    []string
+	// "flagged" or "linked" lists only duplicates in that state
+	DuplicateStatus string
+	Order           string
+	Limit           int64
+	Cursor          string
+}
+
+type RelevancyBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+type RelevancySummary struct {
+	Total   int               `json:"total"`
+	Buckets []RelevancyBucket `json:"buckets"`
+}
+
+// RelevancyUpdate scores the document with DocumentID, or the one stored at
+// FileURL. Duplicates share their original's FileURL, so CaseID picks the
+// document in that case.
+type RelevancyUpdate struct {
+	DocumentID   string   `json:"document_id"`
+	FileURL      string   `json:"file_url"`
+	CaseID       string   `json:"case_id,omitempty"`
+	Relevancy    *float64 `json:"relevancy"`
+	ModelVersion string   `json:"model_version"`
+}
+
+// RelevancyUpdateResult reports the outcome of one update in a batch. Status
+// is updated, invalid, not_found or failed.
+type RelevancyUpdateResult struct {
+	Index      int    `json:"index"`
+	DocumentID string `json:"document_id,omitempty"`
+	FileURL    string `json:"file_url,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+type BatchRelevancyResult struct {
+	Updated int                     `json:"updated"`
+	Failed  int                     `json:"failed"`
+	Results []RelevancyUpdateResult `json:"results"`
+}
+
+// UploadRequest describes a file a client will upload straight to storage.
+// SHA256 is the hex encoded digest of the file.
+type UploadRequest struct {
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// UploadReservation holds a Document ID for a file uploaded straight to
+// storage. The file is PUT to UploadURL with Headers before ExpiresAt and
+// then completed to create the document.
+type UploadReservation struct {
+	ID        string            `json:"_id"`
+	CaseID    string            `json:"case_id"`
+	FileName  string            `json:"file_name"`
+	Key       string            `json:"key"`
+	Size      int64             `json:"size"`
+	SHA256    string            `json:"sha256"`
+	UploadURL string            `json:"upload_url,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	CreatedAt string            `json:"created_at"`
+	ExpiresAt string            `json:"expires_at"`
+}
+
+// UploadCompletionResult reports the outcome of completing one reservation.
+// Status is created, not_found, invalid, rejected or failed.
+type UploadCompletionResult struct {
+	Index      int       `json:"index"`
+	DocumentID string    `json:"document_id"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Document   *Document `json:"document,omitempty"`
+}
+
+type UploadCompletion struct {
+	Created int                      `json:"created"`
+	Failed  int                      `json:"failed"`
+	Results []UploadCompletionResult `json:"results"`
+}
+
+type ReindexResult struct {
+	Updated int `json:"updated"`
+}
+
+type Chat struct {
+	ID           string    `json:"_id"`
+	Messages     []Message `json:"messages"`
+	SelectedDocs []string  `json:"selected_docs"`
+	UserID       string    `json:"user_id"`
+}
+
+type Message struct {
+	Text      string `json:"text"`
+	Sender    string `json:"sender"`
+	Timestamp string `json:"timestamp"`
+}
+
+// ChatEvent is pushed to the subscribers of a case chat stream. Message events
+// carry the message's index in the chat as MessageID. Typing and presence
+// events carry the user and a State of started/stopped or joined/left; the
+// presence snapshot sent on connect lists the users following the chat.
+type ChatEvent struct {
+	Type      string   `json:"type"`
+	CaseID    string   `json:"case_id"`
+	MessageID string   `json:"message_id,omitempty"`
+	Message   *Message `json:"message,omitempty"`
+	UserID    string   `json:"user_id,omitempty"`
+	State     string   `json:"state,omitempty"`
+	Users     []string `json:"users,omitempty"`
+	Timestamp string   `json:"timestamp"`
+}
+
+type AuditEvent struct {
+	ID         string            `json:"_id"`
+	Sequence   int64             `json:"sequence"`
+	Timestamp  string            `json:"timestamp"`
+	Type       string            `json:"type"`
+	ActorID    string            `json:"actor_id"`
+	CaseID     string            `json:"case_id"`
+	DocumentID string            `json:"document_id"`
+	TargetID   string            `json:"target_id"`
+	RemoteAddr string            `json:"remote_addr"`
+	Details    map[string]string `json:"details"`
+	PrevHash   string            `json:"prev_hash"`
+	Hash       string            `json:"hash"`
+}
+
+type AuditFilter struct {
+	ActorID string `json:"actor_id"`
+	CaseID  string `json:"case_id"`
+	Type    string `json:"type"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+}
+
+type AuditVerification struct {
+	Intact   bool  `json:"intact"`
+	BrokenAt int64 `json:"broken_at"`
+}
+
+// Webhook subscribes a URL to events on a user's cases, or on the cases of
+// every user in an organization when OwnerType is "organization". Secret
+// signs the deliveries and is only returned when the webhook is created.
+type Webhook struct {
+	ID        string   `json:"_id"`
+	OwnerType string   `json:"owner_type"`
+	OwnerID   string   `json:"owner_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// WebhookEvent is the body POSTed to a webhook
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt string      `json:"created_at"`
+	UserID    string      `json:"user_id"`
+	CaseID    string      `json:"case_id"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery records one attempt to deliver an event. Dead letters keep
+// the payload so they can be redelivered.
+type WebhookDelivery struct {
+	ID             string `json:"_id"`
+	WebhookID      string `json:"webhook_id"`
+	EventID        string `json:"event_id"`
+	EventType      string `json:"event_type"`
+	Attempt        int    `json:"attempt"`
+	Status         string `json:"status"`
+	ResponseStatus int    `json:"response_status,omitempty"`
+	Error          string `json:"error,omitempty"`
+	DurationMs     int64  `json:"duration_ms"`
+	AttemptedAt    string `json:"attempted_at"`
+	NextAttemptAt  string `json:"next_attempt_at,omitempty"`
+	Payload        string `json:"payload,omitempty"`
+}
+
+// ErasureReport lists what erasing a user removed. DeliveryPayloadsCleared
+// are deliveries to organization webhooks that were kept with the payload of
+// the user's event removed.
+type ErasureReport struct {
+	UserID                    string   `json:"user_id"`
+	Email                     string   `json:"email"`
+	RequestedAt               string   `json:"requested_at"`
+	CompletedAt               string   `json:"completed_at"`
+	CasesDeleted              []string `json:"cases_deleted"`
+	DocumentsDeleted          []string `json:"documents_deleted"`
+	BlobsDeleted              []string `json:"blobs_deleted"`
+	ChatsDeleted              []string `json:"chats_deleted"`
+	ChatsAnonymized           []string `json:"chats_anonymized"`
+	MessagesAnonymized        int      `json:"messages_anonymized"`
+	HistoryDeleted            int      `json:"history_deleted"`
+	WebhooksDeleted           []string `json:"webhooks_deleted"`
+	DeliveryPayloadsCleared   []string `json:"delivery_payloads_cleared"`
+	IdempotencyRecordsDeleted int      `json:"idempotency_records_deleted"`
+	Errors                    []string `json:"errors"`
+	Signature                 string   `json:"signature"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Response is the envelope for every JSON response. Successful responses
+// carry Object, failed ones carry Code and, for validation failures, Errors.
+type Response struct {
+	Message    string       `json:"message"`
+	Status     int          `json:"status"`
+	Code       string       `json:"code,omitempty"`
+	Object     interface{}  `json:"object,omitempty"`
+	Errors     []FieldError `json:"errors,omitempty"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	Summary    interface{}  `json:"summary,omitempty"`
+	RequestID  string       `json:"request_id"`
+}
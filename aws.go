@@ -3,12 +3,15 @@ package main
 import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
+// the interfaces let tests swap in other implementations
 var (
-	dynamo *dynamodb.DynamoDB
-	s3Client *s3.S3
+	dynamo   dynamodbiface.DynamoDBAPI
+	s3Client s3iface.S3API
 )
 
 // connectDynamo returns a dynamoDB client
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// useFakeAWS points the storage clients at in-memory fakes for the length of
+// the test
+func useFakeAWS(t *testing.T) (*fakeDynamo, *fakeS3) {
+	t.Helper()
+
+	db := &fakeDynamo{tables: map[string]map[string]fakeItem{}}
+	store := &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int64][]byte{}}
+
+	oldDynamo, oldS3 := dynamo, s3Client
+	dynamo, s3Client = db, store
+	t.Cleanup(func() {
+		dynamo, s3Client = oldDynamo, oldS3
+	})
+
+	return db, store
+}
+
+type fakeItem = map[string]*dynamodb.AttributeValue
+
+// fakeDynamo keeps every table in memory. Tables are keyed by _id and
+// global secondary indexes are read from the index name, which is
+// <hash>-<range>-index or <hash>-index. It evaluates the condition, filter,
+// key, projection and update expressions the repo writes.
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu     sync.Mutex
+	tables map[string]map[string]fakeItem
+}
+
+func (db *fakeDynamo) table(name string) map[string]fakeItem {
+	table := db.tables[name]
+	if table == nil {
+		table = map[string]fakeItem{}
+		db.tables[name] = table
+	}
+	return table
+}
+
+func itemKey(key fakeItem) (string, error) {
+	id := key["_id"]
+	if id == nil || id.S == nil {
+		return "", awserr.New("ValidationException", "the key must be the _id string", nil)
+	}
+	return *id.S, nil
+}
+
+func conditionFailed() error {
+	return &dynamodb.ConditionalCheckFailedException{Message_: aws.String("The conditional request failed")}
+}
+
+func copyItem(item fakeItem) fakeItem {
+	if item == nil {
+		return nil
+	}
+	out := fakeItem{}
+	for name, value := range item {
+		out[name] = copyValue(value)
+	}
+	return out
+}
+
+func copyValue(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+	out := *v
+	if v.B != nil {
+		out.B = append([]byte(nil), v.B...)
+	}
+	if v.L != nil {
+		out.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, e := range v.L {
+			out.L[i] = copyValue(e)
+		}
+	}
+	if v.M != nil {
+		out.M = copyItem(v.M)
+	}
+	out.SS = append([]*string(nil), v.SS...)
+	out.NS = append([]*string(nil), v.NS...)
+	out.BS = append([][]byte(nil), v.BS...)
+	return &out
+}
+
+func (db *fakeDynamo) check(item fakeItem, condition *string, names map[string]*string, values fakeItem) (bool, error) {
+	if condition == nil || *condition == "" {
+		return true, nil
+	}
+	expr, err := parseCondition(*condition, names, values)
+	if err != nil {
+		return false, err
+	}
+	return expr.eval(item), nil
+}
+
+func (db *fakeDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	id, err := itemKey(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	item := copyItem(db.table(*input.TableName)[id])
+	if item != nil && input.ProjectionExpression != nil {
+		if item, err = project(item, *input.ProjectionExpression, input.ExpressionAttributeNames); err != nil {
+			return nil, err
+		}
+	}
+	return &dynamodb.GetItemOutput{Item: item}, nil
+}
+
+func (db *fakeDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	id, err := itemKey(input.Item)
+	if err != nil {
+		return nil, err
+	}
+	table := db.table(*input.TableName)
+	old := table[id]
+	ok, err := db.check(old, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed()
+	}
+
+	table[id] = copyItem(input.Item)
+	output := &dynamodb.PutItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		output.Attributes = copyItem(old)
+	}
+	return output, nil
+}
+
+func (db *fakeDynamo) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	id, err := itemKey(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	table := db.table(*input.TableName)
+	old := table[id]
+	ok, err := db.check(old, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed()
+	}
+
+	delete(table, id)
+	output := &dynamodb.DeleteItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		output.Attributes = copyItem(old)
+	}
+	return output, nil
+}
+
+func (db *fakeDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.update(input)
+}
+
+func (db *fakeDynamo) update(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	id, err := itemKey(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	table := db.table(*input.TableName)
+	old := table[id]
+	ok, err := db.check(old, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed()
+	}
+
+	item := copyItem(old)
+	if item == nil {
+		item = copyItem(input.Key)
+	}
+	if input.UpdateExpression != nil {
+		if err := applyUpdate(item, *input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues); err != nil {
+			return nil, err
+		}
+	}
+	table[id] = item
+
+	output := &dynamodb.UpdateItemOutput{}
+	switch aws.StringValue(input.ReturnValues) {
+	case dynamodb.ReturnValueAllNew, dynamodb.ReturnValueUpdatedNew:
+		output.Attributes = copyItem(item)
+	case dynamodb.ReturnValueAllOld, dynamodb.ReturnValueUpdatedOld:
+		output.Attributes = copyItem(old)
+	}
+	return output, nil
+}
+
+func (db *fakeDynamo) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// every condition is checked before anything is written
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	canceled := false
+	for i, op := range input.TransactItems {
+		var table, condition *string
+		var key, values fakeItem
+		var names map[string]*string
+		switch {
+		case op.Put != nil:
+			table, key, condition, names, values = op.Put.TableName, op.Put.Item, op.Put.ConditionExpression, op.Put.ExpressionAttributeNames, op.Put.ExpressionAttributeValues
+		case op.Update != nil:
+			table, key, condition, names, values = op.Update.TableName, op.Update.Key, op.Update.ConditionExpression, op.Update.ExpressionAttributeNames, op.Update.ExpressionAttributeValues
+		case op.Delete != nil:
+			table, key, condition, names, values = op.Delete.TableName, op.Delete.Key, op.Delete.ConditionExpression, op.Delete.ExpressionAttributeNames, op.Delete.ExpressionAttributeValues
+		case op.ConditionCheck != nil:
+			table, key, condition, names, values = op.ConditionCheck.TableName, op.ConditionCheck.Key, op.ConditionCheck.ConditionExpression, op.ConditionCheck.ExpressionAttributeNames, op.ConditionCheck.ExpressionAttributeValues
+		}
+
+		id, err := itemKey(key)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := db.check(db.table(*table)[id], condition, names, values)
+		if err != nil {
+			return nil, err
+		}
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+		if !ok {
+			reasons[i].Code = aws.String("ConditionalCheckFailed")
+			canceled = true
+		}
+	}
+	if canceled {
+		return nil, &dynamodb.TransactionCanceledException{
+			Message_:            aws.String("Transaction cancelled"),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for _, op := range input.TransactItems {
+		switch {
+		case op.Put != nil:
+			id, _ := itemKey(op.Put.Item)
+			db.table(*op.Put.TableName)[id] = copyItem(op.Put.Item)
+		case op.Update != nil:
+			if _, err := db.update(&dynamodb.UpdateItemInput{
+				TableName:                 op.Update.TableName,
+				Key:                       op.Update.Key,
+				UpdateExpression:          op.Update.UpdateExpression,
+				ExpressionAttributeNames:  op.Update.ExpressionAttributeNames,
+				ExpressionAttributeValues: op.Update.ExpressionAttributeValues,
+			}); err != nil {
+				return nil, err
+			}
+		case op.Delete != nil:
+			id, _ := itemKey(op.Delete.Key)
+			delete(db.table(*op.Delete.TableName), id)
+		}
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (db *fakeDynamo) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	output := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{}}
+	for name, keys := range input.RequestItems {
+		for _, key := range keys.Keys {
+			id, err := itemKey(key)
+			if err != nil {
+				return nil, err
+			}
+			item := copyItem(db.table(name)[id])
+			if item == nil {
+				continue
+			}
+			if keys.ProjectionExpression != nil {
+				if item, err = project(item, *keys.ProjectionExpression, keys.ExpressionAttributeNames); err != nil {
+					return nil, err
+				}
+			}
+			output.Responses[name] = append(output.Responses[name], item)
+		}
+	}
+	return output, nil
+}
+
+// sortedItems returns the items of a table ordered by _id, so scans page
+// the same way every time
+func (db *fakeDynamo) sortedItems(name string) []fakeItem {
+	table := db.table(name)
+	ids := make([]string, 0, len(table))
+	for id := range table {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	items := make([]fakeItem, len(ids))
+	for i, id := range ids {
+		items[i] = copyItem(table[id])
+	}
+	return items
+}
+
+// page applies ExclusiveStartKey and Limit to items, which are in result
+// order, and returns the page with its LastEvaluatedKey
+func page(items []fakeItem, start fakeItem, limit *int64, keyNames []string) ([]fakeItem, fakeItem) {
+	if start != nil {
+		startID := aws.StringValue(start["_id"].S)
+		for i, item := range items {
+			if aws.StringValue(item["_id"].S) == startID {
+				items = items[i+1:]
+				break
+			}
+		}
+	}
+
+	if limit == nil || int64(len(items)) <= *limit {
+		return items, nil
+	}
+
+	items = items[:*limit]
+	last := items[len(items)-1]
+	lastKey := fakeItem{}
+	for _, name := range append([]string{"_id"}, keyNames...) {
+		if last[name] != nil {
+			lastKey[name] = copyValue(last[name])
+		}
+	}
+	return items, lastKey
+}
+
+func filterItems(items []fakeItem, filter *string, projection *string, names map[string]*string, values fakeItem) ([]fakeItem, error) {
+	var cond condExpr
+	if filter != nil && *filter != "" {
+		var err error
+		if cond, err = parseCondition(*filter, names, values); err != nil {
+			return nil, err
+		}
+	}
+
+	var out []fakeItem
+	for _, item := range items {
+		if cond != nil && !cond.eval(item) {
+			continue
+		}
+		if projection != nil {
+			var err error
+			if item, err = project(item, *projection, names); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+func (db *fakeDynamo) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	items, lastKey := page(db.sortedItems(*input.TableName), input.ExclusiveStartKey, input.Limit, nil)
+	items, err := filterItems(items, input.FilterExpression, input.ProjectionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.ScanOutput{Items: items, Count: aws.Int64(int64(len(items))), LastEvaluatedKey: lastKey}, nil
+}
+
+func (db *fakeDynamo) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	for {
+		output, err := db.Scan(input)
+		if err != nil {
+			return err
+		}
+		last := len(output.LastEvaluatedKey) == 0
+		if !fn(output, last) || last {
+			return nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// indexKeys returns the hash and range attributes of an index, or of the
+// table itself when index is empty
+func indexKeys(index string) (string, string) {
+	if index == "" {
+		return "_id", ""
+	}
+	parts := strings.Split(strings.TrimSuffix(index, "-index"), "-")
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func (db *fakeDynamo) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	hashKey, rangeKey := indexKeys(aws.StringValue(input.IndexName))
+	keyCond, err := parseCondition(aws.StringValue(input.KeyConditionExpression), input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []fakeItem
+	for _, item := range db.sortedItems(*input.TableName) {
+		if item[hashKey] == nil || (rangeKey != "" && item[rangeKey] == nil) {
+			continue
+		}
+		if keyCond.eval(item) {
+			items = append(items, item)
+		}
+	}
+
+	if rangeKey != "" {
+		sort.SliceStable(items, func(i, j int) bool {
+			return compareValues(items[i][rangeKey], items[j][rangeKey]) < 0
+		})
+	}
+	if input.ScanIndexForward != nil && !*input.ScanIndexForward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	var keyNames []string
+	for _, name := range []string{hashKey, rangeKey} {
+		if name != "" && name != "_id" {
+			keyNames = append(keyNames, name)
+		}
+	}
+	items, lastKey := page(items, input.ExclusiveStartKey, input.Limit, keyNames)
+	items, err = filterItems(items, input.FilterExpression, input.ProjectionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.QueryOutput{Items: items, Count: aws.Int64(int64(len(items))), LastEvaluatedKey: lastKey}, nil
+}
+
+func (db *fakeDynamo) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	for {
+		output, err := db.Query(input)
+		if err != nil {
+			return err
+		}
+		last := len(output.LastEvaluatedKey) == 0
+		if !fn(output, last) || last {
+			return nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// count returns the number of items in a table
+func (db *fakeDynamo) count(table string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.table(table))
+}
+
+// item returns a copy of the item with the given _id
+func (db *fakeDynamo) item(table string, id string) fakeItem {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return copyItem(db.table(table)[id])
+}
+
+// fakeS3 keeps objects in memory
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int64][]byte
+	nextID  int
+}
+
+func noSuchKey(key string) error {
+	return awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist: "+key, nil)
+}
+
+func (store *fakeS3) object(key string) ([]byte, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	data, ok := store.objects[key]
+	return data, ok
+}
+
+func (store *fakeS3) put(key string, body io.Reader) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = io.ReadAll(body); err != nil {
+			return err
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.objects[key] = data
+	return nil
+}
+
+func (store *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return &s3.PutObjectOutput{}, store.put(*input.Key, input.Body)
+}
+
+func (store *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, options ...request.Option) (*s3.PutObjectOutput, error) {
+	return store.PutObject(input)
+}
+
+// PutObjectRequest backs both presigned uploads and the single part uploads
+// of s3manager; sending the request stores the object
+func (store *fakeS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	output := &s3.PutObjectOutput{}
+	handlers := request.Handlers{}
+	handlers.Send.PushBack(func(r *request.Request) {
+		r.Error = store.put(*input.Key, input.Body)
+	})
+
+	r := request.New(
+		aws.Config{},
+		metadata.ClientInfo{Endpoint: "https://" + aws.StringValue(input.Bucket) + ".s3.amazonaws.com/" + aws.StringValue(input.Key)},
+		handlers, nil, &request.Operation{Name: "PutObject", HTTPMethod: http.MethodPut}, input, output,
+	)
+	return r, output
+}
+
+func (store *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := store.object(*input.Key)
+	if !ok {
+		return nil, noSuchKey(*input.Key)
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+	}, nil
+}
+
+func (store *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	data, ok := store.object(*input.Key)
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data))), LastModified: aws.Time(time.Now())}, nil
+}
+
+func (store *fakeS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.objects, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (store *fakeS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	source := *input.CopySource
+	if i := strings.Index(source, "/"); i >= 0 {
+		source = source[i+1:]
+	}
+	data, ok := store.object(source)
+	if !ok {
+		return nil, noSuchKey(source)
+	}
+	return &s3.CopyObjectOutput{}, store.put(*input.Key, bytes.NewReader(data))
+}
+
+func (store *fakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	store.mu.Lock()
+	var keys []string
+	for key := range store.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	store.mu.Unlock()
+	sort.Strings(keys)
+
+	output := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	fn(output, true)
+	return nil
+}
+
+func (store *fakeS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.nextID++
+	id := strconv.Itoa(store.nextID)
+	store.uploads[id] = map[int64][]byte{}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id), Key: input.Key}, nil
+}
+
+func (store *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, options ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return store.CreateMultipartUpload(input)
+}
+
+func (store *fakeS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	parts, ok := store.uploads[*input.UploadId]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	parts[*input.PartNumber] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("\"%d\"", *input.PartNumber))}, nil
+}
+
+func (store *fakeS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, options ...request.Option) (*s3.UploadPartOutput, error) {
+	return store.UploadPart(input)
+}
+
+func (store *fakeS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	parts, ok := store.uploads[*input.UploadId]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+
+	var data []byte
+	for _, part := range input.MultipartUpload.Parts {
+		data = append(data, parts[*part.PartNumber]...)
+	}
+	store.objects[*input.Key] = data
+	delete(store.uploads, *input.UploadId)
+	return &s3.CompleteMultipartUploadOutput{Key: input.Key}, nil
+}
+
+func (store *fakeS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, options ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return store.CompleteMultipartUpload(input)
+}
+
+func (store *fakeS3) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.uploads, *input.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (store *fakeS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, options ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return store.AbortMultipartUpload(input)
+}
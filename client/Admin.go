@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"avalon/api"
+)
+
+// The admin routes need a client built with WithAdminToken.
+
+func (c *Client) QueryAuditLog(ctx context.Context, filter api.AuditFilter) ([]api.AuditEvent, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"actor_id": filter.ActorID,
+		"case_id":  filter.CaseID,
+		"type":     filter.Type,
+		"start":    filter.Start,
+		"end":      filter.End,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	var events []api.AuditEvent
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/v1/admin/audit-events", query: query}, &events)
+	return events, err
+}
+
+func (c *Client) VerifyAuditLog(ctx context.Context) (api.AuditVerification, error) {
+	var verification api.AuditVerification
+	err := c.doJSON(ctx, http.MethodGet, "/v1/admin/audit-events/verify", nil, &verification)
+	return verification, err
+}
+
+func (c *Client) ReindexCases(ctx context.Context) (api.ReindexResult, error) {
+	var result api.ReindexResult
+	err := c.doJSON(ctx, http.MethodPost, "/v1/admin/cases/reindex", nil, &result)
+	return result, err
+}
+
+func (c *Client) ReindexDocuments(ctx context.Context) (api.ReindexResult, error) {
+	var result api.ReindexResult
+	err := c.doJSON(ctx, http.MethodPost, "/v1/admin/documents/reindex", nil, &result)
+	return result, err
+}
+
+// ExtractDocuments queues text extraction for documents never processed
+func (c *Client) ExtractDocuments(ctx context.Context) (api.ReindexResult, error) {
+	var result api.ReindexResult
+	err := c.doJSON(ctx, http.MethodPost, "/v1/admin/documents/extract", nil, &result)
+	return result, err
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"avalon/api"
+)
+
+// CasePage is one page of a case listing. NextCursor is empty on the last
+// page.
+type CasePage struct {
+	Cases      []api.Case
+	NextCursor string
+}
+
+func (c *Client) CreateCase(ctx context.Context, newCase api.Case) (api.Case, error) {
+	var created api.Case
+	err := c.create(ctx, "/v1/cases", newCase, &created)
+	return created, err
+}
+
+func (c *Client) GetCase(ctx context.Context, caseID string) (api.Case, error) {
+	var found api.Case
+	err := c.doJSON(ctx, http.MethodGet, pathID("/v1/cases/%s", caseID), nil, &found)
+	return found, err
+}
+
+// UpdateCase changes the non-nil fields of update and returns the case as
+// stored
+func (c *Client) UpdateCase(ctx context.Context, caseID string, update api.CaseUpdate) (api.Case, error) {
+	var updated api.Case
+	err := c.doJSON(ctx, http.MethodPatch, pathID("/v1/cases/%s", caseID), update, &updated)
+	return updated, err
+}
+
+func (c *Client) DeleteCase(ctx context.Context, caseID string) (api.Case, error) {
+	var deleted api.Case
+	err := c.doJSON(ctx, http.MethodDelete, pathID("/v1/cases/%s", caseID), nil, &deleted)
+	return deleted, err
+}
+
+// GetCaseHistory returns the changes made to a case, oldest first
+func (c *Client) GetCaseHistory(ctx context.Context, caseID string) ([]api.CaseChange, error) {
+	var history []api.CaseChange
+	err := c.doJSON(ctx, http.MethodGet, pathID("/v1/cases/%s/history", caseID), nil, &history)
+	return history, err
+}
+
+func caseFilterQuery(filter api.CaseFilter) url.Values {
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"case_type":  filter.CaseType,
+		"state":      filter.State,
+		"city":       filter.City,
+		"judge_name": filter.JudgeName,
+		"date_from":  filter.DateFrom,
+		"date_to":    filter.DateTo,
+		"q":          filter.Query,
+		"sort":       filter.Sort,
+		"order":      filter.Order,
+		"cursor":     filter.Cursor,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.FormatInt(filter.Limit, 10))
+	}
+	return query
+}
+
+// ListUserCases returns one page of the user's cases. Pass the returned
+// NextCursor as filter.Cursor to get the next page.
+func (c *Client) ListUserCases(ctx context.Context, userID string, filter api.CaseFilter) (CasePage, error) {
+	req := request{
+		method: http.MethodGet,
+		path:   pathID("/v1/users/%s/cases", userID),
+		query:  caseFilterQuery(filter),
+	}
+
+	var page CasePage
+	env, err := c.do(ctx, req, &page.Cases)
+	if err != nil {
+		return CasePage{}, err
+	}
+	page.NextCursor = env.NextCursor
+
+	return page, nil
+}
+
+func (c *Client) DeleteUserCases(ctx context.Context, userID string) ([]api.Case, error) {
+	var deleted []api.Case
+	err := c.doJSON(ctx, http.MethodDelete, pathID("/v1/users/%s/cases", userID), nil, &deleted)
+	return deleted, err
+}
+
+// GetCaseChat returns the chat that belongs to a case
+func (c *Client) GetCaseChat(ctx context.Context, caseID string) (api.Chat, error) {
+	var chat api.Chat
+	err := c.doJSON(ctx, http.MethodGet, pathID("/v1/cases/%s/chat", caseID), nil, &chat)
+	return chat, err
+}
+
+func (c *Client) AddMessage(ctx context.Context, caseID string, message api.Message) error {
+	return c.create(ctx, pathID("/v1/cases/%s/chat/messages", caseID), message, nil)
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"avalon/api"
+)
+
+// ChatStream follows a case chat. It is not safe for concurrent use.
+type ChatStream struct {
+	body        io.ReadCloser
+	reader      *bufio.Reader
+	lastEventID string
+}
+
+// StreamCaseChat follows new messages, typing and presence on a case chat.
+// Messages after lastEventID are replayed first; pass "" to only receive
+// what comes next. The stream lasts until ctx is done or Close is called, so
+// the client's http.Client should not set a Timeout. It needs WithToken for
+// a user allowed to follow the chat, or WithAdminToken.
+func (c *Client) StreamCaseChat(ctx context.Context, caseID string, lastEventID string) (*ChatStream, error) {
+	query := url.Values{}
+	if lastEventID != "" {
+		query.Set("last_event_id", lastEventID)
+	}
+
+	body, err := c.stream(ctx, request{
+		method: http.MethodGet,
+		path:   pathID("/v1/cases/%s/chat/stream", caseID),
+		query:  query,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChatStream{body: body, reader: bufio.NewReader(body), lastEventID: lastEventID}, nil
+}
+
+// Next blocks until the next event. It returns io.EOF when the server ends
+// the stream; reconnect with LastEventID to resume without missing messages.
+func (s *ChatStream) Next() (api.ChatEvent, error) {
+	var id, data string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return api.ChatEvent{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if data == "" {
+				continue
+			}
+			var event api.ChatEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return api.ChatEvent{}, err
+			}
+			if id != "" {
+				s.lastEventID = id
+			}
+			return event, nil
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			data += value
+		}
+	}
+}
+
+// LastEventID is the ID of the last message received
+func (s *ChatStream) LastEventID() string {
+	return s.lastEventID
+}
+
+func (s *ChatStream) Close() error {
+	return s.body.Close()
+}
+
+// SetTyping tells the chat's followers whether the client's user is typing.
+// It needs WithToken.
+func (c *Client) SetTyping(ctx context.Context, caseID string, typing bool) error {
+	body := struct {
+		Typing bool `json:"typing"`
+	}{typing}
+
+	return c.doJSON(ctx, http.MethodPut, pathID("/v1/cases/%s/chat/typing", caseID), body, nil)
+}
@@ -0,0 +1,341 @@
+// Package client is a typed Go client for the Avalon API. It uses the /v1
+// resource routes and shares its request and response types with the
+// server through the api package.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"avalon/api"
+)
+
+type Client struct {
+	baseURL      string
+	httpClient   *http.Client
+	token        string
+	adminToken   string
+	userID       string
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used for requests
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken sends token as a bearer token on every request, such as the
+// session token returned by Login
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithAdminToken sends the X-Admin-Token required by the admin routes
+func WithAdminToken(token string) Option {
+	return func(c *Client) {
+		c.adminToken = token
+	}
+}
+
+// WithUserID sends the X-User-ID header. The server attributes changes to
+// the WithToken session's user and only notes a different claimed user in
+// the audit log.
+func WithUserID(userID string) Option {
+	return func(c *Client) {
+		c.userID = userID
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and the delay
+// before the first retry, which doubles on each attempt
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryBackoff = backoff
+	}
+}
+
+// New returns a client for the server at baseURL, such as
+// "http://localhost:8080"
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		httpClient:   &http.Client{Timeout: 60 * time.Second},
+		maxRetries:   3,
+		retryBackoff: 200 * time.Millisecond,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Error is returned for every non-2xx response. Object holds the response
+// object of the few errors that carry one, such as the partial report of a
+// failed erasure.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Errors     []api.FieldError
+	Object     json.RawMessage
+	RequestID  string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("avalon: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	for _, fe := range e.Errors {
+		msg += fmt.Sprintf("; %s %s", fe.Field, fe.Message)
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+type idempotencyKeyContext struct{}
+
+// WithIdempotencyKey sets the Idempotency-Key sent by creation methods
+// called with ctx. Without it the client picks a random key per call, which
+// still makes its own retries safe.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContext{}, key)
+}
+
+func idempotencyKey(ctx context.Context) string {
+	if key, ok := ctx.Value(idempotencyKeyContext{}).(string); ok && key != "" {
+		return key
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// envelope mirrors api.Response with the object left undecoded
+type envelope struct {
+	Message    string           `json:"message"`
+	Status     int              `json:"status"`
+	Code       string           `json:"code"`
+	Object     json.RawMessage  `json:"object"`
+	Errors     []api.FieldError `json:"errors"`
+	NextCursor string           `json:"next_cursor"`
+	Summary    json.RawMessage  `json:"summary"`
+	RequestID  string           `json:"request_id"`
+}
+
+// request describes one API call. Body is sent as is with ContentType, so
+// it can be replayed on retries.
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	body        []byte
+	contentType string
+	header      http.Header
+	idempotent  bool
+}
+
+func jsonRequest(method string, path string, v interface{}) (request, error) {
+	req := request{method: method, path: path}
+	if v == nil {
+		return req, nil
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return request{}, fmt.Errorf("failed to encode request, %v", err)
+	}
+	req.body = body
+	req.contentType = "application/json"
+	return req, nil
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+// send performs the request, retrying network errors and retryable statuses
+// for methods that are safe to repeat. The caller closes the response body.
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	canRetry := req.method == http.MethodGet || req.method == http.MethodPut ||
+		req.method == http.MethodDelete || req.method == http.MethodHead
+	key := ""
+	if req.idempotent {
+		key = idempotencyKey(ctx)
+		canRetry = true
+	}
+
+	target := c.baseURL + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, req.method, target, bytes.NewReader(req.body))
+		if err != nil {
+			return nil, err
+		}
+		if req.contentType != "" {
+			httpReq.Header.Set("Content-Type", req.contentType)
+		}
+		for name, values := range req.header {
+			httpReq.Header[name] = values
+		}
+		httpReq.Header.Set("Accept", "application/json")
+		if c.token != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if c.adminToken != "" {
+			httpReq.Header.Set("X-Admin-Token", c.adminToken)
+		}
+		if c.userID != "" {
+			httpReq.Header.Set("X-User-ID", c.userID)
+		}
+		if key != "" {
+			httpReq.Header.Set("Idempotency-Key", key)
+		}
+
+		resp, err := c.httpClient.Do(httpReq)
+		if err == nil && !(canRetry && retryable(resp.StatusCode)) {
+			return resp, nil
+		}
+		if attempt >= c.maxRetries || !canRetry || ctx.Err() != nil {
+			if err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		delay := time.Duration(float64(c.retryBackoff) * math.Pow(2, float64(attempt)))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+
+	var env envelope
+	if err := json.NewDecoder(resp.Body).Decode(&env); err == nil {
+		apiErr.Code = env.Code
+		apiErr.Message = env.Message
+		apiErr.Errors = env.Errors
+		apiErr.Object = env.Object
+		apiErr.RequestID = env.RequestID
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-ID")
+	}
+
+	return apiErr
+}
+
+// do sends a request and decodes the envelope's object into out, which may
+// be nil
+func (c *Client) do(ctx context.Context, req request, out interface{}) (*envelope, error) {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, decodeError(resp)
+	}
+
+	var env envelope
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return nil, fmt.Errorf("failed to decode response, %v", err)
+	}
+
+	if out != nil && len(env.Object) > 0 && string(env.Object) != "null" {
+		if err := json.Unmarshal(env.Object, out); err != nil {
+			return nil, fmt.Errorf("failed to decode response object, %v", err)
+		}
+	}
+
+	return &env, nil
+}
+
+// doJSON sends v as a JSON body and decodes the response object into out
+func (c *Client) doJSON(ctx context.Context, method string, path string, v interface{}, out interface{}) error {
+	req, err := jsonRequest(method, path, v)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, req, out)
+	return err
+}
+
+// create is doJSON for POST routes that accept an Idempotency-Key
+func (c *Client) create(ctx context.Context, path string, v interface{}, out interface{}) error {
+	req, err := jsonRequest(http.MethodPost, path, v)
+	if err != nil {
+		return err
+	}
+	req.idempotent = true
+	_, err = c.do(ctx, req, out)
+	return err
+}
+
+// stream sends a request whose successful response is not JSON and returns
+// its body, which the caller must close
+func (c *Client) stream(ctx context.Context, req request) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+
+	return resp.Body, nil
+}
+
+func pathID(format string, ids ...string) string {
+	escaped := make([]interface{}, len(ids))
+	for i, id := range ids {
+		escaped[i] = url.PathEscape(id)
+	}
+	return fmt.Sprintf(format, escaped...)
+}
+
+// OpenAPISpec returns the server's OpenAPI document
+func (c *Client) OpenAPISpec(ctx context.Context) ([]byte, error) {
+	body, err := c.stream(ctx, request{method: http.MethodGet, path: "/openapi.json"})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"avalon/api"
+)
+
+func writeResponse(w http.ResponseWriter, status int, resp api.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestCreateCaseEncodesRequest(t *testing.T) {
+	var got api.Case
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/cases" {
+			t.Errorf("request = %s %s, want POST /v1/cases", r.Method, r.URL.Path)
+		}
+		for header, want := range map[string]string{
+			"Content-Type":    "application/json",
+			"Authorization":   "Bearer session",
+			"X-Admin-Token":   "admin",
+			"X-User-ID":       "u1",
+			"Idempotency-Key": "key-1",
+		} {
+			if value := r.Header.Get(header); value != want {
+				t.Errorf("%s = %q, want %q", header, value, want)
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode body: %v", err)
+		}
+
+		got.ID = "c1"
+		writeResponse(w, http.StatusCreated, api.Response{Message: "Case created", Status: http.StatusCreated, Object: got})
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithToken("session"), WithAdminToken("admin"), WithUserID("u1"))
+	ctx := WithIdempotencyKey(context.Background(), "key-1")
+
+	sent := api.Case{CaseTitle: "Doe v. Roe", UserID: "u1", State: "CA", Date: "2024-05-01"}
+	created, err := c.CreateCase(ctx, sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.CaseTitle != sent.CaseTitle || got.UserID != sent.UserID || got.State != sent.State || got.Date != sent.Date {
+		t.Errorf("server received %+v, want %+v", got, sent)
+	}
+	if created.ID != "c1" || created.CaseTitle != sent.CaseTitle {
+		t.Errorf("CreateCase returned %+v", created)
+	}
+}
+
+func TestErrorDecoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/cases/bad":
+			writeResponse(w, http.StatusBadRequest, api.Response{
+				Message:   "Validation failed",
+				Status:    http.StatusBadRequest,
+				Code:      "validation_failed",
+				Errors:    []api.FieldError{{Field: "date", Message: "must be a YYYY-MM-DD date"}},
+				RequestID: "req-1",
+			})
+		default:
+			w.Header().Set("X-Request-ID", "req-2")
+			http.Error(w, "upstream failure", http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(0, 0))
+
+	_, err := c.UpdateCase(context.Background(), "bad", api.CaseUpdate{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("UpdateCase error = %v, want *Error", err)
+	}
+	want := &Error{
+		StatusCode: http.StatusBadRequest,
+		Code:       "validation_failed",
+		Message:    "Validation failed",
+		Errors:     []api.FieldError{{Field: "date", Message: "must be a YYYY-MM-DD date"}},
+		RequestID:  "req-1",
+	}
+	if !reflect.DeepEqual(apiErr, want) {
+		t.Errorf("error = %+v, want %+v", apiErr, want)
+	}
+
+	_, err = c.GetCase(context.Background(), "other")
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("GetCase error = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "" || apiErr.RequestID != "req-2" {
+		t.Errorf("non-JSON error = %+v", apiErr)
+	}
+}
+
+func TestRetriesReuseIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeResponse(w, http.StatusCreated, api.Response{Status: http.StatusCreated, Object: api.Case{ID: "c1"}})
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+	created, err := c.CreateCase(context.Background(), api.Case{CaseTitle: "Doe v. Roe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != "c1" {
+		t.Errorf("CreateCase returned %+v", created)
+	}
+	if len(keys) != 3 || keys[0] == "" || keys[1] != keys[0] || keys[2] != keys[0] {
+		t.Errorf("Idempotency-Key per attempt = %q, want one key reused 3 times", keys)
+	}
+}
+
+func TestListUserCasesPaginates(t *testing.T) {
+	pages := map[string]api.Response{
+		"":     {Status: http.StatusOK, Object: []api.Case{{ID: "c1"}, {ID: "c2"}}, NextCursor: "next"},
+		"next": {Status: http.StatusOK, Object: []api.Case{{ID: "c3"}}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/users/u 1/cases" {
+			t.Errorf("path = %s, want /v1/users/u%%201/cases", r.URL.EscapedPath())
+		}
+		query := r.URL.Query()
+		if query.Get("limit") != "2" || query.Get("sort") != "title" || query.Get("state") != "CA" {
+			t.Errorf("query = %s", r.URL.RawQuery)
+		}
+
+		page, ok := pages[query.Get("cursor")]
+		if !ok {
+			t.Errorf("unexpected cursor %q", query.Get("cursor"))
+		}
+		writeResponse(w, http.StatusOK, page)
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	filter := api.CaseFilter{State: "CA", Sort: "title", Limit: 2}
+
+	var ids []string
+	for requests := 0; requests < 3; requests++ {
+		page, err := c.ListUserCases(context.Background(), "u 1", filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, myCase := range page.Cases {
+			ids = append(ids, myCase.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+
+	if want := []string{"c1", "c2", "c3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("listed %v, want %v", ids, want)
+	}
+}
+
+func TestListCaseDocumentsDecodesSummary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("summary") != "true" || query.Get("bucket_size") != "0.5" || query.Get("file_type") != "pdf,docx" {
+			t.Errorf("query = %s", r.URL.RawQuery)
+		}
+		writeResponse(w, http.StatusOK, api.Response{
+			Status:     http.StatusOK,
+			Object:     []api.Document{{ID: "d1", Relevancy: 0.9}},
+			NextCursor: "more",
+			Summary:    api.RelevancySummary{Buckets: []api.RelevancyBucket{{Min: 0.5, Max: 1, Count: 1}}},
+		})
+	}))
+	defer server.Close()
+
+	page, err := New(server.URL).ListCaseDocuments(context.Background(), "c1", api.DocumentFilter{FileTypes: []string{"pdf", "docx"}}, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Documents) != 1 || page.Documents[0].ID != "d1" || page.NextCursor != "more" {
+		t.Errorf("page = %+v", page)
+	}
+	if page.Summary == nil || len(page.Summary.Buckets) != 1 || page.Summary.Buckets[0].Count != 1 {
+		t.Errorf("summary = %+v", page.Summary)
+	}
+}
+
+func TestEraseUserDataReturnsPartialReport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusInternalServerError, api.Response{
+			Message: "Failed to erase user data",
+			Status:  http.StatusInternalServerError,
+			Code:    "internal_error",
+			Object: api.ErasureReport{
+				UserID:       "u1",
+				CasesDeleted: []string{"c1"},
+				Errors:       []string{"throttled"},
+			},
+		})
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(0, 0))
+
+	report, err := c.EraseUserData(context.Background(), "u1")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("EraseUserData error = %v, want a 500 *Error", err)
+	}
+	if report.UserID != "u1" || !reflect.DeepEqual(report.CasesDeleted, []string{"c1"}) || !reflect.DeepEqual(report.Errors, []string{"throttled"}) {
+		t.Errorf("partial report = %+v", report)
+	}
+}
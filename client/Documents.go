@@ -0,0 +1,379 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"avalon/api"
+)
+
+// File is one file of a multipart upload
+type File struct {
+	Name    string
+	Content io.Reader
+}
+
+// DocumentPage is one page of a case's documents. Summary is set when the
+// listing asked for one.
+type DocumentPage struct {
+	Documents  []api.Document
+	NextCursor string
+	Summary    *api.RelevancySummary
+}
+
+// SearchPage is one page of a case search with the total number of matches
+type SearchPage struct {
+	Hits       []api.SearchHit
+	NextCursor string
+	Total      int
+}
+
+// multipartRequest buffers the form so the request can be retried
+func multipartRequest(path string, fields map[string]string, fileField string, files []File) (request, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			return request{}, err
+		}
+	}
+	for _, file := range files {
+		part, err := writer.CreateFormFile(fileField, file.Name)
+		if err != nil {
+			return request{}, err
+		}
+		if _, err := io.Copy(part, file.Content); err != nil {
+			return request{}, fmt.Errorf("failed to read %s, %v", file.Name, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return request{}, err
+	}
+
+	return request{
+		method:      http.MethodPost,
+		path:        path,
+		body:        body.Bytes(),
+		contentType: writer.FormDataContentType(),
+		idempotent:  true,
+	}, nil
+}
+
+// CreateDocuments uploads files to a case and creates a document for each.
+// Files the case already has are flagged as duplicates.
+func (c *Client) CreateDocuments(ctx context.Context, caseID string, files ...File) ([]api.Document, error) {
+	return c.CreateDocumentsOnDuplicate(ctx, caseID, "", files...)
+}
+
+// CreateDocumentsOnDuplicate is CreateDocuments with a choice for files the
+// case already has: "flag", "link" or "skip". Skipped files have no document
+// in the result.
+func (c *Client) CreateDocumentsOnDuplicate(ctx context.Context, caseID string, onDuplicate string, files ...File) ([]api.Document, error) {
+	req, err := multipartRequest(pathID("/v1/cases/%s/documents", caseID), nil, "files[]", files)
+	if err != nil {
+		return nil, err
+	}
+	if onDuplicate != "" {
+		req.query = url.Values{"on_duplicate": {onDuplicate}}
+	}
+
+	var documents []api.Document
+	_, err = c.do(ctx, req, &documents)
+	return documents, err
+}
+
+// UploadFile stores a file for a case without creating a document and
+// returns its URL
+func (c *Client) UploadFile(ctx context.Context, caseID string, file File) (string, error) {
+	req, err := multipartRequest("/uploadDocument", map[string]string{"case_id": caseID}, "file", []File{file})
+	if err != nil {
+		return "", err
+	}
+
+	var fileURL string
+	_, err = c.do(ctx, req, &fileURL)
+	return fileURL, err
+}
+
+// UploadFiles stores files for a case without creating documents and returns
+// their URLs
+func (c *Client) UploadFiles(ctx context.Context, caseID string, files ...File) ([]string, error) {
+	req, err := multipartRequest("/uploadDocuments", map[string]string{"case_id": caseID}, "files", files)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileURLs []string
+	_, err = c.do(ctx, req, &fileURLs)
+	return fileURLs, err
+}
+
+func documentFilterQuery(filter api.DocumentFilter, bucketSize float64) url.Values {
+	query := url.Values{}
+	if filter.MinRelevancy != nil {
+		query.Set("min_relevancy", strconv.FormatFloat(*filter.MinRelevancy, 'f', -1, 64))
+	}
+	if filter.MaxRelevancy != nil {
+		query.Set("max_relevancy", strconv.FormatFloat(*filter.MaxRelevancy, 'f', -1, 64))
+	}
+	if filter.Stored != nil {
+		query.Set("stored", strconv.FormatBool(*filter.Stored))
+	}
+	if filter.DateFrom != "" {
+		query.Set("date_from", filter.DateFrom)
+	}
+	if filter.DateTo != "" {
+		query.Set("date_to", filter.DateTo)
+	}
+	if len(filter.FileTypes) > 0 {
+		query.Set("file_type", strings.Join(filter.FileTypes, ","))
+	}
+	if filter.DuplicateStatus != "" {
+		query.Set("duplicate_status", filter.DuplicateStatus)
+	}
+	if filter.Order != "" {
+		query.Set("order", filter.Order)
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.FormatInt(filter.Limit, 10))
+	}
+	if filter.Cursor != "" {
+		query.Set("cursor", filter.Cursor)
+	}
+	if bucketSize > 0 {
+		query.Set("summary", "true")
+		query.Set("bucket_size", strconv.FormatFloat(bucketSize, 'f', -1, 64))
+	}
+	return query
+}
+
+// ListCaseDocuments returns one page of a case's documents, most relevant
+// first unless filter.Order is "asc". A bucketSize above zero also returns
+// a relevancy summary of every matching document.
+func (c *Client) ListCaseDocuments(ctx context.Context, caseID string, filter api.DocumentFilter, bucketSize float64) (DocumentPage, error) {
+	req := request{
+		method: http.MethodGet,
+		path:   pathID("/v1/cases/%s/documents", caseID),
+		query:  documentFilterQuery(filter, bucketSize),
+	}
+
+	var page DocumentPage
+	env, err := c.do(ctx, req, &page.Documents)
+	if err != nil {
+		return DocumentPage{}, err
+	}
+	page.NextCursor = env.NextCursor
+
+	if len(env.Summary) > 0 && string(env.Summary) != "null" {
+		page.Summary = &api.RelevancySummary{}
+		if err := json.Unmarshal(env.Summary, page.Summary); err != nil {
+			return DocumentPage{}, fmt.Errorf("failed to decode relevancy summary, %v", err)
+		}
+	}
+
+	return page, nil
+}
+
+// SearchCaseDocuments returns one page of the documents of a case matching
+// query, best match first. A limit of 0 uses the server's default.
+func (c *Client) SearchCaseDocuments(ctx context.Context, caseID string, query string, limit int, cursor string) (SearchPage, error) {
+	params := url.Values{"q": {query}}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+
+	req := request{
+		method: http.MethodGet,
+		path:   pathID("/v1/cases/%s/search", caseID),
+		query:  params,
+	}
+
+	var page SearchPage
+	env, err := c.do(ctx, req, &page.Hits)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	page.NextCursor = env.NextCursor
+
+	var summary api.SearchSummary
+	if len(env.Summary) > 0 && string(env.Summary) != "null" {
+		if err := json.Unmarshal(env.Summary, &summary); err != nil {
+			return SearchPage{}, fmt.Errorf("failed to decode search summary, %v", err)
+		}
+	}
+	page.Total = summary.Total
+
+	return page, nil
+}
+
+func (c *Client) DeleteCaseDocuments(ctx context.Context, caseID string) ([]api.Document, error) {
+	var deleted []api.Document
+	err := c.doJSON(ctx, http.MethodDelete, pathID("/v1/cases/%s/documents", caseID), nil, &deleted)
+	return deleted, err
+}
+
+// FindDocumentID returns the ID of the document stored at fileURL. When
+// duplicates share the file, the original is returned.
+func (c *Client) FindDocumentID(ctx context.Context, fileURL string) (string, error) {
+	return c.FindCaseDocumentID(ctx, "", fileURL)
+}
+
+// FindCaseDocumentID returns the ID of the document in caseID stored at
+// fileURL
+func (c *Client) FindCaseDocumentID(ctx context.Context, caseID string, fileURL string) (string, error) {
+	query := url.Values{"file_url": {fileURL}}
+	if caseID != "" {
+		query.Set("case_id", caseID)
+	}
+
+	req := request{
+		method: http.MethodGet,
+		path:   "/v1/documents",
+		query:  query,
+	}
+
+	var documentID string
+	_, err := c.do(ctx, req, &documentID)
+	return documentID, err
+}
+
+func (c *Client) GetDocument(ctx context.Context, documentID string) (api.Document, error) {
+	var document api.Document
+	err := c.doJSON(ctx, http.MethodGet, pathID("/v1/documents/%s", documentID), nil, &document)
+	return document, err
+}
+
+// UpdateDocument changes the non-nil fields of update and returns the
+// document as stored
+func (c *Client) UpdateDocument(ctx context.Context, documentID string, update api.DocumentUpdate) (api.Document, error) {
+	var document api.Document
+	err := c.doJSON(ctx, http.MethodPatch, pathID("/v1/documents/%s", documentID), update, &document)
+	return document, err
+}
+
+func (c *Client) DeleteDocument(ctx context.Context, documentID string) (api.Document, error) {
+	var deleted api.Document
+	err := c.doJSON(ctx, http.MethodDelete, pathID("/v1/documents/%s", documentID), nil, &deleted)
+	return deleted, err
+}
+
+// DownloadDocument returns the document's file contents. The caller must
+// close it.
+func (c *Client) DownloadDocument(ctx context.Context, documentID string) (io.ReadCloser, error) {
+	return c.stream(ctx, request{method: http.MethodGet, path: pathID("/v1/documents/%s/content", documentID)})
+}
+
+// DocumentVersions lists a document's versions, oldest first
+func (c *Client) DocumentVersions(ctx context.Context, documentID string) ([]api.DocumentVersion, error) {
+	var versions []api.DocumentVersion
+	err := c.doJSON(ctx, http.MethodGet, pathID("/v1/documents/%s/versions", documentID), nil, &versions)
+	return versions, err
+}
+
+// UploadDocumentVersion uploads file as the document's new current version
+// and returns the updated document
+func (c *Client) UploadDocumentVersion(ctx context.Context, documentID string, file File) (api.Document, error) {
+	req, err := multipartRequest(pathID("/v1/documents/%s/versions", documentID), nil, "file", []File{file})
+	if err != nil {
+		return api.Document{}, err
+	}
+
+	var document api.Document
+	_, err = c.do(ctx, req, &document)
+	return document, err
+}
+
+// DownloadDocumentVersion returns the file contents of one version of a
+// document. The caller must close it.
+func (c *Client) DownloadDocumentVersion(ctx context.Context, documentID string, number int) (io.ReadCloser, error) {
+	return c.stream(ctx, request{method: http.MethodGet, path: pathID("/v1/documents/%s/versions/%s/content", documentID, strconv.Itoa(number))})
+}
+
+// RestoreDocumentVersion makes an earlier version current again by adding
+// a new version with its file, and returns the updated document
+func (c *Client) RestoreDocumentVersion(ctx context.Context, documentID string, number int) (api.Document, error) {
+	var document api.Document
+	err := c.doJSON(ctx, http.MethodPost, pathID("/v1/documents/%s/versions/%s/restore", documentID, strconv.Itoa(number)), nil, &document)
+	return document, err
+}
+
+// DocumentText returns the text extracted from a document's current
+// version, one entry per page
+func (c *Client) DocumentText(ctx context.Context, documentID string) (api.DocumentText, error) {
+	var text api.DocumentText
+	err := c.doJSON(ctx, http.MethodGet, pathID("/v1/documents/%s/text", documentID), nil, &text)
+	return text, err
+}
+
+// ExtractDocumentText queues a document's text to be extracted again
+func (c *Client) ExtractDocumentText(ctx context.Context, documentID string) (api.Document, error) {
+	var document api.Document
+	err := c.doJSON(ctx, http.MethodPost, pathID("/v1/documents/%s/text/extract", documentID), nil, &document)
+	return document, err
+}
+
+func (c *Client) MoveDocument(ctx context.Context, documentID string, caseID string) (api.Document, error) {
+	body := struct {
+		CaseID string `json:"case_id"`
+	}{caseID}
+
+	var moved api.Document
+	err := c.doJSON(ctx, http.MethodPost, pathID("/v1/documents/%s/move", documentID), body, &moved)
+	return moved, err
+}
+
+func (c *Client) CopyDocument(ctx context.Context, documentID string, caseID string) (api.Document, error) {
+	body := struct {
+		CaseID string `json:"case_id"`
+	}{caseID}
+
+	var copied api.Document
+	err := c.create(ctx, pathID("/v1/documents/%s/copy", documentID), body, &copied)
+	return copied, err
+}
+
+// ResolveDuplicate applies a review decision to a duplicate document: "skip"
+// deletes it and "link" keeps it alongside its original
+func (c *Client) ResolveDuplicate(ctx context.Context, documentID string, action string) (api.Document, error) {
+	body := struct {
+		Action string `json:"action"`
+	}{action}
+
+	var document api.Document
+	err := c.doJSON(ctx, http.MethodPost, pathID("/v1/documents/%s/duplicate", documentID), body, &document)
+	return document, err
+}
+
+// UpdateRelevancy sets the relevancy of the document stored at fileURL
+func (c *Client) UpdateRelevancy(ctx context.Context, fileURL string, relevancy float64) error {
+	body := struct {
+		FileURL   string  `json:"file_url"`
+		Relevancy float64 `json:"relevancy"`
+	}{fileURL, relevancy}
+
+	return c.doJSON(ctx, http.MethodPost, "/updateRelevancyByFileUrl", body, nil)
+}
+
+// UpdateRelevancyBatch applies many relevancy scores at once. Items that
+// fail are reported in the result rather than as an error.
+func (c *Client) UpdateRelevancyBatch(ctx context.Context, updates []api.RelevancyUpdate) (api.BatchRelevancyResult, error) {
+	body := struct {
+		Updates []api.RelevancyUpdate `json:"updates"`
+	}{updates}
+
+	var result api.BatchRelevancyResult
+	err := c.doJSON(ctx, http.MethodPost, "/v1/documents/relevancy", body, &result)
+	return result, err
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+const tusVersion = "1.0.0"
+
+func tusRequest(method string, path string) request {
+	return request{method: method, path: path, header: http.Header{"Tus-Resumable": {tusVersion}}}
+}
+
+// tusResponse sends a tus request, returning the response headers
+func (c *Client) tusResponse(ctx context.Context, req request, want int) (http.Header, error) {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		return nil, decodeError(resp)
+	}
+	return resp.Header, nil
+}
+
+// CreateResumableUpload starts a resumable upload of size bytes to a case
+// and returns its ID, which becomes the Document ID once every byte is sent
+// with UploadResumable
+func (c *Client) CreateResumableUpload(ctx context.Context, caseID string, fileName string, size int64) (string, error) {
+	req := tusRequest(http.MethodPost, "/v1/tus")
+	req.header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.header.Set("Upload-Metadata", "case_id "+base64.StdEncoding.EncodeToString([]byte(caseID))+
+		",filename "+base64.StdEncoding.EncodeToString([]byte(fileName)))
+
+	header, err := c.tusResponse(ctx, req, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+
+	location := header.Get("Location")
+	if location == "" {
+		return "", errors.New("upload created without a Location")
+	}
+	return path.Base(location), nil
+}
+
+// ResumableUploadOffset returns how many bytes of an upload the server has
+func (c *Client) ResumableUploadOffset(ctx context.Context, uploadID string) (int64, error) {
+	header, err := c.tusResponse(ctx, tusRequest(http.MethodHead, pathID("/v1/tus/%s", uploadID)), http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(header.Get("Upload-Offset"), 10, 64)
+}
+
+// UploadResumable sends the rest of an upload in chunks of chunkSize,
+// starting from the server's offset, so it can be called again after a
+// failure. content must hold the whole file of size bytes.
+func (c *Client) UploadResumable(ctx context.Context, uploadID string, content io.ReaderAt, size int64, chunkSize int64) error {
+	if chunkSize <= 0 {
+		return errors.New("chunk size must be positive")
+	}
+
+	offset, err := c.ResumableUploadOffset(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+
+	for offset < size {
+		chunk := make([]byte, min(chunkSize, size-offset))
+		if _, err := content.ReadAt(chunk, offset); err != nil && !(err == io.EOF && len(chunk) > 0) {
+			return err
+		}
+
+		req := tusRequest(http.MethodPatch, pathID("/v1/tus/%s", uploadID))
+		req.header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		req.body = chunk
+		req.contentType = "application/offset+octet-stream"
+
+		header, err := c.tusResponse(ctx, req, http.StatusNoContent)
+		if err != nil {
+			return err
+		}
+
+		next, err := strconv.ParseInt(header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid Upload-Offset, %v", err)
+		}
+		if next <= offset {
+			return fmt.Errorf("upload %s did not advance past %d", uploadID, offset)
+		}
+		offset = next
+	}
+
+	return nil
+}
+
+// TerminateResumableUpload discards an unfinished upload
+func (c *Client) TerminateResumableUpload(ctx context.Context, uploadID string) error {
+	_, err := c.tusResponse(ctx, tusRequest(http.MethodDelete, pathID("/v1/tus/%s", uploadID)), http.StatusNoContent)
+	return err
+}
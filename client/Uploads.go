@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"avalon/api"
+)
+
+// ReserveUploads reserves document IDs and presigned PUT URLs for files that
+// will be uploaded straight to storage with PutReservedUpload
+func (c *Client) ReserveUploads(ctx context.Context, caseID string, files []api.UploadRequest) ([]api.UploadReservation, error) {
+	body := struct {
+		Files []api.UploadRequest `json:"files"`
+	}{files}
+
+	var reservations []api.UploadReservation
+	err := c.create(ctx, pathID("/v1/cases/%s/uploads", caseID), body, &reservations)
+	return reservations, err
+}
+
+// PutReservedUpload uploads a reserved file to its presigned URL. content
+// must hold exactly the reserved size and digest.
+func (c *Client) PutReservedUpload(ctx context.Context, reservation api.UploadReservation, content io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, reservation.UploadURL, content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = reservation.Size
+	for name, value := range reservation.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &Error{StatusCode: resp.StatusCode, Message: fmt.Sprintf("upload of %s failed: %s", reservation.FileName, message)}
+	}
+
+	return nil
+}
+
+// CompleteUploads creates the documents for uploaded reservations. Each
+// document succeeds or fails on its own; check the results.
+func (c *Client) CompleteUploads(ctx context.Context, caseID string, documentIDs []string) (api.UploadCompletion, error) {
+	body := struct {
+		DocumentIDs []string `json:"document_ids"`
+	}{documentIDs}
+
+	var completion api.UploadCompletion
+	err := c.doJSON(ctx, http.MethodPost, pathID("/v1/cases/%s/uploads/complete", caseID), body, &completion)
+	return completion, err
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"avalon/api"
+)
+
+func (c *Client) CreateUser(ctx context.Context, user api.User) (api.User, error) {
+	var created api.User
+	err := c.create(ctx, "/v1/users", user, &created)
+	return created, err
+}
+
+// Login checks the credentials and returns the user they belong to. The
+// user's Token, when the server issues one, authenticates later requests
+// through WithToken.
+func (c *Client) Login(ctx context.Context, email string, password string) (api.User, error) {
+	var user api.User
+	err := c.doJSON(ctx, http.MethodPost, "/v1/sessions", api.LoginUser{Email: email, Password: password}, &user)
+	return user, err
+}
+
+func (c *Client) GetUser(ctx context.Context, userID string) (api.User, error) {
+	var user api.User
+	err := c.doJSON(ctx, http.MethodGet, pathID("/v1/users/%s", userID), nil, &user)
+	return user, err
+}
+
+// UpdateUser changes the non-nil fields of update. A new email is not
+// applied until it is confirmed with VerifyEmail.
+func (c *Client) UpdateUser(ctx context.Context, userID string, update api.UserProfileUpdate) (api.User, error) {
+	var user api.User
+	err := c.doJSON(ctx, http.MethodPatch, pathID("/v1/users/%s", userID), update, &user)
+	return user, err
+}
+
+// VerifyEmail confirms a pending email change with the token that was mailed
+// to the new address
+func (c *Client) VerifyEmail(ctx context.Context, userID string, token string) (api.User, error) {
+	body := struct {
+		Token string `json:"token"`
+	}{token}
+
+	var user api.User
+	err := c.doJSON(ctx, http.MethodPost, pathID("/v1/users/%s/email/verify", userID), body, &user)
+	return user, err
+}
+
+func (c *Client) ChangePassword(ctx context.Context, userID string, change api.PasswordChange) error {
+	return c.doJSON(ctx, http.MethodPut, pathID("/v1/users/%s/password", userID), change, nil)
+}
+
+func (c *Client) DeleteUser(ctx context.Context, userID string) (api.User, error) {
+	var user api.User
+	err := c.doJSON(ctx, http.MethodDelete, pathID("/v1/users/%s", userID), nil, &user)
+	return user, err
+}
+
+// ExportUserData returns the user's data export as a zip archive. The caller
+// must close it. It needs a client built with WithAdminToken.
+func (c *Client) ExportUserData(ctx context.Context, userID string) (io.ReadCloser, error) {
+	return c.stream(ctx, request{method: http.MethodGet, path: pathID("/v1/users/%s/export", userID)})
+}
+
+// EraseUserData deletes the user and everything they own and returns the
+// signed erasure report. When the erasure stops part way the error comes with
+// the report of what was erased, and calling it again finishes the rest. It
+// needs a client built with WithAdminToken.
+func (c *Client) EraseUserData(ctx context.Context, userID string) (api.ErasureReport, error) {
+	var report api.ErasureReport
+	err := c.doJSON(ctx, http.MethodDelete, pathID("/v1/users/%s/data", userID), nil, &report)
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) && len(apiErr.Object) > 0 {
+		json.Unmarshal(apiErr.Object, &report)
+	}
+	return report, err
+}
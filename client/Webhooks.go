@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"avalon/api"
+)
+
+// The webhook routes need a client built with WithToken for the owning user
+// or a member of the owning organization, or with WithAdminToken.
+
+// DeliveryPage is one page of a webhook's delivery attempts, newest first
+type DeliveryPage struct {
+	Deliveries []api.WebhookDelivery
+	NextCursor string
+}
+
+// CreateWebhook subscribes a URL to events. The URL must resolve to a public
+// address. The returned webhook holds the signing secret, which is not
+// returned again.
+func (c *Client) CreateWebhook(ctx context.Context, webhook api.Webhook) (api.Webhook, error) {
+	body := struct {
+		OwnerType string   `json:"owner_type"`
+		OwnerID   string   `json:"owner_id"`
+		URL       string   `json:"url"`
+		Events    []string `json:"events"`
+	}{webhook.OwnerType, webhook.OwnerID, webhook.URL, webhook.Events}
+
+	var created api.Webhook
+	err := c.create(ctx, "/v1/webhooks", body, &created)
+	return created, err
+}
+
+// ListWebhooks returns the webhooks of a user or an organization, for an
+// ownerType of "user" or "organization"
+func (c *Client) ListWebhooks(ctx context.Context, ownerType string, ownerID string) ([]api.Webhook, error) {
+	req := request{
+		method: http.MethodGet,
+		path:   "/v1/webhooks",
+		query:  url.Values{"owner_type": {ownerType}, "owner_id": {ownerID}},
+	}
+
+	var webhooks []api.Webhook
+	_, err := c.do(ctx, req, &webhooks)
+	return webhooks, err
+}
+
+func (c *Client) GetWebhook(ctx context.Context, webhookID string) (api.Webhook, error) {
+	var webhook api.Webhook
+	err := c.doJSON(ctx, http.MethodGet, pathID("/v1/webhooks/%s", webhookID), nil, &webhook)
+	return webhook, err
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, webhookID string) (api.Webhook, error) {
+	var deleted api.Webhook
+	err := c.doJSON(ctx, http.MethodDelete, pathID("/v1/webhooks/%s", webhookID), nil, &deleted)
+	return deleted, err
+}
+
+// ListWebhookDeliveries returns one page of a webhook's delivery attempts. A
+// status of "dead_letter" lists its dead-letter queue; an empty status lists
+// every attempt.
+func (c *Client) ListWebhookDeliveries(ctx context.Context, webhookID string, status string, limit int64, cursor string) (DeliveryPage, error) {
+	query := url.Values{}
+	if status != "" {
+		query.Set("status", status)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.FormatInt(limit, 10))
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+
+	req := request{
+		method: http.MethodGet,
+		path:   pathID("/v1/webhooks/%s/deliveries", webhookID),
+		query:  query,
+	}
+
+	var page DeliveryPage
+	env, err := c.do(ctx, req, &page.Deliveries)
+	if err != nil {
+		return DeliveryPage{}, err
+	}
+	page.NextCursor = env.NextCursor
+
+	return page, nil
+}
+
+// RedeliverWebhook queues a dead-lettered delivery again
+func (c *Client) RedeliverWebhook(ctx context.Context, webhookID string, deliveryID string) (api.WebhookDelivery, error) {
+	var delivery api.WebhookDelivery
+	err := c.doJSON(ctx, http.MethodPost, pathID("/v1/webhooks/%s/deliveries/%s/redeliver", webhookID, deliveryID), nil, &delivery)
+	return delivery, err
+}
+
+// VerifyWebhookSignature checks the X-Avalon-Signature header of a delivery
+// against the webhook's secret and rejects signatures older than tolerance
+func VerifyWebhookSignature(secret string, header string, body []byte, tolerance time.Duration) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return errors.New("malformed webhook signature")
+	}
+	if age := time.Since(time.Unix(t, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("webhook signature is %s old", age.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", t)
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("webhook signature does not match")
+	}
+	return nil
+}
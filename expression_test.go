@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// This file evaluates DynamoDB expressions for fakeDynamo. It covers the
+// comparisons, functions and update actions the repo uses, not the whole
+// language.
+
+type exprLexer struct {
+	tokens []string
+	pos    int
+}
+
+func lexExpression(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),.[]=+-", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(s) && (s[i+1] == '=' || (c == '<' && s[i+1] == '>')) {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, string(c))
+				i++
+			}
+		case c == '#' || c == ':' || c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q in expression %q", c, s)
+		}
+	}
+	return tokens, nil
+}
+
+func (l *exprLexer) peek() string {
+	if l.pos < len(l.tokens) {
+		return l.tokens[l.pos]
+	}
+	return ""
+}
+
+func (l *exprLexer) next() string {
+	token := l.peek()
+	l.pos++
+	return token
+}
+
+func (l *exprLexer) expect(token string) error {
+	if got := l.next(); got != token {
+		return fmt.Errorf("expected %q, got %q", token, got)
+	}
+	return nil
+}
+
+func (l *exprLexer) keyword(word string) bool {
+	if strings.EqualFold(l.peek(), word) {
+		l.pos++
+		return true
+	}
+	return false
+}
+
+// docPath is an attribute path such as a.b[0]; ints are list indexes
+type docPath []interface{}
+
+func (l *exprLexer) path(names map[string]*string) (docPath, error) {
+	var path docPath
+	for {
+		token := l.next()
+		if token == "" || strings.HasPrefix(token, ":") {
+			return nil, fmt.Errorf("expected an attribute name, got %q", token)
+		}
+		if strings.HasPrefix(token, "#") {
+			name, ok := names[token]
+			if !ok {
+				return nil, fmt.Errorf("undefined attribute name %s", token)
+			}
+			token = *name
+		}
+		path = append(path, token)
+
+		for l.peek() == "[" {
+			l.next()
+			index, err := strconv.Atoi(l.next())
+			if err != nil {
+				return nil, err
+			}
+			if err := l.expect("]"); err != nil {
+				return nil, err
+			}
+			path = append(path, index)
+		}
+
+		if l.peek() != "." {
+			return path, nil
+		}
+		l.next()
+	}
+}
+
+func (path docPath) get(item fakeItem) *dynamodb.AttributeValue {
+	var value *dynamodb.AttributeValue
+	for i, part := range path {
+		switch p := part.(type) {
+		case string:
+			if i == 0 {
+				value = item[p]
+			} else if value != nil && value.M != nil {
+				value = value.M[p]
+			} else {
+				return nil
+			}
+		case int:
+			if value == nil || p >= len(value.L) {
+				return nil
+			}
+			value = value.L[p]
+		}
+		if value == nil {
+			return nil
+		}
+	}
+	return value
+}
+
+// set stores value at the path, which must end in a name
+func (path docPath) set(item fakeItem, value *dynamodb.AttributeValue) {
+	parent := item
+	for i, part := range path[:len(path)-1] {
+		next := docPath(path[:i+1]).get(item)
+		if next == nil || next.M == nil {
+			return
+		}
+		_ = part
+		parent = next.M
+	}
+	if name, ok := path[len(path)-1].(string); ok {
+		parent[name] = value
+	}
+}
+
+func (path docPath) remove(item fakeItem) {
+	parent := item
+	if len(path) > 1 {
+		value := docPath(path[:len(path)-1]).get(item)
+		if value == nil || value.M == nil {
+			return
+		}
+		parent = value.M
+	}
+	if name, ok := path[len(path)-1].(string); ok {
+		delete(parent, name)
+	}
+}
+
+// operand is a path, a value or size(path)
+type operand func(item fakeItem) *dynamodb.AttributeValue
+
+func (l *exprLexer) operand(names map[string]*string, values fakeItem) (operand, error) {
+	token := l.peek()
+	switch {
+	case strings.HasPrefix(token, ":"):
+		l.next()
+		value, ok := values[token]
+		if !ok {
+			return nil, fmt.Errorf("undefined attribute value %s", token)
+		}
+		return func(fakeItem) *dynamodb.AttributeValue { return value }, nil
+	case strings.EqualFold(token, "size"):
+		l.next()
+		if err := l.expect("("); err != nil {
+			return nil, err
+		}
+		path, err := l.path(names)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(item fakeItem) *dynamodb.AttributeValue {
+			value := path.get(item)
+			if value == nil {
+				return nil
+			}
+			return numberValue(big.NewFloat(float64(valueSize(value))))
+		}, nil
+	}
+
+	path, err := l.path(names)
+	if err != nil {
+		return nil, err
+	}
+	return path.get, nil
+}
+
+func valueSize(v *dynamodb.AttributeValue) int {
+	switch {
+	case v.S != nil:
+		return len(*v.S)
+	case v.B != nil:
+		return len(v.B)
+	case v.L != nil:
+		return len(v.L)
+	case v.M != nil:
+		return len(v.M)
+	case v.SS != nil:
+		return len(v.SS)
+	case v.NS != nil:
+		return len(v.NS)
+	case v.BS != nil:
+		return len(v.BS)
+	}
+	return 0
+}
+
+func numberValue(n *big.Float) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(n.Text('f', -1))}
+}
+
+func parseNumber(v *dynamodb.AttributeValue) *big.Float {
+	n, _, err := big.ParseFloat(aws.StringValue(v.N), 10, 200, big.ToNearestEven)
+	if err != nil {
+		return new(big.Float)
+	}
+	return n
+}
+
+// compareValues orders two scalars of the same type, and returns 2 when
+// they cannot be compared
+func compareValues(a, b *dynamodb.AttributeValue) int {
+	switch {
+	case a == nil || b == nil:
+		return 2
+	case a.N != nil && b.N != nil:
+		return parseNumber(a).Cmp(parseNumber(b))
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S)
+	case a.B != nil && b.B != nil:
+		return bytes.Compare(a.B, b.B)
+	}
+	return 2
+}
+
+func valuesEqual(a, b *dynamodb.AttributeValue) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if c := compareValues(a, b); c != 2 {
+		return c == 0
+	}
+	if a.BOOL != nil && b.BOOL != nil {
+		return *a.BOOL == *b.BOOL
+	}
+	if a.NULL != nil && b.NULL != nil {
+		return true
+	}
+	return a.String() == b.String()
+}
+
+type condExpr interface {
+	eval(item fakeItem) bool
+}
+
+type condFunc func(item fakeItem) bool
+
+func (f condFunc) eval(item fakeItem) bool { return f(item) }
+
+func parseCondition(s string, names map[string]*string, values fakeItem) (condExpr, error) {
+	tokens, err := lexExpression(s)
+	if err != nil {
+		return nil, err
+	}
+	l := &exprLexer{tokens: tokens}
+	cond, err := l.or(names, values)
+	if err != nil {
+		return nil, fmt.Errorf("%v in %q", err, s)
+	}
+	if l.peek() != "" {
+		return nil, fmt.Errorf("unexpected %q in %q", l.peek(), s)
+	}
+	return cond, nil
+}
+
+func (l *exprLexer) or(names map[string]*string, values fakeItem) (condExpr, error) {
+	left, err := l.and(names, values)
+	if err != nil {
+		return nil, err
+	}
+	for l.keyword("OR") {
+		right, err := l.and(names, values)
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = condFunc(func(item fakeItem) bool { return a.eval(item) || b.eval(item) })
+	}
+	return left, nil
+}
+
+func (l *exprLexer) and(names map[string]*string, values fakeItem) (condExpr, error) {
+	left, err := l.not(names, values)
+	if err != nil {
+		return nil, err
+	}
+	for l.keyword("AND") {
+		right, err := l.not(names, values)
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = condFunc(func(item fakeItem) bool { return a.eval(item) && b.eval(item) })
+	}
+	return left, nil
+}
+
+func (l *exprLexer) not(names map[string]*string, values fakeItem) (condExpr, error) {
+	if l.keyword("NOT") {
+		inner, err := l.not(names, values)
+		if err != nil {
+			return nil, err
+		}
+		return condFunc(func(item fakeItem) bool { return !inner.eval(item) }), nil
+	}
+	return l.comparison(names, values)
+}
+
+var conditionFunctions = map[string]bool{
+	"attribute_exists": true, "attribute_not_exists": true, "begins_with": true, "contains": true, "attribute_type": true,
+}
+
+func (l *exprLexer) comparison(names map[string]*string, values fakeItem) (condExpr, error) {
+	if l.peek() == "(" {
+		l.next()
+		inner, err := l.or(names, values)
+		if err != nil {
+			return nil, err
+		}
+		return inner, l.expect(")")
+	}
+
+	if name := strings.ToLower(l.peek()); conditionFunctions[name] {
+		l.next()
+		return l.function(name, names, values)
+	}
+
+	left, err := l.operand(names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := l.next(); {
+	case strings.EqualFold(op, "BETWEEN"):
+		low, err := l.operand(names, values)
+		if err != nil {
+			return nil, err
+		}
+		if !l.keyword("AND") {
+			return nil, fmt.Errorf("expected AND in BETWEEN")
+		}
+		high, err := l.operand(names, values)
+		if err != nil {
+			return nil, err
+		}
+		return condFunc(func(item fakeItem) bool {
+			v := left(item)
+			lowCmp, highCmp := compareValues(v, low(item)), compareValues(v, high(item))
+			return lowCmp != 2 && highCmp != 2 && lowCmp >= 0 && highCmp <= 0
+		}), nil
+	case strings.EqualFold(op, "IN"):
+		if err := l.expect("("); err != nil {
+			return nil, err
+		}
+		var candidates []operand
+		for {
+			candidate, err := l.operand(names, values)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, candidate)
+			if l.peek() != "," {
+				break
+			}
+			l.next()
+		}
+		if err := l.expect(")"); err != nil {
+			return nil, err
+		}
+		return condFunc(func(item fakeItem) bool {
+			v := left(item)
+			for _, candidate := range candidates {
+				if valuesEqual(v, candidate(item)) {
+					return true
+				}
+			}
+			return false
+		}), nil
+	case op == "=" || op == "<>" || op == "<" || op == "<=" || op == ">" || op == ">=":
+		right, err := l.operand(names, values)
+		if err != nil {
+			return nil, err
+		}
+		return condFunc(func(item fakeItem) bool {
+			a, b := left(item), right(item)
+			switch op {
+			case "=":
+				return valuesEqual(a, b)
+			case "<>":
+				return a != nil && b != nil && !valuesEqual(a, b)
+			}
+			c := compareValues(a, b)
+			if c == 2 {
+				return false
+			}
+			switch op {
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			}
+			return c >= 0
+		}), nil
+	default:
+		return nil, fmt.Errorf("unexpected comparator %q", op)
+	}
+}
+
+func (l *exprLexer) function(name string, names map[string]*string, values fakeItem) (condExpr, error) {
+	if err := l.expect("("); err != nil {
+		return nil, err
+	}
+	path, err := l.path(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var arg operand
+	if name != "attribute_exists" && name != "attribute_not_exists" {
+		if err := l.expect(","); err != nil {
+			return nil, err
+		}
+		if arg, err = l.operand(names, values); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return condFunc(func(item fakeItem) bool {
+		v := path.get(item)
+		switch name {
+		case "attribute_exists":
+			return v != nil
+		case "attribute_not_exists":
+			return v == nil
+		case "begins_with":
+			prefix := arg(item)
+			switch {
+			case v == nil || prefix == nil:
+				return false
+			case v.S != nil && prefix.S != nil:
+				return strings.HasPrefix(*v.S, *prefix.S)
+			case v.B != nil && prefix.B != nil:
+				return bytes.HasPrefix(v.B, prefix.B)
+			}
+			return false
+		case "contains":
+			return valueContains(v, arg(item))
+		}
+		return false
+	}), nil
+}
+
+func valueContains(v, element *dynamodb.AttributeValue) bool {
+	if v == nil || element == nil {
+		return false
+	}
+	switch {
+	case v.S != nil && element.S != nil:
+		return strings.Contains(*v.S, *element.S)
+	case v.SS != nil && element.S != nil:
+		for _, s := range v.SS {
+			if *s == *element.S {
+				return true
+			}
+		}
+	case v.NS != nil && element.N != nil:
+		for _, n := range v.NS {
+			if valuesEqual(&dynamodb.AttributeValue{N: n}, element) {
+				return true
+			}
+		}
+	case v.L != nil:
+		for _, e := range v.L {
+			if valuesEqual(e, element) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// project keeps only the attributes named in a projection expression
+func project(item fakeItem, projection string, names map[string]*string) (fakeItem, error) {
+	tokens, err := lexExpression(projection)
+	if err != nil {
+		return nil, err
+	}
+	l := &exprLexer{tokens: tokens}
+
+	out := fakeItem{}
+	for l.peek() != "" {
+		path, err := l.path(names)
+		if err != nil {
+			return nil, err
+		}
+		// nested paths keep their whole top level attribute
+		if name, ok := path[0].(string); ok && item[name] != nil {
+			out[name] = item[name]
+		}
+		if l.peek() == "," {
+			l.next()
+		}
+	}
+	return out, nil
+}
+
+// applyUpdate runs the SET, REMOVE, ADD and DELETE clauses of an update
+// expression against item
+func applyUpdate(item fakeItem, update string, names map[string]*string, values fakeItem) error {
+	tokens, err := lexExpression(update)
+	if err != nil {
+		return err
+	}
+	l := &exprLexer{tokens: tokens}
+
+	// every value is read from the item as it was before the update
+	before := copyItem(item)
+	var actions []func()
+
+	for l.peek() != "" {
+		clause := strings.ToUpper(l.next())
+		for {
+			path, err := l.path(names)
+			if err != nil {
+				return err
+			}
+
+			switch clause {
+			case "SET":
+				if err := l.expect("="); err != nil {
+					return err
+				}
+				value, err := l.setValue(names, values)
+				if err != nil {
+					return err
+				}
+				actions = append(actions, func() {
+					if v := value(before); v != nil {
+						path.set(item, copyValue(v))
+					}
+				})
+			case "REMOVE":
+				actions = append(actions, func() { path.remove(item) })
+			case "ADD", "DELETE":
+				arg, err := l.operand(names, values)
+				if err != nil {
+					return err
+				}
+				add := clause == "ADD"
+				actions = append(actions, func() {
+					path.set(item, addOrDelete(path.get(before), arg(before), add))
+				})
+			default:
+				return fmt.Errorf("unknown update clause %q", clause)
+			}
+
+			if l.peek() != "," {
+				break
+			}
+			l.next()
+		}
+	}
+
+	for _, action := range actions {
+		action()
+	}
+	return nil
+}
+
+// setValue parses the right hand side of a SET action
+func (l *exprLexer) setValue(names map[string]*string, values fakeItem) (operand, error) {
+	left, err := l.setOperand(names, values)
+	if err != nil {
+		return nil, err
+	}
+	if op := l.peek(); op == "+" || op == "-" {
+		l.next()
+		right, err := l.setOperand(names, values)
+		if err != nil {
+			return nil, err
+		}
+		return func(item fakeItem) *dynamodb.AttributeValue {
+			a, b := left(item), right(item)
+			if a == nil || b == nil || a.N == nil || b.N == nil {
+				return nil
+			}
+			if op == "+" {
+				return numberValue(new(big.Float).Add(parseNumber(a), parseNumber(b)))
+			}
+			return numberValue(new(big.Float).Sub(parseNumber(a), parseNumber(b)))
+		}, nil
+	}
+	return left, nil
+}
+
+func (l *exprLexer) setOperand(names map[string]*string, values fakeItem) (operand, error) {
+	switch name := strings.ToLower(l.peek()); name {
+	case "if_not_exists", "list_append":
+		l.next()
+		if err := l.expect("("); err != nil {
+			return nil, err
+		}
+		first, err := l.operand(names, values)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.expect(","); err != nil {
+			return nil, err
+		}
+		second, err := l.operand(names, values)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.expect(")"); err != nil {
+			return nil, err
+		}
+
+		if name == "if_not_exists" {
+			return func(item fakeItem) *dynamodb.AttributeValue {
+				if v := first(item); v != nil {
+					return v
+				}
+				return second(item)
+			}, nil
+		}
+		return func(item fakeItem) *dynamodb.AttributeValue {
+			a, b := first(item), second(item)
+			if a == nil || b == nil {
+				return nil
+			}
+			list := append(append([]*dynamodb.AttributeValue{}, a.L...), b.L...)
+			return &dynamodb.AttributeValue{L: list}
+		}, nil
+	}
+	return l.operand(names, values)
+}
+
+// addOrDelete applies ADD or DELETE to the current value of an attribute
+func addOrDelete(current, arg *dynamodb.AttributeValue, add bool) *dynamodb.AttributeValue {
+	if arg == nil {
+		return current
+	}
+	if arg.N != nil {
+		sum := parseNumber(arg)
+		if current != nil && current.N != nil {
+			sum.Add(sum, parseNumber(current))
+		}
+		return numberValue(sum)
+	}
+
+	set := map[string]bool{}
+	var order []string
+	if current != nil {
+		for _, s := range current.SS {
+			set[*s] = true
+			order = append(order, *s)
+		}
+	}
+	for _, s := range arg.SS {
+		if add && !set[*s] {
+			order = append(order, *s)
+		}
+		set[*s] = add
+	}
+
+	out := &dynamodb.AttributeValue{}
+	for _, s := range order {
+		if set[s] {
+			out.SS = append(out.SS, aws.String(s))
+		}
+	}
+	if len(out.SS) == 0 {
+		return nil
+	}
+	return out
+}
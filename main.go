@@ -3,18 +3,59 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 )
 
 var (
-	UsersTable     = "AvalonUsers"
-	CasesTable     = "AvalonCases"
-	DocumentsTable = "AvalonDocuments"
-	ChatsTable     = "AvalonChats"
-	RegionName     = "us-east-1"
-	Bucket         = "avalondocumentbucket"
+	UsersTable       = "AvalonUsers"
+	CasesTable       = "AvalonCases"
+	DocumentsTable   = "AvalonDocuments"
+	ChatsTable       = "AvalonChats"
+	AuditTable       = "AvalonAuditLog"
+	CaseHistoryTable = "AvalonCaseHistory"
+	IdempotencyTable = "AvalonIdempotencyKeys"
+	WebhooksTable    = "AvalonWebhooks"
+	// deliveries are kept for WEBHOOK_DELIVERY_TTL_DAYS through the expires_at
+	// TTL attribute
+	WebhookDeliveriesTable = "AvalonWebhookDeliveries"
+	// reservations for direct uploads, swept once they are abandoned
+	UploadReservationsTable = "AvalonUploadReservations"
+	// resumable uploads in progress, terminated once they expire
+	TusUploadsTable = "AvalonTusUploads"
+	// reference counts of the document files under BlobPrefix
+	BlobsTable = "AvalonBlobs"
+	// every version of documents that have been revised
+	DocumentVersionsTable = "AvalonDocumentVersions"
+	// global secondary indexes on CasesTable, both keyed by user_id
+	CasesByDateIndex  = "user_id-date-index"
+	CasesByTitleIndex = "user_id-title_key-index"
+	// global secondary index on DocumentsTable keyed by case and relevancy
+	DocumentsByRelevancyIndex = "case-relevancy-index"
+	// global secondary index on DocumentsTable keyed by file_url
+	DocumentsByFileURLIndex = "file_url-index"
+	// global secondary index on DocumentVersionsTable keyed by document_id
+	// and number
+	VersionsByDocumentIndex = "document_id-number-index"
+	// global secondary index on WebhooksTable keyed by owner_id and
+	// owner_type
+	WebhooksByOwnerIndex = "owner_id-owner_type-index"
+	// global secondary index on WebhookDeliveriesTable keyed by webhook_id
+	// and attempted_at
+	DeliveriesByWebhookIndex = "webhook_id-attempted_at-index"
+	// global secondary indexes on AuditTable keyed by case, actor and the
+	// UTC day of the event, each sorted by timestamp
+	AuditByCaseIndex  = "case_id-timestamp-index"
+	AuditByActorIndex = "actor_id-timestamp-index"
+	AuditByDayIndex   = "day-timestamp-index"
+
+	RegionName = "us-east-1"
+	Bucket     = "avalondocumentbucket"
 )
 
 func init() {
@@ -22,45 +63,186 @@ func init() {
 	if err != nil {
 		log.Printf("Error loading .env file")
 	}
+	if err := LoadOpenAPISpec(); err != nil {
+		log.Fatalf("Error loading OpenAPI spec: %v", err)
+	}
 	dynamo = InitDynamoDBTClient()
 	s3Client = InitS3Client()
+	scanner = InitScanner()
+	mailer = InitMailer()
+	ocrEngine = InitOCREngine()
+	LoadUploadLimits()
+	LoadDirectUploadLimits()
+	LoadResumableUploadLimits()
 }
 
 func main() {
+	// the same binary is the avalonctl admin tool when run under that name
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == "avalonctl" {
+		os.Exit(RunCtl(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(RunCtl(os.Args[2:]))
+	}
+
+	for _, problem := range CheckSpecCoverage(Routes().Patterns()) {
+		log.Printf("OpenAPI drift: %s", problem)
+	}
+
+	StartWebhookWorkers(envInt("WEBHOOK_WORKERS", 4))
+	StartExtractionWorkers(envInt("EXTRACTION_WORKERS", 2))
+	StartAuditRetryWorker()
+	StartSearchIndexer(os.Getenv("SEARCH_INDEX_DIR"))
+	StartUploadSweeper(time.Duration(envInt("UPLOAD_SWEEP_MINUTES", 15)) * time.Minute)
+
+	log.Println("Server started on :8080")
+	log.Fatal(http.ListenAndServe(":8080", NewServer()))
+}
 
-	router := http.NewServeMux()
+// NewServer returns the API handler: every route behind the request ID,
+// spec validation and CORS middleware
+func NewServer() http.Handler {
+	return cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodHead},
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{"Location", "Upload-Offset", "Upload-Length", "Upload-Expires", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size"},
+	}).Handler(WithRequestID(ValidateRequests(Routes())))
+}
+
+// Routes registers every API route on a new router
+func Routes() *Router {
+	router := NewRouter()
+
+	router.HandleFunc("GET /openapi.json", OpenAPISpecHandler)
 
 	// User Routes
-	router.HandleFunc("POST /createUser", CreateUserHandler)
+	router.HandleFunc("POST /createUser", Idempotent(CreateUserHandler))
 	router.HandleFunc("POST /login", AuthorizeUserHandler)
 	router.HandleFunc("POST /getUser", GetUserHandler)
 	router.HandleFunc("POST /deleteUser", DeleteUserHandler)
 	router.HandleFunc("POST /updateUser", UpdateUserHandler)
+	router.HandleFunc("POST /verifyEmail", VerifyEmailHandler)
+	router.HandleFunc("POST /changePassword", ChangePasswordHandler)
+	router.HandleFunc("POST /exportUserData", ExportUserDataHandler)
+	router.HandleFunc("POST /eraseUserData", EraseUserDataHandler)
 
 	// Case Routes
-	router.HandleFunc("POST /createCase", CreateCaseHandler)
+	router.HandleFunc("POST /createCase", Idempotent(CreateCaseHandler))
 	router.HandleFunc("POST /getCase", GetCaseByIDHandler)
 	router.HandleFunc("POST /getUserCases", GetCaseByUserHandler)
 	router.HandleFunc("POST /deleteCaseById", DeleteCaseByIDHandler)
 	router.HandleFunc("POST /deleteUserCases", DeleteCasesByUserHandler)
+	router.HandleFunc("POST /updateCase", UpdateCaseHandler)
+	router.HandleFunc("POST /getCaseHistory", GetCaseHistoryHandler)
 
 	// Document Routes
-	router.HandleFunc("POST /uploadDocument", UploadDocumentHandler)
-	router.HandleFunc("POST /uploadDocuments", UploadDocumentsHandler)
+	router.HandleFunc("POST /uploadDocument", Idempotent(UploadDocumentHandler))
+	router.HandleFunc("POST /uploadDocuments", Idempotent(UploadDocumentsHandler))
 	router.HandleFunc("POST /getCaseDocuments", GetDocumentsByCaseHandler)
 	router.HandleFunc("POST /getDocumentById", GetDocumentByIDHandler)
 	router.HandleFunc("POST /deleteDocumentById", DeleteDocumentByIDHandler)
 	router.HandleFunc("POST /deleteCaseDocuments", DeleteDocumentsByCaseHandler)
-	router.HandleFunc("POST /createDocuments", CreateDocumentsHandler)
+	router.HandleFunc("POST /createDocuments", Idempotent(CreateDocumentsHandler))
 	router.HandleFunc("POST /getDocumentIdByUrl", GetDocumentByIdByFileUrlHandler)
 	router.HandleFunc("POST /updateRelevancyByFileUrl", UpdateRelevancyByFileUrl)
+	router.HandleFunc("POST /updateRelevancyBatch", BatchUpdateRelevancyHandler)
+	router.HandleFunc("POST /downloadDocument", DownloadDocumentHandler)
+	router.HandleFunc("POST /updateDocument", UpdateDocumentHandler)
+	router.HandleFunc("POST /moveDocument", MoveDocumentHandler)
+	router.HandleFunc("POST /copyDocument", Idempotent(CopyDocumentHandler))
+	router.HandleFunc("POST /resolveDuplicate", ResolveDuplicateHandler)
+	router.HandleFunc("POST /getDocumentVersions", GetDocumentVersionsHandler)
+	router.HandleFunc("POST /downloadDocumentVersion", DownloadDocumentVersionHandler)
+	router.HandleFunc("POST /restoreDocumentVersion", RestoreDocumentVersionHandler)
+	router.HandleFunc("POST /getDocumentText", GetDocumentTextHandler)
+	router.HandleFunc("POST /extractDocumentText", ExtractDocumentTextHandler)
+	router.HandleFunc("POST /searchCaseDocuments", SearchCaseDocumentsHandler)
+	router.HandleFunc("POST /reserveUploads", Idempotent(ReserveUploadsHandler))
+	router.HandleFunc("POST /completeUploads", CompleteUploadsHandler)
 
+	// Chat Routes
 	router.HandleFunc("POST /getCaseChat", GetChatByCaseIDHandler) // the case_id and chat id are the same
-	router.HandleFunc("POST /addMessage", AddMessageToChatHandler)
+	router.HandleFunc("POST /addMessage", Idempotent(AddMessageToChatHandler))
+	router.HandleFunc("POST /setTyping", SetTypingHandler)
 
-	log.Println("Server started on :8080")
-	handler := cors.Default().Handler(router)
+	// Webhook Routes
+	router.HandleFunc("POST /createWebhook", Idempotent(CreateWebhookHandler))
+	router.HandleFunc("POST /getWebhooks", GetWebhooksHandler)
+	router.HandleFunc("POST /deleteWebhook", DeleteWebhookHandler)
+	router.HandleFunc("POST /getWebhookDeliveries", GetWebhookDeliveriesHandler)
+	router.HandleFunc("POST /redeliverWebhook", RedeliverWebhookHandler)
+
+	// Admin Routes
+	router.HandleFunc("POST /admin/auditLog", QueryAuditLogHandler)
+	router.HandleFunc("POST /admin/verifyAuditLog", VerifyAuditLogHandler)
+	router.HandleFunc("POST /admin/reindexCases", ReindexCasesHandler)
+	router.HandleFunc("POST /admin/reindexDocuments", ReindexDocumentsHandler)
+	router.HandleFunc("POST /admin/extractDocuments", ExtractDocumentsHandler)
+
+	// Resource Routes
+	router.HandleFunc("POST /v1/users", Idempotent(CreateUserHandler))
+	router.HandleFunc("POST /v1/sessions", AuthorizeUserHandler)
+	router.HandleFunc("GET /v1/users/{id}", GetUserResourceHandler)
+	router.HandleFunc("PATCH /v1/users/{id}", UpdateUserResourceHandler)
+	router.HandleFunc("POST /v1/users/{id}/email/verify", VerifyEmailResourceHandler)
+	router.HandleFunc("PUT /v1/users/{id}/password", ChangePasswordResourceHandler)
+	router.HandleFunc("DELETE /v1/users/{id}", DeleteUserResourceHandler)
+	router.HandleFunc("GET /v1/users/{id}/cases", GetUserCasesResourceHandler)
+	router.HandleFunc("DELETE /v1/users/{id}/cases", DeleteUserCasesResourceHandler)
+	router.HandleFunc("GET /v1/users/{id}/export", ExportUserDataResourceHandler)
+	router.HandleFunc("DELETE /v1/users/{id}/data", EraseUserDataResourceHandler)
+
+	router.HandleFunc("POST /v1/cases", Idempotent(CreateCaseResourceHandler))
+	router.HandleFunc("GET /v1/cases/{id}", GetCaseResourceHandler)
+	router.HandleFunc("PATCH /v1/cases/{id}", UpdateCaseResourceHandler)
+	router.HandleFunc("DELETE /v1/cases/{id}", DeleteCaseResourceHandler)
+	router.HandleFunc("GET /v1/cases/{id}/history", GetCaseHistoryResourceHandler)
+	router.HandleFunc("GET /v1/cases/{id}/documents", GetCaseDocumentsResourceHandler)
+	router.HandleFunc("POST /v1/cases/{id}/documents", Idempotent(CreateCaseDocumentsResourceHandler))
+	router.HandleFunc("DELETE /v1/cases/{id}/documents", DeleteCaseDocumentsResourceHandler)
+	router.HandleFunc("GET /v1/cases/{id}/search", SearchCaseDocumentsResourceHandler)
+	router.HandleFunc("POST /v1/cases/{id}/uploads", Idempotent(ReserveUploadsResourceHandler))
+	router.HandleFunc("POST /v1/cases/{id}/uploads/complete", CompleteUploadsResourceHandler)
+	router.HandleFunc("GET /v1/cases/{id}/chat", GetCaseChatResourceHandler)
+	router.HandleFunc("POST /v1/cases/{id}/chat/messages", Idempotent(CreateChatMessageResourceHandler))
+	router.HandleFunc("GET /v1/cases/{id}/chat/stream", StreamCaseChatResourceHandler)
+	router.HandleFunc("PUT /v1/cases/{id}/chat/typing", SetTypingResourceHandler)
+
+	router.HandleFunc("OPTIONS /v1/tus", TusOptionsHandler)
+	router.HandleFunc("POST /v1/tus", CreateTusUploadHandler)
+	router.HandleFunc("HEAD /v1/tus/{id}", HeadTusUploadHandler)
+	router.HandleFunc("PATCH /v1/tus/{id}", PatchTusUploadHandler)
+	router.HandleFunc("DELETE /v1/tus/{id}", DeleteTusUploadHandler)
+
+	router.HandleFunc("GET /v1/documents", FindDocumentsResourceHandler)
+	router.HandleFunc("POST /v1/documents/relevancy", BatchUpdateRelevancyHandler)
+	router.HandleFunc("GET /v1/documents/{id}", GetDocumentResourceHandler)
+	router.HandleFunc("PATCH /v1/documents/{id}", UpdateDocumentResourceHandler)
+	router.HandleFunc("DELETE /v1/documents/{id}", DeleteDocumentResourceHandler)
+	router.HandleFunc("GET /v1/documents/{id}/content", DownloadDocumentResourceHandler)
+	router.HandleFunc("POST /v1/documents/{id}/move", MoveDocumentResourceHandler)
+	router.HandleFunc("POST /v1/documents/{id}/copy", Idempotent(CopyDocumentResourceHandler))
+	router.HandleFunc("POST /v1/documents/{id}/duplicate", ResolveDuplicateResourceHandler)
+	router.HandleFunc("GET /v1/documents/{id}/versions", GetDocumentVersionsResourceHandler)
+	router.HandleFunc("POST /v1/documents/{id}/versions", Idempotent(UploadDocumentVersionResourceHandler))
+	router.HandleFunc("GET /v1/documents/{id}/versions/{number}/content", DownloadDocumentVersionResourceHandler)
+	router.HandleFunc("POST /v1/documents/{id}/versions/{number}/restore", RestoreDocumentVersionResourceHandler)
+	router.HandleFunc("GET /v1/documents/{id}/text", GetDocumentTextResourceHandler)
+	router.HandleFunc("POST /v1/documents/{id}/text/extract", ExtractDocumentTextResourceHandler)
+
+	router.HandleFunc("POST /v1/webhooks", Idempotent(CreateWebhookHandler))
+	router.HandleFunc("GET /v1/webhooks", GetWebhooksResourceHandler)
+	router.HandleFunc("GET /v1/webhooks/{id}", GetWebhookResourceHandler)
+	router.HandleFunc("DELETE /v1/webhooks/{id}", DeleteWebhookResourceHandler)
+	router.HandleFunc("GET /v1/webhooks/{id}/deliveries", GetWebhookDeliveriesResourceHandler)
+	router.HandleFunc("POST /v1/webhooks/{id}/deliveries/{delivery_id}/redeliver", RedeliverWebhookResourceHandler)
 
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	router.HandleFunc("GET /v1/admin/audit-events", QueryAuditLogResourceHandler)
+	router.HandleFunc("GET /v1/admin/audit-events/verify", VerifyAuditLogHandler)
+	router.HandleFunc("POST /v1/admin/cases/reindex", ReindexCasesHandler)
+	router.HandleFunc("POST /v1/admin/documents/reindex", ReindexDocumentsHandler)
+	router.HandleFunc("POST /v1/admin/documents/extract", ExtractDocumentsHandler)
 
+	return router
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"avalon/client"
+)
+
+// TestClientAgainstServer runs the Go client against the real server with
+// in-memory storage, so the two cannot drift apart unnoticed
+func TestClientAgainstServer(t *testing.T) {
+	t.Setenv("SESSION_SIGNING_KEY", "secret")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	t.Setenv("REPORT_SIGNING_KEY", "report-secret")
+	useFakeAWS(t)
+
+	server := httptest.NewServer(NewServer())
+	defer server.Close()
+
+	ctx := context.Background()
+	anonymous := client.New(server.URL)
+
+	if _, err := anonymous.CreateUser(ctx, User{
+		Email: "ada@example.com", Password: "correct horse", FirstName: "Ada", LastName: "Lovelace",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := anonymous.Login(ctx, "ada@example.com", "wrong")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != CodeInvalidCredentials {
+		t.Errorf("login with the wrong password returned %v", err)
+	}
+
+	user, err := anonymous.Login(ctx, "ada@example.com", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client.New(server.URL, client.WithToken(user.Token))
+
+	created, err := c.CreateCase(ctx, Case{
+		CaseTitle: "Smith v. Jones", AttorneyFirstName: "Ada", AttorneyLastName: "Lovelace",
+		CaseInfo: "Contract dispute", CaseType: "civil", City: "Boston", Date: "2024-03-01",
+		JudgeName: "Judge Judy", State: "MA", UserID: user.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.CaseTitle != "Smith v. Jones" {
+		t.Errorf("CreateCase returned %+v", created)
+	}
+
+	_, err = c.CreateCase(ctx, Case{CaseTitle: "Missing everything else"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || len(apiErr.Errors) == 0 {
+		t.Errorf("incomplete case returned %v", err)
+	}
+
+	title := "Smith v. Jones LLC"
+	if updated, err := c.UpdateCase(ctx, created.ID, CaseUpdate{CaseTitle: &title}); err != nil || updated.CaseTitle != title {
+		t.Errorf("UpdateCase returned %+v, %v", updated, err)
+	}
+
+	page, err := c.ListUserCases(ctx, user.ID, CaseFilter{})
+	if err != nil || len(page.Cases) != 1 || page.Cases[0].ID != created.ID {
+		t.Errorf("ListUserCases returned %+v, %v", page, err)
+	}
+
+	documents, err := c.CreateDocuments(ctx, created.ID, client.File{Name: "notes.txt", Content: strings.NewReader("the witness was at home")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 1 || !strings.HasSuffix(documents[0].FileName, "notes.txt") {
+		t.Fatalf("CreateDocuments returned %+v", documents)
+	}
+
+	listed, err := c.ListCaseDocuments(ctx, created.ID, DocumentFilter{}, 0)
+	if err != nil || len(listed.Documents) != 1 || listed.Documents[0].ID != documents[0].ID {
+		t.Errorf("ListCaseDocuments returned %+v, %v", listed, err)
+	}
+
+	content, err := c.DownloadDocument(ctx, documents[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := io.ReadAll(content)
+	content.Close()
+	if string(downloaded) != "the witness was at home" {
+		t.Errorf("DownloadDocument returned %q", downloaded)
+	}
+
+	_, err = c.GetDocument(ctx, "missing")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("missing document returned %v", err)
+	}
+
+	admin := client.New(server.URL, client.WithAdminToken("admin-secret"))
+
+	export, err := admin.ExportUserData(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ := io.ReadAll(export)
+	export.Close()
+	if _, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive))); err != nil {
+		t.Errorf("export is not a zip archive: %v", err)
+	}
+
+	report, err := admin.EraseUserData(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.UserID != user.ID || len(report.CasesDeleted) != 1 {
+		t.Errorf("EraseUserData returned %+v", report)
+	}
+
+	_, err = c.GetCase(ctx, created.ID)
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("erased case returned %v", err)
+	}
+}